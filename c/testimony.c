@@ -32,6 +32,10 @@ extern "C" {
 #define TESTIMONY_ERRBUF_SIZE 256
 #define TESTIMONY_BUF_SIZE 256
 
+// Servers send TESTIMONY_VERSION for sockets with more than one interface,
+// which pass a ring per interface, and this version for the rest.
+#define TESTIMONY_SINGLE_RING_VERSION 2
+
 /* This list generated by go/protocol/to_c binary */
 #define TESTIMONY_PROTOCOL_TYPE_BlockIndex 0
 #define TESTIMONY_PROTOCOL_TYPE_ServerToClient 32769
@@ -39,17 +43,37 @@ extern "C" {
 #define TESTIMONY_PROTOCOL_TYPE_FanoutSize 32771
 #define TESTIMONY_PROTOCOL_TYPE_BlockSize 32772
 #define TESTIMONY_PROTOCOL_TYPE_NumBlocks 32773
+#define TESTIMONY_PROTOCOL_TYPE_ShuttingDown 32774
+#define TESTIMONY_PROTOCOL_TYPE_RingReplaced 32775
+#define TESTIMONY_PROTOCOL_TYPE_Timestamping 32776
+#define TESTIMONY_PROTOCOL_TYPE_TxFrameSize 32777
+#define TESTIMONY_PROTOCOL_TYPE_TxNumFrames 32778
+#define TESTIMONY_PROTOCOL_TYPE_TxCompletion 32779
+#define TESTIMONY_PROTOCOL_TYPE_CPUs 32780
+#define TESTIMONY_PROTOCOL_TYPE_NUMANodes 32781
+#define TESTIMONY_PROTOCOL_TYPE_Interfaces 32782
+#define TESTIMONY_PROTOCOL_TYPE_XDPFrameSize 32783
+#define TESTIMONY_PROTOCOL_TYPE_FilterHashes 32784
 #define TESTIMONY_PROTOCOL_TYPE_ClientToServer 49158
 #define TESTIMONY_PROTOCOL_TYPE_FanoutIndex 49159
+#define TESTIMONY_PROTOCOL_TYPE_TxRequest 49160
+#define TESTIMONY_PROTOCOL_TYPE_TxFrameReady 49161
 #define TESTIMONY_PROTOCOL_TYPE_Error 65535
 
 struct testimony_internal {
   testimony_connection conn;
   int sock_fd;
-  int afpacket_fd;
-  uint8_t* ring;
+  int* afpacket_fds;  // one per ring
+  int num_rings;
+  uint8_t* ring;      // all rings, one after another
   char errbuf[TESTIMONY_ERRBUF_SIZE];
   uint32_t* block_counts;
+  uint32_t* cpus;        // conn.cpus
+  uint32_t* numa_nodes;  // conn.numa_nodes
+  char* interface_names;   // NUL-separated names conn.interfaces points into
+  const char** interfaces; // conn.interfaces
+  uint8_t* filter_hashes;  // conn.filter_hashes
+  int num_filter_hashes;
   uint8_t buf[TESTIMONY_BUF_SIZE];
   uint8_t* buf_start;
   uint8_t* buf_limit;
@@ -140,16 +164,22 @@ static int send_be_32(int fd, size_t in) {
 
 // With much thanks to
 // http://blog.varunajayasiri.com/passing-file-descriptors-between-processes-using-sendmsg-and-recvmsg
-static int recv_file_descriptor(int socket) {
+// Receives exactly n file descriptors into fds.
+static int recv_file_descriptors(int socket, int* fds, int n) {
   struct msghdr message;
   struct iovec iov[1];
   struct cmsghdr* control_message = NULL;
-  uint8_t ctrl_buf[CMSG_SPACE(sizeof(int))];
+  size_t ctrl_size = CMSG_SPACE(sizeof(int) * n);
+  uint8_t* ctrl_buf;
   uint8_t data[1];
-  int r;
+  int r, got, i;
 
+  ctrl_buf = (uint8_t*)calloc(1, ctrl_size);
+  if (ctrl_buf == NULL) {
+    errno = ENOMEM;
+    return -1;
+  }
   memset(&message, 0, sizeof(struct msghdr));
-  memset(ctrl_buf, 0, CMSG_SPACE(sizeof(int)));
 
   /* For the block data */
   iov[0].iov_base = data;
@@ -158,24 +188,36 @@ static int recv_file_descriptor(int socket) {
   message.msg_name = NULL;
   message.msg_namelen = 0;
   message.msg_control = ctrl_buf;
-  message.msg_controllen = CMSG_SPACE(sizeof(int));
+  message.msg_controllen = ctrl_size;
   message.msg_iov = iov;
   message.msg_iovlen = 1;
 
   r = recvmsg(socket, &message, 0);
   if (r != sizeof(data)) {
+    free(ctrl_buf);
     return -1;
   }
 
-  /* Iterate through header to find if there is a file descriptor */
+  /* Iterate through header to find the file descriptors */
   for (control_message = CMSG_FIRSTHDR(&message); control_message != NULL;
        control_message = CMSG_NXTHDR(&message, control_message)) {
     if ((control_message->cmsg_level == SOL_SOCKET) &&
         (control_message->cmsg_type == SCM_RIGHTS)) {
-      return *((int*)CMSG_DATA(control_message));
+      got = (control_message->cmsg_len - CMSG_LEN(0)) / sizeof(int);
+      if (got == n && !(message.msg_flags & MSG_CTRUNC)) {
+        memcpy(fds, CMSG_DATA(control_message), sizeof(int) * n);
+        free(ctrl_buf);
+        return 0;
+      }
+      // Don't leak descriptors we weren't expecting.
+      for (i = 0; i < got; i++) {
+        close(((int*)CMSG_DATA(control_message))[i]);
+      }
+      break;
     }
   }
 
+  free(ctrl_buf);
   errno = EIO;
   return -1;
 }
@@ -196,6 +238,74 @@ static int discard_bytes(testimony t, size_t n) {
   return 0;
 }
 
+// Receives a value of len bytes holding a list of uint32s into a newly
+// allocated array.
+static int recv_be_32_list(testimony t, uint32_t len, uint32_t** out) {
+  uint32_t i;
+  int r;
+  if (len % 4) {
+    TERR_SET(EINVAL, "list length %d is not a multiple of 4", (int)len);
+    return -1;
+  }
+  free(*out);
+  *out = (uint32_t*)malloc(len ? len : 1);
+  if (*out == NULL) {
+    TERR_SET(ENOMEM, "could not allocate list");
+    return -1;
+  }
+  for (i = 0; i < len / 4; i++) {
+    r = recv_be_32(t, &(*out)[i]);
+    if (r < 0) {
+      return r;
+    }
+  }
+  return 0;
+}
+
+// Receives a value of len bytes holding NUL-terminated interface names, and
+// points t->interfaces at them.
+static int recv_interfaces(testimony t, uint32_t len) {
+  uint32_t i;
+  int n = 0;
+  if (len == 0) {
+    TERR_SET(EINVAL, "empty interface list");
+    return -1;
+  }
+  free(t->interface_names);
+  free(t->interfaces);
+  t->interfaces = NULL;
+  t->interface_names = (char*)malloc(len);
+  if (t->interface_names == NULL) {
+    TERR_SET(ENOMEM, "could not allocate interface names");
+    return -1;
+  }
+  if (recv_t(t, (uint8_t*)t->interface_names, len) < 0) {
+    TERR("recv of interface names");
+    return -1;
+  }
+  if (t->interface_names[len - 1] != 0) {
+    TERR_SET(EINVAL, "interface names are not NUL-terminated");
+    return -1;
+  }
+  for (i = 0; i < len; i++) {
+    if (t->interface_names[i] == 0) { n++; }
+  }
+  t->interfaces = (const char**)malloc(n * sizeof(char*));
+  if (t->interfaces == NULL) {
+    TERR_SET(ENOMEM, "could not allocate interface list");
+    return -1;
+  }
+  t->interfaces[0] = t->interface_names;
+  n = 1;
+  for (i = 0; i < len - 1; i++) {
+    if (t->interface_names[i] == 0) {
+      t->interfaces[n++] = t->interface_names + i + 1;
+    }
+  }
+  t->conn.num_interfaces = n;
+  return 0;
+}
+
 int testimony_connect(testimony* tp, const char* socket_name) {
   struct sockaddr_un saddr;
   sa_family_t laddr = AF_UNIX;  // Use unnamed socket on client side
@@ -232,7 +342,8 @@ int testimony_connect(testimony* tp, const char* socket_name) {
   if (r < 0) {
     TERR("recv of protocol version failed");
     goto fail;
-  } else if (version != TESTIMONY_VERSION) {
+  } else if (version != TESTIMONY_VERSION &&
+             version != TESTIMONY_SINGLE_RING_VERSION) {
     TERR_SET(EPROTONOSUPPORT, "received unsupported protocol version %d", version);
     goto fail;
   }
@@ -248,6 +359,45 @@ int testimony_connect(testimony* tp, const char* socket_name) {
     if (proto_typ == TESTIMONY_PROTOCOL_TYPE_WaitingForFanoutIndex && proto_len == 0) {
       break;
     }
+    if (proto_typ == TESTIMONY_PROTOCOL_TYPE_CPUs ||
+        proto_typ == TESTIMONY_PROTOCOL_TYPE_NUMANodes) {
+      uint32_t** list = proto_typ == TESTIMONY_PROTOCOL_TYPE_CPUs ? &t->cpus : &t->numa_nodes;
+      if (recv_be_32_list(t, proto_len, list) < 0) {
+        TERR("did not receive type %d list", proto_typ);
+        goto fail;
+      }
+      if (proto_len / 4 != t->conn.fanout_size) {
+        TERR_SET(EINVAL, "type %d list has %d entries, want fanout size %d",
+                 proto_typ, (int)(proto_len / 4), t->conn.fanout_size);
+        goto fail;
+      }
+      continue;
+    }
+    if (proto_typ == TESTIMONY_PROTOCOL_TYPE_Interfaces) {
+      if (recv_interfaces(t, proto_len) < 0) {
+        goto fail;
+      }
+      continue;
+    }
+    if (proto_typ == TESTIMONY_PROTOCOL_TYPE_FilterHashes) {
+      if (proto_len % TESTIMONY_FILTER_HASH_SIZE) {
+        TERR_SET(EINVAL, "filter hashes length %d is not a multiple of %d",
+                 (int)proto_len, TESTIMONY_FILTER_HASH_SIZE);
+        goto fail;
+      }
+      free(t->filter_hashes);
+      t->filter_hashes = (uint8_t*)malloc(proto_len ? proto_len : 1);
+      if (t->filter_hashes == NULL) {
+        TERR_SET(ENOMEM, "could not allocate filter hashes");
+        goto fail;
+      }
+      if (recv_t(t, t->filter_hashes, proto_len) < 0) {
+        TERR("recv of filter hashes");
+        goto fail;
+      }
+      t->num_filter_hashes = proto_len / TESTIMONY_FILTER_HASH_SIZE;
+      continue;
+    }
     if (proto_len == 4) {
       r = recv_be_32(t, &msg);
       if (r < 0) {
@@ -264,6 +414,9 @@ int testimony_connect(testimony* tp, const char* socket_name) {
         case TESTIMONY_PROTOCOL_TYPE_NumBlocks:
           t->conn.block_nr = msg;
           break;
+        case TESTIMONY_PROTOCOL_TYPE_Timestamping:
+          t->conn.timestamping = msg;
+          break;
         default:
           // ignore
           break;
@@ -280,6 +433,26 @@ int testimony_connect(testimony* tp, const char* socket_name) {
     TERR_SET(EINVAL, "didn't get fanout size and block size/nr");
     goto fail;
   }
+  if (t->interfaces != NULL && t->conn.block_nr % t->conn.num_interfaces != 0) {
+    TERR_SET(EINVAL, "%d blocks can't be split between %d interfaces",
+             (int)t->conn.block_nr, t->conn.num_interfaces);
+    goto fail;
+  }
+  t->conn.cpus = t->cpus;
+  t->conn.numa_nodes = t->numa_nodes;
+  t->conn.interfaces = t->interfaces;
+  t->num_rings = t->interfaces != NULL ? t->conn.num_interfaces : 1;
+  if ((version == TESTIMONY_VERSION) != (t->num_rings > 1)) {
+    TERR_SET(EPROTONOSUPPORT, "protocol version %d doesn't match %d interfaces",
+             version, t->num_rings);
+    goto fail;
+  }
+  if (t->filter_hashes != NULL && t->num_filter_hashes != t->num_rings) {
+    TERR_SET(EINVAL, "got filter hashes for %d interfaces, want %d",
+             t->num_filter_hashes, t->num_rings);
+    goto fail;
+  }
+  t->conn.filter_hashes = t->filter_hashes;
   *tp = t;
   return 0;
 fail:
@@ -292,7 +465,9 @@ testimony_connection* testimony_conn(testimony t) { return &t->conn; }
 
 int testimony_init(testimony t) {
   uint8_t msg[4];
-  int r;
+  int r, i;
+  size_t ring_size;
+  void* ring;
   if (t->ring) {
     TERR_SET(EINVAL, "testimony has already been initiated");
     return -errno;
@@ -310,32 +485,61 @@ int testimony_init(testimony t) {
     return -errno;
   }
 
-  t->afpacket_fd = recv_file_descriptor(t->sock_fd);
-  if (t->afpacket_fd < 0) {
-    TERR("recv of file descriptor failed");
+  t->afpacket_fds = (int*)malloc(t->num_rings * sizeof(int));
+  if (t->afpacket_fds == NULL) {
+    TERR_SET(ENOMEM, "could not allocate file descriptors");
+    return -errno;
+  }
+  r = recv_file_descriptors(t->sock_fd, t->afpacket_fds, t->num_rings);
+  if (r < 0) {
+    free(t->afpacket_fds);
+    t->afpacket_fds = NULL;
+    TERR("recv of %d file descriptors failed", t->num_rings);
     return -errno;
   }
 
   // calloc inits memory to zero
   t->block_counts = (uint32_t*)calloc(t->conn.block_nr, sizeof(uint32_t));
 
-  t->ring = mmap(NULL, t->conn.block_size * t->conn.block_nr, PROT_READ,
-                 MAP_SHARED | MAP_NORESERVE, t->afpacket_fd, 0);
+  // Rings are mapped one after another, so blocks can be found by index.
+  t->ring = mmap(NULL, t->conn.block_size * t->conn.block_nr, PROT_NONE,
+                 MAP_PRIVATE | MAP_ANONYMOUS | MAP_NORESERVE, -1, 0);
   if (t->ring == MAP_FAILED) {
     t->ring = 0;
-    TERR("local mmap of file descriptor failed");
+    TERR("local mmap reservation failed");
     return -errno;
   }
+  ring_size = t->conn.block_size * (t->conn.block_nr / t->num_rings);
+  for (i = 0; i < t->num_rings; i++) {
+    ring = mmap(t->ring + ring_size * i, ring_size, PROT_READ,
+                MAP_SHARED | MAP_NORESERVE | MAP_FIXED, t->afpacket_fds[i], 0);
+    if (ring == MAP_FAILED) {
+      TERR("local mmap of file descriptor %d failed", i);
+      return -errno;
+    }
+  }
   return 0;
 }
 
 int testimony_close(testimony t) {
+  int i;
   if (t->ring != 0) {
     if (munmap(t->ring, t->conn.block_nr * t->conn.block_size) < 0)
       return -errno;
   }
   if (close(t->sock_fd) < 0) return -errno;
+  if (t->afpacket_fds != NULL) {
+    for (i = 0; i < t->num_rings; i++) {
+      close(t->afpacket_fds[i]);
+    }
+  }
+  free(t->afpacket_fds);
   free(t->block_counts);
+  free(t->cpus);
+  free(t->numa_nodes);
+  free(t->interface_names);
+  free(t->interfaces);
+  free(t->filter_hashes);
   free(t);
   return 0;
 }
@@ -389,6 +593,14 @@ int testimony_get_block(testimony t, int timeout_millis,
       TERR("recv of block index failed");
       return -errno;
     }
+    if (typ == TESTIMONY_PROTOCOL_TYPE_ShuttingDown) {
+      TERR_SET(ESHUTDOWN, "testimony server is shutting down");
+      return -errno;
+    }
+    if (typ == TESTIMONY_PROTOCOL_TYPE_RingReplaced) {
+      TERR_SET(ESTALE, "testimony server is replacing this socket's ring");
+      return -errno;
+    }
   }
   if (blockidx >= t->conn.block_nr) {
     TERR_SET(EIO, "received invalid block index %d, should be [0, %d)",
@@ -446,6 +658,14 @@ int testimony_return_block(testimony t, const struct tpacket_block_desc* block)
   return 0;
 }
 
+const char* testimony_block_interface(testimony t, const struct tpacket_block_desc* block) {
+  uint32_t blockidx = testimony_block_index(t, block);
+  if (blockidx == kInvalidBlockIndex || t->interfaces == NULL) {
+    return NULL;
+  }
+  return t->interfaces[blockidx / (t->conn.block_nr / t->num_rings)];
+}
+
 int testimony_return_packets(testimony t, const struct tpacket_block_desc* block, uint32_t packets) {
 #ifdef __GCC_HAVE_SYNC_COMPARE_AND_SWAP_4
   uint32_t blockidx = testimony_block_index(t, block);
@@ -15,7 +15,7 @@
 #ifndef __TESTIMONY_H__
 #define __TESTIMONY_H__
 
-#define TESTIMONY_VERSION 2  // Current highest supported protocol version.
+#define TESTIMONY_VERSION 4  // Current highest supported protocol version.
 
 #include <linux/if_packet.h>  // tpacket_block_desc, tpacket3_hdr
 #include <stdint.h>  // int64_t, uint8_t
@@ -59,8 +59,33 @@ typedef struct {
   size_t block_nr;    // set by testimony_init
   // Settable by client to modify behavior of testimony_init:
   int fanout_index;
+  // Filled in by server: where packet timestamps come from, one of
+  // TESTIMONY_TIMESTAMP_*.  Set by testimony_connect.
+  int timestamping;
+  // Filled in by server: the CPU each fanout index's socket is pinned to, or
+  // NULL if they aren't pinned to single CPUs.  Set by testimony_connect.
+  const uint32_t* cpus;
+  // Filled in by server: the NUMA node each fanout index's ring is on, or
+  // NULL if the server didn't choose.  Set by testimony_connect.
+  const uint32_t* numa_nodes;
+  // Filled in by server: the interfaces the socket captures on, each with its
+  // own ring of block_nr / num_interfaces blocks, or NULL (and 0) if the
+  // server didn't say.  Set by testimony_connect.
+  const char* const* interfaces;
+  int num_interfaces;
+  // Filled in by server: the SHA-256 hash of each interface's socket filter,
+  // which the server read back from the kernel and checked before serving the
+  // socket, TESTIMONY_FILTER_HASH_SIZE bytes each, or NULL if the server
+  // didn't say.  Set by testimony_connect.
+  const uint8_t* filter_hashes;
 } testimony_connection;
 
+#define TESTIMONY_TIMESTAMP_SOFTWARE 0      // kernel receive time
+#define TESTIMONY_TIMESTAMP_HARDWARE_RAW 1  // NIC clock
+#define TESTIMONY_TIMESTAMP_HARDWARE_SYS 2  // NIC clock in system time
+
+#define TESTIMONY_FILTER_HASH_SIZE 32  // bytes in each of filter_hashes
+
 // Initializes a connection to the testimony server.
 // After a successful call to testimony_connect, testimony_close should be
 // called on t should any future error occur.
@@ -81,9 +106,17 @@ int testimony_close(testimony t);
 // Gets a new block of packets from testimony.
 // If timeout_millis < 0, block forever.  If == 0, don't block.  If > 0, block
 // for at most the given number of milliseconds.
+// Returns -ESHUTDOWN once the server announces it's shutting down; blocks
+// already received should still be returned, after which the server will
+// close the connection.  Returns -ESTALE, with the same semantics, when the
+// server is replacing the socket's ring because its interface went away or
+// changed; reconnect to get the new ring.
 int testimony_get_block(testimony t, int timeout_millis, const struct tpacket_block_desc** block);
 // Returns a processed block of packets back to testimony.
 int testimony_return_block(testimony t, const struct tpacket_block_desc* block);
+// Returns the name of the interface a block's packets were captured on, or
+// NULL if the server didn't say.
+const char* testimony_block_interface(testimony t, const struct tpacket_block_desc* block);
 
 // testimony_return_packets counts the number of packets processed in a
 // testimony block and auto-returns the block after the Nth call, where N is the
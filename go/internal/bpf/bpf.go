@@ -0,0 +1,244 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package bpf holds the classic BPF instruction set, from linux/filter.h, and
+// an interpreter for it, shared by the filter compiler and the server.
+package bpf
+
+import "encoding/binary"
+
+// Instruction is a single classic BPF instruction, as in struct sock_filter.
+type Instruction struct {
+	Code   uint16
+	Jt, Jf uint8
+	K      uint32
+}
+
+// Instruction fields and values, from linux/filter.h.
+const (
+	Class = 0x07
+	LD    = 0x00
+	LDX   = 0x01
+	ST    = 0x02
+	STX   = 0x03
+	ALU   = 0x04
+	JMP   = 0x05
+	RET   = 0x06
+	MISC  = 0x07
+
+	Size = 0x18
+	W    = 0x00
+	H    = 0x08
+	B    = 0x10
+
+	Mode = 0xe0
+	IMM  = 0x00
+	ABS  = 0x20
+	IND  = 0x40
+	MEM  = 0x60
+	LEN  = 0x80
+	MSH  = 0xa0
+
+	Op   = 0xf0
+	ADD  = 0x00
+	SUB  = 0x10
+	MUL  = 0x20
+	DIV  = 0x30
+	OR   = 0x40
+	AND  = 0x50
+	LSH  = 0x60
+	RSH  = 0x70
+	NEG  = 0x80
+	MOD  = 0x90
+	XOR  = 0xa0
+	JA   = 0x00
+	JEQ  = 0x10
+	JGT  = 0x20
+	JGE  = 0x30
+	JSET = 0x40
+
+	Src = 0x08
+	K   = 0x00
+	X   = 0x08
+	A   = 0x10 // RET source
+
+	TAX = 0x00
+	TXA = 0x80
+
+	MemWords = 16 // BPF_MEMWORDS
+
+	AdOff = 0xfffff000 // SKF_AD_OFF, -0x1000, where ancillary data loads start
+)
+
+// Run runs a program over a packet the way the kernel does for socket
+// filters, returning the number of bytes to accept (0 to drop it).  Like the
+// kernel, it drops packets whose program reads out of bounds.  Linux's
+// ancillary data loads (absolute loads at AdOff and above, like
+// SKF_AD_VLAN_TAG) refer to metadata a bare packet doesn't have, so they're
+// answered by ancillary, which is given the load's offset.  If it's nil, they
+// drop the packet.
+func Run(prog []Instruction, pkt []byte, ancillary func(off uint32) uint32) uint32 {
+	var a, x uint32
+	var mem [MemWords]uint32
+	load := func(off uint32, size uint16) (uint32, bool) {
+		if int32(off) < 0 {
+			return 0, false
+		}
+		switch {
+		case size == W && uint64(off)+4 <= uint64(len(pkt)):
+			return binary.BigEndian.Uint32(pkt[off:]), true
+		case size == H && uint64(off)+2 <= uint64(len(pkt)):
+			return uint32(binary.BigEndian.Uint16(pkt[off:])), true
+		case size == B && uint64(off) < uint64(len(pkt)):
+			return uint32(pkt[off]), true
+		}
+		return 0, false
+	}
+	for pc := 0; pc < len(prog); pc++ {
+		ins := prog[pc]
+		switch ins.Code & Class {
+		case LD:
+			var ok bool
+			switch ins.Code & Mode {
+			case IMM:
+				a, ok = ins.K, true
+			case ABS:
+				if ins.K >= AdOff && ancillary != nil {
+					a, ok = ancillary(ins.K), true
+				} else {
+					a, ok = load(ins.K, ins.Code&Size)
+				}
+			case IND:
+				a, ok = load(x+ins.K, ins.Code&Size)
+			case MEM:
+				if ins.K < MemWords {
+					a, ok = mem[ins.K], true
+				}
+			case LEN:
+				a, ok = uint32(len(pkt)), true
+			}
+			if !ok {
+				return 0
+			}
+		case LDX:
+			var ok bool
+			switch ins.Code & Mode {
+			case IMM:
+				x, ok = ins.K, true
+			case MEM:
+				if ins.K < MemWords {
+					x, ok = mem[ins.K], true
+				}
+			case LEN:
+				x, ok = uint32(len(pkt)), true
+			case MSH:
+				var b uint32
+				if b, ok = load(ins.K, B); ok {
+					x = (b & 0xf) << 2
+				}
+			}
+			if !ok {
+				return 0
+			}
+		case ST, STX:
+			if ins.K >= MemWords {
+				return 0
+			}
+			if ins.Code&Class == ST {
+				mem[ins.K] = a
+			} else {
+				mem[ins.K] = x
+			}
+		case ALU:
+			v := ins.K
+			if ins.Code&Src == X {
+				v = x
+			}
+			switch ins.Code & Op {
+			case ADD:
+				a += v
+			case SUB:
+				a -= v
+			case MUL:
+				a *= v
+			case DIV:
+				if v == 0 {
+					return 0
+				}
+				a /= v
+			case MOD:
+				if v == 0 {
+					return 0
+				}
+				a %= v
+			case OR:
+				a |= v
+			case AND:
+				a &= v
+			case XOR:
+				a ^= v
+			case LSH:
+				a <<= v
+			case RSH:
+				a >>= v
+			case NEG:
+				a = -a
+			default:
+				return 0
+			}
+		case JMP:
+			v := ins.K
+			if ins.Code&Src == X {
+				v = x
+			}
+			var cond bool
+			switch ins.Code & Op {
+			case JA:
+				pc += int(ins.K)
+				continue
+			case JEQ:
+				cond = a == v
+			case JGT:
+				cond = a > v
+			case JGE:
+				cond = a >= v
+			case JSET:
+				cond = a&v != 0
+			default:
+				return 0
+			}
+			if cond {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case RET:
+			switch ins.Code & Size {
+			case A:
+				return a
+			case X:
+				return x
+			}
+			return ins.K
+		case MISC:
+			if ins.Code&Op == TXA {
+				a = x
+			} else {
+				x = a
+			}
+		}
+	}
+	// Falling off the end isn't allowed by the kernel's checker.
+	return 0
+}
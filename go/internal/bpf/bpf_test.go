@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package bpf
+
+import "testing"
+
+// retA ends programs whose result is what they leave in A.
+var retA = Instruction{Code: RET | A}
+
+func TestRun(t *testing.T) {
+	pkt := []byte{0x45, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07}
+	for _, test := range []struct {
+		desc string
+		prog []Instruction
+		want uint32
+	}{
+		{"ret k", []Instruction{{Code: RET | K, K: 1234}}, 1234},
+		{"ld word", []Instruction{{Code: LD | W | ABS, K: 4}, retA}, 0x04050607},
+		{"ld half", []Instruction{{Code: LD | H | ABS, K: 1}, retA}, 0x0102},
+		{"ld byte", []Instruction{{Code: LD | B | ABS, K: 7}, retA}, 0x07},
+		{"ld word past end", []Instruction{{Code: LD | W | ABS, K: 5}, retA}, 0},
+		{"ld byte past end", []Instruction{{Code: LD | B | ABS, K: 8}, {Code: RET | K, K: 1}}, 0},
+		{"ld huge offset", []Instruction{{Code: LD | B | ABS, K: 0x7fffffff}, {Code: RET | K, K: 1}}, 0},
+		{"ld indirect", []Instruction{{Code: LDX | IMM, K: 2}, {Code: LD | H | IND, K: 1}, retA}, 0x0304},
+		{"ld indirect past end", []Instruction{{Code: LDX | IMM, K: 6}, {Code: LD | H | IND, K: 1}, {Code: RET | K, K: 1}}, 0},
+		{"ld imm", []Instruction{{Code: LD | IMM, K: 99}, retA}, 99},
+		{"ld len", []Instruction{{Code: LD | W | LEN}, retA}, 8},
+		{"ldx len", []Instruction{{Code: LDX | W | LEN}, {Code: RET | X}}, 8},
+		{"ldx msh", []Instruction{{Code: LDX | B | MSH, K: 0}, {Code: RET | X}}, 20},
+		{"scratch", []Instruction{
+			{Code: LD | IMM, K: 7},
+			{Code: ST, K: 15},
+			{Code: LDX | IMM, K: 9},
+			{Code: STX, K: 0},
+			{Code: LD | MEM, K: 0},
+			{Code: LDX | MEM, K: 15},
+			{Code: ALU | SUB | X},
+			retA,
+		}, 2},
+		{"tax txa", []Instruction{{Code: LD | IMM, K: 5}, {Code: MISC | TAX}, {Code: LD | IMM}, {Code: MISC | TXA}, retA}, 5},
+		{"add", []Instruction{{Code: LD | IMM, K: 5}, {Code: ALU | ADD | K, K: 3}, retA}, 8},
+		{"sub wraps", []Instruction{{Code: LD | IMM, K: 1}, {Code: ALU | SUB | K, K: 2}, retA}, 0xffffffff},
+		{"mul", []Instruction{{Code: LD | IMM, K: 6}, {Code: ALU | MUL | K, K: 7}, retA}, 42},
+		{"div", []Instruction{{Code: LD | IMM, K: 43}, {Code: ALU | DIV | K, K: 7}, retA}, 6},
+		{"mod", []Instruction{{Code: LD | IMM, K: 43}, {Code: ALU | MOD | K, K: 7}, retA}, 1},
+		{"div by zero X", []Instruction{{Code: LD | IMM, K: 43}, {Code: ALU | DIV | X}, {Code: RET | K, K: 1}}, 0},
+		{"mod by zero X", []Instruction{{Code: LD | IMM, K: 43}, {Code: ALU | MOD | X}, {Code: RET | K, K: 1}}, 0},
+		{"and", []Instruction{{Code: LD | IMM, K: 0xf0f}, {Code: ALU | AND | K, K: 0xff}, retA}, 0xf},
+		{"or", []Instruction{{Code: LD | IMM, K: 0xf00}, {Code: ALU | OR | K, K: 0xf}, retA}, 0xf0f},
+		{"xor", []Instruction{{Code: LD | IMM, K: 0xff}, {Code: ALU | XOR | K, K: 0xf}, retA}, 0xf0},
+		{"lsh", []Instruction{{Code: LD | IMM, K: 1}, {Code: ALU | LSH | K, K: 4}, retA}, 16},
+		{"rsh", []Instruction{{Code: LD | IMM, K: 16}, {Code: ALU | RSH | K, K: 4}, retA}, 1},
+		{"neg", []Instruction{{Code: LD | IMM, K: 1}, {Code: ALU | NEG}, retA}, 0xffffffff},
+		{"alu x", []Instruction{{Code: LD | IMM, K: 5}, {Code: LDX | IMM, K: 3}, {Code: ALU | ADD | X}, retA}, 8},
+		{"ja", []Instruction{{Code: JMP | JA, K: 1}, {Code: RET | K, K: 1}, {Code: RET | K, K: 2}}, 2},
+		{"jeq true", []Instruction{{Code: LD | IMM, K: 3}, {Code: JMP | JEQ | K, Jt: 1, K: 3}, {Code: RET | K, K: 1}, {Code: RET | K, K: 2}}, 2},
+		{"jeq false", []Instruction{{Code: LD | IMM, K: 3}, {Code: JMP | JEQ | K, Jt: 1, K: 4}, {Code: RET | K, K: 1}, {Code: RET | K, K: 2}}, 1},
+		{"jgt equal", []Instruction{{Code: LD | IMM, K: 3}, {Code: JMP | JGT | K, Jf: 1, K: 3}, {Code: RET | K, K: 1}, {Code: RET | K, K: 2}}, 2},
+		{"jge equal", []Instruction{{Code: LD | IMM, K: 3}, {Code: JMP | JGE | K, Jf: 1, K: 3}, {Code: RET | K, K: 1}, {Code: RET | K, K: 2}}, 1},
+		{"jset", []Instruction{{Code: LD | IMM, K: 6}, {Code: JMP | JSET | K, Jf: 1, K: 2}, {Code: RET | K, K: 1}, {Code: RET | K, K: 2}}, 1},
+		{"jset clear", []Instruction{{Code: LD | IMM, K: 6}, {Code: JMP | JSET | K, Jf: 1, K: 1}, {Code: RET | K, K: 1}, {Code: RET | K, K: 2}}, 2},
+		{"jeq x", []Instruction{{Code: LD | IMM, K: 3}, {Code: LDX | IMM, K: 3}, {Code: JMP | JEQ | X, Jf: 1}, {Code: RET | K, K: 1}, {Code: RET | K, K: 2}}, 1},
+		{"ancillary without answers", []Instruction{{Code: LD | W | ABS, K: AdOff + 4}, {Code: RET | K, K: 1}}, 0},
+		{"falls off the end", []Instruction{{Code: LD | IMM, K: 1}}, 0},
+	} {
+		if got := Run(test.prog, pkt, nil); got != test.want {
+			t.Errorf("%s: Run = %#x, want %#x", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestRunAncillary(t *testing.T) {
+	prog := []Instruction{{Code: LD | B | ABS, K: AdOff + 4}, {Code: ALU | ADD | K, K: 1}, retA}
+	var asked uint32
+	got := Run(prog, nil, func(off uint32) uint32 {
+		asked = off
+		return 4
+	})
+	if asked != AdOff+4 || got != 5 {
+		t.Errorf("Run asked for %#x and returned %d, want %#x and 5", asked, got, uint32(AdOff+4))
+	}
+}
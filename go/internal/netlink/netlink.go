@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package netlink watches for network interface changes using rtnetlink.
+package netlink
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// rtmgrpLink is RTMGRP_LINK, the multicast group for link events, from
+// linux/rtnetlink.h.
+const rtmgrpLink = 1
+
+// ErrLost is returned by LinkMonitor.Read when the kernel had to drop events
+// because they weren't read quickly enough.  The caller should recheck every
+// interface it cares about.
+var ErrLost = errors.New("netlink link events lost")
+
+// LinkEvent describes a network interface being added, changed or removed.
+type LinkEvent struct {
+	Name    string
+	Index   int
+	Flags   uint32 // IFF_* flags, from net/if.h
+	Deleted bool
+}
+
+// Up returns true if the interface is administratively up and has a carrier.
+func (e LinkEvent) Up() bool {
+	return !e.Deleted && e.Flags&syscall.IFF_UP != 0 && e.Flags&syscall.IFF_RUNNING != 0
+}
+
+// LinkMonitor receives link events from the kernel.
+type LinkMonitor struct {
+	f   *os.File
+	buf []byte
+}
+
+// ListenLinks returns a LinkMonitor subscribed to link events.
+func ListenLinks() (*LinkMonitor, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("netlink socket: %v", err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink}); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("netlink bind: %v", err)
+	}
+	// A non-blocking file uses Go's poller, so Close interrupts a Read.
+	return &LinkMonitor{f: os.NewFile(uintptr(fd), "netlink"), buf: make([]byte, 64<<10)}, nil
+}
+
+// Read waits for link events and returns them.
+func (m *LinkMonitor) Read() ([]LinkEvent, error) {
+	n, err := m.f.Read(m.buf)
+	if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENOBUFS {
+		return nil, ErrLost
+	} else if err != nil {
+		return nil, err
+	}
+	msgs, err := syscall.ParseNetlinkMessage(m.buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("could not parse netlink message: %v", err)
+	}
+	var events []LinkEvent
+	for i := range msgs {
+		msg := &msgs[i]
+		if msg.Header.Type != syscall.RTM_NEWLINK && msg.Header.Type != syscall.RTM_DELLINK {
+			continue
+		}
+		if len(msg.Data) < syscall.SizeofIfInfomsg {
+			return nil, fmt.Errorf("short netlink link message (%d bytes)", len(msg.Data))
+		}
+		info := (*syscall.IfInfomsg)(unsafe.Pointer(&msg.Data[0]))
+		e := LinkEvent{
+			Index:   int(info.Index),
+			Flags:   info.Flags,
+			Deleted: msg.Header.Type == syscall.RTM_DELLINK,
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(msg)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse netlink link attributes: %v", err)
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == syscall.IFLA_IFNAME {
+				e.Name = strings.TrimRight(string(attr.Value), "\x00")
+			}
+		}
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+// Close stops the monitor, interrupting any Read.
+func (m *LinkMonitor) Close() error {
+	return m.f.Close()
+}
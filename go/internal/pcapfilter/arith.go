@@ -0,0 +1,308 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcapfilter
+
+import (
+	"strconv"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+// value is the code for an arithmetic expression, which leaves it in A.
+type value struct {
+	insns   []bpf.Instruction
+	guard   cond // what packets must be for the value to make sense
+	isConst bool
+	k       uint32 // the value, if it's constant
+}
+
+func constant(k uint32) value {
+	return value{insns: []bpf.Instruction{{Code: bpf.LD | bpf.IMM, K: k}}, guard: condTrue, isConst: true, k: k}
+}
+
+// binops are the arithmetic operators, by precedence (higher binds tighter)
+// and ALU operation.
+var binops = map[string]struct {
+	prec int
+	op   uint16
+}{
+	"|": {1, bpf.OR}, "^": {1, bpf.XOR},
+	"&":  {2, bpf.AND},
+	"<<": {3, bpf.LSH}, ">>": {3, bpf.RSH},
+	"+": {4, bpf.ADD}, "-": {4, bpf.SUB},
+	"*": {5, bpf.MUL}, "/": {5, bpf.DIV}, "%": {5, bpf.MOD},
+}
+
+// arithConsts are names that can be used in arithmetic expressions.
+var arithConsts = map[string]uint32{
+	"tcpflags": 13, "tcp-fin": 0x01, "tcp-syn": 0x02, "tcp-rst": 0x04, "tcp-push": 0x08,
+	"tcp-ack": 0x10, "tcp-urg": 0x20, "tcp-ece": 0x40, "tcp-cwr": 0x80,
+
+	"icmptype": 0, "icmpcode": 1,
+	"icmp-echoreply": 0, "icmp-unreach": 3, "icmp-sourcequench": 4, "icmp-redirect": 5,
+	"icmp-echo": 8, "icmp-routeradvert": 9, "icmp-routersolicit": 10, "icmp-timxceed": 11,
+	"icmp-paramprob": 12, "icmp-tstamp": 13, "icmp-tstampreply": 14, "icmp-ireq": 15,
+	"icmp-ireqreply": 16, "icmp-maskreq": 17, "icmp-maskreply": 18,
+
+	"icmp6type": 0, "icmp6code": 1,
+	"icmp6-destinationunreach": 1, "icmp6-packettoobig": 2, "icmp6-timeexceeded": 3,
+	"icmp6-parameterproblem": 4, "icmp6-echo": 128, "icmp6-echoreply": 129,
+	"icmp6-multicastlistenerquery": 130, "icmp6-multicastlistenerreportv1": 131,
+	"icmp6-multicastlistenerdone": 132, "icmp6-routersolicit": 133, "icmp6-routeradvert": 134,
+	"icmp6-neighborsolicit": 135, "icmp6-neighboradvert": 136, "icmp6-redirect": 137,
+}
+
+// scratch allocates a scratch memory word for the relation being parsed.
+func (p *parser) scratch(t token) (uint32, error) {
+	if p.mem >= bpf.MemWords {
+		return 0, p.errorf(t, "expression is too complex")
+	}
+	p.mem++
+	return uint32(p.mem - 1), nil
+}
+
+// parseRelation parses a comparison of two arithmetic expressions.
+func (p *parser) parseRelation() (cond, error) {
+	p.mem = 0
+	l, err := p.parseArith(1)
+	if err != nil {
+		return nil, err
+	}
+	op := p.next()
+	if !is(op, ">", "<", ">=", "<=", "=", "==", "!=") {
+		return nil, p.errorf(op, "expected a comparison, found %v", op)
+	}
+	r, err := p.parseArith(1)
+	if err != nil {
+		return nil, err
+	}
+	insns, src := l.insns, uint16(bpf.K)
+	if !r.isConst {
+		m, err := p.scratch(op)
+		if err != nil {
+			return nil, err
+		}
+		insns = append(append(append([]bpf.Instruction{}, l.insns...), bpf.Instruction{Code: bpf.ST, K: m}), r.insns...)
+		insns = append(insns, bpf.Instruction{Code: bpf.MISC | bpf.TAX}, bpf.Instruction{Code: bpf.LD | bpf.MEM, K: m})
+		src = bpf.X
+	}
+	test := func(jmp uint16) cond {
+		t := append(testCond{}, insns...)
+		return append(t, bpf.Instruction{Code: bpf.JMP | jmp | src, K: r.k})
+	}
+	var c cond
+	switch op.text {
+	case ">":
+		c = test(bpf.JGT)
+	case ">=":
+		c = test(bpf.JGE)
+	case "=", "==":
+		c = test(bpf.JEQ)
+	case "!=":
+		c = not(test(bpf.JEQ))
+	case "<":
+		c = not(test(bpf.JGE))
+	case "<=":
+		c = not(test(bpf.JGT))
+	}
+	return and(l.guard, r.guard, c), nil
+}
+
+// parseArith parses an arithmetic expression whose operators bind at least
+// as tightly as prec.
+func (p *parser) parseArith(prec int) (value, error) {
+	l, err := p.parseUnary()
+	if err != nil {
+		return value{}, err
+	}
+	for {
+		op := p.peek()
+		b, ok := binops[op.text]
+		if op.kind != tokOp || !ok || b.prec < prec {
+			return l, nil
+		}
+		p.next()
+		r, err := p.parseArith(b.prec + 1)
+		if err != nil {
+			return value{}, err
+		}
+		if l, err = p.binop(op, b.op, l, r); err != nil {
+			return value{}, err
+		}
+	}
+}
+
+// binop combines two values with an ALU operation.
+func (p *parser) binop(t token, op uint16, l, r value) (value, error) {
+	if r.isConst {
+		switch {
+		case (op == bpf.DIV || op == bpf.MOD) && r.k == 0:
+			return value{}, p.errorf(t, "division by zero")
+		case (op == bpf.LSH || op == bpf.RSH) && r.k >= 32:
+			return value{}, p.errorf(t, "shift by %d is more than 31", r.k)
+		}
+	}
+	if l.isConst && r.isConst {
+		a, b := l.k, r.k
+		switch op {
+		case bpf.OR:
+			a |= b
+		case bpf.XOR:
+			a ^= b
+		case bpf.AND:
+			a &= b
+		case bpf.LSH:
+			a <<= b
+		case bpf.RSH:
+			a >>= b
+		case bpf.ADD:
+			a += b
+		case bpf.SUB:
+			a -= b
+		case bpf.MUL:
+			a *= b
+		case bpf.DIV:
+			a /= b
+		case bpf.MOD:
+			a %= b
+		}
+		return constant(a), nil
+	}
+	v := value{insns: append([]bpf.Instruction{}, l.insns...), guard: and(l.guard, r.guard)}
+	if r.isConst {
+		v.insns = append(v.insns, bpf.Instruction{Code: bpf.ALU | op | bpf.K, K: r.k})
+		return v, nil
+	}
+	m, err := p.scratch(t)
+	if err != nil {
+		return value{}, err
+	}
+	v.insns = append(append(v.insns, bpf.Instruction{Code: bpf.ST, K: m}), r.insns...)
+	v.insns = append(v.insns,
+		bpf.Instruction{Code: bpf.MISC | bpf.TAX},
+		bpf.Instruction{Code: bpf.LD | bpf.MEM, K: m},
+		bpf.Instruction{Code: bpf.ALU | op | bpf.X})
+	return v, nil
+}
+
+func (p *parser) parseUnary() (value, error) {
+	if !p.accept("-") {
+		return p.parseOperand()
+	}
+	v, err := p.parseUnary()
+	if err != nil || v.isConst {
+		return constant(-v.k), err
+	}
+	v.insns = append(append([]bpf.Instruction{}, v.insns...), bpf.Instruction{Code: bpf.ALU | bpf.NEG})
+	return v, nil
+}
+
+// parseOperand parses a number, a named constant, len, a parenthesized
+// expression or packet data like "ip[2:2]".
+func (p *parser) parseOperand() (value, error) {
+	t := p.next()
+	switch {
+	case is(t, "("):
+		v, err := p.parseArith(1)
+		if err != nil {
+			return value{}, err
+		}
+		_, err = p.expect(")")
+		return v, err
+	case t.kind != tokWord:
+	case t.text == "len":
+		return value{insns: []bpf.Instruction{{Code: bpf.LD | bpf.W | bpf.LEN}}, guard: condTrue}, nil
+	case is(p.peek(), "["):
+		if _, ok := protoNames[t.text]; ok {
+			return p.parseLoad(t)
+		}
+	default:
+		if n, err := strconv.ParseUint(t.text, 0, 32); err == nil {
+			return constant(uint32(n)), nil
+		}
+		if n, ok := arithConsts[t.text]; ok {
+			return constant(n), nil
+		}
+	}
+	return value{}, p.errorf(t, "expected an expression, found %v", t)
+}
+
+// parseLoad parses the rest of "proto[offset]" or "proto[offset:size]",
+// which loads size bytes at offset into proto's header.
+func (p *parser) parseLoad(proto token) (value, error) {
+	p.next()
+	off, err := p.parseArith(1)
+	if err != nil {
+		return value{}, err
+	}
+	size := 1
+	if p.accept(":") {
+		t := p.next()
+		switch t.text {
+		case "1", "2", "4":
+			size = int(t.text[0] - '0')
+		default:
+			return value{}, p.errorf(t, "expected a size of 1, 2 or 4, found %v", t)
+		}
+	}
+	end, err := p.expect("]")
+	if err != nil {
+		return value{}, err
+	}
+
+	// Headers after IPv4's are found with the header length in X.
+	base, guard, afterIPv4 := p.nl(), condTrue, false
+	switch pr := protoNames[proto.text]; {
+	case pr.ether != 0:
+		guard = p.linkProto(pr.ether)
+	case pr.ip == protoICMP6:
+		base += 40
+		guard = and(p.linkProto(etherIPv6), cmp(1, p.nl()+6, noMask, bpf.JEQ, protoICMP6))
+	case pr.ip != 0:
+		afterIPv4 = true
+		guard = and(p.ipProto(pr.ip), p.ipFirstFragment())
+	default:
+		if p.link != LinkEthernet {
+			return value{}, p.errorf(proto, "%s needs an Ethernet interface", proto.text)
+		}
+		base = 0
+	}
+
+	v := value{guard: and(guard, off.guard)}
+	msh := bpf.Instruction{Code: bpf.LDX | bpf.B | bpf.MSH, K: p.nl()}
+	switch {
+	case off.isConst && !afterIPv4:
+		v.insns = []bpf.Instruction{ld(size, base+off.k)}
+	case off.isConst:
+		v.insns = []bpf.Instruction{msh, {Code: bpf.LD | sizeCode(size) | bpf.IND, K: base + off.k}}
+	case !afterIPv4:
+		v.insns = append(append([]bpf.Instruction{}, off.insns...),
+			bpf.Instruction{Code: bpf.MISC | bpf.TAX},
+			bpf.Instruction{Code: bpf.LD | sizeCode(size) | bpf.IND, K: base})
+	default:
+		m, err := p.scratch(end)
+		if err != nil {
+			return value{}, err
+		}
+		v.insns = append(append([]bpf.Instruction{}, off.insns...),
+			bpf.Instruction{Code: bpf.ST, K: m},
+			msh,
+			bpf.Instruction{Code: bpf.LD | bpf.MEM, K: m},
+			bpf.Instruction{Code: bpf.ALU | bpf.ADD | bpf.X},
+			bpf.Instruction{Code: bpf.MISC | bpf.TAX},
+			bpf.Instruction{Code: bpf.LD | sizeCode(size) | bpf.IND, K: base})
+	}
+	return v, nil
+}
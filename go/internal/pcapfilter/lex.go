@@ -0,0 +1,105 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcapfilter
+
+import "fmt"
+
+// tokenKind says what sort of token a token is.
+type tokenKind int
+
+const (
+	tokEOF  tokenKind = iota
+	tokWord           // keywords, names, numbers and addresses
+	tokOp             // operators and punctuation
+)
+
+// token is a single lexical token of a filter.
+type token struct {
+	kind tokenKind
+	text string
+	pos  int // byte offset in the filter
+}
+
+// String describes the token for error messages.
+func (t token) String() string {
+	if t.kind == tokEOF {
+		return "end of filter"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+// ops are the operators, longest first so that "<<" isn't read as "<".
+var ops = []string{
+	"&&", "||", "==", "!=", "<=", ">=", "<<", ">>",
+	"(", ")", "[", "]", "!", "=", "<", ">", "&", "|", "+", "-", "*", "/", "%", "^", ":",
+}
+
+// isWordStart and isWordByte say which bytes start and continue words.
+func isWordStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '\\'
+}
+
+func isWordByte(c byte) bool {
+	return isWordStart(c) || c == '.'
+}
+
+// lex splits a filter into tokens.  Words may contain dots, like addresses
+// and host names, and outside brackets, colons, like MAC and IPv6 addresses
+// (which may start with "::").  Words starting with a letter may also contain
+// dashes, like "tcp-syn", but others may not, so "1-1024" is a range rather
+// than one word.
+func lex(filter string) ([]token, error) {
+	var toks []token
+	depth := 0 // of brackets, inside which colons separate offsets and sizes
+	for i := 0; i < len(filter); {
+		c := filter[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case isWordStart(c) || c == ':' && depth == 0 && i+1 < len(filter) && filter[i+1] == ':':
+			start := i
+			letter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+			for i < len(filter) {
+				c := filter[i]
+				if isWordByte(c) || c == ':' && depth == 0 || c == '-' && letter {
+					i++
+				} else {
+					break
+				}
+			}
+			toks = append(toks, token{kind: tokWord, text: filter[start:i], pos: start})
+		default:
+			op := ""
+			for _, o := range ops {
+				if len(filter)-i >= len(o) && filter[i:i+len(o)] == o {
+					op = o
+					break
+				}
+			}
+			if op == "" {
+				return nil, &Error{Pos: i, Msg: fmt.Sprintf("unexpected character %q", c)}
+			}
+			switch op {
+			case "[":
+				depth++
+			case "]":
+				depth--
+			}
+			toks = append(toks, token{kind: tokOp, text: op, pos: i})
+			i += len(op)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(filter)}), nil
+}
@@ -0,0 +1,284 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcapfilter
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+// parser turns a filter's tokens into a condition.
+type parser struct {
+	toks []token
+	i    int
+	link LinkType
+	last qualifiers // of the last primitive with an ID, for bare IDs
+	mem  int        // scratch memory words used by the relation being parsed
+
+	// abandoned is the furthest error from relations the parser backed up
+	// from, which may explain a later syntax error better than it does.
+	abandoned error
+}
+
+// qualifiers are the keywords before a primitive's ID, like "tcp src port".
+type qualifiers struct {
+	proto string // "" for any
+	dir   string // "", "src", "dst", "src or dst" or "src and dst"
+	typ   string // "host", "net", "port", "portrange" or "proto"
+}
+
+// keywords can't be used as IDs, except as names of protocols.
+var keywords = map[string]bool{
+	"and": true, "or": true, "not": true,
+	"src": true, "dst": true,
+	"host": true, "net": true, "port": true, "portrange": true, "proto": true,
+	"mask": true, "less": true, "greater": true, "len": true,
+	"broadcast": true, "multicast": true, "vlan": true, "gateway": true,
+}
+
+func init() {
+	for name := range protoNames {
+		keywords[name] = true
+	}
+}
+
+func (p *parser) peek() token {
+	return p.toks[p.i]
+}
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+// is returns true if t is one of texts.
+func is(t token, texts ...string) bool {
+	if t.kind == tokEOF {
+		return false
+	}
+	for _, text := range texts {
+		if t.text == text {
+			return true
+		}
+	}
+	return false
+}
+
+// accept consumes the next token if it's one of texts.
+func (p *parser) accept(texts ...string) bool {
+	if is(p.peek(), texts...) {
+		p.i++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) (token, error) {
+	t := p.next()
+	if !is(t, text) {
+		return t, p.syntaxErrorf(t, "expected %q, found %v", text, t)
+	}
+	return t, nil
+}
+
+func (p *parser) errorf(t token, format string, args ...interface{}) error {
+	return &Error{Pos: t.pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// syntaxErrorf returns an error for an unexpected token, unless a relation
+// the parser backed up from failed further on:  in "tcp[13 & 2 != 0", the
+// missing "]" is more useful than the "[" after "tcp".
+func (p *parser) syntaxErrorf(t token, format string, args ...interface{}) error {
+	err := p.errorf(t, format, args...)
+	if p.abandoned != nil {
+		return further(err, p.abandoned)
+	}
+	return err
+}
+
+// further returns whichever error was found further into the filter,
+// preferring b, as that's likely where the user's intent went wrong.
+func further(a, b error) error {
+	ae, aok := a.(*Error)
+	be, bok := b.(*Error)
+	if aok && bok && ae.Pos > be.Pos {
+		return a
+	}
+	return b
+}
+
+// parseExpr parses terms joined by and and or, which have equal precedence
+// and associate to the left, as in libpcap.
+func (p *parser) parseExpr() (cond, error) {
+	c, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var combine func(...cond) cond
+		switch {
+		case p.accept("and", "&&"):
+			combine = and
+		case p.accept("or", "||"):
+			combine = or
+		default:
+			return c, nil
+		}
+		r, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		c = combine(c, r)
+	}
+}
+
+// parseTerm parses a negated term, a relation, a parenthesized expression or
+// a primitive.  Parentheses may start either a relation or an expression, so
+// relations are tried first, and if that fails the parser backs up.
+func (p *parser) parseTerm() (cond, error) {
+	if p.accept("not", "!") {
+		c, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		return not(c), nil
+	}
+	start := p.i
+	c, relErr := p.parseRelation()
+	if relErr == nil {
+		return c, nil
+	}
+	p.i = start
+	if p.abandoned == nil {
+		p.abandoned = relErr
+	} else {
+		p.abandoned = further(relErr, p.abandoned)
+	}
+	var err error
+	if p.accept("(") {
+		if c, err = p.parseExpr(); err == nil {
+			if _, err = p.expect(")"); err == nil {
+				return c, nil
+			}
+		}
+	} else if c, err = p.parsePrimitive(); err == nil {
+		return c, nil
+	}
+	return nil, further(relErr, err)
+}
+
+// parsePrimitive parses a primitive, like "tcp dst port 80", "arp" or a bare
+// ID that takes the last primitive's qualifiers.
+func (p *parser) parsePrimitive() (cond, error) {
+	t := p.peek()
+	switch {
+	case is(t, "less", "greater"):
+		p.next()
+		n, err := p.parseNumber(p.next(), 0xffffffff)
+		if err != nil {
+			return nil, err
+		}
+		if t.text == "less" {
+			return not(testCond{{Code: bpf.LD | bpf.W | bpf.LEN}, {Code: bpf.JMP | bpf.JGT | bpf.K, K: n}}), nil
+		}
+		return testCond{{Code: bpf.LD | bpf.W | bpf.LEN}, {Code: bpf.JMP | bpf.JGE | bpf.K, K: n}}, nil
+	case is(t, "vlan"):
+		p.next()
+		return p.parseVLAN()
+	case is(t, "broadcast", "multicast"):
+		return p.parseCast("")
+	case is(t, "gateway"):
+		return nil, p.errorf(t, "gateway is not supported")
+	}
+
+	var q qualifiers
+	if _, ok := protoNames[t.text]; ok && t.kind == tokWord {
+		q.proto = t.text
+		p.next()
+		if is(p.peek(), "broadcast", "multicast") {
+			return p.parseCast(q.proto)
+		}
+	}
+	if d := p.peek(); is(d, "src", "dst") {
+		p.next()
+		q.dir = d.text
+		if is(p.peek(), "and", "or") && p.i+1 < len(p.toks) && is(p.toks[p.i+1], "src", "dst") && p.toks[p.i+1].text != d.text {
+			q.dir = "src " + p.next().text + " dst"
+			p.next()
+		}
+	}
+	if ty := p.peek(); is(ty, "host", "net", "port", "portrange", "proto") {
+		p.next()
+		q.typ = ty.text
+	}
+	switch {
+	case q == qualifiers{}:
+		if id := p.peek(); id.kind != tokWord || keywords[id.text] {
+			return nil, p.errorf(id, "expected a primitive, found %v", id)
+		}
+		q = p.last
+	case q.dir == "" && q.typ == "":
+		return p.protoTest(t)
+	}
+	if q.typ == "" {
+		q.typ = "host"
+	}
+	p.last = q
+	return p.parseID(q)
+}
+
+// parseNumber parses a decimal, octal or hex number no greater than max.
+func (p *parser) parseNumber(t token, max uint32) (uint32, error) {
+	n, err := strconv.ParseUint(t.text, 0, 32)
+	if t.kind != tokWord || err != nil {
+		return 0, p.errorf(t, "expected a number, found %v", t)
+	}
+	if n > uint64(max) {
+		return 0, p.errorf(t, "%d is more than %d", n, max)
+	}
+	return uint32(n), nil
+}
+
+// parseID parses the ID of a primitive with the given qualifiers.
+func (p *parser) parseID(q qualifiers) (cond, error) {
+	t := p.next()
+	what := map[string]string{
+		"host":      "a host name or address",
+		"net":       "a network",
+		"port":      "a port",
+		"portrange": "a port range",
+		"proto":     "a protocol",
+	}[q.typ]
+	if t.kind != tokWord || keywords[t.text] && q.typ != "proto" {
+		return nil, p.errorf(t, "expected %s, found %v", what, t)
+	}
+	// Backslashes let protocol names be used as IDs, as in "ether proto \ip".
+	id := strings.TrimPrefix(t.text, `\`)
+	switch q.typ {
+	case "host":
+		return p.host(q, t, id)
+	case "net":
+		return p.net(q, t, id)
+	case "port", "portrange":
+		return p.port(q, t, id)
+	}
+	return p.proto(q, t, id)
+}
@@ -0,0 +1,277 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package pcapfilter compiles pcap filter expressions, as used by tcpdump and
+// described in pcap-filter(7), into classic BPF programs, without libpcap.
+//
+// It supports the commonly used subset of the language:  the ether, ip, ip6,
+// arp, rarp, tcp, udp, sctp, icmp, icmp6 and igmp protocols; host, net, port,
+// portrange and proto primitives with src and dst qualifiers; broadcast,
+// multicast, less, greater and vlan; and comparisons of arithmetic
+// expressions over packet data like "tcp[tcpflags] & tcp-syn != 0".
+// Primitives are combined with and, or and not, and names after and or or
+// inherit the previous primitive's qualifiers, as in "port 80 or 443".
+// Programs aren't optimized as libpcap's are, so they may be longer.
+package pcapfilter
+
+import (
+	"fmt"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+// LinkType is the kind of link-layer header packets start with.
+type LinkType int
+
+// Supported link types.
+const (
+	// LinkEthernet packets start with an Ethernet header (DLT_EN10MB).
+	LinkEthernet LinkType = iota
+	// LinkRaw packets start with an IPv4 or IPv6 header (DLT_RAW).
+	LinkRaw
+)
+
+// String returns the link type's name.
+func (l LinkType) String() string {
+	switch l {
+	case LinkEthernet:
+		return "ethernet"
+	case LinkRaw:
+		return "raw IP"
+	}
+	return fmt.Sprintf("LinkType(%d)", int(l))
+}
+
+// MatchLen is the length programs return for matching packets, as tcpdump's
+// do by default.
+const MatchLen = 262144
+
+// Error is a problem with a filter, found at a particular place in it.
+type Error struct {
+	Pos int // byte offset of the offending token
+	Msg string
+}
+
+// Error returns the message and its (1-based) column.
+func (e *Error) Error() string {
+	return fmt.Sprintf("column %d: %s", e.Pos+1, e.Msg)
+}
+
+// Compile compiles a filter for packets with the given link type.  An empty
+// filter matches every packet.  Errors are *Error.
+func Compile(filter string, link LinkType) ([]bpf.Instruction, error) {
+	if link != LinkEthernet && link != LinkRaw {
+		return nil, fmt.Errorf("unsupported link type %v", link)
+	}
+	toks, err := lex(filter)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks, link: link}
+	c := condTrue
+	if p.peek().kind != tokEOF {
+		if c, err = p.parseExpr(); err != nil {
+			return nil, err
+		}
+		if t := p.peek(); t.kind != tokEOF {
+			return nil, p.syntaxErrorf(t, "unexpected %v", t)
+		}
+	}
+	return emit(c), nil
+}
+
+// cond is a condition on a packet, built up from tests by and, or and not.
+// Only and, or and not build them, so constants are folded away.
+type cond interface{}
+
+type constCond bool
+
+var (
+	condTrue  cond = constCond(true)
+	condFalse cond = constCond(false)
+)
+
+type andCond struct{ l, r cond }
+type orCond struct{ l, r cond }
+type notCond struct{ x cond }
+
+// testCond is a straight-line run of instructions ending in a conditional
+// jump, which jumps to jt if the condition holds and to jf if it doesn't.
+type testCond []bpf.Instruction
+
+func and(conds ...cond) cond {
+	out := condTrue
+	for _, c := range conds {
+		switch {
+		case c == condFalse || out == condFalse:
+			out = condFalse
+		case c == condTrue:
+		case out == condTrue:
+			out = c
+		default:
+			out = andCond{out, c}
+		}
+	}
+	return out
+}
+
+func or(conds ...cond) cond {
+	out := condFalse
+	for _, c := range conds {
+		switch {
+		case c == condTrue || out == condTrue:
+			out = condTrue
+		case c == condFalse:
+		case out == condFalse:
+			out = c
+		default:
+			out = orCond{out, c}
+		}
+	}
+	return out
+}
+
+func not(c cond) cond {
+	switch c {
+	case condTrue:
+		return condFalse
+	case condFalse:
+		return condTrue
+	}
+	if n, ok := c.(notCond); ok {
+		return n.x
+	}
+	return notCond{c}
+}
+
+// pinsn is an instruction being laid out, whose jumps go to labels.
+type pinsn struct {
+	ins        bpf.Instruction
+	jt, jf, ja *label
+}
+
+// label is a place in a program being laid out:  the instruction at it.
+type label struct {
+	at *pinsn
+}
+
+// emitter lays out a program.
+type emitter struct {
+	out     []*pinsn
+	pending []*label // labels at the next instruction
+}
+
+func (e *emitter) add(p *pinsn) {
+	for _, l := range e.pending {
+		l.at = p
+	}
+	e.pending = nil
+	e.out = append(e.out, p)
+}
+
+func (e *emitter) bind(l *label) {
+	e.pending = append(e.pending, l)
+}
+
+// cond lays out c, going to t if it holds and f if it doesn't.
+func (e *emitter) cond(c cond, t, f *label) {
+	switch c := c.(type) {
+	case constCond:
+		if c {
+			e.add(&pinsn{ins: bpf.Instruction{Code: bpf.JMP | bpf.JA}, ja: t})
+		} else {
+			e.add(&pinsn{ins: bpf.Instruction{Code: bpf.JMP | bpf.JA}, ja: f})
+		}
+	case testCond:
+		for _, ins := range c[:len(c)-1] {
+			e.add(&pinsn{ins: ins})
+		}
+		e.add(&pinsn{ins: c[len(c)-1], jt: t, jf: f})
+	case andCond:
+		mid := &label{}
+		e.cond(c.l, mid, f)
+		e.bind(mid)
+		e.cond(c.r, t, f)
+	case orCond:
+		mid := &label{}
+		e.cond(c.l, t, mid)
+		e.bind(mid)
+		e.cond(c.r, t, f)
+	case notCond:
+		e.cond(c.x, f, t)
+	default:
+		panic(fmt.Sprintf("unknown condition %T", c))
+	}
+}
+
+// emit lays out a program returning MatchLen for packets matching c, and 0
+// for others.
+func emit(c cond) []bpf.Instruction {
+	match, drop := bpf.Instruction{Code: bpf.RET | bpf.K, K: MatchLen}, bpf.Instruction{Code: bpf.RET | bpf.K}
+	switch c {
+	case condTrue:
+		return []bpf.Instruction{match}
+	case condFalse:
+		return []bpf.Instruction{drop}
+	}
+	var e emitter
+	t, f := &label{}, &label{}
+	e.cond(c, t, f)
+	e.bind(t)
+	e.add(&pinsn{ins: match})
+	e.bind(f)
+	e.add(&pinsn{ins: drop})
+
+	// Conditional jumps only reach 255 instructions, so farther ones go
+	// through an unconditional jump placed right after them.  Adding those
+	// moves other jumps' targets, so repeat until everything fits.
+	for {
+		pc := map[*pinsn]int{}
+		for i, p := range e.out {
+			pc[p] = i
+		}
+		var out []*pinsn
+		for i, p := range e.out {
+			out = append(out, p)
+			for _, l := range []**label{&p.jt, &p.jf} {
+				if *l != nil && pc[(*l).at]-i-1 > 0xff {
+					ja := &pinsn{ins: bpf.Instruction{Code: bpf.JMP | bpf.JA}, ja: *l}
+					*l = &label{at: ja}
+					out = append(out, ja)
+				}
+			}
+		}
+		if len(out) == len(e.out) {
+			break
+		}
+		e.out = out
+	}
+	pc := map[*pinsn]int{}
+	for i, p := range e.out {
+		pc[p] = i
+	}
+	prog := make([]bpf.Instruction, len(e.out))
+	for i, p := range e.out {
+		ins := p.ins
+		if p.ja != nil {
+			ins.K = uint32(pc[p.ja.at] - i - 1)
+		}
+		if p.jt != nil {
+			ins.Jt = uint8(pc[p.jt.at] - i - 1)
+			ins.Jf = uint8(pc[p.jf.at] - i - 1)
+		}
+		prog[i] = ins
+	}
+	return prog
+}
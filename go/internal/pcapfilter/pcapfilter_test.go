@@ -0,0 +1,476 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcapfilter
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+// tcpdumpTests are programs printed by "tcpdump -ddd" for filters.  Compile
+// doesn't optimize as libpcap does, so its programs are checked by running
+// both over packets rather than compared instruction by instruction.
+var tcpdumpTests = []struct {
+	filter string
+	link   LinkType
+	ddd    string
+}{
+	{"tcp", LinkEthernet, `12
+40 0 0 12
+21 0 5 34525
+48 0 0 20
+21 6 0 6
+21 0 6 44
+48 0 0 54
+21 3 4 6
+21 0 3 2048
+48 0 0 23
+21 0 1 6
+6 0 0 262144
+6 0 0 0`},
+	{"ip proto 17", LinkEthernet, `6
+40 0 0 12
+21 0 3 2048
+48 0 0 23
+21 0 1 17
+6 0 0 262144
+6 0 0 0`},
+	{"ip proto 17", LinkRaw, `7
+48 0 0 0
+84 0 0 240
+21 0 3 64
+48 0 0 9
+21 0 1 17
+6 0 0 262144
+6 0 0 0`},
+	{"host 10.0.0.1", LinkEthernet, `14
+40 0 0 12
+21 0 4 2048
+32 0 0 26
+21 8 0 167772161
+32 0 0 30
+21 6 7 167772161
+21 1 0 2054
+21 0 5 32821
+32 0 0 28
+21 2 0 167772161
+32 0 0 38
+21 0 1 167772161
+6 0 0 262144
+6 0 0 0`},
+	{"src host 10.0.0.1", LinkEthernet, `10
+40 0 0 12
+21 0 2 2048
+32 0 0 26
+21 4 5 167772161
+21 1 0 2054
+21 0 3 32821
+32 0 0 28
+21 0 1 167772161
+6 0 0 262144
+6 0 0 0`},
+	{"host 2001:db8::1", LinkEthernet, `20
+40 0 0 12
+21 0 17 34525
+32 0 0 22
+21 0 6 536939960
+32 0 0 26
+21 0 4 0
+32 0 0 30
+21 0 2 0
+32 0 0 34
+21 8 0 1
+32 0 0 38
+21 0 7 536939960
+32 0 0 42
+21 0 5 0
+32 0 0 46
+21 0 3 0
+32 0 0 50
+21 0 1 1
+6 0 0 262144
+6 0 0 0`},
+	{"net 192.168.0.0/16", LinkEthernet, `18
+40 0 0 12
+21 0 6 2048
+32 0 0 26
+84 0 0 4294901760
+21 11 0 3232235520
+32 0 0 30
+84 0 0 4294901760
+21 8 9 3232235520
+21 1 0 2054
+21 0 7 32821
+32 0 0 28
+84 0 0 4294901760
+21 3 0 3232235520
+32 0 0 38
+84 0 0 4294901760
+21 0 1 3232235520
+6 0 0 262144
+6 0 0 0`},
+	{"tcp port 80", LinkEthernet, `20
+40 0 0 12
+21 0 6 34525
+48 0 0 20
+21 0 15 6
+40 0 0 54
+21 12 0 80
+40 0 0 56
+21 10 11 80
+21 0 10 2048
+48 0 0 23
+21 0 8 6
+40 0 0 20
+69 6 0 8191
+177 0 0 14
+72 0 0 14
+21 2 0 80
+72 0 0 16
+21 0 1 80
+6 0 0 262144
+6 0 0 0`},
+	{"not tcp port 80", LinkEthernet, `20
+40 0 0 12
+21 0 6 34525
+48 0 0 20
+21 0 15 6
+40 0 0 54
+21 12 0 80
+40 0 0 56
+21 10 11 80
+21 0 10 2048
+48 0 0 23
+21 0 8 6
+40 0 0 20
+69 6 0 8191
+177 0 0 14
+72 0 0 14
+21 2 0 80
+72 0 0 16
+21 0 1 80
+6 0 0 0
+6 0 0 262144`},
+	{"portrange 1000-2000", LinkEthernet, `27
+40 0 0 12
+21 0 9 34525
+48 0 0 20
+21 2 0 132
+21 1 0 6
+21 0 20 17
+40 0 0 54
+53 0 1 1000
+37 0 16 2000
+40 0 0 56
+53 13 15 1000
+21 0 14 2048
+48 0 0 23
+21 2 0 132
+21 1 0 6
+21 0 10 17
+40 0 0 20
+69 8 0 8191
+177 0 0 14
+72 0 0 14
+53 0 1 1000
+37 0 3 2000
+72 0 0 16
+53 0 2 1000
+37 1 0 2000
+6 0 0 262144
+6 0 0 0`},
+	{"udp or icmp", LinkEthernet, `13
+40 0 0 12
+21 0 5 34525
+48 0 0 20
+21 7 0 17
+21 0 7 44
+48 0 0 54
+21 4 5 17
+21 0 4 2048
+48 0 0 23
+21 1 0 17
+21 0 1 1
+6 0 0 262144
+6 0 0 0`},
+	{"ip and not udp", LinkEthernet, `6
+40 0 0 12
+21 0 3 2048
+48 0 0 23
+21 1 0 17
+6 0 0 262144
+6 0 0 0`},
+	{"not arp", LinkEthernet, `4
+40 0 0 12
+21 1 0 2054
+6 0 0 262144
+6 0 0 0`},
+	// Linux strips VLAN tags before socket filters see packets, so tcpdump's
+	// checks for tags still in the packet are left out.
+	{"vlan 100 and tcp", LinkEthernet, `17
+48 0 0 4294963248
+21 14 0 0
+40 0 0 4294963244
+84 0 0 4095
+21 0 11 100
+40 0 0 12
+21 0 5 34525
+48 0 0 20
+21 6 0 6
+21 0 6 44
+48 0 0 54
+21 3 4 6
+21 0 3 2048
+48 0 0 23
+21 0 1 6
+6 0 0 262144
+6 0 0 0`},
+}
+
+// parseDDD parses a program in "tcpdump -ddd" format:  the number of
+// instructions, then each instruction's code, jt, jf and k in decimal.
+func parseDDD(ddd string) ([]bpf.Instruction, error) {
+	lines := strings.Split(strings.TrimSpace(ddd), "\n")
+	if n, err := strconv.Atoi(lines[0]); err != nil || n != len(lines)-1 {
+		return nil, fmt.Errorf("bad instruction count %q for %d instructions", lines[0], len(lines)-1)
+	}
+	var prog []bpf.Instruction
+	for _, line := range lines[1:] {
+		var ins bpf.Instruction
+		if _, err := fmt.Sscanf(line, "%d %d %d %d", &ins.Code, &ins.Jt, &ins.Jf, &ins.K); err != nil {
+			return nil, fmt.Errorf("bad instruction %q: %v", line, err)
+		}
+		prog = append(prog, ins)
+	}
+	return prog, nil
+}
+
+// testPacket is a packet, with the VLAN tag Linux would have stripped from
+// it, or -1 if it had none.
+type testPacket struct {
+	desc string
+	data []byte
+	vlan int
+}
+
+// ancillary answers a program's loads of the packet's VLAN tag.
+func (p testPacket) ancillary(off uint32) uint32 {
+	switch {
+	case off == skfAdVLANTagPresent && p.vlan >= 0:
+		return 1
+	case off == skfAdVLANTag && p.vlan >= 0:
+		return uint32(p.vlan)
+	}
+	return 0
+}
+
+// ipv4Packet builds an IPv4 packet, with ports if proto has them.
+func ipv4Packet(proto byte, src, dst string, sport, dport uint16, frag uint16, options int) []byte {
+	hl := 20 + 4*options
+	pkt := make([]byte, hl+8)
+	pkt[0] = 0x40 | byte(hl/4)
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[6:], frag)
+	pkt[8], pkt[9] = 64, proto
+	copy(pkt[12:], net.ParseIP(src).To4())
+	copy(pkt[16:], net.ParseIP(dst).To4())
+	binary.BigEndian.PutUint16(pkt[hl:], sport)
+	binary.BigEndian.PutUint16(pkt[hl+2:], dport)
+	return pkt
+}
+
+// ipv6Packet builds an IPv6 packet, with ports if proto has them.
+func ipv6Packet(proto byte, src, dst string, sport, dport uint16) []byte {
+	pkt := make([]byte, 48)
+	pkt[0] = 0x60
+	binary.BigEndian.PutUint16(pkt[4:], 8)
+	pkt[6], pkt[7] = proto, 64
+	copy(pkt[8:], net.ParseIP(src))
+	copy(pkt[24:], net.ParseIP(dst))
+	binary.BigEndian.PutUint16(pkt[40:], sport)
+	binary.BigEndian.PutUint16(pkt[42:], dport)
+	return pkt
+}
+
+// arpPacket builds an ARP or RARP request's payload.
+func arpPacket(sender, target string) []byte {
+	pkt := make([]byte, 28)
+	binary.BigEndian.PutUint16(pkt[0:], 1)
+	binary.BigEndian.PutUint16(pkt[2:], 0x800)
+	pkt[4], pkt[5] = 6, 4
+	binary.BigEndian.PutUint16(pkt[6:], 1)
+	copy(pkt[14:], net.ParseIP(sender).To4())
+	copy(pkt[24:], net.ParseIP(target).To4())
+	return pkt
+}
+
+// ether wraps a payload in an Ethernet header.
+func ether(etherType uint16, payload []byte) []byte {
+	pkt := make([]byte, 14, 14+len(payload))
+	copy(pkt, []byte{0, 1, 2, 3, 4, 5, 0, 6, 7, 8, 9, 10})
+	binary.BigEndian.PutUint16(pkt[12:], etherType)
+	return append(pkt, payload...)
+}
+
+// testPackets returns packets exercising the tcpdumpTests filters:  IPv4 and
+// IPv6 with each protocol between a few addresses and ports, IPv4 fragments
+// and options, IPv6 fragments, ARP and RARP, and other ethertypes, each with
+// and without VLAN tags.
+func testPackets(link LinkType) []testPacket {
+	var raw []testPacket
+	v4 := []string{"10.0.0.1", "10.0.0.2", "192.168.3.4"}
+	v6 := []string{"2001:db8::1", "2001:db8::2", "2001:db8:1::1"}
+	ports := []uint16{53, 80, 999, 1000, 2000, 2001}
+	for _, proto := range []byte{1, 6, 17, 58, 132} {
+		for _, sport := range ports {
+			for _, dport := range ports {
+				for i := range v4 {
+					for j := range v4 {
+						desc := fmt.Sprintf("IPv4 %d %s:%d > %s:%d", proto, v4[i], sport, v4[j], dport)
+						raw = append(raw,
+							testPacket{desc: desc, data: ipv4Packet(proto, v4[i], v4[j], sport, dport, 0, 0)},
+							testPacket{desc: desc + " with options", data: ipv4Packet(proto, v4[i], v4[j], sport, dport, 0, 1)},
+							testPacket{desc: desc + " fragment", data: ipv4Packet(proto, v4[i], v4[j], sport, dport, 100, 0)},
+							testPacket{desc: fmt.Sprintf("IPv6 %d %s.%d > %s.%d", proto, v6[i], sport, v6[j], dport), data: ipv6Packet(proto, v6[i], v6[j], sport, dport)})
+					}
+				}
+			}
+		}
+		frag := ipv6Packet(44, v6[0], v6[1], 0, 0)
+		frag[40] = proto
+		raw = append(raw, testPacket{desc: fmt.Sprintf("IPv6 %d fragment", proto), data: frag})
+	}
+
+	var pkts []testPacket
+	for _, p := range raw {
+		p.vlan = -1
+		if link == LinkRaw {
+			pkts = append(pkts, p)
+			continue
+		}
+		etherType := uint16(0x800)
+		if p.data[0]>>4 == 6 {
+			etherType = 0x86dd
+		}
+		p.data = ether(etherType, p.data)
+		pkts = append(pkts, p)
+	}
+	if link == LinkRaw {
+		return pkts
+	}
+	for i := range v4 {
+		for j := range v4 {
+			arp := arpPacket(v4[i], v4[j])
+			pkts = append(pkts,
+				testPacket{desc: fmt.Sprintf("ARP %s > %s", v4[i], v4[j]), data: ether(0x806, arp), vlan: -1},
+				testPacket{desc: fmt.Sprintf("RARP %s > %s", v4[i], v4[j]), data: ether(0x8035, arp), vlan: -1})
+		}
+	}
+	pkts = append(pkts, testPacket{desc: "LLDP", data: ether(0x88cc, make([]byte, 40)), vlan: -1})
+	for _, p := range append([]testPacket(nil), pkts...) {
+		for _, vlan := range []int{100, 200} {
+			p.desc = fmt.Sprintf("%s in VLAN %d", p.desc, vlan)
+			p.vlan = vlan
+			pkts = append(pkts, p)
+		}
+	}
+	return pkts
+}
+
+func TestCompileMatchesTcpdump(t *testing.T) {
+	packets := map[LinkType][]testPacket{
+		LinkEthernet: testPackets(LinkEthernet),
+		LinkRaw:      testPackets(LinkRaw),
+	}
+	for _, test := range tcpdumpTests {
+		want, err := parseDDD(test.ddd)
+		if err != nil {
+			t.Fatalf("%q on %v: %v", test.filter, test.link, err)
+		}
+		got, err := Compile(test.filter, test.link)
+		if err != nil {
+			t.Errorf("%q on %v: %v", test.filter, test.link, err)
+			continue
+		}
+		matched, mismatched := 0, 0
+		for _, p := range packets[test.link] {
+			g, w := bpf.Run(got, p.data, p.ancillary), bpf.Run(want, p.data, p.ancillary)
+			if w != 0 {
+				matched++
+			}
+			if g != w {
+				if mismatched++; mismatched <= 5 {
+					t.Errorf("%q on %v: %s: got %d, tcpdump's program returns %d", test.filter, test.link, p.desc, g, w)
+				}
+			}
+		}
+		if mismatched > 5 {
+			t.Errorf("%q on %v: %d more packets differ", test.filter, test.link, mismatched-5)
+		}
+		if matched == 0 || matched == len(packets[test.link]) {
+			t.Errorf("%q on %v: tcpdump's program matches %d of %d packets, so they don't test it", test.filter, test.link, matched, len(packets[test.link]))
+		}
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	for _, test := range []struct {
+		filter string
+		link   LinkType
+		pos    int
+		msg    string
+	}{
+		{"tcp port", LinkEthernet, 8, `expected a port, found end of filter`},
+		{"port 99999", LinkEthernet, 5, `port 99999 is more than 65535`},
+		{"portrange 2000-", LinkEthernet, 15, `expected a port, found end of filter`},
+		{"icmp port 80", LinkEthernet, 10, `icmp can't qualify a port`},
+		{"ip6 net 10.0.0.0/8", LinkEthernet, 8, `ip6 can't qualify an IPv4 network`},
+		{"net 10.0.0.1/8", LinkEthernet, 4, `10.0.0.1 has bits set outside the network's mask`},
+		{"net 10/33", LinkEthernet, 7, `IPv4 prefixes are at most 32 bits`},
+		{"host fe80::1 mask 255.0.0.0", LinkEthernet, 13, `unexpected "mask"`},
+		{"ether host 01:02", LinkEthernet, 11, `invalid Ethernet address "01:02"`},
+		{"ether host 01:02:03:04:05:06", LinkRaw, 11, `Ethernet addresses need an Ethernet interface`},
+		{"broadcast", LinkRaw, 0, `broadcast needs an Ethernet interface; try ip broadcast`},
+		{"ip proto 300", LinkEthernet, 9, `300 is more than 255`},
+		{"vlan 5000", LinkEthernet, 5, `5000 is more than 4095`},
+		{"not", LinkEthernet, 3, `expected a primitive, found end of filter`},
+		{"host 10.0.0.1 and", LinkEthernet, 17, `expected a primitive, found end of filter`},
+		{"tcp or or udp", LinkEthernet, 7, `expected a primitive, found "or"`},
+		{"(tcp", LinkEthernet, 4, `expected ")", found end of filter`},
+		{"tcp)", LinkEthernet, 3, `unexpected ")"`},
+		{"udp and $", LinkEthernet, 8, `unexpected character '$'`},
+		{"tcp[13 & 2 != 0", LinkEthernet, 11, `expected "]", found "!="`},
+		{"len > 10 +", LinkEthernet, 10, `expected an expression, found end of filter`},
+	} {
+		_, err := Compile(test.filter, test.link)
+		e, ok := err.(*Error)
+		if !ok {
+			t.Errorf("%q on %v: got error %v, want *Error", test.filter, test.link, err)
+			continue
+		}
+		if e.Pos != test.pos || e.Msg != test.msg {
+			t.Errorf("%q on %v: got error at %d %q, want at %d %q", test.filter, test.link, e.Pos, e.Msg, test.pos, test.msg)
+		}
+		if want := fmt.Sprintf("column %d: %s", test.pos+1, test.msg); e.Error() != want {
+			t.Errorf("%q on %v: Error() = %q, want %q", test.filter, test.link, e.Error(), want)
+		}
+	}
+}
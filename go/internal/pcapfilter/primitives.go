@@ -0,0 +1,512 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package pcapfilter
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+// Ethertypes and IP protocol numbers.
+const (
+	etherIP   = 0x0800
+	etherARP  = 0x0806
+	etherRARP = 0x8035
+	etherIPv6 = 0x86dd
+
+	protoICMP  = 1
+	protoIGMP  = 2
+	protoTCP   = 6
+	protoUDP   = 17
+	protoFrag6 = 44 // IPv6 fragment header
+	protoICMP6 = 58
+	protoSCTP  = 132
+)
+
+// Linux's ancillary data offsets, from linux/filter.h.
+const (
+	skfAdVLANTag        = bpf.AdOff + 44 // SKF_AD_OFF + SKF_AD_VLAN_TAG
+	skfAdVLANTagPresent = bpf.AdOff + 48 // SKF_AD_OFF + SKF_AD_VLAN_TAG_PRESENT
+)
+
+// noMask says not to mask a loaded value.
+const noMask = 0xffffffff
+
+// protocol says how to recognize a protocol named in a filter.
+type protocol struct {
+	ether uint32 // ethertype, or 0 for an IP protocol
+	ip    uint32 // IP protocol number
+	v4    bool   // carried over IPv4
+	v6    bool   // carried over IPv6
+}
+
+// protoNames are the protocols that can qualify primitives.
+var protoNames = map[string]protocol{
+	"ether": {},
+	"link":  {},
+	"ip":    {ether: etherIP},
+	"ip6":   {ether: etherIPv6},
+	"arp":   {ether: etherARP},
+	"rarp":  {ether: etherRARP},
+	"tcp":   {ip: protoTCP, v4: true, v6: true},
+	"udp":   {ip: protoUDP, v4: true, v6: true},
+	"sctp":  {ip: protoSCTP, v4: true, v6: true},
+	"icmp":  {ip: protoICMP, v4: true},
+	"igmp":  {ip: protoIGMP, v4: true},
+	"icmp6": {ip: protoICMP6, v6: true},
+}
+
+// sizeCode returns the load size field for size bytes.
+func sizeCode(size int) uint16 {
+	switch size {
+	case 1:
+		return bpf.B
+	case 2:
+		return bpf.H
+	}
+	return bpf.W
+}
+
+// ld loads size bytes at off into A.
+func ld(size int, off uint32) bpf.Instruction {
+	return bpf.Instruction{Code: bpf.LD | sizeCode(size) | bpf.ABS, K: off}
+}
+
+// cmp tests the size bytes at off, anded with mask, against k with a jump op.
+func cmp(size int, off, mask uint32, op uint16, k uint32) cond {
+	t := testCond{ld(size, off)}
+	if mask != noMask {
+		t = append(t, bpf.Instruction{Code: bpf.ALU | bpf.AND | bpf.K, K: mask})
+	}
+	return append(t, bpf.Instruction{Code: bpf.JMP | op | bpf.K, K: k})
+}
+
+// nl returns the offset of the network layer header.
+func (p *parser) nl() uint32 {
+	if p.link == LinkRaw {
+		return 0
+	}
+	return 14
+}
+
+// linkProto tests a packet's ethertype.  Raw IP packets are told apart by
+// their version, and are never anything but IPv4 or IPv6.
+func (p *parser) linkProto(ether uint32) cond {
+	if p.link == LinkEthernet {
+		return cmp(2, 12, noMask, bpf.JEQ, ether)
+	}
+	switch ether {
+	case etherIP:
+		return cmp(1, 0, 0xf0, bpf.JEQ, 0x40)
+	case etherIPv6:
+		return cmp(1, 0, 0xf0, bpf.JEQ, 0x60)
+	}
+	return condFalse
+}
+
+// ipProto tests an IPv4 packet's protocol.
+func (p *parser) ipProto(proto uint32) cond {
+	return and(p.linkProto(etherIP), cmp(1, p.nl()+9, noMask, bpf.JEQ, proto))
+}
+
+// ipFirstFragment tests that an IPv4 packet has its transport header.
+func (p *parser) ipFirstFragment() cond {
+	return not(cmp(2, p.nl()+6, noMask, bpf.JSET, 0x1fff))
+}
+
+// ip6Proto tests an IPv6 packet's next header, looking past a fragment
+// header if there is one.
+func (p *parser) ip6Proto(proto uint32) cond {
+	nh := p.nl() + 6
+	return and(p.linkProto(etherIPv6), or(
+		cmp(1, nh, noMask, bpf.JEQ, proto),
+		and(cmp(1, nh, noMask, bpf.JEQ, protoFrag6), cmp(1, p.nl()+40, noMask, bpf.JEQ, proto))))
+}
+
+// protoTest parses a bare protocol, like "tcp", which t names.
+func (p *parser) protoTest(t token) (cond, error) {
+	pr := protoNames[t.text]
+	switch {
+	case pr.ether != 0:
+		return p.linkProto(pr.ether), nil
+	case pr.ip != 0:
+		c := condFalse
+		if pr.v4 {
+			c = or(c, p.ipProto(pr.ip))
+		}
+		if pr.v6 {
+			c = or(c, p.ip6Proto(pr.ip))
+		}
+		return c, nil
+	}
+	if p.link != LinkEthernet {
+		return nil, p.errorf(t, "%s needs an Ethernet interface", t.text)
+	}
+	return condTrue, nil
+}
+
+// dirs combines tests of a packet's source and destination as dir says.
+func dirs(dir string, test func(src bool) cond) cond {
+	switch dir {
+	case "src":
+		return test(true)
+	case "dst":
+		return test(false)
+	case "src and dst":
+		return and(test(true), test(false))
+	}
+	return or(test(true), test(false))
+}
+
+// parseCast parses broadcast or multicast, qualified by proto.
+func (p *parser) parseCast(proto string) (cond, error) {
+	t := p.next()
+	switch proto {
+	case "", "ether", "link":
+		if p.link != LinkEthernet {
+			return nil, p.errorf(t, "%s needs an Ethernet interface; try ip %s", t.text, t.text)
+		}
+		if t.text == "broadcast" {
+			return and(cmp(4, 2, noMask, bpf.JEQ, 0xffffffff), cmp(2, 0, noMask, bpf.JEQ, 0xffff)), nil
+		}
+		return cmp(1, 0, noMask, bpf.JSET, 1), nil
+	case "ip":
+		if t.text == "broadcast" {
+			return nil, p.errorf(t, "ip broadcast is not supported, as it depends on the netmask")
+		}
+		return and(p.linkProto(etherIP), cmp(1, p.nl()+16, noMask, bpf.JGE, 224)), nil
+	case "ip6":
+		if t.text == "broadcast" {
+			return nil, p.errorf(t, "IPv6 has no broadcast")
+		}
+		return and(p.linkProto(etherIPv6), cmp(1, p.nl()+24, noMask, bpf.JEQ, 0xff)), nil
+	}
+	return nil, p.errorf(t, "%s can't be qualified by %s", t.text, proto)
+}
+
+// parseVLAN parses the rest of "vlan [ID]".  Linux strips VLAN tags before
+// socket filters see packets, so it checks the tag the kernel saved.
+func (p *parser) parseVLAN() (cond, error) {
+	c := not(cmp(4, skfAdVLANTagPresent, noMask, bpf.JEQ, 0))
+	if t := p.peek(); t.kind == tokWord && !keywords[t.text] {
+		id, err := p.parseNumber(p.next(), 4095)
+		if err != nil {
+			return nil, err
+		}
+		c = and(c, cmp(4, skfAdVLANTag, 0xfff, bpf.JEQ, id))
+	}
+	return c, nil
+}
+
+// host parses a host ID: an address, a name, or an Ethernet address.
+func (p *parser) host(q qualifiers, t token, id string) (cond, error) {
+	ip := net.ParseIP(id)
+	switch q.proto {
+	case "", "ether", "link":
+		mac, err := net.ParseMAC(id)
+		if q.proto == "" && (ip != nil || err != nil || len(mac) != 6) {
+			break
+		}
+		if err != nil || len(mac) != 6 {
+			return nil, p.errorf(t, "invalid Ethernet address %q", id)
+		}
+		if p.link != LinkEthernet {
+			return nil, p.errorf(t, "Ethernet addresses need an Ethernet interface")
+		}
+		return dirs(q.dir, func(src bool) cond {
+			off := uint32(0)
+			if src {
+				off = 6
+			}
+			return and(
+				cmp(4, off+2, noMask, bpf.JEQ, binary.BigEndian.Uint32(mac[2:])),
+				cmp(2, off, noMask, bpf.JEQ, uint32(binary.BigEndian.Uint16(mac))))
+		}), nil
+	case "ip", "ip6", "arp", "rarp":
+	default:
+		return nil, p.errorf(t, "%s can't qualify a host", q.proto)
+	}
+	ips := []net.IP{ip}
+	if ip == nil {
+		var err error
+		if ips, err = net.LookupIP(id); err != nil {
+			return nil, p.errorf(t, "unknown host %q", id)
+		}
+	}
+	c, found := condFalse, false
+	for _, ip := range ips {
+		if ip4 := ip.To4(); ip4 != nil && q.proto != "ip6" {
+			c = or(c, p.ipv4Host(q, binary.BigEndian.Uint32(ip4), noMask))
+			found = true
+		} else if ip4 == nil && (q.proto == "" || q.proto == "ip6") {
+			c = or(c, p.ipv6Host(q, ip, net.CIDRMask(128, 128)))
+			found = true
+		}
+	}
+	if !found {
+		return nil, p.errorf(t, "%q has no address usable with %s", id, q.proto)
+	}
+	return c, nil
+}
+
+// ipv4Host tests for IPv4 addresses matching addr under mask, in IP packets
+// or ARP and RARP ones as q says.
+func (p *parser) ipv4Host(q qualifiers, addr, mask uint32) cond {
+	test := func(ether, srcOff, dstOff uint32) cond {
+		return and(p.linkProto(ether), dirs(q.dir, func(src bool) cond {
+			off := dstOff
+			if src {
+				off = srcOff
+			}
+			return cmp(4, p.nl()+off, mask, bpf.JEQ, addr)
+		}))
+	}
+	ip, arp, rarp := test(etherIP, 12, 16), test(etherARP, 14, 24), test(etherRARP, 14, 24)
+	switch q.proto {
+	case "ip":
+		return ip
+	case "arp":
+		return arp
+	case "rarp":
+		return rarp
+	}
+	return or(ip, arp, rarp)
+}
+
+// ipv6Host tests for IPv6 addresses matching addr under mask.
+func (p *parser) ipv6Host(q qualifiers, addr net.IP, mask net.IPMask) cond {
+	return and(p.linkProto(etherIPv6), dirs(q.dir, func(src bool) cond {
+		off := p.nl() + 24
+		if src {
+			off = p.nl() + 8
+		}
+		c := condTrue
+		for i := 0; i < 16; i += 4 {
+			if m := binary.BigEndian.Uint32(mask[i:]); m != 0 {
+				c = and(c, cmp(4, off+uint32(i), m, bpf.JEQ, binary.BigEndian.Uint32(addr[i:])))
+			}
+		}
+		return c
+	}))
+}
+
+// net parses a network ID: an IPv4 network, possibly abbreviated like
+// "10.1", an IPv4 network with "mask" and a netmask, or an IPv4 or IPv6
+// network with a prefix length.
+func (p *parser) net(q qualifiers, t token, id string) (cond, error) {
+	switch q.proto {
+	case "", "ip", "ip6", "arp", "rarp":
+	default:
+		return nil, p.errorf(t, "%s can't qualify a net", q.proto)
+	}
+	bits, bitsTok := -1, p.peek()
+	var mask net.IPMask
+	if p.accept("/") {
+		bitsTok = p.peek()
+		n, err := p.parseNumber(p.next(), 128)
+		if err != nil {
+			return nil, err
+		}
+		bits = int(n)
+	} else if p.accept("mask") {
+		m := p.next()
+		ip := net.ParseIP(m.text)
+		if m.kind != tokWord || ip == nil || ip.To4() == nil {
+			return nil, p.errorf(m, "expected an IPv4 netmask, found %v", m)
+		}
+		mask = net.IPMask(ip.To4())
+	}
+
+	if strings.Contains(id, ":") {
+		ip := net.ParseIP(id)
+		switch {
+		case ip == nil || ip.To4() != nil:
+			return nil, p.errorf(t, "invalid IPv6 network %q", id)
+		case mask != nil:
+			return nil, p.errorf(t, "IPv6 networks need a prefix length, not a mask")
+		case q.proto != "" && q.proto != "ip6":
+			return nil, p.errorf(t, "%s can't qualify an IPv6 network", q.proto)
+		}
+		if bits < 0 {
+			bits = 128
+		}
+		mask = net.CIDRMask(bits, 128)
+		if !ip.Mask(mask).Equal(ip) {
+			return nil, p.errorf(t, "%s/%d has bits set outside the network", id, bits)
+		}
+		return p.ipv6Host(q, ip, mask), nil
+	}
+
+	var addr uint32
+	parts := strings.Split(id, ".")
+	if len(parts) > 4 {
+		return nil, p.errorf(t, "invalid network %q", id)
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil, p.errorf(t, "invalid network %q", id)
+		}
+		addr |= uint32(n) << uint(24-8*i)
+	}
+	switch {
+	case q.proto == "ip6":
+		return nil, p.errorf(t, "ip6 can't qualify an IPv4 network")
+	case bits > 32:
+		return nil, p.errorf(bitsTok, "IPv4 prefixes are at most 32 bits")
+	case bits >= 0:
+		mask = net.CIDRMask(bits, 32)
+	case mask == nil:
+		mask = net.CIDRMask(8*len(parts), 32)
+	}
+	m := binary.BigEndian.Uint32(mask)
+	if addr&^m != 0 {
+		return nil, p.errorf(t, "%s has bits set outside the network's mask", id)
+	}
+	return p.ipv4Host(q, addr, m), nil
+}
+
+// port parses a port or port range ID, which may be numbers or service names.
+func (p *parser) port(q qualifiers, t token, id string) (cond, error) {
+	var protos []uint32
+	v4, v6 := true, true
+	switch q.proto {
+	case "tcp", "udp", "sctp":
+		protos = []uint32{protoNames[q.proto].ip}
+	case "", "ip", "ip6":
+		protos = []uint32{protoTCP, protoUDP, protoSCTP}
+		v4, v6 = q.proto != "ip6", q.proto != "ip"
+	default:
+		return nil, p.errorf(t, "%s can't qualify a %s", q.proto, q.typ)
+	}
+	lo, err := p.portNumber(q.proto, t, id)
+	if err != nil {
+		return nil, err
+	}
+	hi := lo
+	if q.typ == "portrange" {
+		if _, err := p.expect("-"); err != nil {
+			return nil, err
+		}
+		t := p.next()
+		if t.kind != tokWord {
+			return nil, p.errorf(t, "expected a port, found %v", t)
+		}
+		if hi, err = p.portNumber(q.proto, t, t.text); err != nil {
+			return nil, err
+		}
+		if lo > hi {
+			lo, hi = hi, lo
+		}
+	}
+
+	// ports tests the port loaded by pre and load, at off + 0 for the
+	// source port, or off + 2 for the destination.
+	ports := func(pre []bpf.Instruction, load bpf.Instruction) cond {
+		return dirs(q.dir, func(src bool) cond {
+			l := load
+			if !src {
+				l.K += 2
+			}
+			test := func(op uint16, k uint32) cond {
+				t := append(append(testCond{}, pre...), l)
+				return append(t, bpf.Instruction{Code: bpf.JMP | op | bpf.K, K: k})
+			}
+			if lo == hi {
+				return test(bpf.JEQ, lo)
+			}
+			return and(test(bpf.JGE, lo), not(test(bpf.JGT, hi)))
+		})
+	}
+	c := condFalse
+	if v4 {
+		pc := condFalse
+		for _, proto := range protos {
+			pc = or(pc, cmp(1, p.nl()+9, noMask, bpf.JEQ, proto))
+		}
+		c = or(c, and(p.linkProto(etherIP), pc, p.ipFirstFragment(), ports(
+			[]bpf.Instruction{{Code: bpf.LDX | bpf.B | bpf.MSH, K: p.nl()}},
+			bpf.Instruction{Code: bpf.LD | bpf.H | bpf.IND, K: p.nl()})))
+	}
+	if v6 {
+		pc := condFalse
+		for _, proto := range protos {
+			pc = or(pc, cmp(1, p.nl()+6, noMask, bpf.JEQ, proto))
+		}
+		c = or(c, and(p.linkProto(etherIPv6), pc, ports(nil, ld(2, p.nl()+40))))
+	}
+	return c, nil
+}
+
+// portNumber returns the port id, a number or a service name, stands for.
+func (p *parser) portNumber(proto string, t token, id string) (uint32, error) {
+	if n, err := strconv.ParseUint(id, 10, 32); err == nil {
+		if n > 0xffff {
+			return 0, p.errorf(t, "port %d is more than 65535", n)
+		}
+		return uint32(n), nil
+	}
+	network := "tcp"
+	if proto == "udp" {
+		network = "udp"
+	}
+	n, err := net.LookupPort(network, id)
+	if err != nil && proto == "" {
+		n, err = net.LookupPort("udp", id)
+	}
+	if err != nil {
+		return 0, p.errorf(t, "unknown port %q", id)
+	}
+	return uint32(n), nil
+}
+
+// ipProtoNumbers are the names "proto" takes for IP protocols.
+var ipProtoNumbers = map[string]uint32{
+	"icmp": protoICMP, "igmp": protoIGMP, "tcp": protoTCP, "udp": protoUDP, "icmp6": protoICMP6, "sctp": protoSCTP,
+}
+
+// proto parses the ID of "proto":  an ethertype after ether, or otherwise an
+// IP protocol.
+func (p *parser) proto(q qualifiers, t token, id string) (cond, error) {
+	names, max := ipProtoNumbers, uint32(0xff)
+	if q.proto == "ether" || q.proto == "link" {
+		names, max = map[string]uint32{"ip": etherIP, "ip6": etherIPv6, "arp": etherARP, "rarp": etherRARP}, 0xffff
+	}
+	n, ok := names[id]
+	if !ok {
+		if _, err := strconv.ParseUint(id, 0, 32); err != nil {
+			return nil, p.errorf(t, "unknown protocol %q", id)
+		}
+		var err error
+		if n, err = p.parseNumber(t, max); err != nil {
+			return nil, err
+		}
+	}
+	switch q.proto {
+	case "ether", "link":
+		return p.linkProto(n), nil
+	case "ip":
+		return p.ipProto(n), nil
+	case "ip6":
+		return p.ip6Proto(n), nil
+	case "":
+		return or(p.ipProto(n), p.ip6Proto(n)), nil
+	}
+	return nil, p.errorf(t, "%s can't qualify proto", q.proto)
+}
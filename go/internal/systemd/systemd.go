@@ -0,0 +1,94 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package systemd implements the parts of systemd's service protocols that
+// testimonyd uses:  sd_notify readiness and watchdog messages, and socket
+// activation.  It talks to systemd directly, without libsystemd.
+package systemd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// listenFDsStart is SD_LISTEN_FDS_START, the first file descriptor passed by
+// socket activation.
+const listenFDsStart = 3
+
+// Notify sends the given state (for example "READY=1") to systemd.  If we
+// weren't started by systemd with a notification socket, it does nothing.
+func Notify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+	// Go treats a leading '@' as an abstract socket address, as systemd does.
+	c, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Net: "unixgram", Name: name})
+	if err != nil {
+		return fmt.Errorf("could not connect to NOTIFY_SOCKET %q: %v", name, err)
+	}
+	defer c.Close()
+	if _, err := c.Write([]byte(state)); err != nil {
+		return fmt.Errorf("could not notify %q: %v", name, err)
+	}
+	return nil
+}
+
+// WatchdogInterval returns how often systemd expects a "WATCHDOG=1"
+// notification from this process, or zero if the watchdog isn't enabled.
+func WatchdogInterval() time.Duration {
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+// Listeners returns the listening UNIX sockets passed to this process by
+// socket activation, keyed by the path they're bound to.  Other passed file
+// descriptors are ignored.  The returned files are marked close-on-exec, so
+// they aren't leaked to child processes.
+func Listeners() (map[string]*os.File, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q: %v", os.Getenv("LISTEN_FDS"), err)
+	}
+	files := map[string]*os.File{}
+	for fd := listenFDsStart; fd < listenFDsStart+n; fd++ {
+		syscall.CloseOnExec(fd)
+		if listening, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN); err != nil || listening == 0 {
+			continue
+		}
+		sa, err := syscall.Getsockname(fd)
+		if err != nil {
+			continue
+		}
+		addr, ok := sa.(*syscall.SockaddrUnix)
+		if !ok || addr.Name == "" {
+			continue
+		}
+		files[addr.Name] = os.NewFile(uintptr(fd), addr.Name)
+	}
+	return files, nil
+}
@@ -12,28 +12,36 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
+// Package vlog provides leveled verbose logging.
 package vlog
 
 import (
-	"flag"
-	"log"
 	"path/filepath"
 	"runtime"
 )
 
-var verbose = flag.Int("v", 0, "Verbose logging, increase for more logs")
+// Printer prints log messages.  *log.Logger implements it.
+type Printer interface {
+	Printf(format string, args ...interface{})
+}
+
+// Logger logs to a Printer, dropping verbose messages above its Verbose level.
+type Logger struct {
+	Printer
+	Verbose int
+}
 
-// V logs a message based on the --v command line flag.
-func V(level int, format string, args ...interface{}) {
-	VUp(level, 1, format, args...)
+// V logs a message if level is at most l.Verbose.
+func (l *Logger) V(level int, format string, args ...interface{}) {
+	l.VUp(level, 1, format, args...)
 }
 
-// Vup logs a message based on the --v command line flag, using the n'th
-// caller's file/line number instead of this one.
-func VUp(level int, caller int, format string, args ...interface{}) {
-	if level <= *verbose {
+// VUp logs a message if level is at most l.Verbose, using the n'th caller's
+// file/line number instead of this one.
+func (l *Logger) VUp(level int, caller int, format string, args ...interface{}) {
+	if level <= l.Verbose {
 		_, file, line, _ := runtime.Caller(caller + 1)
 		args = append([]interface{}{filepath.Base(file), line}, args...)
-		log.Printf("%s:%d -\t"+format, args...)
+		l.Printf("%s:%d -\t"+format, args...)
 	}
 }
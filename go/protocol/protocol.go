@@ -18,6 +18,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"strings"
 )
 
 // Types used when sending requests/data between client and server.
@@ -41,6 +42,98 @@ const (
 	TypeError Type = 0xFFFF
 )
 
+// Server-to-client types added after the initial protocol.  They're numbered
+// from the end of the original block, since adding to it would renumber the
+// client-to-server types.
+const (
+	TypeShuttingDown Type = TypeNumBlocks + 1 + iota
+	TypeRingReplaced
+	TypeTimestamping
+	TypeTxFrameSize
+	TypeTxNumFrames
+	TypeTxCompletion
+	TypeCPUs
+	TypeNUMANodes
+	TypeInterfaces
+	TypeXDPFrameSize
+	TypeFilterHashes
+)
+
+// Client-to-server types added after the initial protocol.
+const (
+	TypeTxRequest Type = TypeFanoutIndex + 1 + iota
+	TypeTxFrameReady
+)
+
+// FilterHashSize is the length of each of the SHA-256 hashes of socket filters
+// in a TypeFilterHashes TLV.
+const FilterHashSize = 32
+
+// TxStatus is the result of transmitting a frame, sent in a TypeTxCompletion
+// TLV along with the frame's index.
+type TxStatus uint32
+
+const (
+	// TxSent frames were handed to the interface.
+	TxSent TxStatus = iota
+	// TxInvalid frames had a bad length.
+	TxInvalid
+	// TxRejected frames didn't match the socket's TxFilter.
+	TxRejected
+	// TxRateLimited frames were dropped because the socket's TxRateLimit was
+	// exceeded.
+	TxRateLimited
+	// TxFailed frames were refused by the kernel.
+	TxFailed
+)
+
+var txStatusNames = map[TxStatus]string{
+	TxSent:        "sent",
+	TxInvalid:     "invalid",
+	TxRejected:    "rejected",
+	TxRateLimited: "rate limited",
+	TxFailed:      "failed",
+}
+
+// String returns the status's name.
+func (s TxStatus) String() string {
+	if name, ok := txStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("TxStatus(%d)", uint32(s))
+}
+
+// TimestampSource is the value of a TypeTimestamping TLV, telling clients
+// where the tp_sec/tp_nsec timestamps of the socket's packets come from.
+type TimestampSource uint32
+
+const (
+	// TimestampSoftware timestamps are taken by the kernel on receipt.
+	TimestampSoftware TimestampSource = iota
+	// TimestampHardwareRaw timestamps are the NIC's own clock
+	// (SOF_TIMESTAMPING_RAW_HARDWARE), which may not be synced to system time.
+	TimestampHardwareRaw
+	// TimestampHardwareSys timestamps are the NIC's clock converted to system
+	// time (SOF_TIMESTAMPING_SYS_HARDWARE).
+	TimestampHardwareSys
+)
+
+// TimestampSourceNames are the names of timestamp sources, as used in
+// testimonyd's configuration.
+var TimestampSourceNames = map[TimestampSource]string{
+	TimestampSoftware:    "software",
+	TimestampHardwareRaw: "hardware-raw",
+	TimestampHardwareSys: "hardware-sys",
+}
+
+// String returns the source's name.
+func (s TimestampSource) String() string {
+	if name, ok := TimestampSourceNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("TimestampSource(%d)", uint32(s))
+}
+
 // TypeNames allows for printing of protocols.
 var TypeNames = map[Type]string{
 	TypeBlockIndex:            "BlockIndex",
@@ -49,8 +142,21 @@ var TypeNames = map[Type]string{
 	TypeFanoutSize:            "FanoutSize",
 	TypeBlockSize:             "BlockSize",
 	TypeNumBlocks:             "NumBlocks",
+	TypeShuttingDown:          "ShuttingDown",
+	TypeRingReplaced:          "RingReplaced",
+	TypeTimestamping:          "Timestamping",
+	TypeTxFrameSize:           "TxFrameSize",
+	TypeTxNumFrames:           "TxNumFrames",
+	TypeTxCompletion:          "TxCompletion",
+	TypeCPUs:                  "CPUs",
+	TypeNUMANodes:             "NUMANodes",
+	TypeInterfaces:            "Interfaces",
+	TypeXDPFrameSize:          "XDPFrameSize",
+	TypeFilterHashes:          "FilterHashes",
 	TypeClientToServer:        "ClientToServer",
 	TypeFanoutIndex:           "FanoutIndex",
+	TypeTxRequest:             "TxRequest",
+	TypeTxFrameReady:          "TxFrameReady",
 	TypeError:                 "Error",
 }
 
@@ -80,6 +186,51 @@ func SendUint32(to io.Writer, typ Type, val uint32) error {
 	return SendTLV(to, typ, buf[:])
 }
 
+// SendUint32s sends a given type with a list of uint32 values to the given
+// writer.
+func SendUint32s(to io.Writer, typ Type, vals []uint32) error {
+	buf := make([]byte, 4*len(vals))
+	for i, v := range vals {
+		binary.BigEndian.PutUint32(buf[4*i:], v)
+	}
+	return SendTLV(to, typ, buf)
+}
+
+// Uint32s decodes a value sent by SendUint32s.
+func Uint32s(val []byte) ([]uint32, error) {
+	if len(val)%4 != 0 {
+		return nil, fmt.Errorf("length %d is not a multiple of 4", len(val))
+	}
+	vals := make([]uint32, len(val)/4)
+	for i := range vals {
+		vals[i] = binary.BigEndian.Uint32(val[4*i:])
+	}
+	return vals, nil
+}
+
+// SendStrings sends a given type with a list of strings, each followed by a
+// NUL byte, to the given writer.
+func SendStrings(to io.Writer, typ Type, vals []string) error {
+	var buf []byte
+	for _, v := range vals {
+		if strings.IndexByte(v, 0) >= 0 {
+			return fmt.Errorf("string %q contains a NUL byte", v)
+		}
+		buf = append(append(buf, v...), 0)
+	}
+	return SendTLV(to, typ, buf)
+}
+
+// Strings decodes a value sent by SendStrings.
+func Strings(val []byte) ([]string, error) {
+	if len(val) == 0 {
+		return nil, nil
+	} else if val[len(val)-1] != 0 {
+		return nil, fmt.Errorf("last string is not NUL-terminated")
+	}
+	return strings.Split(string(val[:len(val)-1]), "\x00"), nil
+}
+
 // SendTLV sends an arbitrary-length value with the given type type to a writer.
 func SendTLV(to io.Writer, typ Type, val []byte) error {
 	if TypeOf(typ) != TypeServerToClient && TypeOf(typ) != TypeClientToServer {
@@ -0,0 +1,174 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	sysCPU  = "/sys/devices/system/cpu"
+	sysNode = "/sys/devices/system/node"
+	maxCPUs = 1024 // size of the affinity masks we pass the kernel
+)
+
+// socketCPUs returns the CPUs fanout index num's goroutines should run on,
+// or nil if they can run anywhere.
+func (sc SocketConfig) socketCPUs(num int) ([]int, error) {
+	switch {
+	case len(sc.CPUs) > 0:
+		if num >= len(sc.CPUs) {
+			return nil, fmt.Errorf("no CPU for fanout index %d", num)
+		}
+		return sc.CPUs[num : num+1], nil
+	case sc.NUMANode != nil:
+		return nodeCPUs(*sc.NUMANode)
+	}
+	return nil, nil
+}
+
+// socketNUMANode returns the NUMA node fanout index num's ring should be
+// allocated on, or -1 if it can go anywhere.
+func (sc SocketConfig) socketNUMANode(num int) (int, error) {
+	switch {
+	case sc.NUMANode != nil:
+		return *sc.NUMANode, nil
+	case len(sc.CPUs) > 0:
+		if num >= len(sc.CPUs) {
+			return -1, fmt.Errorf("no CPU for fanout index %d", num)
+		}
+		return cpuNode(sc.CPUs[num])
+	}
+	return -1, nil
+}
+
+// checkAffinity returns an error if sc's CPUs and NUMANode don't make sense
+// on this machine.
+func (sc SocketConfig) checkAffinity() error {
+	if len(sc.CPUs) > 0 && len(sc.CPUs) != sc.FanoutSize {
+		return fmt.Errorf("CPUs has %d entries, want one per fanout index (%d)", len(sc.CPUs), sc.FanoutSize)
+	}
+	for _, cpu := range sc.CPUs {
+		if cpu < 0 || cpu >= maxCPUs {
+			return fmt.Errorf("CPU %d out of range", cpu)
+		}
+		node, err := cpuNode(cpu)
+		if err != nil {
+			return err
+		}
+		if sc.NUMANode != nil && node != *sc.NUMANode {
+			return fmt.Errorf("CPU %d is on NUMA node %d, not %d", cpu, node, *sc.NUMANode)
+		}
+	}
+	if sc.NUMANode != nil {
+		cpus, err := nodeCPUs(*sc.NUMANode)
+		if err != nil {
+			return err
+		}
+		if len(cpus) == 0 {
+			return fmt.Errorf("NUMA node %d has no CPUs", *sc.NUMANode)
+		}
+	}
+	return nil
+}
+
+// cpuNode returns the NUMA node an online CPU is on.  Machines without NUMA
+// have all their CPUs on node 0.
+func cpuNode(cpu int) (int, error) {
+	dir := filepath.Join(sysCPU, fmt.Sprintf("cpu%d", cpu))
+	if _, err := os.Stat(dir); err != nil {
+		return -1, fmt.Errorf("CPU %d does not exist", cpu)
+	}
+	online, err := readCPUList(filepath.Join(sysCPU, "online"))
+	if err != nil {
+		return -1, err
+	}
+	found := false
+	for _, c := range online {
+		found = found || c == cpu
+	}
+	if !found {
+		return -1, fmt.Errorf("CPU %d is offline", cpu)
+	}
+	nodes, _ := filepath.Glob(filepath.Join(dir, "node*"))
+	for _, n := range nodes {
+		if node, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(n), "node")); err == nil {
+			return node, nil
+		}
+	}
+	return 0, nil
+}
+
+// nodeCPUs returns the online CPUs on a NUMA node.
+func nodeCPUs(node int) ([]int, error) {
+	if node < 0 {
+		return nil, fmt.Errorf("NUMA node %d out of range", node)
+	}
+	cpus, err := readCPUList(filepath.Join(sysNode, fmt.Sprintf("node%d", node), "cpulist"))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("NUMA node %d does not exist", node)
+	}
+	return cpus, err
+}
+
+// readCPUList reads a sysfs list of CPUs, like "0-3,8-11".
+func readCPUList(path string) ([]int, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for _, r := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		if r == "" {
+			continue
+		}
+		lo, hi := r, r
+		if i := strings.IndexByte(r, '-'); i >= 0 {
+			lo, hi = r[:i], r[i+1:]
+		}
+		l, err1 := strconv.Atoi(lo)
+		h, err2 := strconv.Atoi(hi)
+		if err1 != nil || err2 != nil || l > h {
+			return nil, fmt.Errorf("bad CPU list %q in %s", data, path)
+		}
+		for c := l; c <= h; c++ {
+			cpus = append(cpus, c)
+		}
+	}
+	return cpus, nil
+}
+
+// pinThread locks the calling goroutine to its OS thread and restricts that
+// thread to cpus.  The goroutine should exit without unlocking, so the
+// runtime throws the thread away rather than reusing it elsewhere.
+func pinThread(cpus []int) error {
+	runtime.LockOSThread()
+	var mask [maxCPUs / 64]uint64
+	for _, cpu := range cpus {
+		mask[cpu/64] |= 1 << uint(cpu%64)
+	}
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_SCHED_SETAFFINITY, 0, unsafe.Sizeof(mask), uintptr(unsafe.Pointer(&mask[0]))); errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+// #include <linux/filter.h>
+import "C"
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+// toBPFInsns converts kernel sock_filter instructions for use with bpf.Run.
+func toBPFInsns(filt []C.struct_sock_filter) []bpf.Instruction {
+	insns := make([]bpf.Instruction, len(filt))
+	for i, f := range filt {
+		insns[i] = bpf.Instruction{Code: uint16(f.code), Jt: uint8(f.jt), Jf: uint8(f.jf), K: uint32(f.k)}
+	}
+	return insns
+}
+
+// toSockFilter converts instructions for use with the kernel.
+func toSockFilter(insns []bpf.Instruction) []C.struct_sock_filter {
+	filt := make([]C.struct_sock_filter, len(insns))
+	for i, ins := range insns {
+		filt[i] = C.struct_sock_filter{code: C.__u16(ins.Code), jt: C.__u8(ins.Jt), jf: C.__u8(ins.Jf), k: C.__u32(ins.K)}
+	}
+	return filt
+}
+
+// hashBPF returns the SHA-256 of a program, with each instruction as its
+// big-endian code, jt, jf and big-endian k.  A socket without a filter has the
+// hash of an empty program.
+func hashBPF(prog []bpf.Instruction) [sha256.Size]byte {
+	buf := make([]byte, 8*len(prog))
+	for i, ins := range prog {
+		binary.BigEndian.PutUint16(buf[8*i:], ins.Code)
+		buf[8*i+2], buf[8*i+3] = ins.Jt, ins.Jf
+		binary.BigEndian.PutUint32(buf[8*i+4:], ins.K)
+	}
+	return sha256.Sum256(buf)
+}
+
+// checkBPF checks a socket filter the way the kernel's classic BPF checker
+// does, so bad programs are reported with the instruction at fault rather
+// than as EINVAL when they're attached:  every instruction must be known and
+// its operands in range, jumps must stay inside the program, which must end
+// in a return, and scratch memory must be stored before it's loaded.
+func checkBPF(prog []bpf.Instruction) error {
+	if len(prog) == 0 {
+		return fmt.Errorf("program is empty")
+	}
+	if len(prog) > maxFilterLen {
+		return fmt.Errorf("program is %d instructions, more than the kernel's limit of %d", len(prog), maxFilterLen)
+	}
+	for pc, ins := range prog {
+		if !bpfValidCodes[ins.Code] {
+			return fmt.Errorf("instruction %d: unknown opcode %#x", pc, ins.Code)
+		}
+		switch ins.Code {
+		case bpf.ALU | bpf.DIV | bpf.K, bpf.ALU | bpf.MOD | bpf.K:
+			if ins.K == 0 {
+				return fmt.Errorf("instruction %d: division by zero", pc)
+			}
+		case bpf.ALU | bpf.LSH | bpf.K, bpf.ALU | bpf.RSH | bpf.K:
+			if ins.K >= 32 {
+				return fmt.Errorf("instruction %d: shift by %d", pc, ins.K)
+			}
+		case bpf.LD | bpf.MEM, bpf.LDX | bpf.MEM, bpf.ST, bpf.STX:
+			if ins.K >= bpf.MemWords {
+				return fmt.Errorf("instruction %d: scratch memory word %d is out of range", pc, ins.K)
+			}
+		case bpf.JMP | bpf.JA:
+			if uint64(ins.K) >= uint64(len(prog)-pc-1) {
+				return fmt.Errorf("instruction %d jumps past the end of the program", pc)
+			}
+		}
+		if ins.Code&bpf.Class == bpf.JMP && ins.Code&bpf.Op != bpf.JA {
+			if pc+1+int(ins.Jt) >= len(prog) || pc+1+int(ins.Jf) >= len(prog) {
+				return fmt.Errorf("instruction %d jumps past the end of the program", pc)
+			}
+		}
+	}
+	if prog[len(prog)-1].Code&bpf.Class != bpf.RET {
+		return fmt.Errorf("program doesn't end with a return")
+	}
+
+	// valid[pc] is the scratch memory words stored on every jump to pc.
+	valid := make([]uint16, len(prog))
+	for pc := range valid {
+		valid[pc] = 0xffff
+	}
+	stored := uint16(0)
+	for pc, ins := range prog {
+		stored &= valid[pc]
+		switch {
+		case ins.Code == bpf.ST || ins.Code == bpf.STX:
+			stored |= 1 << ins.K
+		case ins.Code == bpf.LD|bpf.MEM || ins.Code == bpf.LDX|bpf.MEM:
+			if stored&(1<<ins.K) == 0 {
+				return fmt.Errorf("instruction %d loads scratch memory word %d before it's stored", pc, ins.K)
+			}
+		case ins.Code == bpf.JMP|bpf.JA:
+			valid[pc+1+int(ins.K)] &= stored
+			stored = 0xffff
+		case ins.Code&bpf.Class == bpf.JMP:
+			valid[pc+1+int(ins.Jt)] &= stored
+			valid[pc+1+int(ins.Jf)] &= stored
+			stored = 0xffff
+		}
+	}
+	return nil
+}
+
+// bpfValidCodes are the instructions the kernel accepts in socket filters.
+var bpfValidCodes = map[uint16]bool{}
+
+func init() {
+	for _, op := range []uint16{bpf.ADD, bpf.SUB, bpf.MUL, bpf.DIV, bpf.MOD, bpf.AND, bpf.OR, bpf.XOR, bpf.LSH, bpf.RSH} {
+		bpfValidCodes[bpf.ALU|op|bpf.K] = true
+		bpfValidCodes[bpf.ALU|op|bpf.X] = true
+	}
+	for _, size := range []uint16{bpf.W, bpf.H, bpf.B} {
+		bpfValidCodes[bpf.LD|size|bpf.ABS] = true
+		bpfValidCodes[bpf.LD|size|bpf.IND] = true
+	}
+	for _, op := range []uint16{bpf.JEQ, bpf.JGT, bpf.JGE, bpf.JSET} {
+		bpfValidCodes[bpf.JMP|op|bpf.K] = true
+		bpfValidCodes[bpf.JMP|op|bpf.X] = true
+	}
+	for _, code := range []uint16{
+		bpf.ALU | bpf.NEG,
+		bpf.LD | bpf.W | bpf.LEN, bpf.LD | bpf.IMM, bpf.LD | bpf.MEM,
+		bpf.LDX | bpf.W | bpf.LEN, bpf.LDX | bpf.IMM, bpf.LDX | bpf.MEM, bpf.LDX | bpf.B | bpf.MSH,
+		bpf.ST, bpf.STX,
+		bpf.MISC | bpf.TAX, bpf.MISC | bpf.TXA,
+		bpf.RET | bpf.K, bpf.RET | bpf.A,
+		bpf.JMP | bpf.JA,
+	} {
+		bpfValidCodes[code] = true
+	}
+}
+
+// limitSnapLen rewrites a socket filter so it accepts at most snapLen bytes of
+// any packet, by capping the values it returns.  An empty prog accepts every
+// packet.  Returns of A or X become a comparison with snapLen, which moves
+// the instructions after them, so jumps over them are fixed up.
+func limitSnapLen(prog []bpf.Instruction, snapLen uint32) ([]bpf.Instruction, error) {
+	if len(prog) == 0 {
+		return []bpf.Instruction{{Code: bpf.RET | bpf.K, K: snapLen}}, nil
+	}
+	capped := func(ins bpf.Instruction) []bpf.Instruction {
+		if ins.Code&bpf.Class != bpf.RET {
+			return []bpf.Instruction{ins}
+		}
+		switch ins.Code & bpf.Size {
+		case bpf.A, bpf.X:
+			var out []bpf.Instruction
+			if ins.Code&bpf.Size == bpf.X {
+				out = append(out, bpf.Instruction{Code: bpf.MISC | bpf.TXA})
+			}
+			return append(out,
+				bpf.Instruction{Code: bpf.JMP | bpf.JGT | bpf.K, Jt: 0, Jf: 1, K: snapLen},
+				bpf.Instruction{Code: bpf.RET | bpf.K, K: snapLen},
+				bpf.Instruction{Code: bpf.RET | bpf.A})
+		}
+		if ins.K > snapLen {
+			ins.K = snapLen
+		}
+		return []bpf.Instruction{ins}
+	}
+	// newPC[i] is where prog[i] ends up.
+	newPC := make([]int, len(prog)+1)
+	for i, ins := range prog {
+		newPC[i+1] = newPC[i] + len(capped(ins))
+	}
+	offset := func(pc int, off uint32) (uint32, error) {
+		target := pc + 1 + int(off)
+		if int(off) < 0 || target >= len(prog) {
+			return 0, fmt.Errorf("instruction %d jumps past the end of the program", pc)
+		}
+		return uint32(newPC[target] - newPC[pc] - 1), nil
+	}
+	var out []bpf.Instruction
+	for pc, ins := range prog {
+		if ins.Code&bpf.Class == bpf.JMP {
+			if ins.Code&bpf.Op == bpf.JA {
+				k, err := offset(pc, ins.K)
+				if err != nil {
+					return nil, err
+				}
+				ins.K = k
+			} else {
+				jt, err := offset(pc, uint32(ins.Jt))
+				if err != nil {
+					return nil, err
+				}
+				jf, err := offset(pc, uint32(ins.Jf))
+				if err != nil {
+					return nil, err
+				}
+				if jt > 0xff || jf > 0xff {
+					return nil, fmt.Errorf("instruction %d jumps too far once SnapLen is applied", pc)
+				}
+				ins.Jt, ins.Jf = uint8(jt), uint8(jf)
+			}
+		}
+		out = append(out, capped(ins)...)
+	}
+	return out, nil
+}
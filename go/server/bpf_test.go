@@ -0,0 +1,190 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+func TestLimitSnapLen(t *testing.T) {
+	// The packet's first byte picks which return it reaches, with jumps over
+	// the returns limitSnapLen lengthens.
+	prog, err := assembleBPF(`
+		ldb [0]
+		jne #0, l1
+		ret #100000
+	l1:	jne #1, l2
+		ld len
+		ret a
+	l2:	jne #2, l3
+		ldx len
+		ret x
+	l3:	jne #3, l4
+		ret #10
+	l4:	ret #0
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const snapLen = 64
+	got, err := limitSnapLen(prog, snapLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := checkBPF(got); err != nil {
+		t.Fatalf("limitSnapLen made an invalid program: %v", err)
+	}
+	for pc, ins := range got {
+		if ins.Code&bpf.Class != bpf.RET {
+			continue
+		}
+		switch ins.Code & bpf.Size {
+		case bpf.K:
+			if ins.K > snapLen {
+				t.Errorf("instruction %d returns %d, more than SnapLen", pc, ins.K)
+			}
+		case bpf.A:
+			if pc < 2 || got[pc-2] != (bpf.Instruction{Code: bpf.JMP | bpf.JGT | bpf.K, Jt: 0, Jf: 1, K: snapLen}) {
+				t.Errorf("instruction %d returns A without comparing it to SnapLen", pc)
+			}
+		default:
+			t.Errorf("instruction %d returns X", pc)
+		}
+	}
+
+	for _, test := range []struct {
+		first byte
+		size  int
+		want  uint32
+	}{
+		{0, 1000, snapLen},
+		{0, 20, snapLen}, // ret #k caps the size; the kernel truncates it
+		{1, 1000, snapLen},
+		{1, 20, 20},
+		{2, 1000, snapLen},
+		{2, 20, 20},
+		{3, 1000, 10},
+		{4, 1000, 0},
+	} {
+		pkt := make([]byte, test.size)
+		pkt[0] = test.first
+		if want := bpf.Run(prog, pkt, nil); want < test.want {
+			t.Errorf("packet %d/%d: original program accepts %d, less than capped %d", test.first, test.size, want, test.want)
+		}
+		if got := bpf.Run(got, pkt, nil); got != test.want {
+			t.Errorf("packet %d/%d: accepted %d, want %d", test.first, test.size, got, test.want)
+		}
+	}
+
+	if got, err := limitSnapLen(nil, snapLen); err != nil || len(got) != 1 || got[0] != (bpf.Instruction{Code: bpf.RET | bpf.K, K: snapLen}) {
+		t.Errorf("limitSnapLen(nil) = %v, %v, want ret #%d", got, err, snapLen)
+	}
+}
+
+func TestCheckBPF(t *testing.T) {
+	ret := bpf.Instruction{Code: bpf.RET | bpf.K}
+	for _, test := range []struct {
+		desc string
+		prog []bpf.Instruction
+		err  string // "" if the program is valid
+	}{
+		{"return", []bpf.Instruction{ret}, ""},
+		{"empty", nil, "program is empty"},
+		{"too long", make([]bpf.Instruction, maxFilterLen+1), "program is 4097 instructions, more than the kernel's limit of 4096"},
+		{"unknown opcode", []bpf.Instruction{{Code: bpf.RET | bpf.X}}, "instruction 0: unknown opcode 0xe"},
+		{"division by zero", []bpf.Instruction{{Code: bpf.ALU | bpf.DIV | bpf.K}, ret}, "instruction 0: division by zero"},
+		{"modulo zero", []bpf.Instruction{{Code: bpf.ALU | bpf.MOD | bpf.K}, ret}, "instruction 0: division by zero"},
+		{"division by X", []bpf.Instruction{{Code: bpf.ALU | bpf.DIV | bpf.X}, ret}, ""},
+		{"long shift", []bpf.Instruction{{Code: bpf.ALU | bpf.LSH | bpf.K, K: 32}, ret}, "instruction 0: shift by 32"},
+		{"store past scratch", []bpf.Instruction{{Code: bpf.ST, K: 16}, ret}, "instruction 0: scratch memory word 16 is out of range"},
+		{"load past scratch", []bpf.Instruction{{Code: bpf.LDX | bpf.MEM, K: 16}, ret}, "instruction 0: scratch memory word 16 is out of range"},
+		{"ja past end", []bpf.Instruction{{Code: bpf.JMP | bpf.JA, K: 1}, ret}, "instruction 0 jumps past the end of the program"},
+		{"jt past end", []bpf.Instruction{{Code: bpf.JMP | bpf.JEQ | bpf.K, Jt: 1}, ret}, "instruction 0 jumps past the end of the program"},
+		{"jf past end", []bpf.Instruction{{Code: bpf.JMP | bpf.JGT | bpf.X, Jf: 1}, ret}, "instruction 0 jumps past the end of the program"},
+		{"no return", []bpf.Instruction{ret, {Code: bpf.LD | bpf.IMM}}, "program doesn't end with a return"},
+		{"load before store", []bpf.Instruction{{Code: bpf.LD | bpf.MEM, K: 2}, ret}, "instruction 0 loads scratch memory word 2 before it's stored"},
+		{"store on one branch", []bpf.Instruction{
+			{Code: bpf.JMP | bpf.JEQ | bpf.K, Jf: 1},
+			{Code: bpf.ST, K: 2},
+			{Code: bpf.LD | bpf.MEM, K: 2},
+			ret,
+		}, "instruction 2 loads scratch memory word 2 before it's stored"},
+		{"store on both branches", []bpf.Instruction{
+			{Code: bpf.JMP | bpf.JEQ | bpf.K, Jf: 2},
+			{Code: bpf.ST, K: 2},
+			{Code: bpf.JMP | bpf.JA, K: 1},
+			{Code: bpf.STX, K: 2},
+			{Code: bpf.LD | bpf.MEM, K: 2},
+			{Code: bpf.RET | bpf.A},
+		}, ""},
+	} {
+		err := checkBPF(test.prog)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %v", test.desc, err)
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Errorf("%s: error %v, want %q", test.desc, err, test.err)
+		}
+	}
+}
+
+func TestParseBPF(t *testing.T) {
+	// "tcpdump -ddd ip", and the same with bpf_asm's commas.
+	ip := []bpf.Instruction{
+		{Code: 40, Jt: 0, Jf: 0, K: 12},
+		{Code: 21, Jt: 0, Jf: 1, K: 2048},
+		{Code: 6, Jt: 0, Jf: 0, K: 262144},
+		{Code: 6, Jt: 0, Jf: 0, K: 0},
+	}
+	for _, test := range []struct {
+		desc, text string
+		want       []bpf.Instruction
+		err        string
+	}{
+		{"tcpdump", "4\n40 0 0 12\n21 0 1 2048\n6 0 0 262144\n6 0 0 0\n", ip, ""},
+		{"bpf_asm", "4,40 0 0 12,21 0 1 2048,6 0 0 262144,6 0 0 0,", ip, ""},
+		{"single", "1,6 0 0 65535", []bpf.Instruction{{Code: 6, K: 65535}}, ""},
+		{"largest fields", "1,65535 255 255 4294967295", []bpf.Instruction{{Code: 65535, Jt: 255, Jf: 255, K: 4294967295}}, ""},
+		{"negative k", "1,6 0 0 -1", []bpf.Instruction{{Code: 6, K: 0xffffffff}}, ""},
+		{"empty", "", nil, "invalid length of BPF ints"},
+		{"count only", "0", nil, "invalid length of BPF ints"},
+		{"too few ints", "2,6 0 0 0", nil, "invalid length of BPF ints"},
+		{"too many ints", "1,6 0 0 0 0", nil, "invalid length of BPF ints"},
+		{"negative count", "-1", nil, "invalid length of BPF ints"},
+		{"bad token", "1,6 0 0 0x10", nil, `error scanning token "0x10": strconv.Atoi: parsing "0x10": invalid syntax`},
+		{"large code", "2,6 0 0 0,65536 0 0 0", nil, "BPF instruction 1 (65536 0 0 0) out of range"},
+		{"large jt", "1,21 256 0 0", nil, "BPF instruction 0 (21 256 0 0) out of range"},
+		{"negative jf", "1,21 0 -1 0", nil, "BPF instruction 0 (21 0 -1 0) out of range"},
+		{"large k", "1,6 0 0 4294967296", nil, "BPF instruction 0 (6 0 0 4294967296) out of range"},
+	} {
+		filt, err := parseBPF(test.text)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error %v, want %q", test.desc, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		if got := toBPFInsns(filt); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.desc, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+// #include <sys/resource.h>
+import "C"
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxFilterLen  = 4096   // BPF_MAXINSNS, from linux/bpf_common.h
+	maxFanoutID   = 0xFFFF // fanout IDs are 16 bits
+	maxSocketName = 107    // UNIX_PATH_MAX minus the trailing NUL
+	capIPCLock    = 14     // CAP_IPC_LOCK, from linux/capability.h
+)
+
+// CheckConfig validates t without creating any sockets.  It applies the same
+// interface pattern expansion and cross-socket validation as a Server, then
+// checks each socket against the running kernel:
+// filters must compile, interfaces must exist, and ring sizes must be
+// acceptable to AF_PACKET.  The effective configuration and any problems found
+// are written to w.  Sockets are also checked against what a Server run with
+// opts could create.  CheckConfig returns false if any problems were found.
+func CheckConfig(t Testimony, opts Options, w io.Writer) bool {
+	ok := true
+	if expanded, err := t.expand(); err != nil {
+		fmt.Fprintf(w, "invalid config: %v\n", err)
+		ok = false
+	} else {
+		t = expanded
+	}
+	if err := t.validate(); err != nil {
+		fmt.Fprintf(w, "invalid config: %v\n", err)
+		ok = false
+	}
+	out, err := json.MarshalIndent(t, "", "  ")
+	if err != nil {
+		fmt.Fprintf(w, "could not print effective config: %v\n", err)
+		return false
+	}
+	fmt.Fprintf(w, "Effective config:\n%s\n", out)
+
+	var total int64
+	for i, sc := range t {
+		errs := sc.check()
+		if err := sc.checkHelper(opts); err != nil {
+			errs = append(errs, err)
+		}
+		if len(errs) == 0 {
+			fmt.Fprintf(w, "socket %d %q: OK\n", i, sc.SocketName)
+		} else {
+			ok = false
+			fmt.Fprintf(w, "socket %d %q: %d error(s)\n", i, sc.SocketName, len(errs))
+			for _, err := range errs {
+				fmt.Fprintf(w, "\t%v\n", err)
+			}
+		}
+		total += sc.ringMemory()
+	}
+	if err := checkMemlock(total); err != nil {
+		fmt.Fprintf(w, "all sockets: %v\n", err)
+		ok = false
+	}
+	return ok
+}
+
+// ringMemory returns the total number of bytes of locked memory the rings for
+// this config will use.
+func (sc SocketConfig) ringMemory() int64 {
+	total := int64(sc.NumBlocks) * int64(sc.BlockSize) * int64(sc.FanoutSize) * int64(len(sc.interfaces()))
+	if sc.TxRing && sc.TxFrameSize > 0 && sc.TxNumFrames > 0 {
+		total += int64(txSlotSize(sc.TxFrameSize)) * int64(sc.TxNumFrames)
+	}
+	return total
+}
+
+// check returns all of the problems it can find with a single socket config,
+// short of actually creating the socket.
+func (sc SocketConfig) check() (errs []error) {
+	add := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if sc.SocketName == "" {
+		add("SocketName not set")
+	} else if len(sc.SocketName) > maxSocketName {
+		add("SocketName is %d bytes long, longer than the %d allowed for UNIX sockets", len(sc.SocketName), maxSocketName)
+	} else if fi, err := os.Stat(filepath.Dir(sc.SocketName)); err != nil {
+		add("SocketName directory: %v", err)
+	} else if !fi.IsDir() {
+		add("SocketName directory %q is not a directory", filepath.Dir(sc.SocketName))
+	}
+	if _, err := sc.uid(); err != nil {
+		add("User %q: %v", sc.User, err)
+	}
+	if _, err := sc.gid(); err != nil {
+		add("Group %q: %v", sc.Group, err)
+	}
+
+	if sc.Interface == "" && len(sc.Interfaces) == 0 {
+		add("Interface not set")
+	} else if len(sc.Interfaces) > 0 {
+		if _, err := sc.aggregate(); err != nil {
+			add("%v", err)
+		}
+	}
+	for _, iface := range sc.interfaces() {
+		if iface == "" {
+			continue
+		} else if _, err := net.InterfaceByName(iface); err != nil {
+			add("Interface %q: %v", iface, err)
+		}
+	}
+
+	// AF_PACKET requires each block to be a whole number of pages (and, since
+	// testimony uses one frame per block, the frame size to be a multiple of
+	// TPACKET_ALIGNMENT, which any page multiple is).
+	pageSize := os.Getpagesize()
+	if sc.BlockSize <= 0 {
+		add("BlockSize %d must be positive", sc.BlockSize)
+	} else if sc.BlockSize%pageSize != 0 {
+		add("BlockSize %d is not a multiple of the page size (%d)", sc.BlockSize, pageSize)
+	}
+	if sc.NumBlocks <= 0 {
+		add("NumBlocks %d must be positive", sc.NumBlocks)
+	} else if sc.BlockSize > 0 && int64(sc.BlockSize)*int64(sc.NumBlocks) > math.MaxUint32 {
+		add("BlockSize*NumBlocks (%d) overflows the kernel's 32-bit ring size", int64(sc.BlockSize)*int64(sc.NumBlocks))
+	}
+	if sc.BlockTimeoutMillis < 0 {
+		add("BlockTimeoutMillis %d must not be negative", sc.BlockTimeoutMillis)
+	}
+
+	if sc.FanoutSize <= 0 {
+		add("FanoutSize %d must be positive", sc.FanoutSize)
+	}
+	if sc.FanoutType < FanoutHash || sc.FanoutType > FanoutEBPF {
+		add("FanoutType %v is not a known fanout type (see linux/if_packet.h)", sc.FanoutType)
+	}
+	if _, unknown := sc.FanoutFlags.names(); unknown != 0 {
+		add("FanoutFlags %v include unknown flags (see linux/if_packet.h)", sc.FanoutFlags)
+	}
+	if sc.FanoutFlags&FanoutFlagUniqueID != 0 && sc.FanoutID != 0 {
+		add("FanoutFlags uniqueid can't be used with a FanoutID")
+	}
+	if sc.FanoutFlags&FanoutFlagIgnoreOutgoing != 0 && sc.FanoutSize == 1 {
+		add("FanoutFlags ignore_outgoing needs a FanoutSize over 1, as a single socket doesn't join a fanout group")
+	}
+	switch {
+	case sc.FanoutProgram == "" && (sc.FanoutType == FanoutCBPF || sc.FanoutType == FanoutEBPF):
+		add("FanoutType %v requires a FanoutProgram", sc.FanoutType)
+	case sc.FanoutProgram == "":
+	case sc.FanoutType == FanoutCBPF:
+		if f, err := parseBPF(sc.FanoutProgram); err != nil {
+			add("FanoutProgram: %v", err)
+		} else if len(f) > maxFilterLen {
+			add("FanoutProgram is %d instructions, more than the kernel's limit of %d", len(f), maxFilterLen)
+		}
+	case sc.FanoutType == FanoutEBPF:
+		if isELF, err := isELFFile(sc.FanoutProgram); err != nil {
+			add("FanoutProgram: %v", err)
+		} else if isELF {
+			if _, _, err := readEBPFObject(sc.FanoutProgram); err != nil {
+				add("FanoutProgram: %v", err)
+			}
+		}
+	default:
+		add("FanoutProgram requires FanoutType cbpf or ebpf, not %v", sc.FanoutType)
+	}
+	if sc.Timestamping < TimestampingSoftware || sc.Timestamping > TimestampingHardwareSys {
+		add("Timestamping %v is not a known timestamp source", sc.Timestamping)
+	} else {
+		for _, iface := range sc.interfaces() {
+			if iface == "" {
+				continue
+			} else if err := checkTimestamping(iface, sc.Timestamping); err != nil {
+				add("Timestamping: %v", err)
+			}
+		}
+	}
+	if sc.FanoutID > maxFanoutID {
+		add("FanoutID %d does not fit in the kernel's 16-bit fanout ID", sc.FanoutID)
+	}
+	if err := checkMemlock(sc.ringMemory()); err != nil {
+		add("NumBlocks*BlockSize*FanoutSize*interfaces: %v", err)
+	}
+
+	if !sc.TxRing {
+		if sc.TxFrameSize != 0 || sc.TxNumFrames != 0 || sc.TxRateLimit != 0 || sc.TxFilter != "" {
+			add("TxFrameSize, TxNumFrames, TxRateLimit and TxFilter require TxRing")
+		}
+	} else {
+		if sc.TxFrameSize <= 0 {
+			add("TxFrameSize %d must be positive", sc.TxFrameSize)
+		}
+		if sc.TxNumFrames <= 0 {
+			add("TxNumFrames %d must be positive", sc.TxNumFrames)
+		}
+		if sc.TxRateLimit < 0 {
+			add("TxRateLimit %d must not be negative", sc.TxRateLimit)
+		}
+		if sc.TxFilter != "" && sc.Interface != "" {
+			if _, err := compileFilter(sc.Interface, sc.TxFilter); err != nil {
+				add("TxFilter %q: %v", sc.TxFilter, err)
+			}
+		}
+	}
+
+	if err := sc.checkAffinity(); err != nil {
+		add("%v", err)
+	}
+	switch {
+	case sc.Backend < BackendAFPacket || sc.Backend > BackendAFXDP:
+		add("Backend %v is not a known backend", sc.Backend)
+	case sc.Backend == BackendAFXDP:
+		if err := sc.checkXDP(); err != nil {
+			add("%v", err)
+		}
+		// Queues beyond FanoutSize are left to the kernel.
+		if sc.Interface != "" && sc.FanoutSize > 0 {
+			if queues, err := rxQueues(sc.Interface); err != nil {
+				add("Backend afxdp: %v", err)
+			} else if sc.FanoutSize > queues {
+				add("Backend afxdp needs a receive queue per fanout index, but %q has %d, fewer than FanoutSize %d", sc.Interface, queues, sc.FanoutSize)
+			}
+		}
+	case sc.XDPGeneric:
+		add("XDPGeneric requires Backend afxdp")
+	}
+	if sc.Direction < DirectionBoth || sc.Direction > DirectionOutbound {
+		add("Direction %v is not a known direction", sc.Direction)
+	} else if sc.Direction == DirectionOutbound && sc.FanoutFlags&FanoutFlagIgnoreOutgoing != 0 {
+		add("Direction outbound can't be used with FanoutFlags ignore_outgoing")
+	}
+	if sc.SnapLen < 0 {
+		add("SnapLen %d must not be negative", sc.SnapLen)
+	} else {
+		seen := map[string]bool{} // FilterProgram errors are the same on every interface
+		for _, iface := range sc.interfaces() {
+			if iface == "" {
+				continue
+			} else if f, err := sc.member(iface).socketFilter(); err != nil {
+				if !seen[err.Error()] {
+					add("%v", err)
+				}
+				seen[err.Error()] = true
+			} else if len(f) > maxFilterLen {
+				add("socket filter is %d instructions on %q, more than the kernel's limit of %d", len(f), iface, maxFilterLen)
+			}
+		}
+	}
+	return errs
+}
+
+// checkMemlock returns an error if the given number of bytes of MAP_LOCKED ring
+// memory can't be allocated by this process.
+func checkMemlock(bytes int64) error {
+	var lim C.struct_rlimit
+	if _, err := C.getrlimit(C.RLIMIT_MEMLOCK, &lim); err != nil {
+		return fmt.Errorf("could not get RLIMIT_MEMLOCK: %v", err)
+	}
+	if lim.rlim_cur == C.RLIM_INFINITY || uint64(bytes) <= uint64(lim.rlim_cur) {
+		return nil
+	}
+	// Processes with CAP_IPC_LOCK aren't bound by RLIMIT_MEMLOCK.
+	if capEffective(capIPCLock) {
+		return nil
+	}
+	return fmt.Errorf("%d bytes of ring memory exceeds RLIMIT_MEMLOCK (%d bytes), and CAP_IPC_LOCK is not held", bytes, uint64(lim.rlim_cur))
+}
+
+// capEffective returns true if the given capability is in this process's
+// effective set.
+func capEffective(capability uint) bool {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "CapEff:") {
+			continue
+		}
+		caps, err := strconv.ParseUint(strings.TrimSpace(line[len("CapEff:"):]), 16, 64)
+		return err == nil && caps&(1<<capability) != 0
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	page := os.Getpagesize()
+	// A small socket on the loopback, which every machine has.
+	base := SocketConfig{SocketName: os.TempDir() + "/testimony-check.sock", Interface: "lo", BlockSize: page, NumBlocks: 4, FanoutSize: 1}
+	with := func(f func(sc *SocketConfig)) SocketConfig {
+		sc := base
+		f(&sc)
+		return sc
+	}
+	for _, test := range []struct {
+		desc string
+		sc   SocketConfig
+		want []string
+	}{
+		{"valid", base, nil},
+		{"valid fanout", with(func(sc *SocketConfig) {
+			sc.FanoutSize, sc.FanoutType, sc.FanoutFlags, sc.FanoutID = 2, FanoutRollover, FanoutFlagDefrag|FanoutFlagIgnoreOutgoing, 7
+		}), nil},
+		{"valid TX", with(func(sc *SocketConfig) { sc.TxRing, sc.TxFrameSize, sc.TxNumFrames, sc.TxRateLimit = true, 1500, 8, 100 }), nil},
+		{"no SocketName", with(func(sc *SocketConfig) { sc.SocketName = "" }), []string{"SocketName not set"}},
+		{"long SocketName", with(func(sc *SocketConfig) { sc.SocketName = "/" + strings.Repeat("a", 107) }),
+			[]string{"SocketName is 108 bytes long, longer than the 107 allowed for UNIX sockets"}},
+		{"no SocketName directory", with(func(sc *SocketConfig) { sc.SocketName = "/nonexistent/testimony.sock" }),
+			[]string{"SocketName directory: stat /nonexistent: no such file or directory"}},
+		{"SocketName directory is a file", with(func(sc *SocketConfig) { sc.SocketName = "/dev/null/testimony.sock" }),
+			[]string{`SocketName directory "/dev/null" is not a directory`}},
+		{"no Interface", with(func(sc *SocketConfig) { sc.Interface = "" }), []string{"Interface not set"}},
+		{"unknown Interface", with(func(sc *SocketConfig) { sc.Interface = "nosuchif0" }),
+			[]string{`Interface "nosuchif0": route ip+net: no such network interface`}},
+		{"Interface and Interfaces", with(func(sc *SocketConfig) { sc.Interfaces = []string{"lo"} }),
+			[]string{`Interface "lo" can't be set along with Interfaces`}},
+		{"bad Interfaces", with(func(sc *SocketConfig) { sc.Interface, sc.Interfaces = "", []string{"lo", "nosuchif0", "lo"} }),
+			[]string{`Interfaces lists "lo" twice`, `Interface "nosuchif0": route ip+net: no such network interface`}},
+		{"zero BlockSize", with(func(sc *SocketConfig) { sc.BlockSize = 0 }), []string{"BlockSize 0 must be positive"}},
+		{"partial page BlockSize", with(func(sc *SocketConfig) { sc.BlockSize = page + 1 }),
+			[]string{fmt.Sprintf("BlockSize %d is not a multiple of the page size (%d)", page+1, page)}},
+		{"zero NumBlocks", with(func(sc *SocketConfig) { sc.NumBlocks = 0 }), []string{"NumBlocks 0 must be positive"}},
+		{"negative BlockTimeoutMillis", with(func(sc *SocketConfig) { sc.BlockTimeoutMillis = -1 }),
+			[]string{"BlockTimeoutMillis -1 must not be negative"}},
+		{"zero FanoutSize", with(func(sc *SocketConfig) { sc.FanoutSize = 0 }), []string{"FanoutSize 0 must be positive"}},
+		{"unknown FanoutType", with(func(sc *SocketConfig) { sc.FanoutType = 9 }),
+			[]string{"FanoutType 9 is not a known fanout type (see linux/if_packet.h)"}},
+		{"unknown FanoutFlags", with(func(sc *SocketConfig) { sc.FanoutFlags = FanoutFlagDefrag | 0x10 }),
+			[]string{"FanoutFlags defrag|0x10 include unknown flags (see linux/if_packet.h)"}},
+		{"uniqueid with FanoutID", with(func(sc *SocketConfig) { sc.FanoutSize, sc.FanoutFlags, sc.FanoutID = 2, FanoutFlagUniqueID, 7 }),
+			[]string{"FanoutFlags uniqueid can't be used with a FanoutID"}},
+		{"ignore_outgoing without fanout", with(func(sc *SocketConfig) { sc.FanoutFlags = FanoutFlagIgnoreOutgoing }),
+			[]string{"FanoutFlags ignore_outgoing needs a FanoutSize over 1, as a single socket doesn't join a fanout group"}},
+		{"large FanoutID", with(func(sc *SocketConfig) { sc.FanoutID = 0x10000 }),
+			[]string{"FanoutID 65536 does not fit in the kernel's 16-bit fanout ID"}},
+		{"cbpf without FanoutProgram", with(func(sc *SocketConfig) { sc.FanoutType = FanoutCBPF }),
+			[]string{"FanoutType cbpf requires a FanoutProgram"}},
+		{"FanoutProgram without cbpf", with(func(sc *SocketConfig) { sc.FanoutProgram = "1,6 0 0 0" }),
+			[]string{"FanoutProgram requires FanoutType cbpf or ebpf, not hash"}},
+		{"bad FanoutProgram", with(func(sc *SocketConfig) { sc.FanoutType, sc.FanoutProgram = FanoutCBPF, "ret" }),
+			[]string{`FanoutProgram: error scanning token "ret": strconv.Atoi: parsing "ret": invalid syntax`}},
+		{"unknown Timestamping", with(func(sc *SocketConfig) { sc.Timestamping = 7 }),
+			[]string{"Timestamping TimestampSource(7) is not a known timestamp source"}},
+		{"TX settings without TxRing", with(func(sc *SocketConfig) { sc.TxRateLimit = 10 }),
+			[]string{"TxFrameSize, TxNumFrames, TxRateLimit and TxFilter require TxRing"}},
+		{"bad TX settings", with(func(sc *SocketConfig) { sc.TxRing, sc.TxRateLimit = true, -1 }), []string{
+			"TxFrameSize 0 must be positive",
+			"TxNumFrames 0 must be positive",
+			"TxRateLimit -1 must not be negative",
+		}},
+		{"TxRing with Interfaces", with(func(sc *SocketConfig) {
+			sc.Interface, sc.Interfaces, sc.TxRing, sc.TxFrameSize, sc.TxNumFrames = "", []string{"lo", "lo2"}, true, 1500, 8
+		}), []string{"TxRing can't be used with more than one interface", `Interface "lo2": route ip+net: no such network interface`}},
+		{"CPUs for the wrong FanoutSize", with(func(sc *SocketConfig) { sc.CPUs = []int{0, 0} }),
+			[]string{"CPUs has 2 entries, want one per fanout index (1)"}},
+		{"unknown Backend", with(func(sc *SocketConfig) { sc.Backend = 5 }), []string{"Backend 5 is not a known backend"}},
+		{"XDPGeneric without afxdp", with(func(sc *SocketConfig) { sc.XDPGeneric = true }),
+			[]string{"XDPGeneric requires Backend afxdp"}},
+		{"unknown Direction", with(func(sc *SocketConfig) { sc.Direction = 9 }), []string{"Direction 9 is not a known direction"}},
+		{"outbound ignoring outgoing", with(func(sc *SocketConfig) {
+			sc.FanoutSize, sc.Direction, sc.FanoutFlags = 2, DirectionOutbound, FanoutFlagIgnoreOutgoing
+		}), []string{"Direction outbound can't be used with FanoutFlags ignore_outgoing"}},
+		{"negative SnapLen", with(func(sc *SocketConfig) { sc.SnapLen = -1 }), []string{"SnapLen -1 must not be negative"}},
+		{"several problems", with(func(sc *SocketConfig) { sc.SocketName, sc.NumBlocks, sc.SnapLen = "", -2, -3 }), []string{
+			"SocketName not set",
+			"NumBlocks -2 must be positive",
+			"SnapLen -3 must not be negative",
+		}},
+	} {
+		var got []string
+		for _, err := range test.sc.check() {
+			got = append(got, err.Error())
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: check() = %q, want %q", test.desc, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// configFile is the format of a config file which sets defaults as well as
+// listing sockets.  A config file may also be just a list of sockets.
+type configFile struct {
+	Defaults json.RawMessage   // SocketConfig values for fields a socket leaves unset
+	Sockets  []json.RawMessage // SocketConfig for each socket
+}
+
+// rawSocket is a socket's config as found in a config file, before defaults
+// are applied.
+type rawSocket struct {
+	file  string
+	index int
+	data  json.RawMessage
+}
+
+// String describes where the socket was configured, for error messages.
+func (r rawSocket) String() string {
+	var named struct{ SocketName string }
+	if json.Unmarshal(r.data, &named) == nil && named.SocketName != "" {
+		return fmt.Sprintf("%q socket %d (%q)", r.file, r.index, named.SocketName)
+	}
+	return fmt.Sprintf("%q socket %d", r.file, r.index)
+}
+
+// ReadConfig reads the configuration at path, which may be a single file, a
+// directory (in which case all *.conf files in it are read), or a glob pattern
+// matching a set of files.  Sockets from all files are merged, in file name
+// order.  A file may set Defaults, which apply to the sockets in every file;
+// at most one file may do so.  Unknown fields are errors.
+func ReadConfig(path string) (Testimony, error) {
+	files, err := configFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	var raws []rawSocket
+	var defaults json.RawMessage
+	var defaultsFile string
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("could not read configuration %q: %v", file, err)
+		}
+		var cf configFile
+		if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+			err = json.Unmarshal(data, &cf.Sockets)
+		} else {
+			err = strictDecode(data, &cf)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("could not parse configuration %q: %v", file, err)
+		}
+		if len(cf.Defaults) > 0 {
+			if defaultsFile != "" {
+				return nil, fmt.Errorf("Defaults set in both %q and %q", defaultsFile, file)
+			}
+			defaults, defaultsFile = cf.Defaults, file
+		}
+		for i, data := range cf.Sockets {
+			raws = append(raws, rawSocket{file: file, index: i, data: data})
+		}
+	}
+
+	if len(defaults) > 0 {
+		if err := strictDecode(defaults, &SocketConfig{}); err != nil {
+			return nil, fmt.Errorf("could not parse configuration %q: Defaults: %v", defaultsFile, err)
+		}
+	}
+	var t Testimony
+	sources := map[string]string{}
+	for _, raw := range raws {
+		// Decoding over the defaults leaves unset fields defaulted.  Each
+		// socket decodes its own copy, as a copy of a decoded SocketConfig
+		// would share its slices and pointers with every other socket.
+		var sc SocketConfig
+		if len(defaults) > 0 {
+			if err := strictDecode(defaults, &sc); err != nil {
+				return nil, fmt.Errorf("could not parse configuration %q: Defaults: %v", defaultsFile, err)
+			}
+		}
+		if err := strictDecode(raw.data, &sc); err != nil {
+			return nil, fmt.Errorf("could not parse configuration %v: %v", raw, err)
+		}
+		if sc.FanoutSize == 0 {
+			sc.FanoutSize = 1
+		}
+		if other, ok := sources[sc.SocketName]; ok {
+			return nil, fmt.Errorf("invalid configuration %v: socket name already defined in %q", raw, other)
+		}
+		sources[sc.SocketName] = raw.file
+		t = append(t, sc)
+	}
+	return t, nil
+}
+
+// configFiles returns the files making up the configuration at path.
+func configFiles(path string) ([]string, error) {
+	var files []string
+	var err error
+	if strings.ContainsAny(path, "*?[") {
+		files, err = filepath.Glob(path)
+	} else if fi, statErr := os.Stat(path); statErr != nil {
+		return nil, fmt.Errorf("could not read configuration %q: %v", path, statErr)
+	} else if fi.IsDir() {
+		files, err = filepath.Glob(filepath.Join(path, "*.conf"))
+	} else {
+		files = []string{path}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("bad configuration path %q: %v", path, err)
+	} else if len(files) == 0 {
+		return nil, fmt.Errorf("no configuration files found at %q", path)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// strictDecode decodes JSON data into v, failing on unknown fields so that
+// misspelled options aren't silently ignored.
+func strictDecode(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return fmt.Errorf("unexpected data after JSON value")
+	}
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadConfigDefaultsNotShared(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testimony_config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "testimony.conf")
+	conf := `{
+  "Defaults": {"Interfaces": ["eth0", "eth1"], "CPUs": [0, 1], "NUMANode": 0, "FanoutSize": 2},
+  "Sockets": [
+    {"SocketName": "/tmp/a.sock", "Interfaces": ["eth2", "eth3"], "CPUs": [7, 1], "NUMANode": 1},
+    {"SocketName": "/tmp/b.sock"}
+  ]
+}`
+	if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d sockets, want 2", len(got))
+	}
+
+	a, b := got[0], got[1]
+	if want := []string{"eth2", "eth3"}; !reflect.DeepEqual(a.Interfaces, want) {
+		t.Errorf("first socket's Interfaces = %q, want %q", a.Interfaces, want)
+	}
+	if want := []int{7, 1}; !reflect.DeepEqual(a.CPUs, want) {
+		t.Errorf("first socket's CPUs = %v, want %v", a.CPUs, want)
+	}
+	if a.NUMANode == nil || *a.NUMANode != 1 {
+		t.Errorf("first socket's NUMANode = %v, want 1", a.NUMANode)
+	}
+	if want := []string{"eth0", "eth1"}; !reflect.DeepEqual(b.Interfaces, want) {
+		t.Errorf("second socket's Interfaces = %q, want defaults %q", b.Interfaces, want)
+	}
+	if want := []int{0, 1}; !reflect.DeepEqual(b.CPUs, want) {
+		t.Errorf("second socket's CPUs = %v, want defaults %v", b.CPUs, want)
+	}
+	if b.NUMANode == nil || *b.NUMANode != 0 {
+		t.Errorf("second socket's NUMANode = %v, want default 0", b.NUMANode)
+	}
+	if b.NUMANode == a.NUMANode {
+		t.Errorf("sockets share a NUMANode pointer")
+	}
+}
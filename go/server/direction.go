@@ -0,0 +1,113 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+// Direction is which packets a socket captures:  those the host receives,
+// those it sends, or both.  In config files it's given by name:  "both" (the
+// default), "inbound" or "outbound".
+type Direction int
+
+// Capture directions.
+const (
+	DirectionBoth Direction = iota
+	DirectionInbound
+	DirectionOutbound
+)
+
+var directionNames = map[Direction]string{
+	DirectionBoth:     "both",
+	DirectionInbound:  "inbound",
+	DirectionOutbound: "outbound",
+}
+
+// String returns the direction's name, or its number if it's not known.
+func (d Direction) String() string {
+	if name, ok := directionNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", int(d))
+}
+
+// MarshalJSON writes the direction by name.
+func (d Direction) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON accepts a direction name.
+func (d *Direction) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return fmt.Errorf("Direction must be a name, got %s", data)
+	}
+	for dir, dirName := range directionNames {
+		if dirName == name {
+			*d = dir
+			return nil
+		}
+	}
+	var known []string
+	for dir := DirectionBoth; dir <= DirectionOutbound; dir++ {
+		known = append(known, dir.String())
+	}
+	return fmt.Errorf("unknown Direction %q, want one of %s", name, strings.Join(known, ", "))
+}
+
+// Values from linux/filter.h and linux/if_packet.h.
+const (
+	skfAdPktType   = bpf.AdOff + 4 // SKF_AD_OFF + SKF_AD_PKTTYPE
+	packetOutgoing = 4
+)
+
+// ignoreOutgoing reports whether sc's sockets should have the kernel skip
+// outgoing packets with PACKET_IGNORE_OUTGOING.  Sockets in a fanout group
+// get packets through the group, which ignores the option, so they need the
+// group's ignore_outgoing flag instead.
+func (sc SocketConfig) ignoreOutgoing() bool {
+	return sc.Direction == DirectionInbound && sc.FanoutSize == 1 && kernelAtLeast(4, 20)
+}
+
+// directionFilter returns instructions to run before sc's filter that drop
+// packets going the wrong way, or nil if the kernel already drops them.  The
+// fanout group's ignore_outgoing flag only counts with a FanoutSize over 1, as
+// a lone socket never joins a group.
+func (sc SocketConfig) directionFilter() []bpf.Instruction {
+	var jt, jf uint8 // where to go if the packet is outgoing, or not
+	switch {
+	case sc.Direction == DirectionInbound:
+		if sc.ignoreOutgoing() || sc.FanoutSize > 1 && sc.FanoutFlags&FanoutFlagIgnoreOutgoing != 0 {
+			return nil
+		}
+		jt, jf = 0, 1
+	case sc.Direction == DirectionOutbound:
+		jt, jf = 1, 0
+	default:
+		return nil
+	}
+	return []bpf.Instruction{
+		{Code: bpf.LD | bpf.B | bpf.ABS, K: skfAdPktType},
+		{Code: bpf.JMP | bpf.JEQ | bpf.K, Jt: jt, Jf: jf, K: packetOutgoing},
+		{Code: bpf.RET | bpf.K, K: 0},
+		// Filters may count on A starting out as zero.
+		{Code: bpf.LD | bpf.IMM, K: 0},
+	}
+}
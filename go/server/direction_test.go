@@ -0,0 +1,75 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"testing"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+func TestDirectionFilter(t *testing.T) {
+	// Lone inbound sockets rely on PACKET_IGNORE_OUTGOING where the kernel
+	// has it, and otherwise need the filter.
+	loneInbound := "inbound"
+	if kernelAtLeast(4, 20) {
+		loneInbound = ""
+	}
+	for _, test := range []struct {
+		dir   Direction
+		size  int
+		flags FanoutFlags
+		want  string // which packets the filter passes, "" for no filter
+	}{
+		{DirectionBoth, 1, 0, ""},
+		{DirectionBoth, 2, 0, ""},
+		{DirectionBoth, 2, FanoutFlagIgnoreOutgoing, ""},
+		{DirectionInbound, 1, 0, loneInbound},
+		{DirectionInbound, 1, FanoutFlagDefrag, loneInbound},
+		// The flag never reaches the kernel without a fanout group.
+		{DirectionInbound, 1, FanoutFlagIgnoreOutgoing, loneInbound},
+		{DirectionInbound, 2, 0, "inbound"},
+		{DirectionInbound, 2, FanoutFlagDefrag, "inbound"},
+		{DirectionInbound, 2, FanoutFlagIgnoreOutgoing, ""},
+		{DirectionInbound, 2, FanoutFlagIgnoreOutgoing | FanoutFlagDefrag, ""},
+		{DirectionOutbound, 1, 0, "outbound"},
+		{DirectionOutbound, 2, 0, "outbound"},
+		{DirectionOutbound, 2, FanoutFlagDefrag, "outbound"},
+	} {
+		sc := SocketConfig{Direction: test.dir, FanoutSize: test.size, FanoutFlags: test.flags}
+		dir := sc.directionFilter()
+		if test.want == "" {
+			if dir != nil {
+				t.Errorf("%v, FanoutSize %d, FanoutFlags %v: got a filter, want none", test.dir, test.size, test.flags)
+			}
+			continue
+		}
+		if dir == nil {
+			t.Errorf("%v, FanoutSize %d, FanoutFlags %v: got no filter, want one passing %s packets", test.dir, test.size, test.flags, test.want)
+			continue
+		}
+		if last := dir[len(dir)-1]; last != (bpf.Instruction{Code: bpf.LD | bpf.IMM}) {
+			t.Errorf("%v, FanoutSize %d, FanoutFlags %v: filter ends with %v, not clearing A", test.dir, test.size, test.flags, last)
+		}
+		prog := append(dir, bpf.Instruction{Code: bpf.RET | bpf.K, K: 1})
+		passes := func(pktType uint32) bool {
+			return bpf.Run(prog, []byte{0}, func(uint32) uint32 { return pktType }) != 0
+		}
+		in, out := passes(0), passes(packetOutgoing) // PACKET_HOST, PACKET_OUTGOING
+		if got := map[[2]bool]string{{true, false}: "inbound", {false, true}: "outbound"}[[2]bool{in, out}]; got != test.want {
+			t.Errorf("%v, FanoutSize %d, FanoutFlags %v: filter passes inbound %v, outbound %v, want %s", test.dir, test.size, test.flags, in, out, test.want)
+		}
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+/*
+#include <stdlib.h>  // for C.free
+
+int LoadEBPF(const void* insns, int insn_cnt, const char* license,
+             char* log_buf, int log_size);
+int GetPinnedEBPF(const char* path);
+*/
+import "C"
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+const (
+	ebpfInsnSize = 8       // sizeof(struct bpf_insn)
+	ebpfLogSize  = 1 << 16 // verifier log buffer size
+)
+
+// loadEBPF returns a file descriptor for the eBPF program at path.  The path
+// is either an ELF object file, whose program is loaded into the kernel, or a
+// program pinned in the BPF filesystem.
+func loadEBPF(path string) (int, error) {
+	isELF, err := isELFFile(path)
+	if err != nil {
+		return -1, err
+	}
+	if !isELF {
+		cpath := C.CString(path)
+		defer C.free(unsafe.Pointer(cpath))
+		fd, err := C.GetPinnedEBPF(cpath)
+		if fd < 0 {
+			return -1, fmt.Errorf("could not get pinned eBPF program: %v", err)
+		}
+		return int(fd), nil
+	}
+	insns, license, err := readEBPFObject(path)
+	if err != nil {
+		return -1, err
+	}
+	clicense := C.CString(license)
+	defer C.free(unsafe.Pointer(clicense))
+	logBuf := make([]byte, ebpfLogSize)
+	fd, err := C.LoadEBPF(unsafe.Pointer(&insns[0]), C.int(len(insns)/ebpfInsnSize), clicense,
+		(*C.char)(unsafe.Pointer(&logBuf[0])), C.int(len(logBuf)))
+	if fd < 0 {
+		if n := bytes.IndexByte(logBuf, 0); n >= 0 {
+			logBuf = logBuf[:n]
+		}
+		if log := strings.TrimSpace(string(logBuf)); log != "" {
+			return -1, fmt.Errorf("kernel rejected eBPF program: %v:\n%s", err, log)
+		}
+		return -1, fmt.Errorf("kernel rejected eBPF program: %v", err)
+	}
+	return int(fd), nil
+}
+
+// isELFFile returns true if the file at path starts with the ELF magic number.
+func isELFFile(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var magic [len(elf.ELFMAG)]byte
+	if _, err := io.ReadFull(f, magic[:]); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return string(magic[:]) == elf.ELFMAG, nil
+}
+
+// readEBPFObject reads the program out of an eBPF ELF object file, like one
+// built with "clang -target bpf -c".  The file must hold exactly one program,
+// in its only non-empty executable section, which must not need relocating:
+// programs using maps or calling other functions aren't supported.  The
+// license is read from the "license" section, if there is one.
+func readEBPFObject(path string) (insns []byte, license string, err error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	defer f.Close()
+	if f.Machine != elf.EM_BPF {
+		return nil, "", fmt.Errorf("%q is not an eBPF object file (machine %v)", path, f.Machine)
+	}
+	var prog *elf.Section
+	progIndex := 0
+	for i, s := range f.Sections {
+		switch {
+		case s.Name == "license":
+			data, err := s.Data()
+			if err != nil {
+				return nil, "", fmt.Errorf("could not read license: %v", err)
+			}
+			license = strings.TrimRight(string(data), "\x00")
+		case s.Type == elf.SHT_PROGBITS && s.Flags&elf.SHF_EXECINSTR != 0 && s.Size > 0:
+			if prog != nil {
+				return nil, "", fmt.Errorf("%q has more than one program (sections %q and %q)", path, prog.Name, s.Name)
+			}
+			prog, progIndex = s, i
+		}
+	}
+	if prog == nil {
+		return nil, "", fmt.Errorf("%q has no program", path)
+	}
+	for _, s := range f.Sections {
+		if (s.Type == elf.SHT_REL || s.Type == elf.SHT_RELA) && int(s.Info) == progIndex {
+			return nil, "", fmt.Errorf("program %q in %q needs relocation (uses maps or calls), which isn't supported", prog.Name, path)
+		}
+	}
+	if insns, err = prog.Data(); err != nil {
+		return nil, "", fmt.Errorf("could not read program %q: %v", prog.Name, err)
+	}
+	if len(insns)%ebpfInsnSize != 0 {
+		return nil, "", fmt.Errorf("program %q is %d bytes, not a whole number of instructions", prog.Name, len(insns))
+	}
+	return insns, license, nil
+}
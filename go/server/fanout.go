@@ -0,0 +1,182 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FanoutType is the PACKET_FANOUT_* mode used to spread packets across a
+// socket's fanout members (see linux/if_packet.h).  In config files it's
+// given by name, like "hash", or by number.
+type FanoutType int
+
+// Fanout types, from linux/if_packet.h.
+const (
+	FanoutHash     FanoutType = 0
+	FanoutLB       FanoutType = 1
+	FanoutCPU      FanoutType = 2
+	FanoutRollover FanoutType = 3
+	FanoutRandom   FanoutType = 4
+	FanoutQM       FanoutType = 5
+	FanoutCBPF     FanoutType = 6
+	FanoutEBPF     FanoutType = 7
+)
+
+var fanoutTypeNames = map[FanoutType]string{
+	FanoutHash:     "hash",
+	FanoutLB:       "lb",
+	FanoutCPU:      "cpu",
+	FanoutRollover: "rollover",
+	FanoutRandom:   "random",
+	FanoutQM:       "qm",
+	FanoutCBPF:     "cbpf",
+	FanoutEBPF:     "ebpf",
+}
+
+// String returns the type's name, or its number if it's not a known type.
+func (t FanoutType) String() string {
+	if name, ok := fanoutTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", int(t))
+}
+
+// MarshalJSON writes known types by name.
+func (t FanoutType) MarshalJSON() ([]byte, error) {
+	if name, ok := fanoutTypeNames[t]; ok {
+		return json.Marshal(name)
+	}
+	return json.Marshal(int(t))
+}
+
+// UnmarshalJSON accepts a type name or number.
+func (t *FanoutType) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		var n int
+		if err := json.Unmarshal(data, &n); err != nil {
+			return fmt.Errorf("FanoutType must be a name or number, got %s", data)
+		}
+		*t = FanoutType(n)
+		return nil
+	}
+	for typ, typName := range fanoutTypeNames {
+		if typName == name {
+			*t = typ
+			return nil
+		}
+	}
+	var known []string
+	for typ := FanoutHash; typ <= FanoutEBPF; typ++ {
+		known = append(known, typ.String())
+	}
+	return fmt.Errorf("unknown FanoutType %q, want one of %s", name, strings.Join(known, ", "))
+}
+
+// FanoutFlags are PACKET_FANOUT_FLAG_* values to OR into a socket's fanout
+// type (see linux/if_packet.h).  In config files they're given as a list of
+// names, like ["defrag", "rollover"].
+type FanoutFlags int
+
+// Fanout flags, from linux/if_packet.h.
+const (
+	FanoutFlagRollover       FanoutFlags = 0x1000
+	FanoutFlagUniqueID       FanoutFlags = 0x2000
+	FanoutFlagIgnoreOutgoing FanoutFlags = 0x4000
+	FanoutFlagDefrag         FanoutFlags = 0x8000
+)
+
+var fanoutFlagNames = map[FanoutFlags]string{
+	FanoutFlagRollover:       "rollover",
+	FanoutFlagUniqueID:       "uniqueid",
+	FanoutFlagIgnoreOutgoing: "ignore_outgoing",
+	FanoutFlagDefrag:         "defrag",
+}
+
+// names returns the names of the flags set in f, and any unknown bits left
+// over.
+func (f FanoutFlags) names() ([]string, FanoutFlags) {
+	var names []string
+	for flag, name := range fanoutFlagNames {
+		if f&flag != 0 {
+			names = append(names, name)
+			f &^= flag
+		}
+	}
+	sort.Strings(names)
+	return names, f
+}
+
+// String returns the flags' names, separated by "|".
+func (f FanoutFlags) String() string {
+	names, unknown := f.names()
+	if unknown != 0 {
+		names = append(names, fmt.Sprintf("%#x", int(unknown)))
+	}
+	return strings.Join(names, "|")
+}
+
+// MarshalJSON writes the flags as a list of names.
+func (f FanoutFlags) MarshalJSON() ([]byte, error) {
+	names, unknown := f.names()
+	if unknown != 0 {
+		return nil, fmt.Errorf("unknown fanout flags %#x", int(unknown))
+	}
+	if names == nil {
+		names = []string{}
+	}
+	return json.Marshal(names)
+}
+
+// UnmarshalJSON reads a list of flag names.
+func (f *FanoutFlags) UnmarshalJSON(data []byte) error {
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return fmt.Errorf("FanoutFlags must be a list of names, got %s", data)
+	}
+	*f = 0
+outer:
+	for _, name := range names {
+		for flag, flagName := range fanoutFlagNames {
+			if flagName == name {
+				*f |= flag
+				continue outer
+			}
+		}
+		var known []string
+		for flag := FanoutFlagRollover; flag <= FanoutFlagDefrag; flag <<= 1 {
+			known = append(known, flag.String())
+		}
+		return fmt.Errorf("unknown fanout flag %q, want some of %s", name, strings.Join(known, ", "))
+	}
+	return nil
+}
+
+// fanoutArg returns the PACKET_FANOUT type and flags for the socket with
+// fanout index num.  Without a configured FanoutID, socket 0 creates the
+// group with uniqueid to have the kernel pick an unused ID, which may be 0.
+// The rest join with the ID it picked, which the kernel refuses along with
+// uniqueid, even if it was configured.
+func (sc SocketConfig) fanoutArg(num int) int {
+	arg := int(sc.FanoutType) | int(sc.FanoutFlags&^FanoutFlagUniqueID)
+	if num == 0 && sc.FanoutID == 0 {
+		arg |= int(FanoutFlagUniqueID)
+	}
+	return arg
+}
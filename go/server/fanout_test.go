@@ -0,0 +1,149 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestFanoutTypeJSON(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want FanoutType
+		out  string // as written back, if it differs from in
+	}{
+		{`"hash"`, FanoutHash, ""},
+		{`"lb"`, FanoutLB, ""},
+		{`"cpu"`, FanoutCPU, ""},
+		{`"rollover"`, FanoutRollover, ""},
+		{`"random"`, FanoutRandom, ""},
+		{`"qm"`, FanoutQM, ""},
+		{`"cbpf"`, FanoutCBPF, ""},
+		{`"ebpf"`, FanoutEBPF, ""},
+		{`3`, FanoutRollover, `"rollover"`},
+		{`0`, FanoutHash, `"hash"`},
+		{`42`, FanoutType(42), ""},
+	} {
+		var got FanoutType
+		if err := json.Unmarshal([]byte(test.in), &got); err != nil {
+			t.Errorf("unmarshaling %s: %v", test.in, err)
+			continue
+		} else if got != test.want {
+			t.Errorf("unmarshaling %s: got %v, want %v", test.in, got, test.want)
+		}
+		want := test.in
+		if test.out != "" {
+			want = test.out
+		}
+		if out, err := json.Marshal(got); err != nil || string(out) != want {
+			t.Errorf("marshaling %v: got %s, %v, want %s", got, out, err, want)
+		}
+	}
+
+	for _, test := range []struct {
+		in, err string
+	}{
+		{`"Hash"`, `unknown FanoutType "Hash", want one of hash, lb, cpu, rollover, random, qm, cbpf, ebpf`},
+		{`"roundrobin"`, `unknown FanoutType "roundrobin", want one of hash, lb, cpu, rollover, random, qm, cbpf, ebpf`},
+		{`""`, `unknown FanoutType "", want one of hash, lb, cpu, rollover, random, qm, cbpf, ebpf`},
+		{`["hash"]`, `FanoutType must be a name or number, got ["hash"]`},
+		{`1.5`, `FanoutType must be a name or number, got 1.5`},
+	} {
+		var got FanoutType
+		if err := got.UnmarshalJSON([]byte(test.in)); err == nil || err.Error() != test.err {
+			t.Errorf("unmarshaling %s: error %v, want %q", test.in, err, test.err)
+		}
+	}
+}
+
+func TestFanoutFlagsJSON(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want FanoutFlags
+		out  string // as written back, if it differs from in
+	}{
+		{`[]`, 0, ""},
+		{`null`, 0, `[]`},
+		{`["defrag"]`, FanoutFlagDefrag, ""},
+		{`["rollover", "defrag"]`, FanoutFlagRollover | FanoutFlagDefrag, `["defrag","rollover"]`},
+		{`["uniqueid","ignore_outgoing","defrag","rollover"]`, FanoutFlagRollover | FanoutFlagUniqueID | FanoutFlagIgnoreOutgoing | FanoutFlagDefrag,
+			`["defrag","ignore_outgoing","rollover","uniqueid"]`},
+		{`["defrag","defrag"]`, FanoutFlagDefrag, `["defrag"]`},
+	} {
+		var got FanoutFlags
+		if err := json.Unmarshal([]byte(test.in), &got); err != nil {
+			t.Errorf("unmarshaling %s: %v", test.in, err)
+			continue
+		} else if got != test.want {
+			t.Errorf("unmarshaling %s: got %v, want %v", test.in, got, test.want)
+		}
+		want := test.in
+		if test.out != "" {
+			want = test.out
+		}
+		if out, err := json.Marshal(got); err != nil || string(out) != want {
+			t.Errorf("marshaling %v: got %s, %v, want %s", got, out, err, want)
+		}
+	}
+
+	for _, test := range []struct {
+		in, err string
+	}{
+		{`["Defrag"]`, `unknown fanout flag "Defrag", want some of rollover, uniqueid, ignore_outgoing, defrag`},
+		{`["defrag", "lb"]`, `unknown fanout flag "lb", want some of rollover, uniqueid, ignore_outgoing, defrag`},
+		{`"defrag"`, `FanoutFlags must be a list of names, got "defrag"`},
+		{`32768`, `FanoutFlags must be a list of names, got 32768`},
+	} {
+		var got FanoutFlags
+		if err := got.UnmarshalJSON([]byte(test.in)); err == nil || err.Error() != test.err {
+			t.Errorf("unmarshaling %s: error %v, want %q", test.in, err, test.err)
+		}
+	}
+
+	if out, err := json.Marshal(FanoutFlagDefrag | 0x10); err == nil {
+		t.Errorf("marshaling unknown flags: got %s, want an error", out)
+	}
+}
+
+func TestFanoutArg(t *testing.T) {
+	for _, typ := range []FanoutType{FanoutHash, FanoutCPU, FanoutEBPF} {
+		for _, flags := range []FanoutFlags{
+			0,
+			FanoutFlagDefrag,
+			FanoutFlagUniqueID,
+			FanoutFlagRollover | FanoutFlagUniqueID | FanoutFlagIgnoreOutgoing | FanoutFlagDefrag,
+		} {
+			others := int(typ) | int(flags&^FanoutFlagUniqueID)
+			// Only the group's creator asks the kernel for an ID, and
+			// every joiner leaves uniqueid out, whatever the config says.
+			for _, test := range []struct {
+				fanoutID, num int
+				want          int
+			}{
+				{0, 0, others | int(FanoutFlagUniqueID)},
+				{0, 1, others},
+				{0, 2, others},
+				{7, 0, others},
+				{7, 1, others},
+			} {
+				sc := SocketConfig{FanoutType: typ, FanoutFlags: flags, FanoutID: test.fanoutID}
+				if got := sc.fanoutArg(test.num); got != test.want {
+					t.Errorf("%v with %v, FanoutID %d, socket %d: got %#x, want %#x", typ, flags, test.fanoutID, test.num, got, test.want)
+				}
+			}
+		}
+	}
+}
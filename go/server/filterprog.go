@@ -0,0 +1,515 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+// BPFInstruction is a classic BPF instruction, as written in config files.
+type BPFInstruction struct {
+	Code uint16 `json:"code"`
+	Jt   uint8  `json:"jt"`
+	Jf   uint8  `json:"jf"`
+	K    uint32 `json:"k"`
+}
+
+// FilterProgram is a hand-written or generated socket filter, for filters
+// pcap-filter syntax can't express.  In config files it's either an array of
+// {"code", "jt", "jf", "k"} instructions or a string of assembly in the
+// syntax of the kernel's bpf_asm, like "ldh [12]\njne #0x800, drop\n...".
+type FilterProgram struct {
+	Instructions []BPFInstruction // the program, if given as instructions
+	Assembly     string           // the program, if given as assembly
+}
+
+// empty returns true if no program was given.
+func (f FilterProgram) empty() bool {
+	return len(f.Instructions) == 0 && f.Assembly == ""
+}
+
+// MarshalJSON writes the program in the form it was given in.
+func (f FilterProgram) MarshalJSON() ([]byte, error) {
+	switch {
+	case f.Assembly != "":
+		return json.Marshal(f.Assembly)
+	case len(f.Instructions) > 0:
+		return json.Marshal(f.Instructions)
+	}
+	return []byte("null"), nil
+}
+
+// UnmarshalJSON accepts an array of instructions or a string of assembly.
+func (f *FilterProgram) UnmarshalJSON(data []byte) error {
+	*f = FilterProgram{}
+	if string(data) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(data, &f.Assembly); err == nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &f.Instructions); err != nil {
+		return fmt.Errorf("FilterProgram must be an array of instructions or a string of assembly: %v", err)
+	}
+	return nil
+}
+
+// program assembles the program if need be, and checks it.
+func (f FilterProgram) program() ([]bpf.Instruction, error) {
+	var prog []bpf.Instruction
+	if f.Assembly != "" {
+		var err error
+		if prog, err = assembleBPF(f.Assembly); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, ins := range f.Instructions {
+			prog = append(prog, bpf.Instruction(ins))
+		}
+	}
+	if err := checkBPF(prog); err != nil {
+		return nil, err
+	}
+	return prog, nil
+}
+
+// asmToken is a single token of BPF assembly.
+type asmToken struct {
+	text string
+	line int
+}
+
+// asmExtensions are the names bpf_asm gives Linux's ancillary data, by
+// offset from SKF_AD_OFF.
+var asmExtensions = map[string]uint32{
+	"proto": 0, "type": 4, "ifidx": 8, "nla": 12, "nlan": 16, "mark": 20, "queue": 24,
+	"hatype": 28, "rxhash": 32, "cpu": 36, "vlan_tci": 44, "vlan_avail": 48, "vlan_pr": 48,
+	"poff": 52, "rand": 56, "vlan_tpid": 60,
+}
+
+// Kinds of assembly operands.
+const (
+	asmImm   = iota // #k
+	asmX            // x or %x
+	asmA            // a or %a
+	asmAbs          // [k]
+	asmInd          // [x + k]
+	asmMem          // M[k]
+	asmMSH          // 4*([k]&0xf)
+	asmLen          // len or #len
+	asmExt          // an ancillary data name, like #proto
+	asmLabel        // a jump target
+)
+
+// asmOperand is an operand of an assembly instruction.
+type asmOperand struct {
+	kind  int
+	k     uint32
+	label asmToken
+}
+
+// assembler assembles BPF in bpf_asm's syntax.
+type assembler struct {
+	toks   []asmToken
+	i      int
+	prog   []bpf.Instruction
+	labels map[string]int
+	fixups []asmFixup
+}
+
+// asmFixup is a jump whose target is a label, to be filled in at the end.
+type asmFixup struct {
+	pc    int
+	field byte // 'k', 't' or 'f'
+	label asmToken
+}
+
+// lexBPF splits assembly into tokens:  words, numbers and punctuation.
+// Comments start with ";" and run to the end of the line.
+func lexBPF(text string) ([]asmToken, error) {
+	var toks []asmToken
+	line := 1
+	isWord := func(c byte) bool {
+		return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+	}
+	for i := 0; i < len(text); {
+		c := text[i]
+		switch {
+		case c == '\n':
+			line++
+			i++
+		case c == ' ' || c == '\t' || c == '\r':
+			i++
+		case c == ';':
+			for i < len(text) && text[i] != '\n' {
+				i++
+			}
+		case isWord(c) || c == '-' && i+1 < len(text) && text[i+1] >= '0' && text[i+1] <= '9':
+			start := i
+			for i++; i < len(text) && isWord(text[i]); i++ {
+			}
+			toks = append(toks, asmToken{text: text[start:i], line: line})
+		case strings.IndexByte("#%[]+*()&,:", c) >= 0:
+			toks = append(toks, asmToken{text: text[i : i+1], line: line})
+			i++
+		default:
+			return nil, fmt.Errorf("line %d: unexpected character %q", line, c)
+		}
+	}
+	return toks, nil
+}
+
+// assembleBPF assembles a program in bpf_asm's syntax:  instructions like
+// "ldh [12]", "jeq #0x800, ip, drop" or "ret #0", each optionally labelled
+// like "drop:".  Conditional jumps to one label fall through if the condition
+// isn't (or for jne, jlt and jle, is) met.
+func assembleBPF(text string) ([]bpf.Instruction, error) {
+	toks, err := lexBPF(text)
+	if err != nil {
+		return nil, err
+	}
+	a := &assembler{toks: toks, labels: map[string]int{}}
+	for a.i < len(a.toks) {
+		t := a.next()
+		if a.accept(":") {
+			if _, ok := a.labels[t.text]; ok {
+				return nil, fmt.Errorf("line %d: label %q is defined twice", t.line, t.text)
+			}
+			a.labels[t.text] = len(a.prog)
+			continue
+		}
+		if err := a.instruction(t); err != nil {
+			return nil, err
+		}
+	}
+	for _, f := range a.fixups {
+		target, ok := a.labels[f.label.text]
+		if !ok {
+			return nil, fmt.Errorf("line %d: undefined label %q", f.label.line, f.label.text)
+		}
+		off := target - f.pc - 1
+		switch {
+		case off < 0:
+			return nil, fmt.Errorf("line %d: label %q is behind the jump; jumps only go forward", f.label.line, f.label.text)
+		case f.field == 'k':
+			a.prog[f.pc].K = uint32(off)
+		case off > 0xff:
+			return nil, fmt.Errorf("line %d: label %q is %d instructions away, more than a conditional jump's 255", f.label.line, f.label.text, off)
+		case f.field == 't':
+			a.prog[f.pc].Jt = uint8(off)
+		default:
+			a.prog[f.pc].Jf = uint8(off)
+		}
+	}
+	return a.prog, nil
+}
+
+func (a *assembler) next() asmToken {
+	if a.i >= len(a.toks) {
+		line := 1
+		if len(a.toks) > 0 {
+			line = a.toks[len(a.toks)-1].line
+		}
+		return asmToken{line: line}
+	}
+	a.i++
+	return a.toks[a.i-1]
+}
+
+func (a *assembler) accept(text string) bool {
+	if a.i < len(a.toks) && a.toks[a.i].text == text {
+		a.i++
+		return true
+	}
+	return false
+}
+
+func (a *assembler) expect(text string) error {
+	if t := a.next(); t.text != text {
+		return a.unexpected(t, fmt.Sprintf("%q", text))
+	}
+	return nil
+}
+
+func (a *assembler) unexpected(t asmToken, want string) error {
+	found := "end of program"
+	if t.text != "" {
+		found = fmt.Sprintf("%q", t.text)
+	}
+	return fmt.Errorf("line %d: expected %s, found %s", t.line, want, found)
+}
+
+// number parses a number, which may be negative, as in "ret #-1".
+func (a *assembler) number() (uint32, error) {
+	t := a.next()
+	n, err := strconv.ParseInt(t.text, 0, 64)
+	if err != nil {
+		return 0, a.unexpected(t, "a number")
+	}
+	if n < -1<<31 || n > 1<<32-1 {
+		return 0, fmt.Errorf("line %d: %s doesn't fit in 32 bits", t.line, t.text)
+	}
+	return uint32(n), nil
+}
+
+// operand parses an instruction's operand.
+func (a *assembler) operand() (asmOperand, error) {
+	t := a.next()
+	switch t.text {
+	case "#":
+		if a.i < len(a.toks) {
+			name := strings.ToLower(a.toks[a.i].text)
+			if name == "len" || name == "pktlen" {
+				a.i++
+				return asmOperand{kind: asmLen}, nil
+			}
+			if off, ok := asmExtensions[name]; ok {
+				a.i++
+				return asmOperand{kind: asmExt, k: bpf.AdOff + off}, nil
+			}
+		}
+		k, err := a.number()
+		return asmOperand{kind: asmImm, k: k}, err
+	case "%":
+		switch r := a.next(); strings.ToLower(r.text) {
+		case "x":
+			return asmOperand{kind: asmX}, nil
+		case "a":
+			return asmOperand{kind: asmA}, nil
+		default:
+			return asmOperand{}, a.unexpected(r, "x or a")
+		}
+	case "[":
+		if a.accept("x") || a.accept("%") && a.accept("x") {
+			var k uint32
+			if a.accept("+") {
+				var err error
+				if k, err = a.number(); err != nil {
+					return asmOperand{}, err
+				}
+			}
+			return asmOperand{kind: asmInd, k: k}, a.expect("]")
+		}
+		k, err := a.number()
+		if err == nil {
+			err = a.expect("]")
+		}
+		return asmOperand{kind: asmAbs, k: k}, err
+	}
+	switch name := strings.ToLower(t.text); {
+	case name == "x":
+		return asmOperand{kind: asmX}, nil
+	case name == "a":
+		return asmOperand{kind: asmA}, nil
+	case name == "len" || name == "pktlen":
+		return asmOperand{kind: asmLen}, nil
+	case t.text == "M" && a.accept("["):
+		k, err := a.number()
+		if err == nil {
+			err = a.expect("]")
+		}
+		return asmOperand{kind: asmMem, k: k}, err
+	}
+	if off, ok := asmExtensions[strings.ToLower(t.text)]; ok {
+		return asmOperand{kind: asmExt, k: bpf.AdOff + off}, nil
+	}
+	if n, err := strconv.ParseInt(t.text, 0, 64); err == nil {
+		if !a.accept("*") {
+			a.i--
+			k, err := a.number()
+			return asmOperand{kind: asmImm, k: k}, err
+		}
+		// 4*([k]&0xf), the IPv4 header length.
+		if n != 4 {
+			return asmOperand{}, fmt.Errorf("line %d: only 4*([k]&0xf) can be loaded this way", t.line)
+		}
+		var k uint32
+		err := a.expect("(")
+		if err == nil {
+			err = a.expect("[")
+		}
+		if err == nil {
+			k, err = a.number()
+		}
+		if err == nil {
+			err = a.expect("]")
+		}
+		if err == nil {
+			err = a.expect("&")
+		}
+		if err == nil {
+			var mask uint32
+			if mask, err = a.number(); err == nil && mask != 0xf {
+				err = fmt.Errorf("line %d: only 4*([k]&0xf) can be loaded this way", t.line)
+			}
+		}
+		if err == nil {
+			err = a.expect(")")
+		}
+		return asmOperand{kind: asmMSH, k: k}, err
+	}
+	if t.text == "" || !(t.text[0] == '_' || t.text[0] >= 'a' && t.text[0] <= 'z' || t.text[0] >= 'A' && t.text[0] <= 'Z') {
+		return asmOperand{}, a.unexpected(t, "an operand")
+	}
+	return asmOperand{kind: asmLabel, label: t}, nil
+}
+
+// asmALU are the arithmetic instructions, by mnemonic.
+var asmALU = map[string]uint16{
+	"add": bpf.ADD, "sub": bpf.SUB, "mul": bpf.MUL, "div": bpf.DIV, "mod": bpf.MOD,
+	"and": bpf.AND, "or": bpf.OR, "xor": bpf.XOR, "lsh": bpf.LSH, "rsh": bpf.RSH,
+}
+
+// asmJumps are the conditional jumps, by mnemonic:  their opcode, and
+// whether the label is where to go if the condition doesn't hold.
+var asmJumps = map[string]struct {
+	op      uint16
+	negated bool
+}{
+	"jeq": {bpf.JEQ, false}, "jgt": {bpf.JGT, false}, "jge": {bpf.JGE, false}, "jset": {bpf.JSET, false},
+	"jne": {bpf.JEQ, true}, "jneq": {bpf.JEQ, true}, "jlt": {bpf.JGE, true}, "jle": {bpf.JGT, true},
+}
+
+// asmMnemonics are the instructions other than arithmetic and conditional
+// jumps.
+var asmMnemonics = map[string]bool{
+	"ld": true, "ldh": true, "ldb": true, "ldi": true, "ldx": true, "ldxi": true, "ldxb": true,
+	"st": true, "stx": true, "jmp": true, "ja": true, "neg": true, "tax": true, "txa": true, "ret": true,
+}
+
+// instruction assembles the instruction the mnemonic m starts.
+func (a *assembler) instruction(m asmToken) error {
+	mnemonic := strings.ToLower(m.text)
+	_, alu := asmALU[mnemonic]
+	_, jump := asmJumps[mnemonic]
+	if !asmMnemonics[mnemonic] && !alu && !jump {
+		return fmt.Errorf("line %d: unknown instruction %q", m.line, m.text)
+	}
+	var ops []asmOperand
+	switch mnemonic {
+	case "neg", "tax", "txa":
+	default:
+		for {
+			op, err := a.operand()
+			if err != nil {
+				return err
+			}
+			ops = append(ops, op)
+			if !a.accept(",") {
+				break
+			}
+		}
+	}
+	bad := func() error {
+		return fmt.Errorf("line %d: invalid operands for %s", m.line, m.text)
+	}
+	emit := func(code uint16, k uint32) error {
+		a.prog = append(a.prog, bpf.Instruction{Code: code, K: k})
+		return nil
+	}
+	one := len(ops) == 1
+	switch mnemonic {
+	case "ld", "ldh", "ldb", "ldi":
+		size := map[string]uint16{"ld": bpf.W, "ldi": bpf.W, "ldh": bpf.H, "ldb": bpf.B}[mnemonic]
+		switch {
+		case !one:
+		case ops[0].kind == asmImm && size == bpf.W:
+			return emit(bpf.LD|bpf.IMM, ops[0].k)
+		case mnemonic == "ldi":
+		case ops[0].kind == asmLen && size == bpf.W:
+			return emit(bpf.LD|bpf.W|bpf.LEN, 0)
+		case ops[0].kind == asmMem && size == bpf.W:
+			return emit(bpf.LD|bpf.MEM, ops[0].k)
+		case ops[0].kind == asmAbs || ops[0].kind == asmExt:
+			return emit(bpf.LD|size|bpf.ABS, ops[0].k)
+		case ops[0].kind == asmInd:
+			return emit(bpf.LD|size|bpf.IND, ops[0].k)
+		}
+	case "ldx", "ldxi", "ldxb":
+		switch {
+		case !one:
+		case ops[0].kind == asmMSH && mnemonic != "ldxi":
+			return emit(bpf.LDX|bpf.B|bpf.MSH, ops[0].k)
+		case mnemonic == "ldxb":
+		case ops[0].kind == asmImm:
+			return emit(bpf.LDX|bpf.IMM, ops[0].k)
+		case mnemonic == "ldxi":
+		case ops[0].kind == asmLen:
+			return emit(bpf.LDX|bpf.W|bpf.LEN, 0)
+		case ops[0].kind == asmMem:
+			return emit(bpf.LDX|bpf.MEM, ops[0].k)
+		}
+	case "st", "stx":
+		if one && ops[0].kind == asmMem {
+			return emit(map[string]uint16{"st": bpf.ST, "stx": bpf.STX}[mnemonic], ops[0].k)
+		}
+	case "jmp", "ja":
+		if one && ops[0].kind == asmLabel {
+			a.fixups = append(a.fixups, asmFixup{pc: len(a.prog), field: 'k', label: ops[0].label})
+			return emit(bpf.JMP|bpf.JA, 0)
+		}
+	case "neg":
+		return emit(bpf.ALU|bpf.NEG, 0)
+	case "tax":
+		return emit(bpf.MISC|bpf.TAX, 0)
+	case "txa":
+		return emit(bpf.MISC|bpf.TXA, 0)
+	case "ret":
+		switch {
+		case !one:
+		case ops[0].kind == asmImm:
+			return emit(bpf.RET|bpf.K, ops[0].k)
+		case ops[0].kind == asmA:
+			return emit(bpf.RET|bpf.A, 0)
+		case ops[0].kind == asmX:
+			return emit(bpf.RET|bpf.X, 0)
+		}
+	}
+	if op := asmALU[mnemonic]; alu && one {
+		switch ops[0].kind {
+		case asmImm:
+			return emit(bpf.ALU|op|bpf.K, ops[0].k)
+		case asmX:
+			return emit(bpf.ALU|op|bpf.X, 0)
+		}
+	}
+	if j := asmJumps[mnemonic]; jump && len(ops) >= 2 && len(ops) <= 3 && (len(ops) == 2 || !j.negated) {
+		code := bpf.JMP | j.op | bpf.K
+		switch ops[0].kind {
+		case asmImm:
+		case asmX:
+			code = bpf.JMP | j.op | bpf.X
+		default:
+			return bad()
+		}
+		fields := []byte{'t', 'f'}
+		if j.negated {
+			fields = []byte{'f'}
+		}
+		for i, op := range ops[1:] {
+			if op.kind != asmLabel {
+				return bad()
+			}
+			a.fixups = append(a.fixups, asmFixup{pc: len(a.prog), field: fields[i], label: op.label})
+		}
+		return emit(code, ops[0].k)
+	}
+	return bad()
+}
@@ -0,0 +1,141 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/google/testimony/go/internal/bpf"
+)
+
+func TestAssembleBPF(t *testing.T) {
+	for _, test := range []struct {
+		asm  string
+		want []bpf.Instruction
+	}{
+		{`
+		; IPv4 TCP
+			ldh [12]
+			jne #0x800, drop
+			ldb [23]
+			jeq #6, keep, drop
+		keep:	ret #-1
+		drop:	ret #0`, []bpf.Instruction{
+			{Code: bpf.LD | bpf.H | bpf.ABS, K: 12},
+			{Code: bpf.JMP | bpf.JEQ | bpf.K, Jf: 3, K: 0x800},
+			{Code: bpf.LD | bpf.B | bpf.ABS, K: 23},
+			{Code: bpf.JMP | bpf.JEQ | bpf.K, Jt: 0, Jf: 1, K: 6},
+			{Code: bpf.RET | bpf.K, K: 0xffffffff},
+			{Code: bpf.RET | bpf.K},
+		}},
+		{"ld #len\nld len\nldx #pktlen\nldi #7\nldxi #010\nret a", []bpf.Instruction{
+			{Code: bpf.LD | bpf.W | bpf.LEN},
+			{Code: bpf.LD | bpf.W | bpf.LEN},
+			{Code: bpf.LDX | bpf.W | bpf.LEN},
+			{Code: bpf.LD | bpf.IMM, K: 7},
+			{Code: bpf.LDX | bpf.IMM, K: 8},
+			{Code: bpf.RET | bpf.A},
+		}},
+		{"ldxb 4*([14]&0xf)\nldx 4*([0]&0xf)\nld [x + 2]\nldh [%x+4]\nldb [x]\nret %a", []bpf.Instruction{
+			{Code: bpf.LDX | bpf.B | bpf.MSH, K: 14},
+			{Code: bpf.LDX | bpf.B | bpf.MSH, K: 0},
+			{Code: bpf.LD | bpf.W | bpf.IND, K: 2},
+			{Code: bpf.LD | bpf.H | bpf.IND, K: 4},
+			{Code: bpf.LD | bpf.B | bpf.IND},
+			{Code: bpf.RET | bpf.A},
+		}},
+		{"st M[3]\nstx M[15]\nld M[3]\nldx M[15]\nld #proto\nldb vlan_avail\nLDH #VLAN_TCI\nret #0", []bpf.Instruction{
+			{Code: bpf.ST, K: 3},
+			{Code: bpf.STX, K: 15},
+			{Code: bpf.LD | bpf.MEM, K: 3},
+			{Code: bpf.LDX | bpf.MEM, K: 15},
+			{Code: bpf.LD | bpf.W | bpf.ABS, K: bpf.AdOff},
+			{Code: bpf.LD | bpf.B | bpf.ABS, K: bpf.AdOff + 48},
+			{Code: bpf.LD | bpf.H | bpf.ABS, K: bpf.AdOff + 44},
+			{Code: bpf.RET | bpf.K},
+		}},
+		{"add #1\nsub x\nmul #2\ndiv %x\nmod #3\nand #0xff\nor x\nxor #1\nlsh #4\nrsh x\nneg\ntax\ntxa\nret a", []bpf.Instruction{
+			{Code: bpf.ALU | bpf.ADD | bpf.K, K: 1},
+			{Code: bpf.ALU | bpf.SUB | bpf.X},
+			{Code: bpf.ALU | bpf.MUL | bpf.K, K: 2},
+			{Code: bpf.ALU | bpf.DIV | bpf.X},
+			{Code: bpf.ALU | bpf.MOD | bpf.K, K: 3},
+			{Code: bpf.ALU | bpf.AND | bpf.K, K: 0xff},
+			{Code: bpf.ALU | bpf.OR | bpf.X},
+			{Code: bpf.ALU | bpf.XOR | bpf.K, K: 1},
+			{Code: bpf.ALU | bpf.LSH | bpf.K, K: 4},
+			{Code: bpf.ALU | bpf.RSH | bpf.X},
+			{Code: bpf.ALU | bpf.NEG},
+			{Code: bpf.MISC | bpf.TAX},
+			{Code: bpf.MISC | bpf.TXA},
+			{Code: bpf.RET | bpf.A},
+		}},
+		// Jumps to one label go there if the condition holds, except for
+		// jne, jlt and jle, which go there if it doesn't.
+		{"jeq #1, l\njgt x, l, m\njge #2, m\njset #4, l\nja l\njne #5, l\njlt #6, l\njle x, l\njmp m\nl: ret #1\nm: ret #0", []bpf.Instruction{
+			{Code: bpf.JMP | bpf.JEQ | bpf.K, Jt: 8, K: 1},
+			{Code: bpf.JMP | bpf.JGT | bpf.X, Jt: 7, Jf: 8},
+			{Code: bpf.JMP | bpf.JGE | bpf.K, Jt: 7, K: 2},
+			{Code: bpf.JMP | bpf.JSET | bpf.K, Jt: 5, K: 4},
+			{Code: bpf.JMP | bpf.JA, K: 4},
+			{Code: bpf.JMP | bpf.JEQ | bpf.K, Jf: 3, K: 5},
+			{Code: bpf.JMP | bpf.JGE | bpf.K, Jf: 2, K: 6},
+			{Code: bpf.JMP | bpf.JGT | bpf.X, Jf: 1},
+			{Code: bpf.JMP | bpf.JA, K: 1},
+			{Code: bpf.RET | bpf.K, K: 1},
+			{Code: bpf.RET | bpf.K},
+		}},
+	} {
+		got, err := assembleBPF(test.asm)
+		if err != nil {
+			t.Errorf("assembleBPF(%q): %v", test.asm, err)
+		} else if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("assembleBPF(%q) = %v, want %v", test.asm, got, test.want)
+		}
+	}
+}
+
+func TestAssembleBPFErrors(t *testing.T) {
+	for _, test := range []struct {
+		asm, err string
+	}{
+		{"ldh [12", `line 1: expected "]", found end of program`},
+		{"; comment\n\nldh [", `line 3: expected a number, found end of program`},
+		{"ld #1 @", `line 1: unexpected character '@'`},
+		{"foo #1", `line 1: unknown instruction "foo"`},
+		{"ret", `line 1: expected an operand, found end of program`},
+		{"ret %y", `line 1: expected x or a, found "y"`},
+		{"ldh #1", `line 1: invalid operands for ldh`},
+		{"ldi len", `line 1: invalid operands for ldi`},
+		{"ldxb #1", `line 1: invalid operands for ldxb`},
+		{"st [1]", `line 1: invalid operands for st`},
+		{"jeq [1], l\nl: ret #0", `line 1: invalid operands for jeq`},
+		{"jne #1, l, m\nl: m: ret #0", `line 1: invalid operands for jne`},
+		{"ld #4294967296", `line 1: 4294967296 doesn't fit in 32 bits`},
+		{"ld #-2147483649", `line 1: -2147483649 doesn't fit in 32 bits`},
+		{"ldx 3*([14]&0xf)", `line 1: only 4*([k]&0xf) can be loaded this way`},
+		{"ldx 4*([14]&0xe)", `line 1: only 4*([k]&0xf) can be loaded this way`},
+		{"jeq #1, nowhere\nret #0", `line 1: undefined label "nowhere"`},
+		{"l: ret #0\nl: ret #1", `line 2: label "l" is defined twice`},
+		{"back: ld #1\nja back", `line 2: label "back" is behind the jump; jumps only go forward`},
+		{"jeq #1, far\n" + strings.Repeat("ld #0\n", 256) + "far: ret #0", `line 1: label "far" is 256 instructions away, more than a conditional jump's 255`},
+	} {
+		if _, err := assembleBPF(test.asm); err == nil || err.Error() != test.err {
+			t.Errorf("assembleBPF(%q) error %v, want %q", test.asm, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/google/testimony/go/internal/bpf"
+	"github.com/google/testimony/go/internal/pcapfilter"
+)
+
+// FilterTestOptions says which socket's filter FilterTest runs, and on what.
+type FilterTestOptions struct {
+	Socket    string // SocketName of the socket whose filter to test
+	Interface string // which of the socket's Interfaces to compile it for, if not the first that matches Pcap's link type
+	Pcap      string // pcap file of packets to run it on
+	Admitted  string // pcap file to write the packets it admits to, if not empty
+	Rejected  string // pcap file to write the packets it rejects to, if not empty
+}
+
+// FilterTest shows exactly which packets a socket's filter admits:  it builds
+// the program the socket would lock onto its sockets, from its Filter or
+// FilterProgram, Direction and SnapLen, runs it over every packet in a pcap
+// file, and writes a report to w.  Pcap files don't have the metadata
+// ancillary data loads read, so those loads see 0, as for an incoming packet
+// without a VLAN tag.
+func FilterTest(t Testimony, opts FilterTestOptions, w io.Writer) error {
+	t, err := t.expand()
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	var sc *SocketConfig
+	for i := range t {
+		if t[i].SocketName == opts.Socket {
+			sc = &t[i]
+		}
+	}
+	switch {
+	case sc == nil:
+		return fmt.Errorf("no socket %q in the config", opts.Socket)
+	case sc.Backend == BackendAFXDP:
+		return fmt.Errorf("socket %q uses Backend %v, which doesn't filter", opts.Socket, sc.Backend)
+	}
+
+	in, err := os.Open(opts.Pcap)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	r, err := newPcapReader(in)
+	if err != nil {
+		return fmt.Errorf("could not read %q: %v", opts.Pcap, err)
+	}
+	link, ok := r.linkType()
+	if !ok {
+		return fmt.Errorf("%q has link type %d, but filters are only compiled for Ethernet and raw IP", opts.Pcap, r.link)
+	}
+
+	// The filter depends on the interface's link type, which has to match
+	// the file's.
+	iface := ""
+	for _, name := range sc.interfaces() {
+		if opts.Interface != "" && name != opts.Interface {
+			continue
+		}
+		ifaceLink, err := linkType(name)
+		if err != nil {
+			return fmt.Errorf("interface %q: %v", name, err)
+		}
+		if ifaceLink == link {
+			iface = name
+			break
+		}
+	}
+	if iface == "" {
+		if opts.Interface != "" && !sc.usesInterface(opts.Interface) {
+			return fmt.Errorf("socket %q doesn't capture on interface %q", opts.Socket, opts.Interface)
+		}
+		return fmt.Errorf("%q has %v packets, but socket %q has no %v interfaces", opts.Pcap, link, opts.Socket, link)
+	}
+	f, err := sc.member(iface).socketFilter()
+	if err != nil {
+		return err
+	}
+	prog := toBPFInsns(f)
+	if len(prog) == 0 {
+		fmt.Fprintf(w, "Socket %q has no filter on interface %q, so it admits every packet\n", opts.Socket, iface)
+	} else {
+		fmt.Fprintf(w, "Socket %q on interface %q (%v): %d-instruction filter, hash %x\n", opts.Socket, iface, link, len(prog), hashBPF(prog))
+	}
+
+	var admitted, rejected *pcapWriter
+	// The writers close their files once every packet is written; any
+	// error before then leaves them to be closed here.
+	defer func() {
+		for _, pw := range []*pcapWriter{admitted, rejected} {
+			if pw != nil && pw.f != nil {
+				pw.f.Close()
+			}
+		}
+	}()
+	for _, out := range []struct {
+		name string
+		pw   **pcapWriter
+	}{{opts.Admitted, &admitted}, {opts.Rejected, &rejected}} {
+		if out.name == "" {
+			continue
+		}
+		file, err := os.Create(out.name)
+		if err != nil {
+			return err
+		}
+		if *out.pw, err = newPcapWriter(file, r.header); err != nil {
+			return fmt.Errorf("could not write %q: %v", out.name, err)
+		}
+	}
+
+	var total, matched, truncated, usedAncillary int
+	for {
+		hdr, data, origLen, err := r.next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return fmt.Errorf("could not read packet %d of %q: %v", total+1, opts.Pcap, err)
+		}
+		total++
+		if origLen > uint32(len(data)) {
+			truncated++
+		}
+		ancillary := false
+		verdict := uint32(1)
+		if len(prog) > 0 {
+			verdict = bpf.Run(prog, data, func(uint32) uint32 {
+				ancillary = true
+				return 0
+			})
+		}
+		if ancillary {
+			usedAncillary++
+		}
+		out := rejected
+		if verdict != 0 {
+			matched++
+			out = admitted
+		}
+		if out != nil {
+			if err := out.write(hdr, data); err != nil {
+				return err
+			}
+		}
+	}
+	for _, pw := range []*pcapWriter{admitted, rejected} {
+		if pw != nil {
+			if err := pw.close(); err != nil {
+				return err
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "%q: %d packets, %d admitted, %d rejected\n", opts.Pcap, total, matched, total-matched)
+	if truncated > 0 {
+		fmt.Fprintf(w, "%d packets were truncated when captured; the filter rejects those it reads past the end of\n", truncated)
+	}
+	if usedAncillary > 0 {
+		fmt.Fprintf(w, "%d packets' verdicts read ancillary data, which pcap files don't have; it was taken as 0\n", usedAncillary)
+	}
+	if opts.Admitted != "" {
+		fmt.Fprintf(w, "wrote %d admitted packets to %q\n", matched, opts.Admitted)
+	}
+	if opts.Rejected != "" {
+		fmt.Fprintf(w, "wrote %d rejected packets to %q\n", total-matched, opts.Rejected)
+	}
+	return nil
+}
+
+// Pcap file magic numbers, and link types, from pcap-linktype(7).
+const (
+	pcapMagic        = 0xa1b2c3d4
+	pcapMagicNanos   = 0xa1b23c4d
+	pcapngMagic      = 0x0a0d0d0a
+	pcapHeaderLen    = 24
+	pcapRecordLen    = 16
+	pcapMaxRecord    = 1 << 26 // larger records mean a corrupt file
+	linktypeEthernet = 1
+	linktypeRaw      = 101
+	linktypeIPv4     = 228
+	linktypeIPv6     = 229
+	dltRaw           = 12         // DLT_RAW on most systems
+	dltRawOpenBSD    = 14         // DLT_RAW on OpenBSD
+	pcapLinkTypeMask = 0x0fffffff // the rest are FCS flags
+)
+
+// pcapReader reads packets from a classic pcap file, in either byte order.
+type pcapReader struct {
+	r      *bufio.Reader
+	order  binary.ByteOrder
+	header []byte // the file header, for files of the same packets
+	link   uint32
+}
+
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	p := &pcapReader{r: bufio.NewReader(r), header: make([]byte, pcapHeaderLen)}
+	if _, err := io.ReadFull(p.r, p.header); err != nil {
+		return nil, fmt.Errorf("could not read pcap header: %v", err)
+	}
+	switch magic := binary.LittleEndian.Uint32(p.header); {
+	case magic == pcapMagic || magic == pcapMagicNanos:
+		p.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(p.header) == pcapMagic || binary.BigEndian.Uint32(p.header) == pcapMagicNanos:
+		p.order = binary.BigEndian
+	case magic == pcapngMagic:
+		return nil, fmt.Errorf("pcapng files aren't supported; convert it with \"editcap -F pcap\"")
+	default:
+		return nil, fmt.Errorf("not a pcap file")
+	}
+	p.link = p.order.Uint32(p.header[20:]) & pcapLinkTypeMask
+	return p, nil
+}
+
+// linkType returns the filter link type of the file's packets.
+func (p *pcapReader) linkType() (pcapfilter.LinkType, bool) {
+	switch p.link {
+	case linktypeEthernet:
+		return pcapfilter.LinkEthernet, true
+	case linktypeRaw, linktypeIPv4, linktypeIPv6, dltRaw, dltRawOpenBSD:
+		return pcapfilter.LinkRaw, true
+	}
+	return 0, false
+}
+
+// next returns the next packet's record header and captured data, and its
+// original length, or io.EOF at the end of the file.
+func (p *pcapReader) next() (hdr, data []byte, origLen uint32, err error) {
+	hdr = make([]byte, pcapRecordLen)
+	if _, err := io.ReadFull(p.r, hdr); err == io.EOF {
+		return nil, nil, 0, io.EOF
+	} else if err != nil {
+		return nil, nil, 0, err
+	}
+	capLen, origLen := p.order.Uint32(hdr[8:]), p.order.Uint32(hdr[12:])
+	if capLen > pcapMaxRecord {
+		return nil, nil, 0, fmt.Errorf("record of %d bytes is too large", capLen)
+	}
+	data = make([]byte, capLen)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return nil, nil, 0, err
+	}
+	return hdr, data, origLen, nil
+}
+
+// pcapWriter writes packets read by a pcapReader to another pcap file.
+type pcapWriter struct {
+	f *os.File
+	w *bufio.Writer
+}
+
+func newPcapWriter(f *os.File, header []byte) (*pcapWriter, error) {
+	p := &pcapWriter{f: f, w: bufio.NewWriter(f)}
+	_, err := p.w.Write(header)
+	return p, err
+}
+
+func (p *pcapWriter) write(hdr, data []byte) error {
+	if _, err := p.w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := p.w.Write(data)
+	return err
+}
+
+// close flushes the file and closes it, even if flushing fails.
+func (p *pcapWriter) close() error {
+	f := p.f
+	p.f = nil
+	err := p.w.Flush()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("could not write %q: %v", f.Name(), err)
+	}
+	return nil
+}
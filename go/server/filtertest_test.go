@@ -0,0 +1,333 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/testimony/go/internal/pcapfilter"
+)
+
+// testRecord is a packet in a pcap file testPcap writes.
+type testRecord struct {
+	data    []byte
+	origLen uint32 // len(data), if 0
+}
+
+// testPcap returns a pcap file's header, and each of its records.
+func testPcap(order binary.ByteOrder, magic, link uint32, records []testRecord) (header []byte, recs [][]byte) {
+	header = make([]byte, pcapHeaderLen)
+	order.PutUint32(header, magic)
+	order.PutUint16(header[4:], 2)
+	order.PutUint16(header[6:], 4)
+	order.PutUint32(header[16:], 65535)
+	order.PutUint32(header[20:], link)
+	for i, r := range records {
+		rec := make([]byte, pcapRecordLen, pcapRecordLen+len(r.data))
+		origLen := r.origLen
+		if origLen == 0 {
+			origLen = uint32(len(r.data))
+		}
+		order.PutUint32(rec, uint32(1500000000+i))
+		order.PutUint32(rec[4:], uint32(i))
+		order.PutUint32(rec[8:], uint32(len(r.data)))
+		order.PutUint32(rec[12:], origLen)
+		recs = append(recs, append(rec, r.data...))
+	}
+	return header, recs
+}
+
+// ethernetIPv4 returns an Ethernet frame holding an IPv4 header for the given
+// protocol.
+func ethernetIPv4(proto byte) []byte {
+	frame := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0x08, 0x00}
+	ip := make([]byte, 20)
+	ip[0], ip[9] = 0x45, proto
+	return append(frame, ip...)
+}
+
+func TestPcapReader(t *testing.T) {
+	records := []testRecord{
+		{data: ethernetIPv4(17)},
+		{data: ethernetIPv4(6)[:20], origLen: 34},
+		{data: []byte{}},
+	}
+	for _, test := range []struct {
+		desc  string
+		order binary.ByteOrder
+		magic uint32
+	}{
+		{"little-endian", binary.LittleEndian, pcapMagic},
+		{"big-endian", binary.BigEndian, pcapMagic},
+		{"little-endian nanoseconds", binary.LittleEndian, pcapMagicNanos},
+		{"big-endian nanoseconds", binary.BigEndian, pcapMagicNanos},
+	} {
+		header, recs := testPcap(test.order, test.magic, linktypeEthernet|0x10000000, records)
+		r, err := newPcapReader(bytes.NewReader(append(header, bytes.Join(recs, nil)...)))
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		if r.order != test.order || !bytes.Equal(r.header, header) {
+			t.Errorf("%s: read as %v with header %x, want %v with %x", test.desc, r.order, r.header, test.order, header)
+		}
+		// The FCS flags don't change the link type.
+		if link, ok := r.linkType(); r.link != linktypeEthernet || link != pcapfilter.LinkEthernet || !ok {
+			t.Errorf("%s: link type %d (%v, %v), want %d (ethernet)", test.desc, r.link, link, ok, linktypeEthernet)
+		}
+		for i, rec := range records {
+			wantLen := rec.origLen
+			if wantLen == 0 {
+				wantLen = uint32(len(rec.data))
+			}
+			hdr, data, origLen, err := r.next()
+			switch {
+			case err != nil:
+				t.Errorf("%s: record %d: %v", test.desc, i, err)
+			case !bytes.Equal(hdr, recs[i][:pcapRecordLen]):
+				t.Errorf("%s: record %d header %x, want %x", test.desc, i, hdr, recs[i][:pcapRecordLen])
+			case !bytes.Equal(data, rec.data):
+				t.Errorf("%s: record %d data %x, want %x", test.desc, i, data, rec.data)
+			case origLen != wantLen:
+				t.Errorf("%s: record %d original length %d, want %d", test.desc, i, origLen, wantLen)
+			}
+		}
+		if _, _, _, err := r.next(); err != io.EOF {
+			t.Errorf("%s: error %v after the last record, want EOF", test.desc, err)
+		}
+	}
+
+	for _, test := range []struct {
+		desc string
+		link uint32
+		want pcapfilter.LinkType
+		ok   bool
+	}{
+		{"LINKTYPE_RAW", linktypeRaw, pcapfilter.LinkRaw, true},
+		{"LINKTYPE_IPV4", linktypeIPv4, pcapfilter.LinkRaw, true},
+		{"LINKTYPE_IPV6", linktypeIPv6, pcapfilter.LinkRaw, true},
+		{"DLT_RAW", dltRaw, pcapfilter.LinkRaw, true},
+		{"OpenBSD DLT_RAW", dltRawOpenBSD, pcapfilter.LinkRaw, true},
+		{"802.11", 105, 0, false},
+	} {
+		header, _ := testPcap(binary.LittleEndian, pcapMagic, test.link, nil)
+		r, err := newPcapReader(bytes.NewReader(header))
+		if err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+		} else if link, ok := r.linkType(); link != test.want || ok != test.ok {
+			t.Errorf("%s: link type %v, %v, want %v, %v", test.desc, link, ok, test.want, test.ok)
+		}
+	}
+
+	pcapng := []byte{0x0a, 0x0d, 0x0d, 0x0a, 28, 0, 0, 0, 0x4d, 0x3c, 0x2b, 0x1a, 1, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	for _, test := range []struct {
+		desc string
+		in   []byte
+		err  string
+	}{
+		{"pcapng", pcapng, `pcapng files aren't supported; convert it with "editcap -F pcap"`},
+		{"not pcap", bytes.Repeat([]byte{0}, pcapHeaderLen), "not a pcap file"},
+		{"short header", pcapng[:10], "could not read pcap header: unexpected EOF"},
+		{"empty", nil, "could not read pcap header: EOF"},
+	} {
+		if _, err := newPcapReader(bytes.NewReader(test.in)); err == nil || err.Error() != test.err {
+			t.Errorf("%s: error %v, want %q", test.desc, err, test.err)
+		}
+	}
+
+	// Records cut short, or too large to be real, are errors.
+	header, recs := testPcap(binary.BigEndian, pcapMagic, linktypeEthernet, []testRecord{{data: ethernetIPv4(17)}})
+	huge := append([]byte(nil), recs[0][:pcapRecordLen]...)
+	binary.BigEndian.PutUint32(huge[8:], pcapMaxRecord+1)
+	for _, test := range []struct {
+		desc string
+		in   []byte
+		err  string
+	}{
+		{"short record header", recs[0][:10], "unexpected EOF"},
+		{"short record data", recs[0][:len(recs[0])-1], "unexpected EOF"},
+		{"huge record", huge, "record of 67108865 bytes is too large"},
+	} {
+		r, err := newPcapReader(bytes.NewReader(append(append([]byte(nil), header...), test.in...)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, err := r.next(); err == nil || err.Error() != test.err {
+			t.Errorf("%s: error %v, want %q", test.desc, err, test.err)
+		}
+	}
+}
+
+func TestPcapWriter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testimony-pcap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	header, recs := testPcap(binary.BigEndian, pcapMagicNanos, linktypeRaw, []testRecord{
+		{data: []byte{0x45, 0, 0, 20}},
+		{data: []byte{0x60, 0}, origLen: 40},
+	})
+	f, err := os.Create(filepath.Join(dir, "out.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, err := newPcapWriter(f, header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rec := range recs {
+		if err := pw.write(rec[:pcapRecordLen], rec[pcapRecordLen:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pw.close(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(header, bytes.Join(recs, nil)...); !bytes.Equal(got, want) {
+		t.Errorf("wrote %x, want %x", got, want)
+	}
+	// The file is closed, so it can't be written again.
+	if _, err := f.Write([]byte{0}); err == nil {
+		t.Errorf("file still open after close")
+	}
+}
+
+func TestFilterTest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "testimony-filtertest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := func(name string) string { return filepath.Join(dir, name) }
+
+	// UDP and TCP packets, one of each cut short, and an ARP packet.
+	arp := ethernetIPv4(0)
+	arp[12], arp[13] = 0x08, 0x06
+	header, recs := testPcap(binary.LittleEndian, pcapMagic, linktypeEthernet, []testRecord{
+		{data: ethernetIPv4(17)},
+		{data: ethernetIPv4(6)},
+		{data: ethernetIPv4(17)[:24], origLen: 34},
+		{data: arp},
+		{data: ethernetIPv4(6)[:24], origLen: 34},
+		{data: ethernetIPv4(17)},
+	})
+	if err := ioutil.WriteFile(path("in.pcap"), append(header, bytes.Join(recs, nil)...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rawHeader, _ := testPcap(binary.LittleEndian, pcapMagic, linktypeRaw, nil)
+	if err := ioutil.WriteFile(path("raw.pcap"), rawHeader, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The loopback has an Ethernet link type, which every machine has.
+	sock := func(name string) string { return path(name + ".sock") }
+	conf := Testimony{
+		{SocketName: sock("udp"), Interface: "lo", Filter: "udp"},
+		{SocketName: sock("all"), Interface: "lo"},
+		{SocketName: sock("xdp"), Interface: "lo", Backend: BackendAFXDP},
+	}
+	join := func(recs ...[]byte) []byte { return append(append([]byte(nil), header...), bytes.Join(recs, nil)...) }
+	for _, test := range []struct {
+		desc               string
+		opts               FilterTestOptions
+		report             []string // after the first line
+		admitted, rejected []byte   // the files written, if any
+	}{
+		{"udp", FilterTestOptions{Socket: sock("udp"), Pcap: path("in.pcap"), Admitted: path("udp-in.pcap"), Rejected: path("udp-out.pcap")}, []string{
+			`"` + path("in.pcap") + `": 6 packets, 3 admitted, 3 rejected`,
+			"2 packets were truncated when captured; the filter rejects those it reads past the end of",
+			`wrote 3 admitted packets to "` + path("udp-in.pcap") + `"`,
+			`wrote 3 rejected packets to "` + path("udp-out.pcap") + `"`,
+		}, join(recs[0], recs[2], recs[5]), join(recs[1], recs[3], recs[4])},
+		{"udp, rejected only", FilterTestOptions{Socket: sock("udp"), Pcap: path("in.pcap"), Rejected: path("udp-out-only.pcap")}, []string{
+			`"` + path("in.pcap") + `": 6 packets, 3 admitted, 3 rejected`,
+			"2 packets were truncated when captured; the filter rejects those it reads past the end of",
+			`wrote 3 rejected packets to "` + path("udp-out-only.pcap") + `"`,
+		}, nil, join(recs[1], recs[3], recs[4])},
+		{"no filter", FilterTestOptions{Socket: sock("all"), Interface: "lo", Pcap: path("in.pcap"), Admitted: path("all-in.pcap"), Rejected: path("all-out.pcap")}, []string{
+			`"` + path("in.pcap") + `": 6 packets, 6 admitted, 0 rejected`,
+			"2 packets were truncated when captured; the filter rejects those it reads past the end of",
+			`wrote 6 admitted packets to "` + path("all-in.pcap") + `"`,
+			`wrote 0 rejected packets to "` + path("all-out.pcap") + `"`,
+		}, join(recs...), join()},
+	} {
+		var w bytes.Buffer
+		if err := FilterTest(conf, test.opts, &w); err != nil {
+			t.Errorf("%s: %v", test.desc, err)
+			continue
+		}
+		lines := strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n")
+		if first := `Socket "` + test.opts.Socket + `"`; !strings.HasPrefix(lines[0], first) {
+			t.Errorf("%s: report starts %q, want %q", test.desc, lines[0], first)
+		}
+		if got := strings.Join(lines[1:], "\n"); got != strings.Join(test.report, "\n") {
+			t.Errorf("%s: report:\n%s\nwant:\n%s", test.desc, got, strings.Join(test.report, "\n"))
+		}
+		// The split files hold the input's records, unchanged and in order.
+		for _, out := range []struct {
+			name string
+			want []byte
+		}{{test.opts.Admitted, test.admitted}, {test.opts.Rejected, test.rejected}} {
+			if out.name == "" {
+				continue
+			}
+			if got, err := ioutil.ReadFile(out.name); err != nil {
+				t.Errorf("%s: %v", test.desc, err)
+			} else if !bytes.Equal(got, out.want) {
+				t.Errorf("%s: %q holds %x, want %x", test.desc, out.name, got, out.want)
+			}
+		}
+	}
+
+	var w bytes.Buffer
+	if err := FilterTest(conf, FilterTestOptions{Socket: sock("all"), Pcap: path("in.pcap")}, &w); err != nil {
+		t.Error(err)
+	} else if want := `Socket "` + sock("all") + `" has no filter on interface "lo", so it admits every packet`; !strings.HasPrefix(w.String(), want+"\n") {
+		t.Errorf("report %q, want it to start %q", w.String(), want)
+	}
+
+	for _, test := range []struct {
+		desc string
+		opts FilterTestOptions
+		err  string
+	}{
+		{"unknown socket", FilterTestOptions{Socket: sock("nosuch"), Pcap: path("in.pcap")}, `no socket "` + sock("nosuch") + `" in the config`},
+		{"afxdp", FilterTestOptions{Socket: sock("xdp"), Pcap: path("in.pcap")}, `socket "` + sock("xdp") + `" uses Backend afxdp, which doesn't filter`},
+		{"no pcap", FilterTestOptions{Socket: sock("udp"), Pcap: path("nosuch.pcap")}, "open " + path("nosuch.pcap") + ": no such file or directory"},
+		{"link type mismatch", FilterTestOptions{Socket: sock("udp"), Pcap: path("raw.pcap")},
+			`"` + path("raw.pcap") + `" has raw IP packets, but socket "` + sock("udp") + `" has no raw IP interfaces`},
+		{"other interface", FilterTestOptions{Socket: sock("udp"), Interface: "nosuchif0", Pcap: path("in.pcap")},
+			`socket "` + sock("udp") + `" doesn't capture on interface "nosuchif0"`},
+		{"unwritable output", FilterTestOptions{Socket: sock("udp"), Pcap: path("in.pcap"), Admitted: path("a.pcap"), Rejected: path("nosuch/b.pcap")},
+			"open " + path("nosuch/b.pcap") + ": no such file or directory"},
+	} {
+		if err := FilterTest(conf, test.opts, ioutil.Discard); err == nil || err.Error() != test.err {
+			t.Errorf("%s: error %v, want %q", test.desc, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,340 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/testimony/go/internal/netlink"
+	"github.com/google/testimony/go/protocol"
+)
+
+// ifaceTemplate in a SocketName is replaced by the name of the interface the
+// socket sniffs on.
+const ifaceTemplate = "{iface}"
+
+// multiInterfaceProtocolVersion is sent to clients of sockets with more than
+// one interface instead of protocolVersion, since they're passed a ring per
+// interface rather than a single socket.
+const multiInterfaceProtocolVersion = 4
+
+// interfaceMatcher returns a function matching interface names if iface is a
+// pattern:  either a regular expression between slashes, like "/^eth[0-3]$/",
+// or a glob, like "ens*".  If iface is a plain interface name, it returns nil.
+func interfaceMatcher(iface string) (func(string) bool, error) {
+	if len(iface) > 1 && strings.HasPrefix(iface, "/") && strings.HasSuffix(iface, "/") {
+		re, err := regexp.Compile(iface[1 : len(iface)-1])
+		if err != nil {
+			return nil, fmt.Errorf("bad Interface regexp %q: %v", iface, err)
+		}
+		return re.MatchString, nil
+	}
+	if !strings.ContainsAny(iface, "*?[") {
+		return nil, nil
+	}
+	if _, err := filepath.Match(iface, ""); err != nil {
+		return nil, fmt.Errorf("bad Interface glob %q: %v", iface, err)
+	}
+	return func(name string) bool {
+		ok, _ := filepath.Match(iface, name)
+		return ok
+	}, nil
+}
+
+// interfaceNames returns the names of all network interfaces, sorted.
+func interfaceNames() ([]string, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("could not list interfaces: %v", err)
+	}
+	var names []string
+	for _, iface := range ifaces {
+		names = append(names, iface.Name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// interfaces returns the names of the interfaces sc sniffs on.
+func (sc SocketConfig) interfaces() []string {
+	if len(sc.Interfaces) > 0 {
+		return sc.Interfaces
+	}
+	return []string{sc.Interface}
+}
+
+// usesInterface returns true if sc sniffs on the named interface.
+func (sc SocketConfig) usesInterface(name string) bool {
+	for _, iface := range sc.interfaces() {
+		if iface == name {
+			return true
+		}
+	}
+	return false
+}
+
+// member returns the config of the AF_PACKET sockets sc has on one of its
+// interfaces.
+func (sc SocketConfig) member(iface string) SocketConfig {
+	sc.Interface, sc.Interfaces = iface, nil
+	return sc
+}
+
+// aggregate checks a config that lists its Interfaces.  A list of one is
+// returned as a plain Interface.
+func (sc SocketConfig) aggregate() (SocketConfig, error) {
+	if sc.Interface != "" {
+		return sc, fmt.Errorf("Interface %q can't be set along with Interfaces", sc.Interface)
+	}
+	seen := map[string]bool{}
+	for _, iface := range sc.Interfaces {
+		if match, err := interfaceMatcher(iface); err != nil {
+			return sc, err
+		} else if match != nil {
+			return sc, fmt.Errorf("Interfaces can't contain patterns like %q", iface)
+		} else if iface == "" {
+			return sc, fmt.Errorf("Interfaces contains an empty name")
+		} else if seen[iface] {
+			return sc, fmt.Errorf("Interfaces lists %q twice", iface)
+		}
+		seen[iface] = true
+	}
+	if len(sc.Interfaces) == 1 {
+		return sc.member(sc.Interfaces[0]), nil
+	}
+	// Each interface gets its own fanout group, and transmitting needs a
+	// single interface to go out of.
+	switch {
+	case strings.Contains(sc.SocketName, ifaceTemplate):
+		return sc, fmt.Errorf("SocketName can't contain %s with more than one interface", ifaceTemplate)
+	case sc.FanoutID != 0:
+		return sc, fmt.Errorf("FanoutID can't be set with more than one interface")
+	case sc.TxRing:
+		return sc, fmt.Errorf("TxRing can't be used with more than one interface")
+	}
+	return sc, nil
+}
+
+// expand returns t with every socket whose Interface is a pattern replaced by
+// one socket per matching interface, in interface name order.  Each gets its
+// own SocketName by substituting the interface name for {iface}, and is
+// auto-assigned its own fanout ID.  Sockets listing their Interfaces are
+// served as they are.
+func (t Testimony) expand() (Testimony, error) {
+	var out Testimony
+	var names []string
+	for _, sc := range t {
+		if len(sc.Interfaces) > 0 {
+			var err error
+			if sc, err = sc.aggregate(); err != nil {
+				return nil, fmt.Errorf("socket %q: %v", sc.SocketName, err)
+			}
+			if len(sc.Interfaces) > 0 {
+				out = append(out, sc)
+				continue
+			}
+		}
+		match, err := interfaceMatcher(sc.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("socket %q: %v", sc.SocketName, err)
+		}
+		if match == nil {
+			sc.SocketName = strings.Replace(sc.SocketName, ifaceTemplate, sc.Interface, -1)
+			out = append(out, sc)
+			continue
+		}
+		if !strings.Contains(sc.SocketName, ifaceTemplate) {
+			return nil, fmt.Errorf("socket %q: SocketName must contain %s when Interface %q is a pattern", sc.SocketName, ifaceTemplate, sc.Interface)
+		}
+		if sc.FanoutID != 0 {
+			return nil, fmt.Errorf("socket %q: FanoutID can't be set when Interface %q is a pattern", sc.SocketName, sc.Interface)
+		}
+		if names == nil {
+			if names, err = interfaceNames(); err != nil {
+				return nil, err
+			}
+		}
+		matched := false
+		for _, name := range names {
+			if !match(name) {
+				continue
+			}
+			matched = true
+			expanded := sc
+			expanded.Interface = name
+			expanded.SocketName = strings.Replace(sc.SocketName, ifaceTemplate, name, -1)
+			out = append(out, expanded)
+		}
+		if !matched {
+			return nil, fmt.Errorf("socket %q: Interface %q matches no interfaces", sc.SocketName, sc.Interface)
+		}
+	}
+	return out, nil
+}
+
+// watchLinks passes link events from m to the returned channel until the
+// server stops.  A nil event list means events were lost, and every
+// interface should be rechecked.
+func (s *Server) watchLinks(m *netlink.LinkMonitor) <-chan []netlink.LinkEvent {
+	events := make(chan []netlink.LinkEvent)
+	go func() {
+		defer close(events)
+		for {
+			evs, err := m.Read()
+			if err == netlink.ErrLost {
+				s.log.Printf("lost interface events, rechecking all interfaces")
+			} else if errors.Is(err, os.ErrClosed) {
+				return // shutting down
+			} else if err != nil {
+				s.log.Printf("no longer watching interfaces: %v", err)
+				return
+			}
+			select {
+			case events <- evs:
+			case <-s.done:
+				return
+			}
+		}
+	}()
+	return events
+}
+
+// linkEvents handles link events from watchLinks.  Changes in link state are
+// logged for interfaces in use; AF_PACKET sockets survive a link going down
+// and up again.  Interfaces that were added, removed or replaced have their
+// sockets rebuilt.
+func (s *Server) linkEvents(evs []netlink.LinkEvent) {
+	if evs == nil {
+		s.relink("")
+		return
+	}
+	for _, e := range evs {
+		used := false
+		for _, l := range s.running {
+			used = used || l.conf.usesInterface(e.Name)
+		}
+		if !used {
+			continue
+		}
+		if up, ok := s.linkUp[e.Name]; !ok || up != e.Up() {
+			s.linkUp[e.Name] = e.Up()
+			if ok && !e.Deleted {
+				s.log.Printf("Interface %q is now %s", e.Name, upDown(e.Up()))
+			}
+		}
+		if e.Deleted {
+			delete(s.linkUp, e.Name)
+		}
+		s.relink(e.Name)
+	}
+}
+
+func upDown(up bool) string {
+	if up {
+		return "up"
+	}
+	return "down"
+}
+
+// relink rebuilds the listeners using the named interface (or all
+// interfaces, if name is empty) when one of their interfaces has appeared,
+// gone away, or been replaced by one with a different index since they were
+// set up.  Clients of the old sockets are told their ring is being replaced.
+// The old listeners are all closed, in parallel, before any is rebuilt.  A
+// listener with several interfaces serves nothing while any is missing.
+func (s *Server) relink(name string) {
+	var replaced []*listener
+	for socketName, l := range s.running {
+		if name != "" && !l.conf.usesInterface(name) {
+			continue
+		}
+		changed := false
+		for i, iface := range l.conf.interfaces() {
+			index, old := 0, 0
+			if ni, err := net.InterfaceByName(iface); err == nil {
+				index = ni.Index
+			}
+			if l.ifindexes != nil {
+				old = l.ifindexes[i]
+			}
+			if index == old {
+				continue
+			}
+			changed = true
+			switch {
+			case old == 0:
+				s.log.Printf("Interface %q appeared, setting up socket %q", iface, socketName)
+			case index == 0:
+				s.log.Printf("Interface %q went away, replacing socket %q", iface, socketName)
+			default:
+				s.log.Printf("Interface %q changed index from %d to %d, replacing socket %q", iface, old, index, socketName)
+			}
+		}
+		if changed {
+			replaced = append(replaced, l)
+		}
+	}
+	closeListeners(replaced, protocol.TypeRingReplaced)
+	for _, l := range replaced {
+		socketName := l.conf.SocketName
+		nl, err := s.newListener(l.conf)
+		if err != nil {
+			// Wait for the next change to the interface before trying again.
+			s.log.Printf("Socket %q could not be set up, waiting for its interfaces %q to change: %v", socketName, l.conf.interfaces(), err)
+			nl = s.waitingListener(l.conf)
+		}
+		s.running[socketName] = nl
+	}
+}
+
+// iffPromisc is IFF_PROMISC, from linux/if.h.
+const iffPromisc = 0x100
+
+// promiscuous reports whether an interface is in promiscuous mode, for any
+// reason.  Unlike SIOCGIFFLAGS, which only shows promiscuous mode that was
+// asked for through the interface's flags, sysfs shows the kernel's view.
+func promiscuous(iface string) (bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", iface, "flags"))
+	if err != nil {
+		return false, err
+	}
+	flags, err := strconv.ParseUint(strings.TrimSpace(string(data)), 0, 32)
+	if err != nil {
+		return false, fmt.Errorf("could not parse flags %q: %v", data, err)
+	}
+	return flags&iffPromisc != 0, nil
+}
+
+// logPromiscuous logs whether the listener's interfaces are in promiscuous
+// mode.  Other sockets, or other programs, may keep them promiscuous after
+// ours are gone.
+func (l *listener) logPromiscuous() {
+	for _, iface := range l.conf.interfaces() {
+		if on, err := promiscuous(iface); err != nil {
+			l.srv.log.Printf("Socket %q could not get promiscuous state of %q: %v", l.conf.SocketName, iface, err)
+		} else {
+			l.srv.log.Printf("Socket %q: interface %q promiscuous: %v", l.conf.SocketName, iface, on)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestInterfaceMatcher(t *testing.T) {
+	for _, test := range []struct {
+		iface          string
+		match, nomatch []string // nil match means iface isn't a pattern
+		err            string
+	}{
+		{iface: "eth0"},
+		{iface: "/"},
+		{iface: "/^eth[0-3]$/", match: []string{"eth0", "eth3"}, nomatch: []string{"eth4", "eth10", "xeth0"}},
+		{iface: "/eth/", match: []string{"eth0", "veth1"}, nomatch: []string{"lo"}},
+		{iface: "ens*", match: []string{"ens", "ens1f0"}, nomatch: []string{"en1", "xens1"}},
+		{iface: "eth?", match: []string{"eth1"}, nomatch: []string{"eth", "eth10"}},
+		{iface: "eth[13]", match: []string{"eth1", "eth3"}, nomatch: []string{"eth2"}},
+		{iface: "/eth(/", err: "bad Interface regexp \"/eth(/\": error parsing regexp: missing closing ): `eth(`"},
+		{iface: "eth[", err: "bad Interface glob \"eth[\": syntax error in pattern"},
+	} {
+		match, err := interfaceMatcher(test.iface)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("interfaceMatcher(%q) error %v, want %q", test.iface, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("interfaceMatcher(%q): %v", test.iface, err)
+			continue
+		}
+		if (match == nil) != (test.match == nil) {
+			t.Errorf("interfaceMatcher(%q) is a pattern: %v, want %v", test.iface, match != nil, test.match != nil)
+			continue
+		}
+		for _, name := range test.match {
+			if !match(name) {
+				t.Errorf("interfaceMatcher(%q) doesn't match %q", test.iface, name)
+			}
+		}
+		for _, name := range test.nomatch {
+			if match(name) {
+				t.Errorf("interfaceMatcher(%q) matches %q", test.iface, name)
+			}
+		}
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	base := SocketConfig{SocketName: "/tmp/a.sock", NumBlocks: 16}
+	with := func(f func(sc *SocketConfig)) SocketConfig {
+		sc := base
+		f(&sc)
+		return sc
+	}
+	for _, test := range []struct {
+		desc string
+		sc   SocketConfig
+		want SocketConfig
+		err  string
+	}{
+		{"two", with(func(sc *SocketConfig) { sc.Interfaces = []string{"eth0", "eth1"} }),
+			with(func(sc *SocketConfig) { sc.Interfaces = []string{"eth0", "eth1"} }), ""},
+		{"one is a plain Interface", with(func(sc *SocketConfig) { sc.Interfaces = []string{"eth0"} }),
+			with(func(sc *SocketConfig) { sc.Interface = "eth0" }), ""},
+		{"one with a template and FanoutID", with(func(sc *SocketConfig) {
+			sc.Interfaces, sc.SocketName, sc.FanoutID, sc.TxRing = []string{"eth0"}, "/tmp/{iface}.sock", 7, true
+		}), with(func(sc *SocketConfig) {
+			sc.Interface, sc.SocketName, sc.FanoutID, sc.TxRing = "eth0", "/tmp/{iface}.sock", 7, true
+		}), ""},
+		{"Interface too", with(func(sc *SocketConfig) { sc.Interface, sc.Interfaces = "eth2", []string{"eth0", "eth1"} }),
+			SocketConfig{}, `Interface "eth2" can't be set along with Interfaces`},
+		{"glob", with(func(sc *SocketConfig) { sc.Interfaces = []string{"eth0", "eth*"} }),
+			SocketConfig{}, `Interfaces can't contain patterns like "eth*"`},
+		{"regexp", with(func(sc *SocketConfig) { sc.Interfaces = []string{"/eth/"} }),
+			SocketConfig{}, `Interfaces can't contain patterns like "/eth/"`},
+		{"bad glob", with(func(sc *SocketConfig) { sc.Interfaces = []string{"eth["} }),
+			SocketConfig{}, `bad Interface glob "eth[": syntax error in pattern`},
+		{"empty name", with(func(sc *SocketConfig) { sc.Interfaces = []string{"eth0", ""} }),
+			SocketConfig{}, "Interfaces contains an empty name"},
+		{"duplicate", with(func(sc *SocketConfig) { sc.Interfaces = []string{"eth0", "eth1", "eth0"} }),
+			SocketConfig{}, `Interfaces lists "eth0" twice`},
+		{"template", with(func(sc *SocketConfig) { sc.Interfaces, sc.SocketName = []string{"eth0", "eth1"}, "/tmp/{iface}.sock" }),
+			SocketConfig{}, "SocketName can't contain {iface} with more than one interface"},
+		{"FanoutID", with(func(sc *SocketConfig) { sc.Interfaces, sc.FanoutID = []string{"eth0", "eth1"}, 7 }),
+			SocketConfig{}, "FanoutID can't be set with more than one interface"},
+		{"TxRing", with(func(sc *SocketConfig) { sc.Interfaces, sc.TxRing = []string{"eth0", "eth1"}, true }),
+			SocketConfig{}, "TxRing can't be used with more than one interface"},
+	} {
+		got, err := test.sc.aggregate()
+		switch {
+		case test.err != "":
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error %v, want %q", test.desc, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", test.desc, err)
+		case !reflect.DeepEqual(got, test.want):
+			t.Errorf("%s: got %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
+
+func TestExpand(t *testing.T) {
+	// Patterns are matched against the machine's interfaces, which always
+	// include the loopback.
+	names, err := interfaceNames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lo []string
+	for _, name := range names {
+		if name[0] == 'l' {
+			lo = append(lo, name)
+		}
+	}
+	if len(lo) == 0 {
+		t.Skip("no loopback interface")
+	}
+	var wantLo Testimony
+	for _, name := range lo {
+		wantLo = append(wantLo, SocketConfig{SocketName: "/tmp/" + name + ".sock", Interface: name, NumBlocks: 16})
+	}
+
+	for _, test := range []struct {
+		desc string
+		in   Testimony
+		want Testimony
+		err  string
+	}{
+		{"plain", Testimony{{SocketName: "/tmp/a.sock", Interface: "eth0"}},
+			Testimony{{SocketName: "/tmp/a.sock", Interface: "eth0"}}, ""},
+		{"plain with template", Testimony{{SocketName: "/tmp/{iface}-{iface}.sock", Interface: "eth0"}},
+			Testimony{{SocketName: "/tmp/eth0-eth0.sock", Interface: "eth0"}}, ""},
+		{"glob", Testimony{{SocketName: "/tmp/{iface}.sock", Interface: "l*", NumBlocks: 16}}, wantLo, ""},
+		{"regexp, in order with others", Testimony{
+			{SocketName: "/tmp/first.sock", Interface: "eth0"},
+			{SocketName: "/tmp/{iface}.sock", Interface: "/^l/", NumBlocks: 16},
+			{SocketName: "/tmp/last.sock", Interfaces: []string{"eth0", "eth1"}},
+		}, append(append(Testimony{{SocketName: "/tmp/first.sock", Interface: "eth0"}}, wantLo...),
+			SocketConfig{SocketName: "/tmp/last.sock", Interfaces: []string{"eth0", "eth1"}}), ""},
+		{"one of Interfaces", Testimony{{SocketName: "/tmp/{iface}.sock", Interfaces: []string{"eth0"}}},
+			Testimony{{SocketName: "/tmp/eth0.sock", Interface: "eth0"}}, ""},
+		{"bad Interfaces", Testimony{{SocketName: "/tmp/a.sock", Interfaces: []string{"eth0", "eth0"}}},
+			nil, `socket "/tmp/a.sock": Interfaces lists "eth0" twice`},
+		{"bad pattern", Testimony{{SocketName: "/tmp/{iface}.sock", Interface: "/(/"}},
+			nil, "socket \"/tmp/{iface}.sock\": bad Interface regexp \"/(/\": error parsing regexp: missing closing ): `(`"},
+		{"pattern without template", Testimony{{SocketName: "/tmp/a.sock", Interface: "l*"}},
+			nil, `socket "/tmp/a.sock": SocketName must contain {iface} when Interface "l*" is a pattern`},
+		{"pattern with FanoutID", Testimony{{SocketName: "/tmp/{iface}.sock", Interface: "l*", FanoutID: 7}},
+			nil, `socket "/tmp/{iface}.sock": FanoutID can't be set when Interface "l*" is a pattern`},
+		{"no matches", Testimony{{SocketName: "/tmp/{iface}.sock", Interface: "/^no such interface$/"}},
+			nil, `socket "/tmp/{iface}.sock": Interface "/^no such interface$/" matches no interfaces`},
+	} {
+		got, err := test.in.expand()
+		switch {
+		case test.err != "":
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error %v, want %q", test.desc, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", test.desc, err)
+		case !reflect.DeepEqual(got, test.want):
+			t.Errorf("%s: got %+v, want %+v", test.desc, got, test.want)
+		}
+	}
+}
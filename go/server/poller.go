@@ -0,0 +1,135 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// epollET is EPOLLET, which the syscall package defines as a negative number.
+const epollET = 1 << 31
+
+// blockPoller watches all of a server's AF_PACKET sockets for new blocks with
+// a single epoll instance, waking a socket's getNewBlocks when the kernel
+// retires one of its blocks.  It's edge-triggered, so a socket that's waiting
+// for its clients to return blocks isn't woken over and over, and idle
+// sockets aren't woken at all.
+type blockPoller struct {
+	srv    *Server
+	epfd   int
+	stopR  int // read end of a pipe which stops run when written to
+	stopW  int
+	mu     sync.Mutex
+	wakes  map[int32]chan struct{} // keyed by fd
+	done   chan struct{}           // closed once run returns
+	closed sync.Once
+}
+
+// newBlockPoller returns a running blockPoller.  Call close to stop it.
+func newBlockPoller(srv *Server) (*blockPoller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("epoll_create1: %v", err)
+	}
+	var stop [2]int
+	if err := syscall.Pipe2(stop[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(epfd)
+		return nil, fmt.Errorf("pipe2: %v", err)
+	}
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(stop[0])}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, stop[0], &ev); err != nil {
+		syscall.Close(epfd)
+		syscall.Close(stop[0])
+		syscall.Close(stop[1])
+		return nil, fmt.Errorf("epoll_ctl: %v", err)
+	}
+	p := &blockPoller{
+		srv:   srv,
+		epfd:  epfd,
+		stopR: stop[0],
+		stopW: stop[1],
+		wakes: map[int32]chan struct{}{},
+		done:  make(chan struct{}),
+	}
+	go p.run()
+	return p, nil
+}
+
+// add starts watching fd, sending to wake (which should be buffered) whenever
+// the socket may have a new block.  Sends are dropped if wake is full.
+func (p *blockPoller) add(fd int, wake chan struct{}) error {
+	p.mu.Lock()
+	p.wakes[int32(fd)] = wake
+	p.mu.Unlock()
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN | epollET, Fd: int32(fd)}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &ev); err != nil {
+		p.mu.Lock()
+		delete(p.wakes, int32(fd))
+		p.mu.Unlock()
+		return fmt.Errorf("epoll_ctl: %v", err)
+	}
+	return nil
+}
+
+// remove stops watching fd.  It must be called before fd is closed.
+func (p *blockPoller) remove(fd int) {
+	syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+	p.mu.Lock()
+	delete(p.wakes, int32(fd))
+	p.mu.Unlock()
+}
+
+// run waits for events until close is called.
+func (p *blockPoller) run() {
+	defer close(p.done)
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		} else if err != nil {
+			p.srv.fail(fmt.Errorf("waiting for new blocks: epoll_wait: %v", err))
+			return
+		}
+		p.mu.Lock()
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == p.stopR {
+				p.mu.Unlock()
+				return
+			}
+			// An fd that was just removed may still have an event.
+			if wake := p.wakes[ev.Fd]; wake != nil {
+				select {
+				case wake <- struct{}{}:
+				default:
+				}
+			}
+		}
+		p.mu.Unlock()
+	}
+}
+
+// close stops the poller.  Sockets should have removed their fds first.
+func (p *blockPoller) close() {
+	p.closed.Do(func() {
+		syscall.Write(p.stopW, []byte{0})
+		<-p.done
+		syscall.Close(p.epfd)
+		syscall.Close(p.stopR)
+		syscall.Close(p.stopW)
+	})
+}
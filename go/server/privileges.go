@@ -0,0 +1,539 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+// #include <sys/resource.h>
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/google/testimony/go/internal/vlog"
+)
+
+// HelperFlag is the flag the privileged helper is run with by default, see
+// Options.HelperArgs.  A program's main function should check for it, and if
+// set, call RunPrivilegedHelper instead of starting a Server.
+const HelperFlag = "privileged_helper"
+
+const (
+	capNetAdmin = 12 // CAP_NET_ADMIN, from linux/capability.h
+	capNetRaw   = 13 // CAP_NET_RAW, from linux/capability.h
+)
+
+// opener performs the operations that need privileges:  creating AF_PACKET
+// and AF_XDP sockets and UNIX listeners, and removing socket files.
+type opener interface {
+	afPacket(sc SocketConfig, fanoutID, num int) (int, error)
+	afXDP(sc SocketConfig) ([]int, error)
+	txPacket(sc SocketConfig) (int, error)
+	listenUnix(sc SocketConfig) (*net.UnixListener, error)
+	remove(socketName string) error
+}
+
+// direct performs privileged operations in-process.
+type direct struct {
+	log *vlog.Logger
+}
+
+func (direct) afPacket(sc SocketConfig, fanoutID, num int) (int, error) {
+	return openAFPacket(sc, fanoutID, num)
+}
+
+func (direct) afXDP(sc SocketConfig) ([]int, error) {
+	return openAFXDP(sc)
+}
+
+func (direct) txPacket(sc SocketConfig) (int, error) {
+	return openTxPacket(sc)
+}
+
+func (direct) remove(socketName string) error {
+	if err := os.Remove(socketName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// dropPrivileges starts the privileged helper and switches to the RunAs user
+// and group, if requested.  It must be called once all initial sockets and
+// listeners are set up.  Until then, s.privileged performs operations
+// in-process; afterwards, it's the privileged helper.
+func (s *Server) dropPrivileges() error {
+	runAs := s.opts.RunAs
+	if runAs == "" {
+		if s.opts.KeepNetCaps {
+			return errors.New("KeepNetCaps requires RunAs")
+		}
+		return nil
+	}
+	userName, groupName := runAs, ""
+	if i := strings.Index(runAs, ":"); i >= 0 {
+		userName, groupName = runAs[:i], runAs[i+1:]
+	}
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return fmt.Errorf("could not get user: %v", err)
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return err
+	}
+	if groupName != "" {
+		if gid, err = lookupGID(groupName); err != nil {
+			return err
+		}
+	}
+
+	// Rings are mapped with MAP_LOCKED, so make sure rings set up after the
+	// switch can still be locked.  If we can't lift the limit entirely, raise
+	// it as far as we can.
+	lim := C.struct_rlimit{rlim_cur: C.RLIM_INFINITY, rlim_max: C.RLIM_INFINITY}
+	if _, err := C.setrlimit(C.RLIMIT_MEMLOCK, &lim); err != nil {
+		s.log.Printf("could not lift RLIMIT_MEMLOCK, rings set up later may fail: %v", err)
+		if _, err := C.getrlimit(C.RLIMIT_MEMLOCK, &lim); err == nil {
+			lim.rlim_cur = lim.rlim_max
+			C.setrlimit(C.RLIMIT_MEMLOCK, &lim)
+		}
+	}
+	h, err := s.startHelper(uid, gid)
+	if err != nil {
+		return fmt.Errorf("could not start privileged helper: %v", err)
+	}
+
+	// Go's syscall package applies these to all threads.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+	s.privileged = h
+	s.log.Printf("Dropped privileges, now running as %d/%d", uid, gid)
+	return nil
+}
+
+// checkHelper returns an error if the privileged helper, as opts run it,
+// couldn't create sc's sockets.  With KeepNetCaps it only has CAP_NET_RAW and
+// CAP_NET_ADMIN, and loading the eBPF programs of FanoutType ebpf and AF_XDP
+// sockets needs CAP_BPF or CAP_SYS_ADMIN as well.
+func (sc SocketConfig) checkHelper(opts Options) error {
+	switch {
+	case !opts.KeepNetCaps:
+		return nil
+	case sc.FanoutType == FanoutEBPF:
+		return errors.New("FanoutType ebpf can't be used with KeepNetCaps, as the privileged helper can't load eBPF programs")
+	case sc.Backend == BackendAFXDP:
+		return errors.New("Backend afxdp can't be used with KeepNetCaps, as the privileged helper can't load XDP programs")
+	}
+	return nil
+}
+
+// checkHelper checks that the privileged helper could create every socket in
+// t, so a reload or a returning interface doesn't find out too late.
+func (t Testimony) checkHelper(opts Options) error {
+	for _, sc := range t {
+		if err := sc.checkHelper(opts); err != nil {
+			return fmt.Errorf("socket %q: %v", sc.SocketName, err)
+		}
+	}
+	return nil
+}
+
+// helperRequest is sent from the daemon to the privileged helper.
+type helperRequest struct {
+	Op       string // "afpacket", "afxdp", "txpacket", "listen" or "remove"
+	Config   SocketConfig
+	FanoutID int
+	Num      int // fanout index of an "afpacket" socket
+}
+
+// helperResponse is the privileged helper's reply to a helperRequest.
+// Successful "afpacket", "txpacket" and "listen" replies carry a file
+// descriptor, and "afxdp" replies carry those openAFXDP returns.
+type helperResponse struct {
+	Error string
+}
+
+// helper is the daemon's side of a connection to the privileged helper.
+type helper struct {
+	mu sync.Mutex
+	c  *net.UnixConn
+}
+
+// startHelper starts the privileged helper, a copy of this binary run with
+// HelperArgs, connected to us over a SOCK_SEQPACKET socket pair.
+func (s *Server) startHelper(uid, gid int) (*helper, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_SEQPACKET|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("socketpair: %v", err)
+	}
+	ours, theirs := os.NewFile(uintptr(fds[0]), "helper"), os.NewFile(uintptr(fds[1]), "helper")
+	defer theirs.Close()
+
+	cmd := exec.Command("/proc/self/exe", s.opts.HelperArgs...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = []*os.File{theirs} // fd 3
+	// The helper exits when it reads EOF from the socket pair, which happens
+	// however we exit.  Pdeathsig would fire when the thread that started it
+	// exits (golang/go#27505), and pinThread makes threads exit.
+	cmd.SysProcAttr = &syscall.SysProcAttr{}
+	if s.opts.KeepNetCaps {
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{uint32(gid)}}
+		cmd.SysProcAttr.AmbientCaps = []uintptr{capNetRaw, capNetAdmin}
+	}
+	if err := cmd.Start(); err != nil {
+		ours.Close()
+		return nil, err
+	}
+	go func() {
+		s.log.Printf("privileged helper exited: %v", cmd.Wait())
+	}()
+	fc, err := net.FileConn(ours)
+	ours.Close()
+	if err != nil {
+		return nil, err
+	}
+	return &helper{c: fc.(*net.UnixConn)}, nil
+}
+
+// call sends a request to the privileged helper and waits for its response,
+// returning the file descriptors it passed back, if any.
+func (h *helper) call(req helperRequest) ([]int, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	msg, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := h.c.Write(msg); err != nil {
+		return nil, fmt.Errorf("writing to privileged helper: %v", err)
+	}
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4*scmMaxFD))
+	n, oobn, _, _, err := h.c.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return nil, fmt.Errorf("reading from privileged helper: %v", err)
+	}
+	var fds []int
+	if oobn > 0 {
+		msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil || len(msgs) != 1 {
+			return nil, fmt.Errorf("could not parse privileged helper control message: %v", err)
+		}
+		if fds, err = syscall.ParseUnixRights(&msgs[0]); err != nil {
+			return nil, fmt.Errorf("could not parse privileged helper file descriptors: %v", err)
+		}
+	}
+	var resp helperResponse
+	if err := json.Unmarshal(buf[:n], &resp); err != nil {
+		closeAll(fds)
+		return nil, fmt.Errorf("could not parse privileged helper response: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return fds, nil
+}
+
+// callOne is call for requests answered with a single file descriptor.
+func (h *helper) callOne(req helperRequest) (int, error) {
+	fds, err := h.call(req)
+	if err != nil {
+		return -1, err
+	} else if len(fds) != 1 {
+		closeAll(fds)
+		return -1, fmt.Errorf("privileged helper returned %d file descriptors, want 1", len(fds))
+	}
+	return fds[0], nil
+}
+
+// closeAll closes file descriptors.
+func closeAll(fds []int) {
+	for _, fd := range fds {
+		syscall.Close(fd)
+	}
+}
+
+func (h *helper) afPacket(sc SocketConfig, fanoutID, num int) (int, error) {
+	return h.callOne(helperRequest{Op: "afpacket", Config: sc, FanoutID: fanoutID, Num: num})
+}
+
+func (h *helper) afXDP(sc SocketConfig) ([]int, error) {
+	fds, err := h.call(helperRequest{Op: "afxdp", Config: sc})
+	if err == nil && len(fds) != 2+sc.FanoutSize {
+		closeAll(fds)
+		return nil, fmt.Errorf("privileged helper returned %d file descriptors, want %d", len(fds), 2+sc.FanoutSize)
+	}
+	return fds, err
+}
+
+func (h *helper) txPacket(sc SocketConfig) (int, error) {
+	return h.callOne(helperRequest{Op: "txpacket", Config: sc})
+}
+
+func (h *helper) listenUnix(sc SocketConfig) (*net.UnixListener, error) {
+	fd, err := h.callOne(helperRequest{Op: "listen", Config: sc})
+	if err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(fd), sc.SocketName)
+	defer f.Close()
+	list, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	return list.(*net.UnixListener), nil
+}
+
+func (h *helper) remove(socketName string) error {
+	fds, err := h.call(helperRequest{Op: "remove", Config: SocketConfig{SocketName: socketName}})
+	closeAll(fds)
+	return err
+}
+
+// RunPrivilegedHelper runs the privileged helper, serving requests from the
+// server over conn until the server closes it, which it does by exiting.  The
+// helper only ever creates sockets and removes socket files on the server's
+// behalf, and only for the sockets in the configuration load returns, which
+// it reads itself rather than trusting the server with it.  Only the Logger
+// and Verbosity options are used.
+func RunPrivilegedHelper(conn *os.File, opts Options, load func() (Testimony, error)) error {
+	if opts.Logger == nil {
+		opts.Logger = stdLogger{}
+	}
+	d := direct{log: &vlog.Logger{Printer: opts.Logger, Verbose: opts.Verbosity}}
+	configs := &helperConfigs{load: load, names: map[string]bool{}}
+	if err := configs.reload(); err != nil {
+		return fmt.Errorf("privileged helper could not load configuration: %v", err)
+	}
+	fc, err := net.FileConn(conn)
+	if err != nil {
+		return fmt.Errorf("privileged helper could not use connection: %v", err)
+	}
+	c := fc.(*net.UnixConn)
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := c.Read(buf)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("privileged helper read failed: %v", err)
+		}
+		var req helperRequest
+		var resp helperResponse
+		var files []*os.File
+		if err := json.Unmarshal(buf[:n], &req); err != nil {
+			resp.Error = fmt.Sprintf("could not parse request: %v", err)
+		} else if files, err = req.handle(d, configs); err != nil {
+			resp.Error = err.Error()
+		}
+		d.log.V(1, "privileged helper handled %v %q: %q", req.Op, req.Config.SocketName, resp.Error)
+		msg, err := json.Marshal(resp)
+		if err != nil {
+			return fmt.Errorf("privileged helper could not encode response: %v", err)
+		}
+		var oob []byte
+		if len(files) > 0 {
+			var fds []int
+			for _, f := range files {
+				fds = append(fds, int(f.Fd()))
+			}
+			oob = syscall.UnixRights(fds...)
+		}
+		_, _, err = c.WriteMsgUnix(msg, oob, nil)
+		for _, f := range files {
+			f.Close()
+		}
+		if err != nil {
+			return fmt.Errorf("privileged helper write failed: %v", err)
+		}
+	}
+}
+
+// handle performs a single privileged helper request, returning the files to
+// pass back to the daemon, if any.  Sockets are created from the helper's own
+// copy of the request's config.
+func (req helperRequest) handle(d direct, configs *helperConfigs) ([]*os.File, error) {
+	switch req.Op {
+	case "afpacket":
+		sc, err := configs.lookup(req.Config, true)
+		if err != nil {
+			return nil, err
+		}
+		if req.Num < 0 || req.Num >= sc.FanoutSize {
+			return nil, fmt.Errorf("socket %q has no fanout index %d", sc.SocketName, req.Num)
+		} else if sc.FanoutID != 0 && req.FanoutID != sc.FanoutID {
+			return nil, fmt.Errorf("socket %q has FanoutID %d, not %d", sc.SocketName, sc.FanoutID, req.FanoutID)
+		}
+		fd, err := openAFPacket(sc, req.FanoutID, req.Num)
+		if err != nil {
+			return nil, err
+		}
+		return []*os.File{os.NewFile(uintptr(fd), sc.SocketName)}, nil
+	case "afxdp":
+		sc, err := configs.lookup(req.Config, false)
+		if err != nil {
+			return nil, err
+		}
+		fds, err := openAFXDP(sc)
+		if err != nil {
+			return nil, err
+		}
+		var files []*os.File
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), sc.SocketName))
+		}
+		return files, nil
+	case "txpacket":
+		sc, err := configs.lookup(req.Config, false)
+		if err != nil {
+			return nil, err
+		} else if !sc.TxRing {
+			return nil, fmt.Errorf("socket %q doesn't have TxRing set", sc.SocketName)
+		}
+		fd, err := openTxPacket(sc)
+		if err != nil {
+			return nil, err
+		}
+		return []*os.File{os.NewFile(uintptr(fd), sc.SocketName)}, nil
+	case "listen":
+		sc, err := configs.lookup(req.Config, false)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkSocketFile(sc.SocketName); err != nil {
+			return nil, err
+		}
+		list, err := d.listenUnix(sc)
+		if err != nil {
+			return nil, err
+		}
+		// The daemon owns the socket file now, and asks us to remove it.
+		list.SetUnlinkOnClose(false)
+		defer list.Close()
+		f, err := list.File()
+		if err != nil {
+			return nil, err
+		}
+		return []*os.File{f}, nil
+	case "remove":
+		// Sockets dropped from the configuration are removed after it's
+		// reloaded, so any name the helper has loaded may be removed.
+		if !configs.names[req.Config.SocketName] {
+			if err := configs.reload(); err != nil {
+				return nil, fmt.Errorf("could not reload configuration: %v", err)
+			} else if !configs.names[req.Config.SocketName] {
+				return nil, fmt.Errorf("socket %q is not in the configuration", req.Config.SocketName)
+			}
+		}
+		if err := checkSocketFile(req.Config.SocketName); err != nil {
+			return nil, err
+		}
+		return nil, d.remove(req.Config.SocketName)
+	}
+	return nil, fmt.Errorf("unknown request %q", req.Op)
+}
+
+// helperConfigs are the sockets the privileged helper may create sockets for:
+// those in the configuration it loads itself.  A compromised daemon could
+// otherwise ask it for an unfiltered socket on any interface, or to own or
+// remove any path.
+type helperConfigs struct {
+	load  func() (Testimony, error)
+	conf  Testimony       // expanded, as the daemon serves it
+	names map[string]bool // every SocketName ever loaded
+}
+
+// reload reads the configuration again.
+func (h *helperConfigs) reload() error {
+	t, err := h.load()
+	if err != nil {
+		return err
+	}
+	if t, err = t.prepare(); err != nil {
+		return err
+	}
+	h.conf = t
+	for _, sc := range t {
+		h.names[sc.SocketName] = true
+	}
+	return nil
+}
+
+// lookup returns the helper's config for the socket the daemon asked about,
+// which must be identical to it:  either one of the configured sockets or,
+// with member set, one of their members.  If none is, the configuration is
+// reloaded once, as the daemon may have been reloaded since it was read.
+func (h *helperConfigs) lookup(want SocketConfig, member bool) (SocketConfig, error) {
+	wantStr := want.String()
+	for tries := 0; tries < 2; tries++ {
+		if tries > 0 {
+			if err := h.reload(); err != nil {
+				return SocketConfig{}, fmt.Errorf("could not reload configuration: %v", err)
+			}
+		}
+		for _, sc := range h.conf {
+			if sc.SocketName != want.SocketName {
+				continue
+			}
+			candidates := []SocketConfig{sc}
+			if member {
+				candidates = nil
+				for _, iface := range sc.interfaces() {
+					candidates = append(candidates, sc.member(iface))
+				}
+			}
+			for _, c := range candidates {
+				if c.String() == wantStr {
+					return c, nil
+				}
+			}
+		}
+	}
+	return SocketConfig{}, fmt.Errorf("socket %q is not configured as requested", want.SocketName)
+}
+
+// checkSocketFile returns an error if name exists and isn't a socket, so the
+// privileged helper can't be used to remove arbitrary files.
+func checkSocketFile(name string) error {
+	fi, err := os.Lstat(name)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	} else if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%q exists and is not a socket", name)
+	}
+	return nil
+}
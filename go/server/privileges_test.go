@@ -0,0 +1,102 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import "testing"
+
+func TestHelperConfigsLookup(t *testing.T) {
+	filtered := SocketConfig{SocketName: "/tmp/a.sock", Interface: "lo", FanoutSize: 1, Filter: "tcp port 80"}
+	multi := SocketConfig{SocketName: "/tmp/b.sock", Interfaces: []string{"lo", "eth9"}, FanoutSize: 1}
+	conf := Testimony{filtered, multi}
+	loads := 0
+	h := &helperConfigs{
+		load:  func() (Testimony, error) { loads++; return conf, nil },
+		names: map[string]bool{},
+	}
+	if err := h.reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	unfiltered := filtered
+	unfiltered.Filter = ""
+	otherIface := filtered
+	otherIface.Interface = "eth0"
+	for _, test := range []struct {
+		desc   string
+		want   SocketConfig
+		member bool
+		ok     bool
+	}{
+		{"as configured", filtered, false, true},
+		{"member as configured", filtered, true, true},
+		{"member of Interfaces", multi.member("eth9"), true, true},
+		{"whole socket as a member", multi, true, false},
+		{"member as a whole socket", multi.member("lo"), false, false},
+		{"filter removed", unfiltered, false, false},
+		{"other interface", otherIface, true, false},
+		{"unknown socket", SocketConfig{SocketName: "/etc/passwd"}, false, false},
+	} {
+		got, err := h.lookup(test.want, test.member)
+		if (err == nil) != test.ok {
+			t.Errorf("%s: lookup(%v) error %v, want ok %v", test.desc, test.want, err, test.ok)
+		} else if err == nil && got.String() != test.want.String() {
+			t.Errorf("%s: lookup(%v) = %v", test.desc, test.want, got)
+		}
+	}
+
+	// A socket added to the configuration since it was loaded is found once
+	// it's reloaded, and names stay known after they're removed from it.
+	added := SocketConfig{SocketName: "/tmp/c.sock", Interface: "lo", FanoutSize: 1}
+	conf = Testimony{added}
+	before := loads
+	if _, err := h.lookup(added, false); err != nil {
+		t.Errorf("lookup of added socket: %v", err)
+	}
+	if loads != before+1 {
+		t.Errorf("lookup of added socket loaded the config %d times, want 1", loads-before)
+	}
+	for _, name := range []string{"/tmp/a.sock", "/tmp/c.sock"} {
+		if !h.names[name] {
+			t.Errorf("%q is not a known name", name)
+		}
+	}
+}
+
+func TestCheckHelper(t *testing.T) {
+	ebpf := SocketConfig{SocketName: "/tmp/a.sock", FanoutType: FanoutEBPF}
+	xdp := SocketConfig{SocketName: "/tmp/b.sock", Backend: BackendAFXDP}
+	cbpf := SocketConfig{SocketName: "/tmp/c.sock", FanoutType: FanoutCBPF}
+	for _, test := range []struct {
+		conf Testimony
+		opts Options
+		err  string
+	}{
+		{Testimony{ebpf, xdp, cbpf}, Options{}, ""},
+		{Testimony{ebpf, xdp, cbpf}, Options{RunAs: "nobody"}, ""},
+		{Testimony{cbpf}, Options{RunAs: "nobody", KeepNetCaps: true}, ""},
+		{Testimony{cbpf, ebpf}, Options{RunAs: "nobody", KeepNetCaps: true},
+			`socket "/tmp/a.sock": FanoutType ebpf can't be used with KeepNetCaps, as the privileged helper can't load eBPF programs`},
+		{Testimony{cbpf, xdp}, Options{RunAs: "nobody", KeepNetCaps: true},
+			`socket "/tmp/b.sock": Backend afxdp can't be used with KeepNetCaps, as the privileged helper can't load XDP programs`},
+	} {
+		err := test.conf.checkHelper(test.opts)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("checkHelper(%+v): %v", test.opts, err)
+		case test.err != "" && (err == nil || err.Error() != test.err):
+			t.Errorf("checkHelper(%+v) error %v, want %q", test.opts, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,921 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package server implements testimonyd:  it sets up AF_PACKET sockets and
+// serves them to clients over UNIX sockets.  It can be embedded in other
+// programs; the testimonyd binary is a thin wrapper around it.
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/user"
+	"reflect"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/testimony/go/internal/netlink"
+	"github.com/google/testimony/go/internal/systemd"
+	"github.com/google/testimony/go/internal/vlog"
+	"github.com/google/testimony/go/protocol"
+)
+
+// #include <grp.h>
+// #include <stdlib.h>
+import "C"
+
+// Testimony is the configuration parsed from the config file.
+type Testimony []SocketConfig
+
+const protocolVersion = 2
+
+// SocketConfig defines how an individual socket should be set up.
+type SocketConfig struct {
+	SocketName         string        // filename for the socket
+	Interface          string        // interface to sniff packets on
+	Interfaces         []string      // interfaces to sniff packets on, instead of Interface, served as one
+	BlockSize          int           // block size (in bytes) of a single packet block
+	NumBlocks          int           // number of packet blocks in the memory region
+	BlockTimeoutMillis int           // timeout for filling up a single block
+	FanoutType         FanoutType    // which type of fanout to use (see linux/if_packet.h)
+	FanoutFlags        FanoutFlags   // flags to add to the fanout type
+	FanoutSize         int           // number of threads to fan out to
+	FanoutID           int           // fanout id to avoid conflicts, 0 to have the kernel pick one
+	FanoutProgram      string        // cBPF program text for FanoutCBPF, eBPF program path for FanoutEBPF
+	Timestamping       Timestamping  // where packet timestamps come from
+	Promiscuous        bool          // put Interface in promiscuous mode while the socket's open
+	RxHash             bool          // have the kernel fill in each packet's receive hash
+	TxRing             bool          // let clients transmit through a TX_RING
+	TxFrameSize        int           // largest frame clients may transmit
+	TxNumFrames        int           // number of frames each client may have in flight
+	TxRateLimit        int           // frames per second the socket may transmit, 0 for no limit
+	TxFilter           string        // BPF filter frames must match to be transmitted
+	User, Group        string        // user/group to provide the socket to (will chown it)
+	Filter             string        // BPF filter to apply to this socket
+	FilterProgram      FilterProgram // hand-written BPF program to apply instead of Filter
+	SnapLen            int           // most bytes of each packet to capture, 0 for all
+	Direction          Direction     // whether to capture packets the host receives, sends, or both
+	CPUs               []int         // CPU to pin each fanout index to, and allocate its ring near
+	NUMANode           *int          // NUMA node to pin all fanout indexes to and allocate rings on
+	Backend            Backend       // how packets are captured:  AF_PACKET or AF_XDP
+	XDPGeneric         bool          // attach the AF_XDP backend's XDP program in generic (skb) mode
+}
+
+// String returns the config as it would be written in a config file.
+func (s SocketConfig) String() string {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Sprintf("<%v>", err)
+	}
+	return string(data)
+}
+
+func (s SocketConfig) uid() (int, error) {
+	return lookupUID(s.User)
+}
+
+func (s SocketConfig) gid() (int, error) {
+	return lookupGID(s.Group)
+}
+
+// lookupUID returns the uid of the named user, or of the current user if name
+// is empty.
+func lookupUID(name string) (int, error) {
+	var u *user.User
+	var err error
+	if name == "" {
+		u, err = user.Current()
+	} else {
+		u, err = user.Lookup(name)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("could not get user: %v", err)
+	}
+	return strconv.Atoi(u.Uid)
+}
+
+// lookupGID returns the gid of the named group, or 0 if name is empty.
+func lookupGID(name string) (int, error) {
+	// Sadly, at present Go doesn't have group functions to match its os/user
+	// functions... so we jump down into C.
+	if name == "" {
+		return 0, nil
+	}
+	groupName := C.CString(name)
+	defer C.free(unsafe.Pointer(groupName))
+	var buf [2048]byte
+	var grp C.struct_group
+	var grpPtr *C.struct_group
+	if _, err := C.getgrnam_r(groupName, &grp, (*C.char)(unsafe.Pointer(&buf[0])), C.size_t(len(buf)), &grpPtr); err != nil {
+		return -1, err
+	} else if grpPtr == nil {
+		return -1, fmt.Errorf("group %q not found", name)
+	}
+	return int(grpPtr.gr_gid), nil
+}
+
+// Logger is where a Server sends its log messages.  *log.Logger implements it.
+type Logger interface {
+	Printf(format string, args ...interface{})
+}
+
+// stdLogger logs through the standard log package.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, args ...interface{}) {
+	log.Printf(format, args...)
+}
+
+// Options control how a Server runs.  The zero value is usable.
+type Options struct {
+	// Logger receives all log messages.  Defaults to the standard log package.
+	Logger Logger
+	// Verbosity enables more detailed logging; higher logs more.
+	Verbosity int
+	// ShutdownGrace is how long to wait for clients to return their blocks
+	// when a socket shuts down.  Defaults to 5 seconds.
+	ShutdownGrace time.Duration
+	// RunAs is the user[:group] to switch to once Start has set up all
+	// sockets.  Sockets created later are created by a privileged helper,
+	// a copy of this binary run with HelperArgs, which must call
+	// RunPrivilegedHelper.
+	RunAs string
+	// KeepNetCaps runs the privileged helper as the RunAs user with only
+	// CAP_NET_RAW and CAP_NET_ADMIN, rather than as root.  Sockets with
+	// FanoutType ebpf or Backend afxdp can't be used with it.
+	KeepNetCaps bool
+	// HelperArgs are the arguments to run the privileged helper with.
+	// Defaults to -privileged_helper followed by this process's arguments.
+	HelperArgs []string
+	// Systemd enables readiness and watchdog notifications to systemd, and
+	// serving on sockets passed in by systemd socket activation.
+	Systemd bool
+}
+
+// Server serves the sockets in a Testimony configuration.
+type Server struct {
+	conf       Testimony
+	opts       Options
+	log        *vlog.Logger
+	privileged opener               // see dropPrivileges
+	activated  map[string]*os.File  // see activatedListener
+	running    map[string]*listener // keyed by socket name, owned by run
+	links      *netlink.LinkMonitor // nil if interfaces can't be watched
+	linkUp     map[string]bool      // link state of interfaces in use, owned by run
+	poller     *blockPoller         // wakes sockets when they have new blocks
+	reload     chan reloadRequest
+	failed     chan error // receives the first fatal error, see fail
+	stop       chan struct{}
+	stopOnce   sync.Once
+	done       chan struct{} // closed once the server has stopped
+	err        error         // why the server stopped, valid once done is closed
+
+	mu      sync.Mutex
+	started bool
+}
+
+type reloadRequest struct {
+	conf Testimony
+	err  chan error
+}
+
+// New returns a Server for the given configuration.  It does nothing until
+// Start is called.
+func New(t Testimony, opts Options) *Server {
+	if opts.Logger == nil {
+		opts.Logger = stdLogger{}
+	}
+	if opts.ShutdownGrace == 0 {
+		opts.ShutdownGrace = 5 * time.Second
+	}
+	if opts.HelperArgs == nil {
+		opts.HelperArgs = append([]string{"-" + HelperFlag}, os.Args[1:]...)
+	}
+	lg := &vlog.Logger{Printer: opts.Logger, Verbose: opts.Verbosity}
+	return &Server{
+		conf:       t,
+		opts:       opts,
+		log:        lg,
+		privileged: direct{log: lg},
+		running:    map[string]*listener{},
+		linkUp:     map[string]bool{},
+		reload:     make(chan reloadRequest),
+		failed:     make(chan error, 1),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Start sets up all configured sockets, drops privileges if requested, then
+// serves the sockets in the background until ctx is done, Close is called, or
+// the server fails.  If any socket can't be set up, Start tears down the ones
+// that were and returns an error.
+func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.started {
+		return errors.New("server already started")
+	}
+	s.started = true
+	if err := s.start(); err != nil {
+		s.shutdown()
+		s.err = err
+		close(s.done)
+		return err
+	}
+	go s.run(ctx)
+	return nil
+}
+
+func (s *Server) start() error {
+	t, err := s.conf.prepare()
+	if err == nil {
+		err = t.checkHelper(s.opts)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	// Watch for interface changes before setting up sockets, so none are
+	// missed.
+	if s.links, err = netlink.ListenLinks(); err != nil {
+		s.log.Printf("not watching for interface changes: %v", err)
+	}
+	if s.poller, err = newBlockPoller(s); err != nil {
+		return fmt.Errorf("could not watch for new blocks: %v", err)
+	}
+	if s.opts.Systemd {
+		if s.activated, err = systemd.Listeners(); err != nil {
+			return fmt.Errorf("socket activation failed: %v", err)
+		} else if len(s.activated) > 0 {
+			s.log.Printf("Received %d sockets from socket activation", len(s.activated))
+		}
+	}
+	if err := s.update(t); err != nil {
+		return fmt.Errorf("invalid config: %v", err)
+	}
+	// Everything that needs privileges from here on goes through the
+	// privileged helper, if we're dropping them.
+	if err := s.dropPrivileges(); err != nil {
+		return fmt.Errorf("failed to drop privileges: %v", err)
+	}
+	return nil
+}
+
+// Reload replaces the running configuration with t.  Sockets which have been
+// removed or changed are torn down, new or changed ones are created, and
+// sockets whose SocketConfig is unchanged keep their AF_PACKET sockets and
+// connected clients untouched.  If t is invalid, the running configuration is
+// kept.  If some sockets can't be set up, the rest are, and an error is
+// returned.
+func (s *Server) Reload(t Testimony) error {
+	s.mu.Lock()
+	started := s.started
+	s.mu.Unlock()
+	if !started {
+		return errors.New("server not started")
+	}
+	req := reloadRequest{conf: t, err: make(chan error, 1)}
+	select {
+	case s.reload <- req:
+	case <-s.done:
+		return errors.New("server stopped")
+	}
+	return <-req.err
+}
+
+// Close shuts down all sockets and waits for the server to stop.  Clients
+// are told their sockets are going away, and given up to ShutdownGrace to
+// return their blocks.  It returns the same error as Wait.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if !s.started {
+		// Nothing to shut down.
+		s.started = true
+		close(s.done)
+	}
+	s.mu.Unlock()
+	s.stopOnce.Do(func() { close(s.stop) })
+	return s.Wait()
+}
+
+// Wait waits for a started server to stop.  It returns nil if the server was
+// stopped by Close or its context, or the error that stopped it otherwise.
+func (s *Server) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// fail stops the server with the given error.  Only the first error is kept.
+func (s *Server) fail(err error) {
+	select {
+	case s.failed <- err:
+	default:
+	}
+}
+
+// run serves the running sockets until the server is stopped.
+func (s *Server) run(ctx context.Context) {
+	defer close(s.done)
+	s.notify(fmt.Sprintf("READY=1\nSTATUS=Serving %d sockets", len(s.running)))
+
+	// If systemd's watchdog is enabled, ping it as long as every socket is
+	// still watching for new blocks.
+	var watchdog <-chan time.Time
+	maxAge := 2 * time.Second
+	if interval := systemd.WatchdogInterval(); s.opts.Systemd && interval > 0 {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		watchdog = ticker.C
+		if interval/2 > maxAge {
+			maxAge = interval / 2
+		}
+	}
+	var links <-chan []netlink.LinkEvent
+	if s.links != nil {
+		links = s.watchLinks(s.links)
+	}
+	for {
+		select {
+		case evs, ok := <-links:
+			if !ok {
+				links = nil
+				continue
+			}
+			s.linkEvents(evs)
+		case req := <-s.reload:
+			s.log.Printf("Reloading configuration")
+			s.notify("RELOADING=1")
+			t, err := req.conf.prepare()
+			if err == nil {
+				err = t.checkHelper(s.opts)
+			}
+			if err != nil {
+				err = fmt.Errorf("invalid config, keeping the current one: %v", err)
+			} else if err = s.update(t); err != nil {
+				err = fmt.Errorf("reload incomplete: %v", err)
+			}
+			req.err <- err
+			s.notify(fmt.Sprintf("READY=1\nSTATUS=Serving %d sockets", len(s.running)))
+		case <-watchdog:
+			if err := s.healthy(maxAge); err != nil {
+				s.log.Printf("not pinging watchdog: %v", err)
+				continue
+			}
+			s.notify("WATCHDOG=1")
+		case err := <-s.failed:
+			s.log.Printf("Server failed: %v", err)
+			s.err = err
+			s.shutdown()
+			return
+		case <-ctx.Done():
+			s.shutdown()
+			return
+		case <-s.stop:
+			s.shutdown()
+			return
+		}
+	}
+}
+
+// shutdown stops watching interfaces and closes all running listeners in
+// parallel.
+func (s *Server) shutdown() {
+	if s.links != nil {
+		s.links.Close()
+	}
+	s.log.Printf("Shutting down %d sockets", len(s.running))
+	s.notify("STOPPING=1")
+	var ls []*listener
+	for _, l := range s.running {
+		ls = append(ls, l)
+	}
+	closeListeners(ls, protocol.TypeShuttingDown)
+	if s.poller != nil {
+		s.poller.close()
+	}
+	s.log.Printf("Shutdown complete")
+}
+
+// notify sends a state change to systemd, if enabled, logging any failure.
+func (s *Server) notify(state string) {
+	if !s.opts.Systemd {
+		return
+	}
+	if err := systemd.Notify(state); err != nil {
+		s.log.Printf("systemd notification failed: %v", err)
+	}
+}
+
+// healthy returns an error if any socket's getNewBlocks loop has been stuck
+// for more than maxAge.
+func (s *Server) healthy(maxAge time.Duration) error {
+	for _, l := range s.running {
+		for _, sock := range l.socks {
+			if err := sock.healthy(maxAge); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// prepare expands interface patterns in t, then validates the result.
+func (t Testimony) prepare() (Testimony, error) {
+	t, err := t.expand()
+	if err != nil {
+		return nil, err
+	}
+	return t, t.validate()
+}
+
+// validate checks the configuration for problems that span sockets, like
+// duplicate socket names or fanout IDs.
+func (t Testimony) validate() error {
+	names := map[string]bool{}
+	ids := map[int]bool{}
+	xdp := map[string]string{} // interfaces with an XDP program, to socket name
+	for _, sc := range t {
+		if names[sc.SocketName] {
+			return fmt.Errorf("duplicate socket name %q", sc.SocketName)
+		}
+		names[sc.SocketName] = true
+		if sc.FanoutID < 0 {
+			return fmt.Errorf("%d is not a valid FanoutID", sc.FanoutID)
+		}
+		if ids[sc.FanoutID] {
+			return fmt.Errorf("duplicate FanoutID %d", sc.FanoutID)
+		}
+		if sc.FanoutID > 0 {
+			ids[sc.FanoutID] = true
+		}
+		if sc.Backend == BackendAFXDP {
+			// An interface only runs one XDP program.
+			if other, ok := xdp[sc.Interface]; ok {
+				return fmt.Errorf("sockets %q and %q both use the afxdp Backend on %q", other, sc.SocketName, sc.Interface)
+			}
+			xdp[sc.Interface] = sc.SocketName
+		}
+	}
+	return nil
+}
+
+// update brings the set of running listeners in line with t.  Listeners that
+// are no longer configured, or whose config changed, are torn down first, in
+// parallel, then new listeners are created for everything not already
+// running.  Failures to create a listener don't stop the others from being
+// created, but are reported in the returned error.
+func (s *Server) update(t Testimony) error {
+	want := map[string]SocketConfig{}
+	for _, sc := range t {
+		want[sc.SocketName] = sc
+	}
+	var removed []*listener
+	for name, l := range s.running {
+		if sc, ok := want[name]; ok && reflect.DeepEqual(sc, l.conf) {
+			continue
+		}
+		s.log.Printf("Removing socket %q", name)
+		removed = append(removed, l)
+		delete(s.running, name)
+	}
+	closeListeners(removed, protocol.TypeShuttingDown)
+	// Kernel-assigned fanout IDs don't clash with anything, but configured
+	// ones may clash with IDs the kernel already gave running sockets.  A
+	// configured FanoutID is never 0, though the kernel may give that out.
+	keptIDs := map[int]string{}
+	for name, l := range s.running {
+		for _, id := range l.fanoutIDs {
+			if id != 0 {
+				keptIDs[id] = name
+			}
+		}
+	}
+	var failed []string
+	for _, sc := range t {
+		if s.running[sc.SocketName] != nil {
+			continue
+		}
+		if name, ok := keptIDs[sc.FanoutID]; ok {
+			s.log.Printf("invalid config %+v: FanoutID %d already in use by %q", sc, sc.FanoutID, name)
+			failed = append(failed, sc.SocketName)
+			continue
+		}
+		l, err := s.newListener(sc)
+		if err != nil {
+			s.log.Printf("invalid config %+v: %v", sc, err)
+			failed = append(failed, sc.SocketName)
+			continue
+		}
+		s.running[sc.SocketName] = l
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to set up sockets %q", failed)
+	}
+	return nil
+}
+
+// listener serves a single SocketConfig:  the UNIX socket clients connect to,
+// and the FanoutSize AF_PACKET sockets handed out over it.
+type listener struct {
+	srv       *Server
+	conf      SocketConfig
+	fanoutIDs []int // fanout group ID per interface, which the kernel picks (maybe 0) if conf.FanoutID is 0
+	ifindexes []int // index of each interface when set up, nil while waiting for them
+	list      *net.UnixListener
+	socks     []*socket
+	tx        *txRing       // TX_RING shared by socks, if conf.TxRing is set
+	xdp       *xdpSockets   // AF_XDP capture socks read from, if conf.Backend is afxdp
+	done      chan struct{} // closed when the listener is torn down
+	activated bool          // list came from systemd socket activation
+}
+
+// newListener sets up FanoutSize AF_PACKET sockets for the given config, then
+// starts serving them on the config's UNIX socket.  If one of the config's
+// interfaces doesn't exist, it returns a listener that's waiting for it
+// instead.
+func (s *Server) newListener(sc SocketConfig) (*listener, error) {
+	l := s.waitingListener(sc)
+	var indexes []int
+	for _, name := range sc.interfaces() {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			s.log.Printf("Socket %q waiting for interface %q: %v", sc.SocketName, name, err)
+			return l, nil
+		}
+		indexes = append(indexes, iface.Index)
+	}
+	l.ifindexes = indexes
+	var err error
+	if sc.TxRing {
+		if l.tx, err = s.newTxRing(sc); err != nil {
+			return nil, err
+		}
+	}
+	if sc.Backend == BackendAFXDP {
+		if err := sc.checkXDP(); err != nil {
+			return nil, err
+		}
+		if l.xdp, err = s.newXDPSockets(sc); err != nil {
+			return nil, err
+		}
+	}
+	// Set up FanoutSize sockets and start goroutines to manage each.
+	for i := 0; i < sc.FanoutSize; i++ {
+		sock, err := s.newSocket(sc, l.fanoutIDs, i, l.xdp)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		sock.tx = l.tx
+		l.socks = append(l.socks, sock)
+		go sock.run()
+		// The first socket creates the fanout groups, one per interface, so
+		// the rest join the groups it got.  AF_XDP sockets don't fan out.
+		if i > 0 || sc.FanoutSize == 1 || sc.FanoutID != 0 || l.xdp != nil {
+			continue
+		}
+		for j, m := range sock.members {
+			if l.fanoutIDs[j], err = fanoutGroupID(m.fd); err != nil {
+				l.close()
+				return nil, fmt.Errorf("could not get fanout ID: %v", err)
+			}
+			s.log.Printf("Socket %q got fanout ID %d on %q", sc.SocketName, l.fanoutIDs[j], m.iface)
+		}
+	}
+
+	// Set up UNIX socket to serve these AF_PACKET sockets on, and start
+	// goroutine to manage its connections.  If systemd passed us a socket for
+	// this name, use it rather than creating our own.
+	var list *net.UnixListener
+	if f := s.activated[sc.SocketName]; f != nil {
+		l.activated = true
+		list, err = s.activatedListener(f)
+	} else {
+		list, err = s.privileged.listenUnix(sc)
+	}
+	if err != nil {
+		l.close()
+		return nil, err
+	}
+	l.list = list
+	go l.run()
+	if sc.Promiscuous {
+		l.logPromiscuous()
+	}
+	return l, nil
+}
+
+// waitingListener returns a listener for sc that's waiting for its interfaces
+// to exist.  It serves nothing until relink replaces it.
+func (s *Server) waitingListener(sc SocketConfig) *listener {
+	l := &listener{
+		srv:  s,
+		conf: sc,
+		done: make(chan struct{}),
+	}
+	for range sc.interfaces() {
+		l.fanoutIDs = append(l.fanoutIDs, sc.FanoutID)
+	}
+	return l
+}
+
+// activatedListener returns a new listener on a socket passed to us by systemd.
+// Activated sockets are kept in s.activated, keyed by socket name, for the
+// life of the server, so a listener torn down by a reload can be rebuilt on
+// the same socket.  The listener gets its own copy of the file descriptor, so
+// closing it leaves the original open.  Ownership and permissions are left as
+// systemd set them.
+func (s *Server) activatedListener(f *os.File) (*net.UnixListener, error) {
+	list, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use activated socket %q: %v", f.Name(), err)
+	}
+	ul, ok := list.(*net.UnixListener)
+	if !ok {
+		list.Close()
+		return nil, fmt.Errorf("activated socket %q is not a UNIX socket", f.Name())
+	}
+	s.log.Printf("Using activated socket %q", f.Name())
+	return ul, nil
+}
+
+// listenUnix creates the UNIX socket for sc, replacing any stale socket file,
+// and gives it sc's ownership.
+func (d direct) listenUnix(sc SocketConfig) (*net.UnixListener, error) {
+	_ignore_error_ := os.Remove(sc.SocketName)
+	_ = _ignore_error_
+	list, err := net.ListenUnix("unix", &net.UnixAddr{Net: "unix", Name: sc.SocketName})
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on socket: %v", err)
+	}
+	if err := d.setPermissions(sc); err != nil {
+		list.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %v", err)
+	}
+	return list, nil
+}
+
+// close stops accepting new connections and removes the socket file (unless
+// systemd owns it), then shuts down all AF_PACKET sockets.  Their clients are
+// told the sockets are going away, and given a chance to return their blocks
+// before being disconnected.
+func (l *listener) close() {
+	l.closeWith(protocol.TypeShuttingDown)
+}
+
+// closeListeners closes listeners in parallel, telling their clients why with
+// the given TLV type, so each one's clients get the whole ShutdownGrace to
+// return their blocks without holding up the rest.
+func closeListeners(ls []*listener, msg protocol.Type) {
+	var wg sync.WaitGroup
+	for _, l := range ls {
+		wg.Add(1)
+		go func(l *listener) {
+			defer wg.Done()
+			l.closeWith(msg)
+		}(l)
+	}
+	wg.Wait()
+}
+
+// closeWith is close, but tells clients why with the given TLV type.
+func (l *listener) closeWith(msg protocol.Type) {
+	close(l.done)
+	if l.list != nil {
+		l.list.Close()
+		// Activated sockets belong to systemd, which keeps listening on them.
+		if !l.activated {
+			if err := l.srv.privileged.remove(l.conf.SocketName); err != nil {
+				l.srv.log.Printf("failed to remove socket file %q: %v", l.conf.SocketName, err)
+			}
+		}
+	}
+	for _, s := range l.socks {
+		s.closeMsg = msg
+		close(s.done)
+	}
+	for _, s := range l.socks {
+		<-s.stopped
+	}
+	if l.tx != nil {
+		l.tx.close()
+	}
+	if l.xdp != nil {
+		l.xdp.close()
+	}
+	if l.conf.Promiscuous && len(l.socks) > 0 {
+		l.logPromiscuous()
+	}
+}
+
+func (d direct) setPermissions(sc SocketConfig) error {
+	uid, err := sc.uid()
+	if err != nil {
+		return fmt.Errorf("could not get uid to change to: %v", err)
+	}
+	gid, err := sc.gid()
+	if err != nil {
+		return fmt.Errorf("could not get gid to change to: %v", err)
+	}
+	d.log.V(1, "chowning %q to %d/%d", sc.SocketName, uid, gid)
+	if err := syscall.Chown(sc.SocketName, uid, gid); err != nil {
+		return fmt.Errorf("unable to chown to (%d, 0): %v", uid, err)
+	}
+	return nil
+}
+
+func (l *listener) run() {
+	for {
+		c, err := l.list.AcceptUnix()
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			default:
+			}
+			l.srv.fail(fmt.Errorf("%q failed to accept connection: %v", l.conf.SocketName, err))
+			return
+		}
+		go l.handle(c)
+	}
+}
+
+func (l *listener) handle(c *net.UnixConn) {
+	var tx *txBuffer
+	defer func() {
+		if c != nil {
+			c.Close()
+		}
+		if tx != nil {
+			syscall.Munmap(tx.mem)
+		}
+	}()
+	connStr := c.RemoteAddr().String()
+	l.srv.log.Printf("Received new connection %q", connStr)
+	socks := l.socks
+	conf := socks[0].conf
+	var version [1]byte
+	version[0] = protocolVersion
+	if l.xdp != nil {
+		version[0] = xdpProtocolVersion
+	} else if len(conf.interfaces()) > 1 {
+		version[0] = multiInterfaceProtocolVersion
+	}
+	if _, err := c.Write(version[:]); err != nil {
+		l.srv.log.Printf("new conn %q failed to write version: %v", connStr, err)
+		return
+	}
+	if err := protocol.SendUint32(c, protocol.TypeFanoutSize, uint32(len(socks))); err != nil {
+		l.srv.log.Printf("new conn %q failed to send fanout size: %v", connStr, err)
+		return
+	}
+	if err := protocol.SendUint32(c, protocol.TypeBlockSize, uint32(conf.BlockSize)); err != nil {
+		l.srv.log.Printf("new conn %q failed to send block size: %v", connStr, err)
+		return
+	}
+	if err := protocol.SendUint32(c, protocol.TypeNumBlocks, uint32(len(socks[0].blocks))); err != nil {
+		l.srv.log.Printf("new conn %q failed to send number of blocks: %v", connStr, err)
+		return
+	}
+	if err := protocol.SendStrings(c, protocol.TypeInterfaces, conf.interfaces()); err != nil {
+		l.srv.log.Printf("new conn %q failed to send interfaces: %v", connStr, err)
+		return
+	}
+	if l.xdp == nil {
+		// Every fanout index has the same filters, so clients can check
+		// they're the ones they expect before reading any packets.
+		var hashes []byte
+		for _, m := range socks[0].members {
+			hashes = append(hashes, m.filterHash[:]...)
+		}
+		if err := protocol.SendTLV(c, protocol.TypeFilterHashes, hashes); err != nil {
+			l.srv.log.Printf("new conn %q failed to send filter hashes: %v", connStr, err)
+			return
+		}
+	}
+	if err := protocol.SendUint32(c, protocol.TypeTimestamping, uint32(conf.Timestamping)); err != nil {
+		l.srv.log.Printf("new conn %q failed to send timestamping: %v", connStr, err)
+		return
+	}
+	if l.xdp != nil {
+		if err := protocol.SendUint32(c, protocol.TypeXDPFrameSize, xdpFrameSize); err != nil {
+			l.srv.log.Printf("new conn %q failed to send XDP frame size: %v", connStr, err)
+			return
+		}
+	}
+	if len(conf.CPUs) > 0 || conf.NUMANode != nil {
+		var cpus, nodes []uint32
+		for _, sock := range socks {
+			if len(conf.CPUs) > 0 {
+				cpus = append(cpus, uint32(sock.cpus[0]))
+			}
+			nodes = append(nodes, uint32(sock.node))
+		}
+		if cpus != nil {
+			if err := protocol.SendUint32s(c, protocol.TypeCPUs, cpus); err != nil {
+				l.srv.log.Printf("new conn %q failed to send CPUs: %v", connStr, err)
+				return
+			}
+		}
+		if err := protocol.SendUint32s(c, protocol.TypeNUMANodes, nodes); err != nil {
+			l.srv.log.Printf("new conn %q failed to send NUMA nodes: %v", connStr, err)
+			return
+		}
+	}
+	if conf.TxRing {
+		if err := protocol.SendUint32(c, protocol.TypeTxFrameSize, uint32(conf.TxFrameSize)); err != nil {
+			l.srv.log.Printf("new conn %q failed to send TX frame size: %v", connStr, err)
+			return
+		}
+		if err := protocol.SendUint32(c, protocol.TypeTxNumFrames, uint32(conf.TxNumFrames)); err != nil {
+			l.srv.log.Printf("new conn %q failed to send number of TX frames: %v", connStr, err)
+			return
+		}
+	}
+	if err := protocol.SendType(c, protocol.TypeWaitingForFanoutIndex); err != nil {
+		l.srv.log.Printf("new conn %q failed to send wait: %v", connStr, err)
+		return
+	}
+	// Clients that want to transmit say so before sending their fanout index.
+	wantTx := false
+	var idx int
+fanoutLoop:
+	for {
+		var fanoutMsg [4]byte
+		if _, err := io.ReadFull(c, fanoutMsg[:]); err == io.EOF {
+			l.srv.log.Printf("new conn %q closed early, probably just gathering connection data", connStr)
+			return
+		} else if err != nil {
+			l.srv.log.Printf("new conn %q failed to read fanout index: %v", connStr, err)
+			return
+		}
+		valA := binary.BigEndian.Uint32(fanoutMsg[:])
+		switch {
+		case valA == protocol.ToTL(protocol.TypeTxRequest, 0) && l.tx != nil:
+			wantTx = true
+		case valA == protocol.ToTL(protocol.TypeFanoutIndex, 4):
+			if _, err := io.ReadFull(c, fanoutMsg[:]); err != nil {
+				l.srv.log.Printf("new conn %q failed to read fanout index: %v", connStr, err)
+				return
+			}
+			idx = int(binary.BigEndian.Uint32(fanoutMsg[:]))
+			break fanoutLoop
+		default:
+			l.srv.log.Printf("new conn %q got unexpected type/value waiting for fanout message: %d/%d", connStr, valA>>16, valA&0xFFFF)
+			return
+		}
+	}
+	if idx < 0 || idx >= len(socks) {
+		l.srv.log.Printf("new conn %q invalid index %v", connStr, idx)
+		return
+	}
+	sock := socks[idx]
+	fds := sock.fds()
+	if wantTx {
+		var f *os.File
+		var err error
+		if tx, f, err = newTxBuffer(conf); err != nil {
+			l.srv.log.Printf("new conn %q: %v", connStr, err)
+			return
+		}
+		defer f.Close()
+		fds = append(fds, int(f.Fd()))
+	}
+	fdMsg := syscall.UnixRights(fds...)
+	var msg [1]byte // dummy byte
+	n, n2, err := c.WriteMsgUnix(
+		msg[:], fdMsg, nil)
+	if err != nil || n != len(msg) || n2 != len(fdMsg) {
+		l.srv.log.Printf("new conn %q failed to send file descriptor: %v", connStr, err)
+		return
+	}
+	l.srv.log.V(2, "new conn %q spun up, passing off to socket", connStr)
+	newConn := sock.newConn(c, tx)
+	select {
+	case sock.newConns <- newConn:
+		c, tx = nil, nil // so they don't get closed by deferred func.
+	case <-sock.done:
+		l.srv.log.Printf("new conn %q arrived as %v was shutting down", connStr, sock)
+	}
+}
@@ -0,0 +1,115 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/google/testimony/go/protocol"
+)
+
+// testLogger sends a Server's logs to the test's.
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(format string, args ...interface{}) {
+	l.t.Logf(format, args...)
+}
+
+func TestUpdate(t *testing.T) {
+	// Sockets on interfaces that don't exist wait for them, so update can
+	// add and remove them without any privileges.
+	sock := func(name string, fanoutID int) SocketConfig {
+		return SocketConfig{SocketName: "/tmp/testimony-update-" + name + ".sock", Interface: "nosuchif0", BlockSize: 4096, NumBlocks: 4, FanoutSize: 2, FanoutID: fanoutID}
+	}
+	kept, changed, removed, assigned := sock("kept", 0), sock("changed", 0), sock("removed", 0), sock("assigned", 0)
+	s := New(nil, Options{Logger: testLogger{t}})
+	if err := s.update(Testimony{kept, changed, removed, assigned}); err != nil {
+		t.Fatal(err)
+	}
+	old := map[string]*listener{}
+	for name, l := range s.running {
+		old[name] = l
+	}
+	if len(old) != 4 {
+		t.Fatalf("running %d sockets, want 4", len(old))
+	}
+	// The kernel gave this socket's group an ID, which configured IDs then
+	// can't use.  It may give out 0 too, which configured IDs can't be.
+	s.running[assigned.SocketName].fanoutIDs = []int{100}
+	s.running[kept.SocketName].fanoutIDs = []int{0}
+
+	changed.NumBlocks = 8
+	added, clash, free := sock("added", 0), sock("clash", 100), sock("free", 101)
+	err := s.update(Testimony{kept, changed, assigned, added, clash, free})
+	if want := fmt.Sprintf("failed to set up sockets [%q]", clash.SocketName); err == nil || err.Error() != want {
+		t.Errorf("update error %v, want %q", err, want)
+	}
+	for _, test := range []struct {
+		sc      SocketConfig
+		running bool
+		same    bool // as the listener before the update
+	}{
+		{kept, true, true},
+		{assigned, true, true},
+		{changed, true, false},
+		{removed, false, false},
+		{added, true, false},
+		{clash, false, false},
+		{free, true, false},
+	} {
+		l := s.running[test.sc.SocketName]
+		switch {
+		case (l != nil) != test.running:
+			t.Errorf("%q running: %v, want %v", test.sc.SocketName, l != nil, test.running)
+		case l == nil:
+		case (l == old[test.sc.SocketName]) != test.same:
+			t.Errorf("%q kept its listener: %v, want %v", test.sc.SocketName, l == old[test.sc.SocketName], test.same)
+		case l.conf.String() != test.sc.String():
+			t.Errorf("%q running with %v, want %v", test.sc.SocketName, l.conf, test.sc)
+		}
+		// Listeners that were replaced or removed are torn down.
+		if prev := old[test.sc.SocketName]; prev != nil && prev != l {
+			select {
+			case <-prev.done:
+			default:
+				t.Errorf("%q old listener is still running", test.sc.SocketName)
+			}
+		}
+	}
+	if len(s.running) != 5 {
+		t.Errorf("running %d sockets, want 5", len(s.running))
+	}
+
+	// Updating to the same config changes nothing.
+	before := map[string]*listener{}
+	for name, l := range s.running {
+		before[name] = l
+	}
+	if err := s.update(Testimony{kept, changed, assigned, added, free}); err != nil {
+		t.Errorf("update to the same config: %v", err)
+	}
+	for name, l := range s.running {
+		if before[name] != l {
+			t.Errorf("update to the same config replaced %q", name)
+		}
+	}
+
+	var ls []*listener
+	for _, l := range s.running {
+		ls = append(ls, l)
+	}
+	closeListeners(ls, protocol.TypeShuttingDown)
+}
@@ -0,0 +1,527 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <arpa/inet.h>   // htons()
+#include <sys/socket.h>  // socket(), bind(), listen(), accept(), SOCK_STREAM
+#include <sys/types.h>   // See socket man page
+#include <string.h>      // strerror()
+#include <linux/if_ether.h>   // ETH_P_ALL
+#include <linux/if_packet.h>  // TPACKET_V3, PACKET_FANOUT_LB
+#include <errno.h>            // errno
+#include <net/if.h>           // if_nametoindex()
+#include <sys/mman.h>         // mmap(), PROT_*, MAP_*
+#include <unistd.h>           // close()
+#include <linux/filter.h>     // sock_fprog, sock_filter
+#include <linux/bpf.h>        // bpf_attr, BPF_PROG_LOAD
+#include <sys/syscall.h>      // __NR_bpf, __NR_set_mempolicy
+#include <sys/ioctl.h>        // ioctl()
+#include <linux/sockios.h>    // SIOCSHWTSTAMP, SIOCGHWTSTAMP, SIOCETHTOOL
+#include <linux/net_tstamp.h> // hwtstamp_config, SOF_TIMESTAMPING_*
+#include <linux/ethtool.h>    // ethtool_ts_info
+#include <linux/memfd.h>      // MFD_CLOEXEC, MFD_ALLOW_SEALING
+#include <fcntl.h>            // fcntl()
+#include <sched.h>            // sched_yield()
+#include <linux/mempolicy.h>  // MPOL_*
+
+#ifndef F_ADD_SEALS
+#define F_ADD_SEALS 1033  // from linux/fcntl.h, which clashes with fcntl.h
+#define F_SEAL_SEAL 0x0001
+#define F_SEAL_SHRINK 0x0002
+#define F_SEAL_GROW 0x0004
+#endif
+
+#ifndef PACKET_IGNORE_OUTGOING
+#define PACKET_IGNORE_OUTGOING 23  // since Linux 4.20
+#endif
+
+#ifndef UNIX_PATH_MAX
+#define UNIX_PATH_MAX 108
+#endif
+
+// Node masks passed to the mempolicy syscalls, which (for historical reasons)
+// are told they hold one more bit than they do.
+#define NODE_MASK_BITS 1024
+#define NODE_MASK_LONGS (NODE_MASK_BITS / (8 * sizeof(unsigned long)))
+
+// PreferNode makes the calling thread's allocations prefer the given NUMA
+// node, storing its old memory policy in old_mode and old_nodes for
+// RestoreMemPolicy.  Returns zero on success, on error returns -1 and sets
+// errno.
+static int PreferNode(int node, int* old_mode, unsigned long* old_nodes) {
+  if (syscall(__NR_get_mempolicy, old_mode, old_nodes, NODE_MASK_BITS + 1,
+              NULL, 0) < 0) {
+    return -1;
+  }
+  unsigned long nodes[NODE_MASK_LONGS];
+  memset(nodes, 0, sizeof(nodes));
+  nodes[node / (8 * sizeof(unsigned long))] |=
+      1UL << (node % (8 * sizeof(unsigned long)));
+  return syscall(__NR_set_mempolicy, MPOL_PREFERRED, nodes, NODE_MASK_BITS + 1);
+}
+
+// RestoreMemPolicy puts back a memory policy saved by PreferNode.
+static void RestoreMemPolicy(int mode, unsigned long* nodes) {
+  if (mode == MPOL_DEFAULT) {
+    syscall(__NR_set_mempolicy, MPOL_DEFAULT, NULL, 0);
+  } else {
+    syscall(__NR_set_mempolicy, mode, nodes, NODE_MASK_BITS + 1);
+  }
+}
+
+// EnableHWTimestamps turns on NIC timestamping of all received packets on the
+// given interface, leaving transmit timestamping as it was.  This is a
+// setting of the NIC, not the socket, so it's left on after the socket closes.
+// Returns zero on success, on error returns -1 and sets errno.
+static int EnableHWTimestamps(int fd, const char* iface, const char** err) {
+  struct hwtstamp_config hwconfig;
+  struct ifreq ifr;
+  memset(&hwconfig, 0, sizeof(hwconfig));
+  memset(&ifr, 0, sizeof(ifr));
+  strncpy(ifr.ifr_name, iface, sizeof(ifr.ifr_name) - 1);
+  ifr.ifr_data = (void*)&hwconfig;
+  // Older drivers can't report their config, in which case we set it all.
+  if (ioctl(fd, SIOCGHWTSTAMP, &ifr) == 0 &&
+      hwconfig.rx_filter == HWTSTAMP_FILTER_ALL) {
+    return 0;
+  }
+  hwconfig.rx_filter = HWTSTAMP_FILTER_ALL;
+  if (ioctl(fd, SIOCSHWTSTAMP, &ifr) < 0) {
+    *err = "ioctl SIOCSHWTSTAMP failed";
+    return -1;
+  }
+  if (hwconfig.rx_filter != HWTSTAMP_FILTER_ALL) {
+    *err = "NIC can't timestamp all received packets";
+    errno = EOPNOTSUPP;
+    return -1;
+  }
+  return 0;
+}
+
+// HWTimestampInfo outputs the SOF_TIMESTAMPING_* capabilities of an interface
+// and the HWTSTAMP_FILTER_* values (as bits) its NIC supports for received
+// packets.  Returns zero on success, on error returns -1 and sets errno.
+int HWTimestampInfo(const char* iface, unsigned int* so_timestamping,
+                    unsigned int* rx_filters) {
+  int fd = socket(AF_INET, SOCK_DGRAM, 0);
+  if (fd < 0) {
+    return -1;
+  }
+  struct ethtool_ts_info info;
+  struct ifreq ifr;
+  memset(&info, 0, sizeof(info));
+  memset(&ifr, 0, sizeof(ifr));
+  info.cmd = ETHTOOL_GET_TS_INFO;
+  strncpy(ifr.ifr_name, iface, sizeof(ifr.ifr_name) - 1);
+  ifr.ifr_data = (void*)&info;
+  int r = ioctl(fd, SIOCETHTOOL, &ifr);
+  int e = errno;
+  close(fd);
+  if (r < 0) {
+    errno = e;
+    return -1;
+  }
+  *so_timestamping = info.so_timestamping;
+  *rx_filters = info.rx_filters;
+  return 0;
+}
+
+// AFPacket does all of the necessary construction of an AF_PACKET socket
+// in C, to avoid a bunch of C.blah cgo stuff in daemon.go.  It takes in a bunch
+// of arguments and outputs an AF_PACKET socket file descriptor, with its
+// RX_RING set up but not yet mapped (see MapRing), and any error message.
+// A fanout program, for PACKET_FANOUT_CBPF or PACKET_FANOUT_EBPF, is given as
+// either cBPF instructions or an eBPF program file descriptor (or -1).
+// Timestamping is a protocol.TimestampSource; for the hardware sources, NIC
+// timestamping is turned on for the interface.  If promisc is set, the socket
+// puts the interface in promiscuous mode for as long as it's open.  If
+// fill_rxhash is set, the kernel fills in each packet's tp_rxhash.  If
+// ignore_outgoing is set, the socket doesn't see packets the host sends.  If
+// numa_node isn't -1, the ring is allocated on that node.
+// Returns zero on success, on error returns -1 and sets errno.
+int AFPacket(const char* iface, int block_size, int block_nr, int block_ms,
+             int fanout_id, int fanout_size, int fanout_type_flags,
+             int filter_size, struct sock_filter* filters,
+             int fanout_filter_size, struct sock_filter* fanout_filters,
+             int fanout_prog_fd, int timestamping, int promisc,
+             int fill_rxhash, int ignore_outgoing, int numa_node,
+             // outputs:
+             int* fd, const char** err) {
+  // Set up the initial socket.
+  *fd = socket(AF_PACKET, SOCK_RAW, htons(ETH_P_ALL));
+  if (*fd < 0) {
+    *err = "socket creation failure";
+    return -1;
+  }
+
+  // Request TPACKET_V3.
+  int v = TPACKET_V3;
+  int r = setsockopt(*fd, SOL_PACKET, PACKET_VERSION, &v, sizeof(v));
+  if (r < 0) {
+    *err = "setsockopt PACKET_VERSION failure";
+    goto fail;
+  }
+
+  if (ignore_outgoing) {
+    v = 1;
+    r = setsockopt(*fd, SOL_PACKET, PACKET_IGNORE_OUTGOING, &v, sizeof(v));
+    if (r < 0) {
+      *err = "setsockopt PACKET_IGNORE_OUTGOING failure";
+      goto fail;
+    }
+  }
+
+  // If requested, set up and lock a BPF filter on the socket.
+  if (filter_size) {
+#if defined(SO_ATTACH_FILTER) && defined(SO_LOCK_FILTER)
+    struct sock_fprog filter;
+    filter.filter = filters;
+    filter.len = filter_size;
+
+    r = setsockopt(*fd, SOL_SOCKET, SO_ATTACH_FILTER, &filter, sizeof(filter));
+    if (r < 0) {
+      *err = "setsockopt SO_ATTACH_FILTER error";
+      goto fail;
+    }
+    // The filter is locked once the fanout program (if any) is set up, below.
+#else
+    // If folks want a filter, that means they want to give access to specific
+    // packets to a specific user.  If we can't attach a filter, we give them
+    // too many packets.  If we can't lock the filter, they can change the
+    // filter on the socket they receive and elevate their permissions.  In
+    // either case, fail hard.  If this isn't supported, folks can still use
+    // testimonyd without filters.
+    *err = "filter requested, but BPF filtering or filter locking unsupported";
+    errno = ENOSYS;
+    goto fail;
+#endif
+  }
+
+  // Have the kernel put hardware timestamps in the ring, if requested.
+  if (timestamping) {
+    v = timestamping == 1 ? SOF_TIMESTAMPING_RAW_HARDWARE
+                          : SOF_TIMESTAMPING_SYS_HARDWARE;
+    if (EnableHWTimestamps(*fd, iface, err) < 0) {
+      goto fail;
+    }
+    r = setsockopt(*fd, SOL_PACKET, PACKET_TIMESTAMP, &v, sizeof(v));
+    if (r < 0) {
+      *err = "setsockopt PACKET_TIMESTAMP failure";
+      goto fail;
+    }
+  }
+
+  // Request a RX_RING so we can mmap the socket.
+  struct tpacket_req3 tp3;
+  memset(&tp3, 0, sizeof(tp3));
+  tp3.tp_block_size = block_size;
+  tp3.tp_frame_size = block_size;
+  tp3.tp_block_nr = block_nr;
+  tp3.tp_frame_nr = block_nr;
+  tp3.tp_retire_blk_tov = block_ms;  // timeout, ms
+  // VLAN tags stripped from packets are always reported, but the receive hash
+  // has to be asked for.
+  if (fill_rxhash) {
+    tp3.tp_feature_req_word = TP_FT_REQ_FILL_RXHASH;
+  }
+  // The kernel allocates the ring here, following our memory policy.
+  int old_mode;
+  unsigned long old_nodes[NODE_MASK_LONGS];
+  if (numa_node >= 0 && PreferNode(numa_node, &old_mode, old_nodes) < 0) {
+    *err = "set_mempolicy failure";
+    goto fail;
+  }
+  r = setsockopt(*fd, SOL_PACKET, PACKET_RX_RING, &tp3, sizeof(tp3));
+  if (numa_node >= 0) {
+    int saved = errno;
+    RestoreMemPolicy(old_mode, old_nodes);
+    errno = saved;
+  }
+  if (r < 0) {
+    *err = "setsockopt PACKET_RX_RING failure";
+    goto fail;
+  }
+
+  // Bind the socket to a single interface.
+  struct sockaddr_ll ll;
+  memset(&ll, 0, sizeof(ll));
+  ll.sll_family = AF_PACKET;
+  ll.sll_protocol = htons(ETH_P_ALL);
+  ll.sll_ifindex = if_nametoindex(iface);
+  if (ll.sll_ifindex == 0) {
+    *err = "if_nametoindex failed";
+    errno = EINVAL;
+    goto fail;
+  }
+  r = bind(*fd, (struct sockaddr*)&ll, sizeof(ll));
+  if (r < 0) {
+    *err = "bind failed";
+    goto fail;
+  }
+
+  // The kernel counts promiscuous memberships, and drops ours when the socket
+  // is closed.
+  if (promisc) {
+    struct packet_mreq mreq;
+    memset(&mreq, 0, sizeof(mreq));
+    mreq.mr_ifindex = ll.sll_ifindex;
+    mreq.mr_type = PACKET_MR_PROMISC;
+    r = setsockopt(*fd, SOL_PACKET, PACKET_ADD_MEMBERSHIP, &mreq, sizeof(mreq));
+    if (r < 0) {
+      *err = "setsockopt PACKET_ADD_MEMBERSHIP failed";
+      goto fail;
+    }
+  }
+
+  // Set up fanout.
+  // If fanout size is 1, there's no point in trying to set fanout.
+  if (fanout_size != 1) {
+    int fanout = (fanout_id & 0xFFFF) | (fanout_type_flags << 16);
+    r = setsockopt(*fd, SOL_PACKET, PACKET_FANOUT, &fanout, sizeof(fanout));
+    if (r < 0) {
+      *err = "setsockopt PACKET_FANOUT failed";
+      goto fail;
+    }
+    // The fanout program is shared by the whole fanout group.
+    if (fanout_filter_size) {
+      struct sock_fprog prog;
+      prog.filter = fanout_filters;
+      prog.len = fanout_filter_size;
+      r = setsockopt(*fd, SOL_PACKET, PACKET_FANOUT_DATA, &prog, sizeof(prog));
+    } else if (fanout_prog_fd >= 0) {
+      r = setsockopt(*fd, SOL_PACKET, PACKET_FANOUT_DATA, &fanout_prog_fd,
+                     sizeof(fanout_prog_fd));
+    }
+    if (r < 0) {
+      *err = "setsockopt PACKET_FANOUT_DATA failed";
+      goto fail;
+    }
+  }
+
+  // Lock the filter, and with it the fanout program, so clients can't
+  // remove or replace them.
+  if (filter_size || fanout_filter_size || fanout_prog_fd >= 0) {
+#ifdef SO_LOCK_FILTER
+    v = 1;
+    r = setsockopt(*fd, SOL_SOCKET, SO_LOCK_FILTER, &v, sizeof(v));
+    if (r < 0) {
+      *err = "setsockopt SO_LOCK_FILTER error";
+      goto fail;
+    }
+#else
+    *err = "filter or fanout program requested, but locking unsupported";
+    errno = ENOSYS;
+    goto fail;
+#endif
+  }
+  return 0;
+
+fail : {
+  int err = errno;
+  close(*fd);
+  errno = err;
+}
+  return -1;
+}
+
+// MapRing mmaps the RX_RING of an AF_PACKET socket created by AFPacket,
+// outputting a void* pointing to the mmap'd region and any error message.
+// Returns zero on success, on error returns -1 and sets errno.
+int MapRing(int fd, int block_size, int block_nr,
+            // outputs:
+            void** ring, const char** err) {
+  *ring =
+      mmap(NULL, (size_t) block_size * block_nr,
+           PROT_READ | PROT_WRITE, MAP_SHARED | MAP_LOCKED | MAP_NORESERVE,
+           fd, 0);
+  if (*ring == MAP_FAILED) {
+    *err = "ring mmap failed";
+    return -1;
+  }
+  return 0;
+}
+
+// TxSlotSize returns the size of a TX_RING slot, a whole number of pages,
+// that holds a frame of up to frame_size bytes.
+int TxSlotSize(int frame_size) {
+  int page = getpagesize();
+  int size = TPACKET2_HDRLEN - sizeof(struct sockaddr_ll) + frame_size;
+  return (size + page - 1) / page * page;
+}
+
+// TxPacket creates an AF_PACKET socket for transmitting on the given
+// interface through a TPACKET_V2 TX_RING of slot_nr frames, each slot_size
+// bytes (a whole number of pages) and in its own block.  The socket doesn't
+// receive packets.  The ring is mapped with MapRing(fd, slot_size, slot_nr).
+// Returns zero on success, on error returns -1 and sets errno.
+int TxPacket(const char* iface, int slot_size, int slot_nr,
+             // outputs:
+             int* fd, const char** err) {
+  *fd = socket(AF_PACKET, SOCK_RAW, 0);
+  if (*fd < 0) {
+    *err = "socket creation failure";
+    return -1;
+  }
+  int v = TPACKET_V2;
+  int r = setsockopt(*fd, SOL_PACKET, PACKET_VERSION, &v, sizeof(v));
+  if (r < 0) {
+    *err = "setsockopt PACKET_VERSION failure";
+    goto fail;
+  }
+  struct tpacket_req req;
+  memset(&req, 0, sizeof(req));
+  req.tp_block_size = slot_size;
+  req.tp_frame_size = slot_size;
+  req.tp_block_nr = slot_nr;
+  req.tp_frame_nr = slot_nr;
+  r = setsockopt(*fd, SOL_PACKET, PACKET_TX_RING, &req, sizeof(req));
+  if (r < 0) {
+    *err = "setsockopt PACKET_TX_RING failure";
+    goto fail;
+  }
+  struct sockaddr_ll ll;
+  memset(&ll, 0, sizeof(ll));
+  ll.sll_family = AF_PACKET;
+  ll.sll_ifindex = if_nametoindex(iface);
+  if (ll.sll_ifindex == 0) {
+    *err = "if_nametoindex failed";
+    errno = EINVAL;
+    goto fail;
+  }
+  r = bind(*fd, (struct sockaddr*)&ll, sizeof(ll));
+  if (r < 0) {
+    *err = "bind failed";
+    goto fail;
+  }
+  return 0;
+
+fail : {
+  int err = errno;
+  close(*fd);
+  errno = err;
+}
+  return -1;
+}
+
+// TxSlot returns the header of the given slot of a TX_RING.
+static struct tpacket2_hdr* TxSlot(void* ring, int slot_size, int slot) {
+  return (struct tpacket2_hdr*)((char*)ring + (size_t)slot_size * slot);
+}
+
+// TxFill copies len bytes of frame data into the given slot of a TX_RING, which
+// must be available, and marks it to be sent by the next TxFlush.
+void TxFill(void* ring, int slot_size, int slot, const void* data, int len) {
+  struct tpacket2_hdr* hdr = TxSlot(ring, slot_size, slot);
+  memcpy((char*)hdr + TPACKET2_HDRLEN - sizeof(struct sockaddr_ll), data, len);
+  hdr->tp_len = len;
+  __sync_synchronize();
+  hdr->tp_status = TP_STATUS_SEND_REQUEST;
+}
+
+// TxFlush sends count frames filled in by TxFill, in the slot_nr slots of a
+// TX_RING starting at slot head.  The kernel sends frames in ring order,
+// starting from the slot after the last one it sent, and stops at the first
+// it can't send, so head must be that slot.  Returns the number of frames
+// sent.  If that's less than count, the next frame failed, with an errno
+// value output in err, and it and the frames after it are made available
+// again without being sent.
+int TxFlush(int fd, void* ring, int slot_size, int slot_nr, int head, int count,
+            // outputs:
+            int* err) {
+  int r;
+  do {
+    r = send(fd, NULL, 0, 0);
+  } while (r < 0 && errno == EINTR);
+  int send_err = r < 0 ? errno : 0;
+  // A failed send may return with frames still in flight.  Wait for the
+  // kernel to finish with them before we touch them.
+  for (int i = 0; i < count; i++) {
+    while (TxSlot(ring, slot_size, (head + i) % slot_nr)->tp_status &
+           TP_STATUS_SENDING) {
+      sched_yield();
+    }
+  }
+  __sync_synchronize();
+  int sent = 0;
+  while (sent < count && TxSlot(ring, slot_size, (head + sent) % slot_nr)
+                                 ->tp_status == TP_STATUS_AVAILABLE) {
+    sent++;
+  }
+  if (sent < count) {
+    struct tpacket2_hdr* hdr = TxSlot(ring, slot_size, (head + sent) % slot_nr);
+    if (hdr->tp_status == TP_STATUS_WRONG_FORMAT) {
+      *err = EINVAL;
+    } else {
+      *err = send_err ? send_err : EAGAIN;
+    }
+    for (int i = sent; i < count; i++) {
+      TxSlot(ring, slot_size, (head + i) % slot_nr)->tp_status =
+          TP_STATUS_AVAILABLE;
+    }
+  }
+  return sent;
+}
+
+// TxBuffer creates an anonymous memory file of the given size for a client to
+// pass frames to transmit through, sealed so its size can't change.
+// Returns its file descriptor, or -1 and sets errno.
+int TxBuffer(int size) {
+  int fd = syscall(__NR_memfd_create, "testimony-tx",
+                   MFD_CLOEXEC | MFD_ALLOW_SEALING);
+  if (fd < 0) {
+    return -1;
+  }
+  if (ftruncate(fd, size) < 0 ||
+      fcntl(fd, F_ADD_SEALS, F_SEAL_SHRINK | F_SEAL_GROW | F_SEAL_SEAL) < 0) {
+    int err = errno;
+    close(fd);
+    errno = err;
+    return -1;
+  }
+  return fd;
+}
+
+// LoadEBPF loads a BPF_PROG_TYPE_SOCKET_FILTER eBPF program into the kernel.
+// On failure, the verifier's log (if any) is written to log_buf.
+// Returns the program's file descriptor, or -1 and sets errno.
+int LoadEBPF(const void* insns, int insn_cnt, const char* license,
+             char* log_buf, int log_size) {
+  union bpf_attr attr;
+  memset(&attr, 0, sizeof(attr));
+  attr.prog_type = BPF_PROG_TYPE_SOCKET_FILTER;
+  attr.insns = (unsigned long)insns;
+  attr.insn_cnt = insn_cnt;
+  attr.license = (unsigned long)license;
+  attr.log_buf = (unsigned long)log_buf;
+  attr.log_size = log_size;
+  attr.log_level = 1;
+  int fd = syscall(__NR_bpf, BPF_PROG_LOAD, &attr, sizeof(attr));
+  if (fd < 0 && errno == ENOSPC) {
+    // The log didn't fit; try again without it.
+    attr.log_buf = 0;
+    attr.log_size = 0;
+    attr.log_level = 0;
+    log_buf[0] = 0;
+    fd = syscall(__NR_bpf, BPF_PROG_LOAD, &attr, sizeof(attr));
+  }
+  return fd;
+}
+
+// GetPinnedEBPF returns a file descriptor for the eBPF object pinned at path
+// in the BPF filesystem, or -1 and sets errno.
+int GetPinnedEBPF(const char* path) {
+  union bpf_attr attr;
+  memset(&attr, 0, sizeof(attr));
+  attr.pathname = (unsigned long)path;
+  return syscall(__NR_bpf, BPF_OBJ_GET, &attr, sizeof(attr));
+}
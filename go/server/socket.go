@@ -0,0 +1,962 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+/*
+#include <linux/if_packet.h>
+#include <linux/filter.h>
+#include <stdlib.h>  // for C.free
+#include <sys/mman.h>  // for munmap
+#include <sys/socket.h>  // for SOL_PACKET, getsockopt
+#include <unistd.h>  // for close
+
+struct sock_fprog;
+
+// See comments in socket.cc
+int AFPacket(const char* iface, int block_size, int block_nr, int block_ms,
+             int fanout_id, int fanout_size, int fanout_type_flags,
+             int filter_size, struct sock_filter* filters,
+             int fanout_filter_size, struct sock_filter* fanout_filters,
+             int fanout_prog_fd, int timestamping, int promisc,
+             int fill_rxhash, int ignore_outgoing, int numa_node,
+             // Outputs:
+			 int* fd, const char** err);
+int MapRing(int fd, int block_size, int block_nr,
+            // Outputs:
+            void** ring, const char** err);
+
+*/
+import "C"
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unsafe"
+
+	"github.com/google/testimony/go/internal/bpf"
+	"github.com/google/testimony/go/internal/pcapfilter"
+	"github.com/google/testimony/go/protocol"
+)
+
+// socket handles the AF_PACKET sockets for one fanout index of a
+// SocketConfig.  There will be N Socket objects for each SocketConfig, where
+// N == FanoutSize.  A socket has one underlying AF_PACKET socket (a member)
+// per interface, and hands out all of their blocks to its clients.
+type socket struct {
+	srv          *Server        // server this socket belongs to
+	num          int            // fanout index for this socket
+	conf         SocketConfig   // configuration
+	members      []*member      // AF_PACKET socket for each interface
+	newConns     chan *conn     // new client connections come in here
+	oldConns     chan *conn     // old client connections come in here for cleanup
+	newBlocks    chan *block    // when a new block is available, it comes in here
+	blocks       []*block       // all blocks in the members' memory regions, in member order
+	currentConns map[*conn]bool // list of current connections a new block will be sent to
+	done         chan struct{}  // closed to ask the socket to shut down
+	closeMsg     protocol.Type  // TLV sent to clients once done is closed
+	stopped      chan struct{}  // closed once the socket has shut down
+	tx           *txRing        // ring for clients to transmit through, if TxRing is set
+	cpus         []int          // CPUs run and getNewBlocks are pinned to, nil for any
+	node         int            // NUMA node the rings are on, -1 if not chosen
+}
+
+// member is the AF_PACKET socket a socket has on one of its interfaces.
+// Its blocks are conf.NumBlocks of the socket's blocks, starting at first.
+type member struct {
+	s          *socket
+	iface      string            // interface the AF_PACKET socket sniffs on
+	fd         int               // file descriptor for AF_PACKET socket
+	ring       unsafe.Pointer    // pointer to memory region
+	first      int               // index of the member's first block in s.blocks
+	heartbeat  int64             // UnixNano of getNewBlocks' last check for blocks, uses atomic
+	waiting    int32             // 1 while getNewBlocks waits for the kernel, uses atomic
+	blockIndex int32             // next block getNewBlocks will hand out, uses atomic
+	xdp        *xdpMember        // AF_XDP state, nil for AF_PACKET members
+	filterHash [sha256.Size]byte // hash of the verified socket filter
+}
+
+// newSocket creates a new Socket object based on a config, with an AF_PACKET
+// socket on each of its interfaces, joining the fanout groups in fanoutIDs.
+// With the AF_XDP backend, it instead captures from x's socket for queue num.
+func (srv *Server) newSocket(sc SocketConfig, fanoutIDs []int, num int, x *xdpSockets) (*socket, error) {
+	ifaces := sc.interfaces()
+	s := &socket{
+		srv:          srv,
+		num:          num,
+		conf:         sc,
+		newConns:     make(chan *conn),
+		oldConns:     make(chan *conn),
+		newBlocks:    make(chan *block, sc.NumBlocks*len(ifaces)),
+		currentConns: map[*conn]bool{},
+		done:         make(chan struct{}),
+		closeMsg:     protocol.TypeShuttingDown,
+		stopped:      make(chan struct{}),
+	}
+
+	var err error
+	if s.cpus, err = sc.socketCPUs(num); err != nil {
+		return nil, err
+	}
+	if s.node, err = sc.socketNUMANode(num); err != nil {
+		return nil, err
+	}
+
+	if x != nil {
+		// The UMEM was allocated wherever the kernel chose.
+		s.node = -1
+		m, err := s.newXDPMember(x)
+		if err != nil {
+			return nil, err
+		}
+		s.members = []*member{m}
+		for j := 0; j < sc.NumBlocks; j++ {
+			s.blocks = append(s.blocks, &block{s: s, m: m, index: j})
+		}
+		srv.log.Printf("%v set up with %+v", s, sc)
+		return s, nil
+	}
+	for i, iface := range ifaces {
+		m, err := s.newMember(iface, fanoutIDs[i])
+		if err != nil {
+			s.closeMembers()
+			return nil, err
+		}
+		s.members = append(s.members, m)
+		// Set up block objects, used to reference count blocks for clients.
+		for j := 0; j < sc.NumBlocks; j++ {
+			s.blocks = append(s.blocks, &block{s: s, m: m, index: m.first + j})
+		}
+	}
+	srv.log.Printf("%v set up with %+v, filter hashes %v", s, sc, s.filterHashes())
+	return s, nil
+}
+
+// newMember creates the socket's AF_PACKET socket on iface and maps its ring.
+func (s *socket) newMember(iface string, fanoutID int) (*member, error) {
+	// Creating the socket needs privileges we may have dropped, so it may be
+	// done by the privileged helper.  Mapping its ring doesn't.
+	sc := s.conf.member(iface)
+	fd, err := s.srv.privileged.afPacket(sc, fanoutID, s.num)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := verifyFilter(fd, sc)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("refusing to serve interface %q: %v", iface, err)
+	}
+	var ring unsafe.Pointer
+	var errStr *C.char
+	if _, err := C.MapRing(C.int(fd), C.int(sc.BlockSize), C.int(sc.NumBlocks), &ring, &errStr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("C MapRing call failed: %v: %v", C.GoString(errStr), err)
+	}
+	return &member{
+		s:          s,
+		iface:      iface,
+		fd:         fd,
+		ring:       ring,
+		first:      len(s.members) * sc.NumBlocks,
+		filterHash: hash,
+	}, nil
+}
+
+// closeMembers unmaps the members' rings and closes their AF_PACKET sockets.
+func (s *socket) closeMembers() {
+	for _, m := range s.members {
+		if m.xdp != nil {
+			// The AF_XDP socket belongs to the listener.
+			m.xdp.unmap()
+			continue
+		}
+		C.munmap(m.ring, C.size_t(s.conf.BlockSize)*C.size_t(s.conf.NumBlocks))
+		C.close(C.int(m.fd))
+	}
+}
+
+// fds returns the file descriptors of the members' AF_PACKET sockets, in
+// member order, or of the memory file holding the UMEM for AF_XDP.
+func (s *socket) fds() []int {
+	var fds []int
+	for _, m := range s.members {
+		if m.xdp != nil {
+			return []int{m.xdp.x.memFD}
+		}
+		fds = append(fds, m.fd)
+	}
+	return fds
+}
+
+// openAFPacket creates an AF_PACKET socket for fanout index num of the given
+// config, with its filter attached and locked and its RX_RING set up, and
+// returns its file descriptor.
+func openAFPacket(sc SocketConfig, fanoutID, num int) (int, error) {
+	// Compile the BPF filter, if it was requested.
+	var filt *C.struct_sock_filter
+	var filtsize C.int
+	f, err := sc.socketFilter()
+	if err != nil {
+		return -1, err
+	} else if len(f) > 0 {
+		filt = &f[0]
+		filtsize = C.int(len(f))
+	}
+
+	// Set up the fanout program, if there is one.
+	var fanoutFilt *C.struct_sock_filter
+	var fanoutFiltSize C.int
+	fanoutProgFD := -1
+	if sc.FanoutProgram != "" {
+		switch sc.FanoutType {
+		case FanoutCBPF:
+			f, err := parseBPF(sc.FanoutProgram)
+			if err != nil {
+				return -1, fmt.Errorf("bad FanoutProgram: %v", err)
+			}
+			fanoutFilt = &f[0]
+			fanoutFiltSize = C.int(len(f))
+		case FanoutEBPF:
+			fd, err := loadEBPF(sc.FanoutProgram)
+			if err != nil {
+				return -1, fmt.Errorf("could not load FanoutProgram %q: %v", sc.FanoutProgram, err)
+			}
+			// The fanout group keeps its own reference to the program.
+			defer syscall.Close(fd)
+			fanoutProgFD = fd
+		default:
+			return -1, fmt.Errorf("FanoutProgram requires FanoutType cbpf or ebpf, not %v", sc.FanoutType)
+		}
+	}
+
+	if err := checkTimestamping(sc.Interface, sc.Timestamping); err != nil {
+		return -1, fmt.Errorf("bad Timestamping: %v", err)
+	}
+	node, err := sc.socketNUMANode(num)
+	if err != nil {
+		return -1, fmt.Errorf("bad CPUs: %v", err)
+	}
+
+	fanoutType := sc.fanoutArg(num)
+
+	// Call into our C code to actually create the socket.
+	iface := C.CString(sc.Interface)
+	defer C.free(unsafe.Pointer(iface))
+	var promisc C.int
+	if sc.Promiscuous {
+		promisc = 1
+	}
+	var rxhash C.int
+	if sc.RxHash {
+		rxhash = 1
+	}
+	var ignoreOutgoing C.int
+	if sc.ignoreOutgoing() {
+		ignoreOutgoing = 1
+	}
+	var fd C.int
+	var errStr *C.char
+	if _, err := C.AFPacket(iface, C.int(sc.BlockSize), C.int(sc.NumBlocks),
+		C.int(sc.BlockTimeoutMillis), C.int(fanoutID), C.int(sc.FanoutSize), C.int(fanoutType),
+		filtsize, filt,
+		fanoutFiltSize, fanoutFilt, C.int(fanoutProgFD), C.int(sc.Timestamping), promisc, rxhash,
+		ignoreOutgoing, C.int(node),
+		&fd, &errStr); err != nil {
+		return -1, fmt.Errorf("C AFPacket call failed: %v: %v", C.GoString(errStr), err)
+	}
+	return int(fd), nil
+}
+
+// fanoutGroupID returns the ID of the fanout group an AF_PACKET socket is in.
+func fanoutGroupID(fd int) (int, error) {
+	var val C.int
+	size := C.socklen_t(unsafe.Sizeof(val))
+	if _, err := C.getsockopt(C.int(fd), C.SOL_PACKET, C.PACKET_FANOUT, unsafe.Pointer(&val), &size); err != nil {
+		return 0, err
+	}
+	return int(val & 0xFFFF), nil
+}
+
+// verifyFilter reads back the filter the kernel has on an AF_PACKET socket
+// and checks that it's locked and exactly the program sc calls for, since a
+// socket with any other filter could give its clients packets they shouldn't
+// see.  It returns the verified program's hash.
+func verifyFilter(fd int, sc SocketConfig) ([sha256.Size]byte, error) {
+	var hash [sha256.Size]byte
+	f, err := sc.socketFilter()
+	if err != nil {
+		return hash, err
+	}
+	want := toBPFInsns(f)
+
+	// SO_GET_FILTER's length is in instructions, not bytes.  Asking with a
+	// length of 0 returns the filter's length, or 0 if there's no filter.
+	var n C.socklen_t
+	if _, err := C.getsockopt(C.int(fd), C.SOL_SOCKET, C.SO_GET_FILTER, nil, &n); err != nil {
+		return hash, fmt.Errorf("could not read back socket filter: %v", err)
+	}
+	var got []bpf.Instruction
+	if n > 0 {
+		buf := make([]C.struct_sock_filter, n)
+		if _, err := C.getsockopt(C.int(fd), C.SOL_SOCKET, C.SO_GET_FILTER, unsafe.Pointer(&buf[0]), &n); err != nil {
+			return hash, fmt.Errorf("could not read back socket filter: %v", err)
+		}
+		got = toBPFInsns(buf[:n])
+	}
+	if len(got) != len(want) {
+		return hash, fmt.Errorf("kernel has a %d-instruction socket filter, want %d instructions", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			return hash, fmt.Errorf("socket filter instruction %d is %+v in the kernel, want %+v", i, got[i], want[i])
+		}
+	}
+
+	if len(want) > 0 {
+		var locked C.int
+		size := C.socklen_t(unsafe.Sizeof(locked))
+		if _, err := C.getsockopt(C.int(fd), C.SOL_SOCKET, C.SO_LOCK_FILTER, unsafe.Pointer(&locked), &size); err != nil {
+			return hash, fmt.Errorf("could not check socket filter is locked: %v", err)
+		} else if locked == 0 {
+			return hash, fmt.Errorf("socket filter is not locked")
+		}
+	}
+	return hashBPF(want), nil
+}
+
+// filterHashes returns the hex hashes of the members' verified socket
+// filters, in member order, or nil for AF_XDP, which doesn't filter.
+func (s *socket) filterHashes() []string {
+	var hashes []string
+	for _, m := range s.members {
+		if m.xdp != nil {
+			return nil
+		}
+		hashes = append(hashes, hex.EncodeToString(m.filterHash[:]))
+	}
+	return hashes
+}
+
+// String returns a unique string for this socket.
+func (s *socket) String() string {
+	return fmt.Sprintf("[S:%v:%v]", s.conf.SocketName, s.num)
+}
+
+// String returns a unique string for this member.
+func (m *member) String() string {
+	return fmt.Sprintf("[S:%v:%v:%v]", m.s.conf.SocketName, m.s.num, m.iface)
+}
+
+// getNewBlocks is a goroutine that watches for new available packet blocks
+// in a member's ring, which the run() method passes to clients.  It returns
+// once the socket is shutting down.
+func (s *socket) getNewBlocks(m *member) {
+	if m.xdp != nil {
+		s.getNewXDPBlocks(m)
+		return
+	}
+	s.pin()
+	// The server's poller wakes us when the kernel retires a block.  It only
+	// reports changes, so every ready block is handed out before waiting.
+	wake := make(chan struct{}, 1)
+	if err := s.srv.poller.add(m.fd, wake); err != nil {
+		s.srv.fail(fmt.Errorf("%v can't watch for new blocks: %v", m, err))
+		return
+	}
+	defer s.srv.poller.remove(m.fd)
+	blockIndex := 0
+	for {
+		b := s.blocks[m.first+blockIndex]
+		atomic.StoreInt32(&m.blockIndex, int32(blockIndex))
+		for !b.ready() {
+			atomic.StoreInt64(&m.heartbeat, time.Now().UnixNano())
+			atomic.StoreInt32(&m.waiting, 1)
+			select {
+			case <-wake:
+			case <-s.done:
+				return
+			}
+			atomic.StoreInt32(&m.waiting, 0)
+		}
+		b.ref()
+		s.srv.log.V(3, "%v got new block %v", m, b)
+		select {
+		case s.newBlocks <- b:
+		case <-s.done:
+			b.unref()
+			return
+		}
+		blockIndex = (blockIndex + 1) % s.conf.NumBlocks
+		atomic.StoreInt64(&m.heartbeat, time.Now().UnixNano())
+	}
+}
+
+// pin keeps the calling goroutine on the socket's CPUs, if it has any.  The
+// goroutine's thread is dedicated to it from then on.
+func (s *socket) pin() {
+	if len(s.cpus) == 0 {
+		return
+	}
+	if err := pinThread(s.cpus); err != nil {
+		s.srv.log.Printf("%v could not pin to CPUs %v: %v", s, s.cpus, err)
+	}
+}
+
+// healthy returns an error if a member's getNewBlocks has been stuck for more
+// than maxAge:  either handing a block to run(), or waiting while its next
+// block is ready.  A socket waiting for packets is healthy however long it
+// waits.
+func (s *socket) healthy(maxAge time.Duration) error {
+	for _, m := range s.members {
+		last := atomic.LoadInt64(&m.heartbeat)
+		if last == 0 {
+			continue // not started yet
+		}
+		age := time.Since(time.Unix(0, last))
+		if age <= maxAge {
+			continue
+		}
+		if atomic.LoadInt32(&m.waiting) != 0 && !s.blocks[m.first+int(atomic.LoadInt32(&m.blockIndex))].ready() {
+			continue
+		}
+		return fmt.Errorf("%v has not picked up new blocks in %v", m, age)
+	}
+	return nil
+}
+
+func (s *socket) reportStats() {
+	var totalPackets, totalDrops uint64
+	// getting statistics returns the stats since the last invocation.  We clear
+	// counters by doing an initial read we ignore.
+	s.stats()
+	filters := s.filterHashes()
+	const seconds = 60
+	ticker := time.NewTicker(time.Second * seconds)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.done:
+			return
+		}
+		// Output stats to log on each full round of a ring.
+		stats, err := s.stats()
+		if err != nil {
+			s.srv.log.Printf("error getting statistics: %v", err)
+		} else {
+			totalPackets += uint64(stats.tp_packets)
+			totalDrops += uint64(stats.tp_drops)
+			s.srv.log.V(1, "%v stats: %d packets (%.02fpps), %d drops (%.02fpps) (%.02f%% dropped) since last log, %d packets, %d drops total (%.02f%% dropped), filter hashes %v", s,
+				stats.tp_packets, float64(stats.tp_packets)/seconds, stats.tp_drops, float64(stats.tp_drops)/seconds, float64(stats.tp_drops)/float64(stats.tp_drops+stats.tp_packets)*100,
+				totalPackets, totalDrops, float64(totalDrops)/float64(totalPackets+totalDrops)*100, filters)
+		}
+	}
+}
+
+// run handles new connections, old connections, new blocks... basically
+// everything.
+func (s *socket) run() {
+	defer close(s.stopped)
+	s.pin()
+	blocksDone := make(chan struct{})
+	var getters sync.WaitGroup
+	for _, m := range s.members {
+		getters.Add(1)
+		go func(m *member) {
+			defer getters.Done()
+			s.getNewBlocks(m)
+		}(m)
+	}
+	go func() {
+		getters.Wait()
+		close(blocksDone)
+	}()
+	go s.reportStats()
+	for {
+		select {
+		case c := <-s.newConns:
+			// register a new client connection
+			s.addNewConn(c)
+		case c := <-s.oldConns:
+			// unregister an old client connection and close its blocks
+			close(c.newBlocks)
+			delete(s.currentConns, c)
+		case b := <-s.newBlocks:
+			// a new block is avaiable, send it out to all clients
+			for c, _ := range s.currentConns {
+				b.ref()
+				select {
+				case c.newBlocks <- b:
+				default:
+					s.srv.log.V(1, "failed to send %v to %v", b, c)
+					b.unref()
+				}
+			}
+			b.unref()
+		case <-s.done:
+			s.shutdown(blocksDone)
+			return
+		}
+	}
+}
+
+// shutdown is called by run() once the socket's done channel is closed.  It
+// waits up to the server's ShutdownGrace for clients to return their
+// outstanding blocks and disconnect, forcibly disconnecting any that don't.
+// Once clients and getNewBlocks are finished with the rings, it unmaps the
+// rings and closes the AF_PACKET sockets.
+func (s *socket) shutdown(blocksDone chan struct{}) {
+	grace := s.srv.opts.ShutdownGrace
+	s.srv.log.Printf("%v shutting down, waiting up to %v for %d connections", s, grace, len(s.currentConns))
+	graceTimer := time.NewTimer(grace)
+	defer graceTimer.Stop()
+	for len(s.currentConns) > 0 || blocksDone != nil {
+		select {
+		case c := <-s.oldConns:
+			close(c.newBlocks)
+			delete(s.currentConns, c)
+		case b := <-s.newBlocks:
+			b.unref()
+		case <-blocksDone:
+			blocksDone = nil
+		case <-graceTimer.C:
+			for c := range s.currentConns {
+				s.srv.log.Printf("%v did not finish within %v, disconnecting", c, grace)
+				c.c.Close()
+			}
+		}
+	}
+	s.closeMembers()
+	s.srv.log.V(1, "%v shut down", s)
+}
+
+// conn represents a set-up client connection (already initiated and with the
+// file descriptor passed through).
+type conn struct {
+	s         *socket
+	c         *net.UnixConn
+	newBlocks chan *block
+	oldBlocks chan int
+	tx        *txBuffer         // frames to transmit, if the client asked to
+	txDone    chan txCompletion // results of sending frames, nil without tx
+}
+
+// String returns a unique string for this connection.
+func (c *conn) String() string {
+	return fmt.Sprintf("[C:%v:%v]", c.s, c.c.RemoteAddr())
+}
+
+// handleReads handles client->server communication.
+func (c *conn) handleReads() {
+	defer close(c.oldBlocks)
+	if c.tx != nil {
+		defer syscall.Munmap(c.tx.mem)
+	}
+	for {
+		// Wait for a block index to be passed back from the client.
+		var buf [4]byte
+		n, err := c.c.Read(buf[:])
+		if err == io.EOF {
+			return
+		} else if err != nil || n != len(buf) {
+			c.s.srv.log.V(1, "%v read error (%d bytes): %v", c, n, err)
+			return
+		}
+		num := binary.BigEndian.Uint32(buf[:])
+		if num&0x80000000 != 0 {
+			typ, length := protocol.TLFrom(num)
+			if protocol.TypeOf(typ) != protocol.TypeClientToServer {
+				c.s.srv.log.V(1, "%v client sent bad type %d", c, typ)
+			}
+			var val []byte
+			if length != 0 {
+				val = make([]byte, length)
+				if _, err := io.ReadFull(c.c, val); err != nil {
+					c.s.srv.log.V(2, "%v read TLV %d length %d: %v", c, typ, length, err)
+					return
+				}
+			}
+			if err := c.handleTLV(typ, val); err != nil {
+				c.s.srv.log.V(2, "%v handling type %d: %v", c, typ, err)
+				return
+			}
+		} else {
+			i := int(num)
+			if i < 0 || i >= len(c.s.blocks) {
+				c.s.srv.log.Printf("%v got invalid block %d", c, i)
+				return
+			}
+			// We add one to the returned int so we can detect a closed channel (which
+			// returns 0, the zero-value for ints).
+			c.oldBlocks <- i + 1
+		}
+	}
+}
+
+func (c *conn) handleTLV(typ protocol.Type, val []byte) error {
+	switch typ {
+	case protocol.TypeTxFrameReady:
+		return c.txFrameReady(val)
+	}
+	c.s.srv.log.Printf("IGNORING TLV: %d = %x", typ, val)
+	return nil
+}
+
+// run handles communicating with a single external client via a single
+// connection.  It maintains the invariant that every block it gets via the
+// newBlocks channel will be unref'd exactly once.  It's up to the block sender
+// to ref the blocks for the conn.
+func (c *conn) run() {
+	go c.handleReads()
+	outstanding := make([]time.Time, len(c.s.blocks))
+	numOutstanding := 0
+	newBlocks := c.newBlocks
+	done := c.s.done
+
+	// Wait for either the reader or writer to stop.
+	var out []byte
+loop:
+	for {
+		select {
+		case b := <-newBlocks:
+			out = out[:0]
+			c.s.srv.log.V(2, "%v writing %v", c, b)
+		blockLoop:
+			for {
+				if !outstanding[b.index].IsZero() {
+					c.s.srv.log.Printf("%v received already outstanding block %v", c, b)
+					b.unref()
+					break loop
+				}
+				outstanding[b.index] = time.Now()
+				numOutstanding++
+				idx := len(out)
+				out = append(out, 0, 0, 0, 0)
+				binary.BigEndian.PutUint32(out[idx:], uint32(b.index))
+				select {
+				case b = <-c.newBlocks:
+					c.s.srv.log.V(2, "%v batching %v", c, b)
+				default:
+					break blockLoop
+				}
+			}
+			if _, err := c.c.Write(out); err != nil {
+				c.s.srv.log.V(1, "%v write error: %v", c, err)
+				break loop
+			}
+		case i := <-c.oldBlocks:
+			if i == 0 {
+				// read loop is closed
+				break loop
+			}
+			i-- // We added 1 to index in handleReads, remove 1 to get back to correct index.
+			if outstanding[i].IsZero() {
+				c.s.srv.log.Printf("%v received non-outstanding block %v from client", c, i)
+				break loop
+			}
+			b := c.s.blocks[i]
+			c.s.srv.log.V(3, "%v took %v to process block %v", c, time.Since(outstanding[i]), b)
+			outstanding[i] = time.Time{}
+			numOutstanding--
+			b.unref() // MOST IMPORTANT LINE EVER
+			if done == nil && numOutstanding == 0 {
+				break loop
+			}
+		case t := <-c.txDone:
+			if err := c.txComplete(t); err != nil {
+				c.s.srv.log.V(1, "%v write error: %v", c, err)
+				break loop
+			}
+		case <-done:
+			// The socket is shutting down.  Tell the client, stop sending it new
+			// blocks, and give it a chance to return the ones it has.  The
+			// socket closes our connection if this takes too long.
+			done, newBlocks = nil, nil
+			if err := protocol.SendType(c.c, c.s.closeMsg); err != nil {
+				c.s.srv.log.V(1, "%v write error: %v", c, err)
+				break loop
+			}
+			if numOutstanding == 0 {
+				break loop
+			}
+			c.s.srv.log.V(2, "%v waiting for %d outstanding blocks", c, numOutstanding)
+		}
+	}
+
+	// Close things down.
+	c.s.srv.log.Printf("Connection %v closing", c)
+	c.c.Close()
+	c.s.srv.log.V(3, "%v marking self old", c)
+	c.s.oldConns <- c
+	c.s.srv.log.V(3, "%v waiting for reads", c)
+	for b := range c.newBlocks {
+		c.s.srv.log.V(3, "%v returning unsent %v", c, b)
+		b.unref()
+	}
+	// empty out oldBlocks to allow handleReads to finish, but don't do anything
+	// with them.  the next loop (over outstanding) will unref and return all
+	// remaining blocks.
+	for _ = range c.oldBlocks {
+	}
+	for i, t := range outstanding {
+		if !t.IsZero() {
+			b := c.s.blocks[i]
+			c.s.srv.log.V(3, "%v returning outstanding %v after %v", c, b, time.Since(t))
+			b.unref()
+		}
+	}
+}
+
+// newConn creates a conn for a client connection to this socket, which
+// transmits through tx if it's not nil.
+func (s *socket) newConn(c *net.UnixConn, tx *txBuffer) *conn {
+	newConn := &conn{
+		s:         s,
+		c:         c,
+		newBlocks: make(chan *block, len(s.blocks)),
+		oldBlocks: make(chan int, len(s.blocks)),
+		tx:        tx,
+	}
+	if tx != nil {
+		newConn.txDone = make(chan txCompletion, len(tx.pending))
+	}
+	return newConn
+}
+
+// addNewConn is called by the testimonyd server when a new connection has been
+// initiated.  The passed-in conn should already have done the initial
+// configuration handshake, and be ready to start receiving blocks.
+func (s *socket) addNewConn(newConn *conn) {
+	s.srv.log.Printf("%v new connection %v", s, newConn)
+	s.currentConns[newConn] = true
+	go newConn.run()
+}
+
+// block stores ilocal information on a single block within the memory region.
+type block struct {
+	s     *socket
+	m     *member // member whose ring the block is in
+	index int     // my index within the socket's blocks
+
+	r int32 // reference count for this block, uses atomic
+}
+
+// ref reference the block.
+func (b *block) ref() {
+	refs := atomic.AddInt32(&b.r, 1)
+	b.s.srv.log.VUp(5, 1, "%v refs = %d", b, refs)
+}
+
+// unref dereferences the block.  When the refcount reaches zero, the block is
+// returned to the kernel via clear().
+func (b *block) unref() {
+	refs := atomic.AddInt32(&b.r, -1)
+	b.s.srv.log.VUp(5, 1, "%v unref = %d", b, refs)
+	if refs == 0 {
+		b.clear()
+	} else if refs < 0 {
+		panic(fmt.Sprintf("invalid unref of %v to %d", b, refs))
+	}
+}
+
+// String provides a unique human-readable string.
+func (b *block) String() string {
+	return fmt.Sprintf("[B:%v:%v]", b.s, b.index)
+}
+
+// cblock provides this block as a C tpacket pointer.
+func (b *block) cblock() *C.struct_tpacket_hdr_v1 {
+	blockDesc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(uintptr(b.m.ring) + uintptr(b.s.conf.BlockSize)*uintptr(b.index-b.m.first)))
+	hdr := (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&blockDesc.hdr[0]))
+	return hdr
+}
+
+// clear clears the block's block status, returning the block to the kernel so
+// it can add additional packets.
+func (b *block) clear() {
+	b.s.srv.log.VUp(3, 2, "%v clear", b)
+	if b.m.xdp != nil {
+		b.m.xdp.clear(b)
+		return
+	}
+	b.cblock().block_status = 0
+}
+
+// ready returns true when the block status has been set by the kernel, saying
+// that packets are ready for processing.
+func (b *block) ready() bool {
+	if b.m.xdp != nil {
+		return b.m.xdp.ready(b)
+	}
+	return atomic.LoadInt32(&b.r) == 0 && b.cblock().block_status != 0
+}
+
+// socketFilter returns the program to attach to a config's sockets:  its
+// Filter or FilterProgram, behind a check of the packet's Direction if the
+// kernel can't do that itself, limited to SnapLen bytes, or nothing if none
+// of those are set.
+func (sc SocketConfig) socketFilter() ([]C.struct_sock_filter, error) {
+	var prog []bpf.Instruction
+	source := "no filter" // where prog came from, for errors
+	switch {
+	case sc.Filter != "" && !sc.FilterProgram.empty():
+		return nil, fmt.Errorf("Filter and FilterProgram can't both be set")
+	case sc.Filter != "":
+		f, err := compileFilter(sc.Interface, sc.Filter)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile filter %q on interface %q: %v", sc.Filter, sc.Interface, err)
+		}
+		prog = toBPFInsns(f)
+		source = fmt.Sprintf("Filter %q", sc.Filter)
+	case !sc.FilterProgram.empty():
+		var err error
+		if prog, err = sc.FilterProgram.program(); err != nil {
+			return nil, fmt.Errorf("invalid FilterProgram: %v", err)
+		}
+		source = "FilterProgram"
+	}
+	if dir := sc.directionFilter(); dir != nil {
+		if len(prog) == 0 {
+			source = fmt.Sprintf("Direction %q", sc.Direction)
+			prog = []bpf.Instruction{{Code: bpf.RET | bpf.K, K: 0xffffffff}}
+		}
+		prog = append(dir, prog...)
+	}
+	if sc.SnapLen > 0 {
+		var err error
+		if prog, err = limitSnapLen(prog, uint32(sc.SnapLen)); err != nil {
+			return nil, fmt.Errorf("could not apply SnapLen %d to %s: %v", sc.SnapLen, source, err)
+		}
+	}
+	if len(prog) == 0 {
+		return nil, nil
+	}
+	return toSockFilter(prog), nil
+}
+
+// compileFilter compiles a pcap-filter(7) expression for an interface's link
+// type.
+func compileFilter(iface, filt string) ([]C.struct_sock_filter, error) {
+	link, err := linkType(iface)
+	if err != nil {
+		return nil, err
+	}
+	prog, err := pcapfilter.Compile(filt, link)
+	if err != nil {
+		return nil, err
+	}
+	return toSockFilter(prog), nil
+}
+
+// ARPHRD_* hardware types, from linux/if_arp.h.
+const (
+	arphrdEther    = 1
+	arphrdRawIP    = 519
+	arphrdLoopback = 772
+	arphrdNone     = 65534
+)
+
+// linkType returns the link-layer header an interface's packets start with.
+func linkType(iface string) (pcapfilter.LinkType, error) {
+	data, err := ioutil.ReadFile(filepath.Join("/sys/class/net", iface, "type"))
+	if err != nil {
+		return 0, err
+	}
+	typ, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 0, fmt.Errorf("could not parse link type %q: %v", data, err)
+	}
+	switch typ {
+	case arphrdEther, arphrdLoopback:
+		return pcapfilter.LinkEthernet, nil
+	case arphrdRawIP, arphrdNone:
+		return pcapfilter.LinkRaw, nil
+	}
+	return 0, fmt.Errorf("filters can't be compiled for link type %d", typ)
+}
+
+// parseBPF parses cBPF instructions in the decimal text format output by
+// "tcpdump -ddd" or bpf_asm:  the instruction count, then each instruction's
+// code, jt, jf and k, separated by whitespace or commas.
+func parseBPF(text string) ([]C.struct_sock_filter, error) {
+	ints := []int{}
+	fields := strings.FieldsFunc(text, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+	for _, field := range fields {
+		i, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, fmt.Errorf("error scanning token %q: %v", field, err)
+		}
+		ints = append(ints, i)
+	}
+	if len(ints) <= 1 || len(ints) != ints[0]*4+1 {
+		return nil, fmt.Errorf("invalid length of BPF ints")
+	}
+	ints = ints[1:]
+	var bpfs []C.struct_sock_filter
+	for i := 0; i < len(ints); i += 4 {
+		code, jt, jf, k := ints[i], ints[i+1], ints[i+2], ints[i+3]
+		if code < 0 || code > math.MaxUint16 || jt < 0 || jt > math.MaxUint8 ||
+			jf < 0 || jf > math.MaxUint8 || k < math.MinInt32 || k > math.MaxUint32 {
+			return nil, fmt.Errorf("BPF instruction %d (%d %d %d %d) out of range", i/4, code, jt, jf, k)
+		}
+		bpfs = append(bpfs, C.struct_sock_filter{
+			code: C.__u16(code),
+			jt:   C.__u8(jt),
+			jf:   C.__u8(jf),
+			k:    C.__u32(k),
+		})
+	}
+	return bpfs, nil
+}
+
+// stats returns the members' statistics, summed, since the last call.
+func (s *socket) stats() (*C.struct_tpacket_stats_v3, error) {
+	var total C.struct_tpacket_stats_v3
+	for _, m := range s.members {
+		if m.xdp != nil {
+			packets, drops, err := m.xdpStats()
+			if err != nil {
+				return nil, err
+			}
+			total.tp_packets += C.uint(packets)
+			total.tp_drops += C.uint(drops)
+			continue
+		}
+		var out C.struct_tpacket_stats_v3
+		size := C.socklen_t(unsafe.Sizeof(out))
+		if _, err := C.getsockopt(C.int(m.fd), C.SOL_PACKET, C.PACKET_STATISTICS, unsafe.Pointer(&out), &size); err != nil {
+			return nil, err
+		}
+		total.tp_packets += out.tp_packets
+		total.tp_drops += out.tp_drops
+		total.tp_freeze_q_cnt += out.tp_freeze_q_cnt
+	}
+	return &total, nil
+}
@@ -0,0 +1,134 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+/*
+#include <stdlib.h>  // for C.free
+
+int HWTimestampInfo(const char* iface, unsigned int* so_timestamping,
+                    unsigned int* rx_filters);
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/google/testimony/go/protocol"
+)
+
+// Timestamping is where a socket's packet timestamps come from.  In config
+// files it's given by name:  "software" (the default), "hardware-raw" or
+// "hardware-sys".  Clients are told which one in the handshake.
+type Timestamping protocol.TimestampSource
+
+// Timestamp sources, matching protocol.TimestampSource.
+const (
+	TimestampingSoftware    = Timestamping(protocol.TimestampSoftware)
+	TimestampingHardwareRaw = Timestamping(protocol.TimestampHardwareRaw)
+	TimestampingHardwareSys = Timestamping(protocol.TimestampHardwareSys)
+)
+
+// Hardware reports whether timestamps come from the NIC.
+func (t Timestamping) Hardware() bool {
+	return t == TimestampingHardwareRaw || t == TimestampingHardwareSys
+}
+
+// String returns the source's name.
+func (t Timestamping) String() string {
+	return protocol.TimestampSource(t).String()
+}
+
+// MarshalJSON writes the source by name.
+func (t Timestamping) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.String())
+}
+
+// UnmarshalJSON accepts a source name.
+func (t *Timestamping) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return fmt.Errorf("Timestamping must be a name, got %s", data)
+	}
+	for src, srcName := range protocol.TimestampSourceNames {
+		if srcName == name {
+			*t = Timestamping(src)
+			return nil
+		}
+	}
+	var known []string
+	for src := TimestampingSoftware; src <= TimestampingHardwareSys; src++ {
+		known = append(known, src.String())
+	}
+	return fmt.Errorf("unknown Timestamping %q, want one of %s", name, strings.Join(known, ", "))
+}
+
+// Values from linux/net_tstamp.h.
+const (
+	sofTimestampingSysHardware = 1 << 5
+	sofTimestampingRawHardware = 1 << 6
+	hwtstampFilterAll          = 1
+)
+
+// checkTimestamping returns an error if iface can't give t's timestamps for
+// every packet it receives.
+func checkTimestamping(iface string, t Timestamping) error {
+	if !t.Hardware() {
+		return nil
+	}
+	if t == TimestampingHardwareSys && kernelAtLeast(3, 17) {
+		return fmt.Errorf("kernels since 3.17 ignore hardware-sys and give software timestamps instead; use hardware-raw")
+	}
+	cIface := C.CString(iface)
+	defer C.free(unsafe.Pointer(cIface))
+	var soTimestamping, rxFilters C.uint
+	if _, err := C.HWTimestampInfo(cIface, &soTimestamping, &rxFilters); err != nil {
+		return fmt.Errorf("could not get timestamping capabilities of %q: %v", iface, err)
+	}
+	want := C.uint(sofTimestampingRawHardware)
+	if t == TimestampingHardwareSys {
+		want = sofTimestampingSysHardware
+	}
+	if soTimestamping&want == 0 {
+		return fmt.Errorf("interface %q does not support %v timestamps", iface, t)
+	}
+	if rxFilters&(1<<hwtstampFilterAll) == 0 {
+		return fmt.Errorf("interface %q can't timestamp all received packets", iface)
+	}
+	return nil
+}
+
+// kernelAtLeast reports whether the running kernel is at least major.minor.
+func kernelAtLeast(major, minor int) bool {
+	var uts syscall.Utsname
+	if err := syscall.Uname(&uts); err != nil {
+		return false
+	}
+	var release []byte
+	for _, c := range uts.Release {
+		if c == 0 {
+			break
+		}
+		release = append(release, byte(c))
+	}
+	var maj, min int
+	if _, err := fmt.Sscanf(string(release), "%d.%d", &maj, &min); err != nil {
+		return false
+	}
+	return maj > major || (maj == major && min >= minor)
+}
@@ -0,0 +1,69 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestTimestampingJSON(t *testing.T) {
+	for _, test := range []struct {
+		in       string
+		want     Timestamping
+		hardware bool
+	}{
+		{`"software"`, TimestampingSoftware, false},
+		{`"hardware-raw"`, TimestampingHardwareRaw, true},
+		{`"hardware-sys"`, TimestampingHardwareSys, true},
+	} {
+		var got Timestamping
+		if err := json.Unmarshal([]byte(test.in), &got); err != nil {
+			t.Errorf("unmarshaling %s: %v", test.in, err)
+			continue
+		} else if got != test.want {
+			t.Errorf("unmarshaling %s: got %v, want %v", test.in, got, test.want)
+		}
+		if got.Hardware() != test.hardware {
+			t.Errorf("%v.Hardware() = %v, want %v", got, got.Hardware(), test.hardware)
+		}
+		if out, err := json.Marshal(got); err != nil || string(out) != test.in {
+			t.Errorf("marshaling %v: got %s, %v, want %s", got, out, err, test.in)
+		}
+	}
+
+	for _, test := range []struct {
+		in, err string
+	}{
+		{`"hardware"`, `unknown Timestamping "hardware", want one of software, hardware-raw, hardware-sys`},
+		{`"Software"`, `unknown Timestamping "Software", want one of software, hardware-raw, hardware-sys`},
+		{`""`, `unknown Timestamping "", want one of software, hardware-raw, hardware-sys`},
+		{`1`, `Timestamping must be a name, got 1`},
+		{`["software"]`, `Timestamping must be a name, got ["software"]`},
+	} {
+		var got Timestamping
+		if err := got.UnmarshalJSON([]byte(test.in)); err == nil || err.Error() != test.err {
+			t.Errorf("unmarshaling %s: error %v, want %q", test.in, err, test.err)
+		}
+	}
+
+	// Configs that don't say get software timestamps.
+	var sc SocketConfig
+	if err := json.Unmarshal([]byte(`{"SocketName": "/tmp/a.sock"}`), &sc); err != nil {
+		t.Fatal(err)
+	} else if sc.Timestamping != TimestampingSoftware {
+		t.Errorf("default Timestamping is %v, want software", sc.Timestamping)
+	}
+}
@@ -0,0 +1,291 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+/*
+#include <stdlib.h>  // for C.free
+#include <sys/mman.h>  // for munmap
+
+int MapRing(int fd, int block_size, int block_nr, void** ring, const char** err);
+int TxSlotSize(int frame_size);
+int TxPacket(const char* iface, int slot_size, int slot_nr, int* fd, const char** err);
+void TxFill(void* ring, int slot_size, int slot, const void* data, int len);
+int TxFlush(int fd, void* ring, int slot_size, int slot_nr, int head, int count, int* err);
+int TxBuffer(int size);
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/testimony/go/internal/bpf"
+	"github.com/google/testimony/go/protocol"
+)
+
+// txRing transmits frames for a listener's clients through an AF_PACKET
+// TX_RING.  Clients never get the TX socket or its ring.  Instead each client
+// that asks for it gets its own txBuffer, and tells us when a frame in it is
+// ready.  We copy the frame out before checking it against the socket's
+// TxFilter and TxRateLimit, so clients can't change it once it's checked.
+type txRing struct {
+	srv      *Server
+	conf     SocketConfig
+	fd       int
+	ring     unsafe.Pointer
+	slotSize int
+	head     int               // next slot the kernel will send, used only by run
+	filter   []bpf.Instruction // TxFilter, nil to allow all frames
+	requests chan txRequest    // frames to send come in here
+	done     chan struct{}     // closed to ask the ring to shut down
+	stopped  chan struct{}     // closed once run has returned
+	tokens   float64           // rate limiting token bucket, used only by run
+	refilled time.Time         // when tokens was last refilled
+}
+
+// txRequest asks a txRing to send a frame copied from a client's txBuffer.
+type txRequest struct {
+	c     *conn
+	frame int // index of the frame in the client's txBuffer
+	data  []byte
+}
+
+// txCompletion tells a client the outcome of sending one of its frames.
+type txCompletion struct {
+	frame  int
+	status protocol.TxStatus
+}
+
+// txSlotSize returns the size of a TX_RING slot holding a frame of up to
+// frameSize bytes.
+func txSlotSize(frameSize int) int {
+	return int(C.TxSlotSize(C.int(frameSize)))
+}
+
+// newTxRing sets up the TX_RING for a config with TxRing set, and starts
+// sending frames through it.
+func (srv *Server) newTxRing(sc SocketConfig) (*txRing, error) {
+	t := &txRing{
+		srv:      srv,
+		conf:     sc,
+		slotSize: txSlotSize(sc.TxFrameSize),
+		requests: make(chan txRequest, sc.TxNumFrames),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+		tokens:   float64(sc.TxRateLimit),
+		refilled: time.Now(),
+	}
+	if sc.TxFilter != "" {
+		f, err := compileFilter(sc.Interface, sc.TxFilter)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compile TxFilter %q on interface %q: %v", sc.TxFilter, sc.Interface, err)
+		}
+		t.filter = toBPFInsns(f)
+	}
+	fd, err := srv.privileged.txPacket(sc)
+	if err != nil {
+		return nil, err
+	}
+	var ring unsafe.Pointer
+	var errStr *C.char
+	if _, err := C.MapRing(C.int(fd), C.int(t.slotSize), C.int(sc.TxNumFrames), &ring, &errStr); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("C MapRing call failed for TX ring: %v: %v", C.GoString(errStr), err)
+	}
+	t.fd = fd
+	t.ring = ring
+	go t.run()
+	srv.log.Printf("%v set up with %d frames of %d bytes", t, sc.TxNumFrames, sc.TxFrameSize)
+	return t, nil
+}
+
+// openTxPacket creates the AF_PACKET socket for a config's TX_RING, and
+// returns its file descriptor.
+func openTxPacket(sc SocketConfig) (int, error) {
+	if sc.TxFrameSize <= 0 || sc.TxNumFrames <= 0 {
+		return -1, fmt.Errorf("TxFrameSize %d and TxNumFrames %d must be positive", sc.TxFrameSize, sc.TxNumFrames)
+	}
+	iface := C.CString(sc.Interface)
+	defer C.free(unsafe.Pointer(iface))
+	var fd C.int
+	var errStr *C.char
+	if _, err := C.TxPacket(iface, C.TxSlotSize(C.int(sc.TxFrameSize)), C.int(sc.TxNumFrames), &fd, &errStr); err != nil {
+		return -1, fmt.Errorf("C TxPacket call failed: %v: %v", C.GoString(errStr), err)
+	}
+	return int(fd), nil
+}
+
+// String returns a unique string for this TX ring.
+func (t *txRing) String() string {
+	return fmt.Sprintf("[T:%v]", t.conf.SocketName)
+}
+
+// run sends frames as they're requested, batching those that arrive together
+// into a single send, and tells each frame's client how it went.
+func (t *txRing) run() {
+	defer close(t.stopped)
+	for {
+		var batch []txRequest
+		select {
+		case r := <-t.requests:
+			batch = append(batch, r)
+		case <-t.done:
+			return
+		}
+	fill:
+		for len(batch) < t.conf.TxNumFrames {
+			select {
+			case r := <-t.requests:
+				batch = append(batch, r)
+			default:
+				break fill
+			}
+		}
+		statuses := make([]protocol.TxStatus, len(batch))
+		var send []int // indexes into batch of frames to send, in order
+		for i, r := range batch {
+			if statuses[i] = t.check(r.data); statuses[i] == protocol.TxSent {
+				send = append(send, i)
+			} else {
+				t.srv.log.V(1, "%v not sending frame %d from %v: %v", t, r.frame, r.c, statuses[i])
+			}
+		}
+		// The kernel stops at the first frame it can't send, so send the
+		// rest again after it.
+		for len(send) > 0 {
+			for j, i := range send {
+				slot := (t.head + j) % t.conf.TxNumFrames
+				C.TxFill(t.ring, C.int(t.slotSize), C.int(slot), unsafe.Pointer(&batch[i].data[0]), C.int(len(batch[i].data)))
+			}
+			var errno C.int
+			sent := int(C.TxFlush(C.int(t.fd), t.ring, C.int(t.slotSize), C.int(t.conf.TxNumFrames), C.int(t.head), C.int(len(send)), &errno))
+			t.head = (t.head + sent) % t.conf.TxNumFrames
+			if sent == len(send) {
+				break
+			}
+			r := batch[send[sent]]
+			t.srv.log.V(1, "%v failed to send frame %d from %v: %v", t, r.frame, r.c, syscall.Errno(errno))
+			statuses[send[sent]] = protocol.TxFailed
+			send = send[sent+1:]
+		}
+		for i, r := range batch {
+			// Clients have at most TxNumFrames frames outstanding, which
+			// always fit in txDone.
+			r.c.txDone <- txCompletion{frame: r.frame, status: statuses[i]}
+		}
+	}
+}
+
+// check decides whether a frame may be sent, applying TxFilter and then
+// TxRateLimit.  Frames the filter rejects don't count against the rate limit.
+func (t *txRing) check(frame []byte) protocol.TxStatus {
+	if t.filter != nil && bpf.Run(t.filter, frame, nil) == 0 {
+		return protocol.TxRejected
+	}
+	if limit := float64(t.conf.TxRateLimit); limit > 0 {
+		now := time.Now()
+		t.tokens += now.Sub(t.refilled).Seconds() * limit
+		t.refilled = now
+		if t.tokens > limit {
+			t.tokens = limit
+		}
+		if t.tokens < 1 {
+			return protocol.TxRateLimited
+		}
+		t.tokens--
+	}
+	return protocol.TxSent
+}
+
+// close stops sending frames and closes the TX socket.  It's called once
+// all of the listener's clients are gone.
+func (t *txRing) close() {
+	close(t.done)
+	<-t.stopped
+	C.munmap(t.ring, C.size_t(t.slotSize)*C.size_t(t.conf.TxNumFrames))
+	syscall.Close(t.fd)
+	t.srv.log.V(1, "%v shut down", t)
+}
+
+// txBuffer is a client's view of the memory it passes frames to transmit in:
+// TxNumFrames frames of TxFrameSize bytes each, shared with the client.
+type txBuffer struct {
+	mem     []byte
+	pending []int32 // 1 while a frame is being sent, uses atomic
+}
+
+// newTxBuffer creates a client's txBuffer, returning it along with the file
+// to pass to the client, which the caller should close once it's passed.
+// The file is sealed at its size, so the client can't shrink it out from
+// under our mapping.
+func newTxBuffer(sc SocketConfig) (*txBuffer, *os.File, error) {
+	size := sc.TxFrameSize * sc.TxNumFrames
+	fd, err := C.TxBuffer(C.int(size))
+	if fd < 0 {
+		return nil, nil, fmt.Errorf("could not create TX buffer: %v", err)
+	}
+	f := os.NewFile(uintptr(fd), "testimony-tx")
+	mem, err := syscall.Mmap(int(fd), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("could not map TX buffer: %v", err)
+	}
+	return &txBuffer{mem: mem, pending: make([]int32, sc.TxNumFrames)}, f, nil
+}
+
+// txFrameReady handles a client's TxFrameReady TLV, which holds the index of
+// a frame in its txBuffer and the frame's length.  Returns an error if the
+// client broke the protocol, which ends the connection.
+func (c *conn) txFrameReady(val []byte) error {
+	if c.tx == nil {
+		return fmt.Errorf("client did not ask to transmit")
+	} else if len(val) != 8 {
+		return fmt.Errorf("bad TxFrameReady length %d", len(val))
+	}
+	frame, length := binary.BigEndian.Uint32(val[:4]), binary.BigEndian.Uint32(val[4:])
+	if frame >= uint32(len(c.tx.pending)) {
+		return fmt.Errorf("invalid TX frame %d", frame)
+	} else if !atomic.CompareAndSwapInt32(&c.tx.pending[frame], 0, 1) {
+		return fmt.Errorf("TX frame %d is already being sent", frame)
+	}
+	if length == 0 || length > uint32(c.s.conf.TxFrameSize) {
+		c.txDone <- txCompletion{frame: int(frame), status: protocol.TxInvalid}
+		return nil
+	}
+	start := int(frame) * c.s.conf.TxFrameSize
+	data := make([]byte, length)
+	copy(data, c.tx.mem[start:])
+	select {
+	case c.s.tx.requests <- txRequest{c: c, frame: int(frame), data: data}:
+	case <-c.s.tx.done:
+		return fmt.Errorf("TX ring is shut down")
+	}
+	return nil
+}
+
+// txComplete tells the client how sending a frame went, and lets it reuse
+// the frame.
+func (c *conn) txComplete(done txCompletion) error {
+	atomic.StoreInt32(&c.tx.pending[done.frame], 0)
+	var val [8]byte
+	binary.BigEndian.PutUint32(val[:4], uint32(done.frame))
+	binary.BigEndian.PutUint32(val[4:], uint32(done.status))
+	return protocol.SendTLV(c.c, protocol.TypeTxCompletion, val[:])
+}
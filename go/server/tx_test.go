@@ -0,0 +1,167 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/google/testimony/go/protocol"
+)
+
+func TestTxRingCheck(t *testing.T) {
+	// The filter admits frames whose first byte isn't zero.
+	filter, err := assembleBPF("ldb [0]\nret a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	const (
+		S = protocol.TxSent
+		R = protocol.TxRejected
+		L = protocol.TxRateLimited
+	)
+	pass, fail := []byte{1}, []byte{0}
+	for _, test := range []struct {
+		desc   string
+		filter bool
+		limit  int
+		tokens float64
+		idle   time.Duration // since the bucket was last refilled
+		frames [][]byte
+		want   []protocol.TxStatus
+	}{
+		{"no limits", false, 0, 0, 0, [][]byte{fail, fail, pass}, []protocol.TxStatus{S, S, S}},
+		{"filter", true, 0, 0, 0, [][]byte{pass, fail, pass}, []protocol.TxStatus{S, R, S}},
+		{"limit", false, 2, 2, 0, [][]byte{pass, pass, pass}, []protocol.TxStatus{S, S, L}},
+		{"empty bucket", false, 2, 0, 0, [][]byte{pass}, []protocol.TxStatus{L}},
+		{"refilled", false, 2, 0, 600 * time.Millisecond, [][]byte{pass, pass}, []protocol.TxStatus{S, L}},
+		// However long the socket has been idle, it can only send a burst
+		// of TxRateLimit frames.
+		{"burst capped", false, 3, 0, time.Hour, [][]byte{pass, pass, pass, pass}, []protocol.TxStatus{S, S, S, L}},
+		{"rejected frames are free", true, 2, 2, 0, [][]byte{fail, fail, fail, pass, fail, pass, pass}, []protocol.TxStatus{R, R, R, S, R, S, L}},
+		{"rate limited frames are still filtered", true, 1, 0, 0, [][]byte{fail, pass}, []protocol.TxStatus{R, L}},
+	} {
+		ring := &txRing{
+			conf:     SocketConfig{TxRateLimit: test.limit},
+			tokens:   test.tokens,
+			refilled: time.Now().Add(-test.idle),
+		}
+		if test.filter {
+			ring.filter = filter
+		}
+		var got []protocol.TxStatus
+		for _, frame := range test.frames {
+			got = append(got, ring.check(frame))
+		}
+		for i := range test.want {
+			if got[i] != test.want[i] {
+				t.Errorf("%s: got %v, want %v", test.desc, got, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestTxFrameReady(t *testing.T) {
+	const frameSize, numFrames = 8, 2
+	ready := func(frame, length uint32) []byte {
+		var val [8]byte
+		binary.BigEndian.PutUint32(val[:4], frame)
+		binary.BigEndian.PutUint32(val[4:], length)
+		return val[:]
+	}
+	for _, test := range []struct {
+		desc    string
+		val     []byte
+		pending int // frame already being sent, or -1
+		err     string
+		status  protocol.TxStatus // of an immediate completion, if no data
+		data    []byte            // sent to the TX ring
+	}{
+		{"first frame", ready(0, 3), -1, "", 0, []byte{0, 1, 2}},
+		{"whole last frame", ready(1, frameSize), -1, "", 0, []byte{8, 9, 10, 11, 12, 13, 14, 15}},
+		{"short value", ready(0, 3)[:4], -1, "bad TxFrameReady length 4", 0, nil},
+		{"long value", append(ready(0, 3), 0), -1, "bad TxFrameReady length 9", 0, nil},
+		{"bad index", ready(numFrames, 3), -1, "invalid TX frame 2", 0, nil},
+		{"huge index", ready(0xffffffff, 3), -1, "invalid TX frame 4294967295", 0, nil},
+		{"double submit", ready(1, 3), 1, "TX frame 1 is already being sent", 0, nil},
+		{"other frame pending", ready(0, 3), 1, "", 0, []byte{0, 1, 2}},
+		{"empty", ready(0, 0), -1, "", protocol.TxInvalid, nil},
+		{"too long", ready(1, frameSize+1), -1, "", protocol.TxInvalid, nil},
+	} {
+		mem := make([]byte, frameSize*numFrames)
+		for i := range mem {
+			mem[i] = byte(i)
+		}
+		c := &conn{
+			s: &socket{
+				conf: SocketConfig{TxFrameSize: frameSize, TxNumFrames: numFrames},
+				tx:   &txRing{requests: make(chan txRequest, numFrames), done: make(chan struct{})},
+			},
+			tx:     &txBuffer{mem: mem, pending: make([]int32, numFrames)},
+			txDone: make(chan txCompletion, numFrames),
+		}
+		if test.pending >= 0 {
+			c.tx.pending[test.pending] = 1
+		}
+		err := c.txFrameReady(test.val)
+		switch {
+		case test.err != "":
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: error %v, want %q", test.desc, err, test.err)
+			}
+		case err != nil:
+			t.Errorf("%s: %v", test.desc, err)
+		case test.data != nil:
+			select {
+			case r := <-c.s.tx.requests:
+				frame := int(binary.BigEndian.Uint32(test.val[:4]))
+				if r.c != c || r.frame != frame || !bytes.Equal(r.data, test.data) {
+					t.Errorf("%s: requested frame %d with %v, want frame %d with %v", test.desc, r.frame, r.data, frame, test.data)
+				}
+				// The ring gets a copy, so the client can't change a frame
+				// once it's been checked.
+				mem[frame*frameSize] ^= 0xff
+				if r.data[0] != test.data[0] {
+					t.Errorf("%s: request shares the client's buffer", test.desc)
+				}
+				if c.tx.pending[frame] != 1 {
+					t.Errorf("%s: frame %d isn't marked pending", test.desc, frame)
+				}
+			default:
+				t.Errorf("%s: no request sent to the TX ring", test.desc)
+			}
+		default:
+			select {
+			case done := <-c.txDone:
+				if done.status != test.status {
+					t.Errorf("%s: completed with %v, want %v", test.desc, done.status, test.status)
+				}
+			default:
+				t.Errorf("%s: no completion sent", test.desc)
+			}
+		}
+		if len(c.s.tx.requests) > 0 && test.data == nil {
+			t.Errorf("%s: unexpected request sent to the TX ring", test.desc)
+		}
+	}
+
+	c := &conn{}
+	if err := c.txFrameReady(ready(0, 1)); err == nil || err.Error() != "client did not ask to transmit" {
+		t.Errorf("without a TX buffer: error %v", err)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+#include <sys/socket.h>    // socket(), bind(), setsockopt()
+#include <sys/types.h>     // See socket man page
+#include <string.h>        // memset()
+#include <errno.h>         // errno
+#include <net/if.h>        // if_nametoindex()
+#include <sys/mman.h>      // mmap(), PROT_*, MAP_*
+#include <unistd.h>        // close(), ftruncate()
+#include <stddef.h>        // offsetof()
+#include <stdint.h>        // uint32_t, uint64_t
+#include <linux/bpf.h>     // bpf_attr, bpf_insn, BPF_MAP_TYPE_XSKMAP
+#include <linux/if_link.h> // XDP_FLAGS_SKB_MODE
+#include <linux/if_xdp.h>  // sockaddr_xdp, xdp_umem_reg, xdp_mmap_offsets
+#include <linux/memfd.h>   // MFD_CLOEXEC
+#include <sys/syscall.h>   // __NR_bpf, __NR_memfd_create
+
+#include "xdp.h"
+
+static int bpf(int cmd, union bpf_attr* attr) {
+  return syscall(__NR_bpf, cmd, attr, sizeof(*attr));
+}
+
+// xdpProgram loads an XDP program that redirects each packet to the AF_XDP
+// socket for its RX queue in the XSKMAP map_fd, and passes packets on queues
+// without one to the kernel.  Returns the program's file descriptor, or -1
+// and sets errno.
+static int xdpProgram(int map_fd, char* log_buf, int log_size) {
+  struct bpf_insn insns[] = {
+      // r2 = ctx->rx_queue_index
+      {.code = BPF_LDX | BPF_W | BPF_MEM, .dst_reg = BPF_REG_2,
+       .src_reg = BPF_REG_1, .off = offsetof(struct xdp_md, rx_queue_index)},
+      // r1 = map_fd, two instructions long
+      {.code = BPF_LD | BPF_DW | BPF_IMM, .dst_reg = BPF_REG_1,
+       .src_reg = BPF_PSEUDO_MAP_FD, .imm = map_fd},
+      {0},
+      // r3 = XDP_PASS, which bpf_redirect_map returns if r2 isn't in r1
+      {.code = BPF_ALU64 | BPF_MOV | BPF_K, .dst_reg = BPF_REG_3,
+       .imm = XDP_PASS},
+      {.code = BPF_JMP | BPF_CALL, .imm = BPF_FUNC_redirect_map},
+      {.code = BPF_JMP | BPF_EXIT},
+  };
+  union bpf_attr attr;
+  memset(&attr, 0, sizeof(attr));
+  attr.prog_type = BPF_PROG_TYPE_XDP;
+  attr.insns = (unsigned long)insns;
+  attr.insn_cnt = sizeof(insns) / sizeof(insns[0]);
+  attr.license = (unsigned long)"Apache-2.0";
+  attr.log_buf = (unsigned long)log_buf;
+  attr.log_size = log_size;
+  attr.log_level = 1;
+  log_buf[0] = 0;
+  return bpf(BPF_PROG_LOAD, &attr);
+}
+
+// xdpSocket creates an AF_XDP socket bound to the given queue of ifindex,
+// with RX, fill and completion rings of ring_size entries.  If shared_fd is
+// -1, the socket registers the umem_size bytes at umem as its UMEM;
+// otherwise, it shares shared_fd's UMEM.  Returns the socket, or -1 and sets
+// errno and err.
+static int xdpSocket(int ifindex, int queue, void* umem, size_t umem_size,
+                     int frame_size, int shared_fd, int ring_size,
+                     int generic, const char** err) {
+  int fd = socket(AF_XDP, SOCK_RAW | SOCK_CLOEXEC, 0);
+  if (fd < 0) {
+    *err = "AF_XDP socket creation failure";
+    return -1;
+  }
+  if (shared_fd < 0) {
+    struct xdp_umem_reg reg;
+    memset(&reg, 0, sizeof(reg));
+    reg.addr = (uint64_t)(uintptr_t)umem;
+    reg.len = umem_size;
+    reg.chunk_size = frame_size;
+    if (setsockopt(fd, SOL_XDP, XDP_UMEM_REG, &reg, sizeof(reg)) < 0) {
+      *err = "setsockopt XDP_UMEM_REG failure";
+      goto fail;
+    }
+  }
+  // Sockets sharing a UMEM on other queues need their own fill and
+  // completion rings.  We never transmit, but the kernel insists on both.
+  if (setsockopt(fd, SOL_XDP, XDP_UMEM_FILL_RING, &ring_size,
+                 sizeof(ring_size)) < 0) {
+    *err = "setsockopt XDP_UMEM_FILL_RING failure";
+    goto fail;
+  }
+  if (setsockopt(fd, SOL_XDP, XDP_UMEM_COMPLETION_RING, &ring_size,
+                 sizeof(ring_size)) < 0) {
+    *err = "setsockopt XDP_UMEM_COMPLETION_RING failure";
+    goto fail;
+  }
+  if (setsockopt(fd, SOL_XDP, XDP_RX_RING, &ring_size, sizeof(ring_size)) <
+      0) {
+    *err = "setsockopt XDP_RX_RING failure";
+    goto fail;
+  }
+  struct sockaddr_xdp addr;
+  memset(&addr, 0, sizeof(addr));
+  addr.sxdp_family = AF_XDP;
+  addr.sxdp_ifindex = ifindex;
+  addr.sxdp_queue_id = queue;
+  if (shared_fd >= 0) {
+    addr.sxdp_flags = XDP_SHARED_UMEM;
+    addr.sxdp_shared_umem_fd = shared_fd;
+  } else if (generic) {
+    addr.sxdp_flags = XDP_COPY;
+  }
+  if (bind(fd, (struct sockaddr*)&addr, sizeof(addr)) < 0) {
+    *err = "bind AF_XDP socket to queue failure";
+    goto fail;
+  }
+  return fd;
+
+fail:;
+  int e = errno;
+  close(fd);
+  errno = e;
+  return -1;
+}
+
+// XDPSockets sets up AF_XDP capture on queues 0 to queues-1 of an interface.
+// It creates an anonymous memory file of file_size bytes, whose first
+// umem_size bytes are a UMEM of frame_size byte frames shared by one AF_XDP
+// socket per queue (see xdpSocket), and attaches an XDP program redirecting
+// packets to them, in generic (skb) mode if generic is set.  It outputs the
+// memory file, the sockets (into xsk_fds, which must hold queues entries),
+// and a BPF link which detaches the program when it's closed.  On failure,
+// the verifier's log (if any) is written to log_buf.
+// Returns zero on success, on error returns -1 and sets errno.
+int XDPSockets(const char* iface, int queues, size_t umem_size,
+               size_t file_size, int frame_size, int ring_size, int generic,
+               // outputs:
+               int* mem_fd, int* xsk_fds, int* link_fd, char* log_buf,
+               int log_size, const char** err) {
+  int i, e, map_fd = -1, prog_fd = -1;
+  void* mem = MAP_FAILED;
+  union bpf_attr attr;
+  *mem_fd = -1;
+  *link_fd = -1;
+  for (i = 0; i < queues; i++) {
+    xsk_fds[i] = -1;
+  }
+  int ifindex = if_nametoindex(iface);
+  if (ifindex == 0) {
+    *err = "interface lookup failure";
+    return -1;
+  }
+
+  // The UMEM's pages stay pinned once registered, so we don't need to keep
+  // our mapping of them.
+  *mem_fd = syscall(__NR_memfd_create, "testimony-xdp", MFD_CLOEXEC);
+  if (*mem_fd < 0) {
+    *err = "memfd_create failure";
+    goto fail;
+  }
+  if (ftruncate(*mem_fd, file_size) < 0) {
+    *err = "memory file ftruncate failure";
+    goto fail;
+  }
+  mem = mmap(NULL, umem_size, PROT_READ | PROT_WRITE, MAP_SHARED, *mem_fd, 0);
+  if (mem == MAP_FAILED) {
+    *err = "UMEM mmap failure";
+    goto fail;
+  }
+  for (i = 0; i < queues; i++) {
+    xsk_fds[i] = xdpSocket(ifindex, i, mem, umem_size, frame_size,
+                           i == 0 ? -1 : xsk_fds[0], ring_size, generic, err);
+    if (xsk_fds[i] < 0) {
+      goto fail;
+    }
+  }
+  munmap(mem, umem_size);
+  mem = MAP_FAILED;
+
+  memset(&attr, 0, sizeof(attr));
+  attr.map_type = BPF_MAP_TYPE_XSKMAP;
+  attr.key_size = 4;
+  attr.value_size = 4;
+  attr.max_entries = queues;
+  map_fd = bpf(BPF_MAP_CREATE, &attr);
+  if (map_fd < 0) {
+    *err = "XSKMAP creation failure";
+    goto fail;
+  }
+  for (i = 0; i < queues; i++) {
+    uint32_t key = i, value = xsk_fds[i];
+    memset(&attr, 0, sizeof(attr));
+    attr.map_fd = map_fd;
+    attr.key = (unsigned long)&key;
+    attr.value = (unsigned long)&value;
+    if (bpf(BPF_MAP_UPDATE_ELEM, &attr) < 0) {
+      *err = "XSKMAP update failure";
+      goto fail;
+    }
+  }
+  prog_fd = xdpProgram(map_fd, log_buf, log_size);
+  if (prog_fd < 0) {
+    *err = "XDP program load failure";
+    goto fail;
+  }
+  memset(&attr, 0, sizeof(attr));
+  attr.link_create.prog_fd = prog_fd;
+  attr.link_create.target_ifindex = ifindex;
+  attr.link_create.attach_type = BPF_XDP;
+  attr.link_create.flags = generic ? XDP_FLAGS_SKB_MODE : 0;
+  *link_fd = bpf(BPF_LINK_CREATE, &attr);
+  if (*link_fd < 0) {
+    *err = "XDP program attach failure";
+    goto fail;
+  }
+  // The link holds the program, which holds the map, which holds the sockets.
+  close(prog_fd);
+  close(map_fd);
+  return 0;
+
+fail:
+  e = errno;
+  if (mem != MAP_FAILED) munmap(mem, umem_size);
+  if (prog_fd >= 0) close(prog_fd);
+  if (map_fd >= 0) close(map_fd);
+  for (i = 0; i < queues; i++) {
+    if (xsk_fds[i] >= 0) close(xsk_fds[i]);
+  }
+  if (*mem_fd >= 0) close(*mem_fd);
+  errno = e;
+  return -1;
+}
+
+// mapRing maps one of an AF_XDP socket's rings, of size entries of
+// desc_size bytes, at the given page offset.
+static int mapRing(int fd, struct xdp_ring_offset* off, int size,
+                   size_t desc_size, uint64_t pgoff, struct XDPRing* ring) {
+  ring->len = off->desc + size * desc_size;
+  ring->map = mmap(NULL, ring->len, PROT_READ | PROT_WRITE,
+                   MAP_SHARED | MAP_POPULATE, fd, pgoff);
+  if (ring->map == MAP_FAILED) {
+    ring->map = NULL;
+    return -1;
+  }
+  ring->producer = (uint32_t*)((char*)ring->map + off->producer);
+  ring->consumer = (uint32_t*)((char*)ring->map + off->consumer);
+  ring->descs = (char*)ring->map + off->desc;
+  ring->mask = size - 1;
+  return 0;
+}
+
+// XDPMapRings maps the RX and fill rings, of size entries each, of an AF_XDP
+// socket created by XDPSockets.
+// Returns zero on success, on error returns -1 and sets errno.
+int XDPMapRings(int fd, int size, struct XDPRing* rx, struct XDPRing* fill,
+                const char** err) {
+  struct xdp_mmap_offsets off;
+  socklen_t len = sizeof(off);
+  if (getsockopt(fd, SOL_XDP, XDP_MMAP_OFFSETS, &off, &len) < 0) {
+    *err = "getsockopt XDP_MMAP_OFFSETS failure";
+    return -1;
+  }
+  if (mapRing(fd, &off.rx, size, sizeof(struct xdp_desc), XDP_PGOFF_RX_RING,
+              rx) < 0) {
+    *err = "RX ring mmap failure";
+    return -1;
+  }
+  if (mapRing(fd, &off.fr, size, sizeof(uint64_t), XDP_UMEM_PGOFF_FILL_RING,
+              fill) < 0) {
+    *err = "fill ring mmap failure";
+    XDPUnmapRing(rx);
+    return -1;
+  }
+  return 0;
+}
+
+// XDPUnmapRing unmaps a ring mapped by XDPMapRings.
+void XDPUnmapRing(struct XDPRing* ring) {
+  if (ring->map != NULL) {
+    munmap(ring->map, ring->len);
+    ring->map = NULL;
+  }
+}
+
+// XDPPending returns the number of descriptors waiting in an RX ring.
+int XDPPending(struct XDPRing* rx) {
+  return __atomic_load_n(rx->producer, __ATOMIC_ACQUIRE) - *rx->consumer;
+}
+
+// XDPReceive moves up to max descriptors from an RX ring into block, stamping
+// each with nanos, and returns how many it moved.  Only one thread may
+// receive from a ring.
+int XDPReceive(struct XDPRing* rx, struct XDPBlock* block,
+               int max, int64_t nanos) {
+  uint32_t cons = *rx->consumer;
+  uint32_t n = __atomic_load_n(rx->producer, __ATOMIC_ACQUIRE) - cons;
+  uint32_t i;
+  struct xdp_desc* descs = (struct xdp_desc*)rx->descs;
+  if (n > (uint32_t)max) n = max;
+  for (i = 0; i < n; i++) {
+    struct xdp_desc* d = &descs[(cons + i) & rx->mask];
+    struct XDPPacket* p = &block->packets[block->num_pkts + i];
+    p->addr = d->addr;
+    p->len = d->len;
+    p->nanos = nanos;
+  }
+  __atomic_store_n(rx->consumer, cons + n, __ATOMIC_RELEASE);
+  block->num_pkts += n;
+  return n;
+}
+
+// XDPFill gives the frames holding a block's packets back to the kernel
+// through a fill ring, which must have room for them.  Only one thread may
+// fill a ring at a time.
+void XDPFill(struct XDPRing* fill, struct XDPBlock* block) {
+  uint32_t prod = *fill->producer;
+  uint32_t i;
+  uint64_t* addrs = (uint64_t*)fill->descs;
+  for (i = 0; i < block->num_pkts; i++) {
+    addrs[(prod + i) & fill->mask] = block->packets[i].addr;
+  }
+  __atomic_store_n(fill->producer, prod + block->num_pkts, __ATOMIC_RELEASE);
+}
+
+// XDPFillFrames gives frames frame_size bytes apart, starting at first, to
+// the kernel through a fill ring, which must have room for them.
+void XDPFillFrames(struct XDPRing* fill, uint64_t first, int frame_size,
+                   int count) {
+  uint32_t prod = *fill->producer;
+  int i;
+  uint64_t* addrs = (uint64_t*)fill->descs;
+  for (i = 0; i < count; i++) {
+    addrs[(prod + i) & fill->mask] = first + (uint64_t)i * frame_size;
+  }
+  __atomic_store_n(fill->producer, prod + count, __ATOMIC_RELEASE);
+}
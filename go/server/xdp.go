@@ -0,0 +1,461 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+/*
+#include <linux/if_xdp.h>  // for struct xdp_statistics
+#include <stdlib.h>  // for C.free
+#include <sys/mman.h>  // for mmap
+#include <sys/socket.h>  // for getsockopt
+
+#include "xdp.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Backend is how a socket captures packets.  In config files it's given by
+// name:  "afpacket" (the default) or "afxdp".
+type Backend int
+
+// Capture backends.
+const (
+	// BackendAFPacket captures with AF_PACKET sockets and TPACKET_V3 rings.
+	BackendAFPacket Backend = iota
+	// BackendAFXDP captures with one AF_XDP socket per receive queue, all
+	// sharing one UMEM, fed by an XDP program attached to the interface.
+	BackendAFXDP
+)
+
+var backendNames = map[Backend]string{
+	BackendAFPacket: "afpacket",
+	BackendAFXDP:    "afxdp",
+}
+
+// String returns the backend's name, or its number if it's not known.
+func (b Backend) String() string {
+	if name, ok := backendNames[b]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", int(b))
+}
+
+// MarshalJSON writes the backend by name.
+func (b Backend) MarshalJSON() ([]byte, error) {
+	return json.Marshal(b.String())
+}
+
+// UnmarshalJSON accepts a backend name.
+func (b *Backend) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err != nil {
+		return fmt.Errorf("Backend must be a name, got %s", data)
+	}
+	for backend, backendName := range backendNames {
+		if backendName == name {
+			*b = backend
+			return nil
+		}
+	}
+	var known []string
+	for backend := BackendAFPacket; backend <= BackendAFXDP; backend++ {
+		known = append(known, backend.String())
+	}
+	return fmt.Errorf("unknown Backend %q, want one of %s", name, strings.Join(known, ", "))
+}
+
+const (
+	// xdpProtocolVersion is sent to clients of AF_XDP sockets instead of
+	// protocolVersion, since their blocks aren't TPACKET_V3 blocks.
+	xdpProtocolVersion = 3
+	// xdpFrameSize is the size of each UMEM frame, which holds one packet.
+	xdpFrameSize = 4096
+	// xdpBlockHeaderSize and xdpPacketSize are the sizes of struct XDPBlock
+	// and struct XDPPacket.
+	xdpBlockHeaderSize = 8
+	xdpPacketSize      = 24
+	// xdpDefaultBlockTimeout is how long a block waits to fill up when
+	// BlockTimeoutMillis is 0.
+	xdpDefaultBlockTimeout = 8 * time.Millisecond
+	// xdpBusyRetries and xdpBusyDelay say how often and how long to wait for
+	// the kernel to release a queue (see openAFXDP).
+	xdpBusyRetries = 20
+	xdpBusyDelay   = 50 * time.Millisecond
+	// xdpLogSize is the size of the buffer for the verifier's log.
+	xdpLogSize = 1 << 16
+	// scmMaxFD is the most file descriptors one message can carry (SCM_MAX_FD).
+	scmMaxFD = 253
+)
+
+// The AF_XDP backend's memory file holds the UMEM, split into FanoutSize
+// regions of NumBlocks*BlockSize bytes, one per socket, followed by a table
+// of packets (a struct XDPBlock) for each of every socket's blocks.  A block
+// has room for a packet per BlockSize/xdpFrameSize frames, though the frames
+// its packets are in may be anywhere in its socket's region.
+
+// xdpFrames returns the number of packets each block can hold.
+func (sc SocketConfig) xdpFrames() int {
+	return sc.BlockSize / xdpFrameSize
+}
+
+// xdpTableSize returns the size of each block's packet table.
+func (sc SocketConfig) xdpTableSize() int {
+	return xdpBlockHeaderSize + xdpPacketSize*sc.xdpFrames()
+}
+
+// xdpUMEMSize returns the size of the UMEM.
+func (sc SocketConfig) xdpUMEMSize() int64 {
+	return int64(sc.FanoutSize) * int64(sc.NumBlocks) * int64(sc.BlockSize)
+}
+
+// xdpFileSize returns the size of the memory file holding the UMEM and the
+// packet tables.
+func (sc SocketConfig) xdpFileSize() int64 {
+	return sc.xdpUMEMSize() + int64(sc.FanoutSize)*int64(sc.NumBlocks)*int64(sc.xdpTableSize())
+}
+
+// xdpRingSize returns the number of entries in each AF_XDP socket's rings,
+// enough to hold every frame in its region.
+func (sc SocketConfig) xdpRingSize() int {
+	size := 1
+	for size < sc.NumBlocks*sc.xdpFrames() {
+		size <<= 1
+	}
+	return size
+}
+
+// rxQueues returns the number of receive queues an interface has.
+func rxQueues(iface string) (int, error) {
+	queues, err := filepath.Glob(filepath.Join("/sys/class/net", iface, "queues", "rx-*"))
+	if err != nil {
+		return 0, err
+	} else if len(queues) == 0 {
+		return 0, fmt.Errorf("could not find receive queues of %q", iface)
+	}
+	return len(queues), nil
+}
+
+// checkXDP returns an error if sc asks for something the AF_XDP backend
+// can't do.  Its XDP program redirects every packet on the captured queues,
+// and nothing filters, trims or timestamps them on the way.
+func (sc SocketConfig) checkXDP() error {
+	var bad []string
+	if len(sc.Interfaces) > 0 {
+		bad = append(bad, "Interfaces")
+	}
+	if sc.Filter != "" || !sc.FilterProgram.empty() {
+		bad = append(bad, "Filter and FilterProgram")
+	}
+	if sc.SnapLen != 0 {
+		bad = append(bad, "SnapLen")
+	}
+	if sc.Direction != DirectionBoth {
+		bad = append(bad, "Direction")
+	}
+	if sc.Promiscuous {
+		bad = append(bad, "Promiscuous")
+	}
+	if sc.RxHash {
+		bad = append(bad, "RxHash")
+	}
+	if sc.Timestamping != TimestampingSoftware {
+		bad = append(bad, "Timestamping")
+	}
+	if sc.TxRing {
+		bad = append(bad, "TxRing")
+	}
+	// Packets are fanned out by the receive queue they arrive on.
+	if sc.FanoutType != FanoutHash || sc.FanoutFlags != 0 || sc.FanoutID != 0 || sc.FanoutProgram != "" {
+		bad = append(bad, "FanoutType, FanoutFlags, FanoutID and FanoutProgram")
+	}
+	// The kernel decides where the UMEM goes.
+	if sc.NUMANode != nil {
+		bad = append(bad, "NUMANode")
+	}
+	if len(bad) > 0 {
+		return fmt.Errorf("Backend afxdp doesn't support %s", strings.Join(bad, ", "))
+	}
+	if sc.BlockSize%xdpFrameSize != 0 {
+		return fmt.Errorf("Backend afxdp needs BlockSize %d to be a multiple of its %d byte frames", sc.BlockSize, xdpFrameSize)
+	}
+	if sc.FanoutSize+2 > scmMaxFD {
+		return fmt.Errorf("Backend afxdp can't capture more than %d queues", scmMaxFD-2)
+	}
+	return nil
+}
+
+// openAFXDP sets up AF_XDP capture on queues 0 to FanoutSize-1 of a config's
+// interface, and returns the file descriptors of the memory file, the link
+// holding the XDP program to the interface, and each queue's socket, in that
+// order.
+func openAFXDP(sc SocketConfig) ([]int, error) {
+	iface := C.CString(sc.Interface)
+	defer C.free(unsafe.Pointer(iface))
+	var generic C.int
+	if sc.XDPGeneric {
+		generic = 1
+	}
+	xsks := make([]C.int, sc.FanoutSize)
+	logBuf := make([]byte, xdpLogSize)
+	var memFD, linkFD C.int
+	var errStr *C.char
+	var err error
+	// The kernel lets go of a queue's previous AF_XDP socket, like one a
+	// reload just closed, asynchronously, so binding may briefly be refused.
+	for try := 0; ; try++ {
+		_, err = C.XDPSockets(iface, C.int(sc.FanoutSize), C.size_t(sc.xdpUMEMSize()),
+			C.size_t(sc.xdpFileSize()), xdpFrameSize, C.int(sc.xdpRingSize()), generic,
+			&memFD, &xsks[0], &linkFD, (*C.char)(unsafe.Pointer(&logBuf[0])), C.int(len(logBuf)),
+			&errStr)
+		if err != syscall.EBUSY || try == xdpBusyRetries {
+			break
+		}
+		time.Sleep(xdpBusyDelay)
+	}
+	if err != nil {
+		if n := bytes.IndexByte(logBuf, 0); n >= 0 {
+			logBuf = logBuf[:n]
+		}
+		if log := strings.TrimSpace(string(logBuf)); log != "" {
+			return nil, fmt.Errorf("C XDPSockets call failed: %v: %v:\n%s", C.GoString(errStr), err, log)
+		}
+		return nil, fmt.Errorf("C XDPSockets call failed: %v: %v", C.GoString(errStr), err)
+	}
+	fds := []int{int(memFD), int(linkFD)}
+	for _, fd := range xsks {
+		fds = append(fds, int(fd))
+	}
+	return fds, nil
+}
+
+// xdpSockets is a listener's AF_XDP capture:  its UMEM, and the sockets and
+// XDP program feeding it.  The listener's sockets each use one AF_XDP socket.
+type xdpSockets struct {
+	memFD  int            // memory file holding the UMEM and packet tables
+	linkFD int            // link attaching the XDP program, which detaches it once closed
+	xsks   []int          // AF_XDP socket for each queue
+	tables unsafe.Pointer // the memory file's packet tables, mapped read-write
+	size   int            // size of tables
+}
+
+// newXDPSockets sets up AF_XDP capture for sc.
+func (s *Server) newXDPSockets(sc SocketConfig) (*xdpSockets, error) {
+	// Like AF_PACKET sockets, creating these may need the privileged helper.
+	fds, err := s.privileged.afXDP(sc)
+	if err != nil {
+		return nil, err
+	}
+	x := &xdpSockets{memFD: fds[0], linkFD: fds[1], xsks: fds[2:]}
+	x.size = int(sc.xdpFileSize() - sc.xdpUMEMSize())
+	tables, err := C.mmap(nil, C.size_t(x.size), C.PROT_READ|C.PROT_WRITE, C.MAP_SHARED, C.int(x.memFD), C.off_t(sc.xdpUMEMSize()))
+	if tables == C.MAP_FAILED {
+		x.size = 0
+		x.close()
+		return nil, fmt.Errorf("could not map packet tables: %v", err)
+	}
+	x.tables = tables
+	return x, nil
+}
+
+// close unmaps the packet tables and closes all file descriptors, detaching
+// the XDP program.  The listener's sockets must have stopped.
+func (x *xdpSockets) close() {
+	if x.size > 0 {
+		C.munmap(x.tables, C.size_t(x.size))
+	}
+	for _, fd := range x.xsks {
+		syscall.Close(fd)
+	}
+	syscall.Close(x.linkFD)
+	syscall.Close(x.memFD)
+}
+
+// xdpMember is the AF_XDP state of a socket's only member.
+type xdpMember struct {
+	x       *xdpSockets
+	rx      C.struct_XDPRing
+	fill    C.struct_XDPRing
+	fillMu  sync.Mutex     // guards fill, which blocks are returned through
+	wake    chan struct{}  // wakes getNewXDPBlocks, for packets or returned blocks
+	tables  unsafe.Pointer // the socket's first packet table
+	packets uint64         // packets received since the last stats call, uses atomic
+	drops   uint64         // drops the kernel reported at the last stats call
+}
+
+// newXDPMember sets up a socket to capture from its queue's AF_XDP socket, and
+// gives all the frames in its region of the UMEM to the kernel.
+func (s *socket) newXDPMember(x *xdpSockets) (*member, error) {
+	sc := s.conf
+	xm := &xdpMember{
+		x:      x,
+		wake:   make(chan struct{}, 1),
+		tables: unsafe.Pointer(uintptr(x.tables) + uintptr(s.num*sc.NumBlocks*sc.xdpTableSize())),
+	}
+	fd := x.xsks[s.num]
+	var errStr *C.char
+	if _, err := C.XDPMapRings(C.int(fd), C.int(sc.xdpRingSize()), &xm.rx, &xm.fill, &errStr); err != nil {
+		return nil, fmt.Errorf("C XDPMapRings call failed: %v: %v", C.GoString(errStr), err)
+	}
+	first := int64(s.num) * int64(sc.NumBlocks) * int64(sc.BlockSize)
+	C.XDPFillFrames(&xm.fill, C.uint64_t(first), xdpFrameSize, C.int(sc.NumBlocks*sc.xdpFrames()))
+	return &member{
+		s:     s,
+		iface: sc.Interface,
+		fd:    fd,
+		xdp:   xm,
+	}, nil
+}
+
+// unmap unmaps the member's rings.
+func (xm *xdpMember) unmap() {
+	C.XDPUnmapRing(&xm.rx)
+	C.XDPUnmapRing(&xm.fill)
+}
+
+// table returns the packet table of the socket's block i.
+func (xm *xdpMember) table(sc SocketConfig, i int) *C.struct_XDPBlock {
+	return (*C.struct_XDPBlock)(unsafe.Pointer(uintptr(xm.tables) + uintptr(i*sc.xdpTableSize())))
+}
+
+// numPackets returns the number of packets in a block's table.  A block with
+// no packets is free to be filled.
+func numPackets(t *C.struct_XDPBlock) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Pointer(&t.num_pkts)))
+}
+
+// getNewXDPBlocks is getNewBlocks for an AF_XDP member.  The kernel has no
+// notion of blocks, so it builds them itself:  each gets up to one packet per
+// frame its size would hold, and is handed out once it's full or its first
+// packet has waited BlockTimeoutMillis.
+func (s *socket) getNewXDPBlocks(m *member) {
+	s.pin()
+	xm := m.xdp
+	if err := s.srv.poller.add(m.fd, xm.wake); err != nil {
+		s.srv.fail(fmt.Errorf("%v can't watch for new packets: %v", m, err))
+		return
+	}
+	defer s.srv.poller.remove(m.fd)
+	timeout := time.Duration(s.conf.BlockTimeoutMillis) * time.Millisecond
+	if timeout == 0 {
+		timeout = xdpDefaultBlockTimeout
+	}
+	frames := C.uint32_t(s.conf.xdpFrames())
+	// wait waits for packets, a returned block, or the deadline.  It returns
+	// whether the deadline passed, and false for ok if the socket is
+	// shutting down.
+	wait := func(deadline <-chan time.Time) (expired, ok bool) {
+		atomic.StoreInt64(&m.heartbeat, time.Now().UnixNano())
+		atomic.StoreInt32(&m.waiting, 1)
+		defer atomic.StoreInt32(&m.waiting, 0)
+		select {
+		case <-xm.wake:
+		case <-deadline:
+			expired = true
+		case <-s.done:
+			return false, false
+		}
+		return expired, true
+	}
+	blockIndex := 0
+	for {
+		b := s.blocks[blockIndex]
+		t := xm.table(s.conf, blockIndex)
+		atomic.StoreInt32(&m.blockIndex, int32(blockIndex))
+		// Wait for the block's last user to give its frames back.
+		for numPackets(t) != 0 {
+			if _, ok := wait(nil); !ok {
+				return
+			}
+		}
+		var timer *time.Timer
+		var deadline <-chan time.Time
+		expired, ok := false, true
+		for t.num_pkts < frames {
+			n := C.XDPReceive(&xm.rx, t, C.int(frames-t.num_pkts), C.int64_t(time.Now().UnixNano()))
+			if n > 0 {
+				atomic.AddUint64(&xm.packets, uint64(n))
+				if timer == nil {
+					timer = time.NewTimer(timeout)
+					deadline = timer.C
+				}
+				continue
+			} else if expired {
+				break
+			}
+			if expired, ok = wait(deadline); !ok {
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		b.ref()
+		s.srv.log.V(3, "%v got new block %v with %d packets", m, b, t.num_pkts)
+		select {
+		case s.newBlocks <- b:
+		case <-s.done:
+			b.unref()
+			return
+		}
+		blockIndex = (blockIndex + 1) % s.conf.NumBlocks
+		atomic.StoreInt64(&m.heartbeat, time.Now().UnixNano())
+	}
+}
+
+// clear gives the frames holding a block's packets back to the kernel, and
+// frees the block to be filled again.
+func (xm *xdpMember) clear(b *block) {
+	t := xm.table(b.s.conf, b.index)
+	xm.fillMu.Lock()
+	C.XDPFill(&xm.fill, t)
+	xm.fillMu.Unlock()
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&t.num_pkts)), 0)
+	select {
+	case xm.wake <- struct{}{}:
+	default:
+	}
+}
+
+// ready returns true when a block is free and packets are waiting for it.
+func (xm *xdpMember) ready(b *block) bool {
+	return numPackets(xm.table(b.s.conf, b.index)) == 0 && C.XDPPending(&xm.rx) > 0
+}
+
+// xdpStats returns the packets received and dropped since the last call.
+func (m *member) xdpStats() (packets, drops uint64, err error) {
+	var out C.struct_xdp_statistics
+	size := C.socklen_t(unsafe.Sizeof(out))
+	if _, err := C.getsockopt(C.int(m.fd), C.SOL_XDP, C.XDP_STATISTICS, unsafe.Pointer(&out), &size); err != nil {
+		return 0, 0, err
+	}
+	// Unlike PACKET_STATISTICS, these counters don't reset when read.
+	total := uint64(out.rx_dropped) + uint64(out.rx_ring_full)
+	drops, m.xdp.drops = total-m.xdp.drops, total
+	return atomic.SwapUint64(&m.xdp.packets, 0), drops, nil
+}
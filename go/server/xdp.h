@@ -0,0 +1,72 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Shared between xdp.c and xdp.go.
+
+#ifndef TESTIMONY_SERVER_XDP_H_
+#define TESTIMONY_SERVER_XDP_H_
+
+#include <stddef.h>  // size_t
+#include <stdint.h>  // uint32_t, uint64_t, int64_t
+
+#ifndef AF_XDP
+#define AF_XDP 44  // since Linux 4.18
+#endif
+
+#ifndef SOL_XDP
+#define SOL_XDP 283
+#endif
+
+// XDPRing is one of an AF_XDP socket's rings, as mapped by XDPMapRings.
+struct XDPRing {
+  void* map;
+  size_t len;
+  uint32_t* producer;
+  uint32_t* consumer;
+  void* descs;
+  uint32_t mask;
+};
+
+// XDPPacket describes a packet in the UMEM.  Clients read these, so the
+// layout is part of the protocol (see README.md).
+struct XDPPacket {
+  uint64_t addr;  // offset of the packet's data in the UMEM
+  uint32_t len;   // length of the packet's data
+  uint32_t reserved;
+  int64_t nanos;  // receive time, in nanoseconds since the epoch
+};
+
+// XDPBlock is the table of packets making up one block of an AF_XDP socket.
+struct XDPBlock {
+  uint32_t num_pkts;
+  uint32_t reserved;
+  struct XDPPacket packets[];
+};
+
+int XDPSockets(const char* iface, int queues, size_t umem_size,
+               size_t file_size, int frame_size, int ring_size, int generic,
+               // outputs:
+               int* mem_fd, int* xsk_fds, int* link_fd, char* log_buf,
+               int log_size, const char** err);
+int XDPMapRings(int fd, int size, struct XDPRing* rx, struct XDPRing* fill,
+                const char** err);
+void XDPUnmapRing(struct XDPRing* ring);
+int XDPPending(struct XDPRing* rx);
+int XDPReceive(struct XDPRing* rx, struct XDPBlock* block, int max,
+               int64_t nanos);
+void XDPFill(struct XDPRing* fill, struct XDPBlock* block);
+void XDPFillFrames(struct XDPRing* fill, uint64_t first, int frame_size,
+                   int count);
+
+#endif  // TESTIMONY_SERVER_XDP_H_
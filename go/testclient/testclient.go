@@ -28,6 +28,7 @@ var (
 	socketName = flag.String("socket", "", "Name of testimony socket")
 	fanoutInt  = flag.Int("fanout", 0, "Fanout number, if applicable")
 	dump       = flag.Bool("dump", false, "If true, output packet dump as hex")
+	vlan       = flag.Bool("vlan", false, "If true, dump packets with stripped VLAN tags put back")
 	count      = flag.Int("count", -1, "If == 0, number of packets to read in")
 )
 
@@ -39,6 +40,16 @@ func main() {
 	if err != nil {
 		log.Fatalf("failed to connect: %v", err)
 	}
+	log.Printf("connected, %v timestamps", conn.Timestamping())
+	if ifaces := conn.Interfaces(); len(ifaces) > 1 {
+		log.Printf("capturing on interfaces %q", ifaces)
+	}
+	if hashes := conn.FilterHashes(); hashes != nil {
+		log.Printf("socket filter hashes %v", hashes)
+	}
+	if cpu, node := conn.CPU(*fanoutInt), conn.NUMANode(*fanoutInt); cpu >= 0 || node >= 0 {
+		log.Printf("fanout %d is on CPU %d, NUMA node %d", *fanoutInt, cpu, node)
+	}
 	log.Printf("setting fanout to %d", *fanoutInt)
 	if err := conn.Init(*fanoutInt); err != nil {
 		log.Fatalf("failed to set fanout: %v", err)
@@ -62,7 +73,9 @@ func main() {
 				break
 			}
 			*count--
-			if *dump {
+			if *dump && *vlan {
+				fmt.Printf("%x\n", block.PacketDataWithVLAN())
+			} else if *dump {
 				fmt.Printf("%x\n", block.PacketData())
 			}
 			blockCount++
@@ -72,7 +85,7 @@ func main() {
 			log.Fatalf("block return failed: %v", err)
 		}
 		totalCount += blockCount
-		log.Printf("block %d had %d packets, %d total in %v", blockNum, blockCount, totalCount, time.Since(start))
+		log.Printf("block %d from %q had %d packets, %d total in %v", blockNum, block.Interface(), blockCount, totalCount, time.Since(start))
 		if *count == 0 {
 			break
 		}
@@ -16,19 +16,34 @@
 // across multiple processes.
 package testimony
 
-// #include <linux/if_packet.h>
+/*
+#include <linux/if_packet.h>
+
+// The variant fields are in an anonymous union, which cgo can't get at.
+static __u32 packet_rxhash(struct tpacket3_hdr* h) { return h->hv1.tp_rxhash; }
+static __u16 packet_vlan_tci(struct tpacket3_hdr* h) { return h->hv1.tp_vlan_tci; }
+static __u16 packet_vlan_tpid(struct tpacket3_hdr* h) { return h->hv1.tp_vlan_tpid; }
+
+// The packet's address follows its header.
+static unsigned char packet_pkttype(struct tpacket3_hdr* h) {
+  return ((struct sockaddr_ll*)((char*)h + TPACKET_ALIGN(sizeof(*h))))->sll_pkttype;
+}
+*/
 import "C"
 
 import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
 	"syscall"
+	"time"
 	"unsafe"
 
 	"github.com/google/testimony/go/protocol"
@@ -36,6 +51,34 @@ import (
 
 const protocolVersion = 2
 
+// xdpProtocolVersion is sent by servers capturing with AF_XDP, whose blocks
+// are tables of packets in a UMEM rather than TPACKET_V3 blocks.
+const xdpProtocolVersion = 3
+
+// multiInterfaceProtocolVersion is sent by servers for sockets with more than
+// one interface, which pass a ring per interface.
+const multiInterfaceProtocolVersion = 4
+
+// Sizes of the AF_XDP packet table's header and of each of its packets.
+const (
+	xdpBlockHeaderSize = 8
+	xdpPacketSize      = 24
+)
+
+// ErrShuttingDown is returned by Block once the server has announced that it's
+// shutting down.  Outstanding blocks should still be returned, after which the
+// server closes the connection.
+var ErrShuttingDown = errors.New("testimonyd is shutting down")
+
+// ErrRingReplaced is returned by Block once the server has announced that the
+// socket's interface went away or changed, so its ring is being replaced.
+// Outstanding blocks should still be returned, then the client should
+// reconnect to get the new ring.
+var ErrRingReplaced = errors.New("testimonyd is replacing this socket's ring")
+
+// ErrTxBusy is returned by Transmit when every TX frame is still being sent.
+var ErrTxBusy = errors.New("no free TX frames")
+
 func localSocketName() string {
 	var randbytes [8]byte
 	if n, err := rand.Read(randbytes[:]); err != nil || n != len(randbytes) {
@@ -47,34 +90,105 @@ func localSocketName() string {
 // Conn is a connection to the testimonyd server.  It allows the current process
 // to share testimonyd AF_PACKET sockets.
 type Conn struct {
-	c    *net.UnixConn
-	fd   int
-	ring []byte
+	c     *net.UnixConn
+	fds   []int    // AF_PACKET socket for each interface
+	rings [][]byte // ring of each AF_PACKET socket
 
-	numBlocks  int
-	blockSize  int
-	fanoutSize int
+	interfaces   []string // interface of each ring, nil if the server didn't say
+	filterHashes []string // hash of each ring's socket filter, nil if the server didn't say
+
+	numBlocks    int
+	blockSize    int
+	fanoutSize   int
+	timestamping protocol.TimestampSource
+	cpus         []uint32 // CPU each fanout index is pinned to, nil if none
+	numaNodes    []uint32 // NUMA node each fanout index's ring is on, nil if unknown
+	xdpFrameSize int      // size of the UMEM's frames, 0 unless the server uses AF_XDP
+	fanoutIndex  int
+
+	txFrameSize int
+	txNumFrames int
+	tx          []byte // shared with testimonyd, nil if not transmitting
+	txMu        sync.Mutex
+	txFree      []int // indexes of TX frames not being sent, guarded by txMu
+	txDone      chan TxCompletion
+}
+
+// TxCompletion is the outcome of sending a frame passed to Transmit.
+type TxCompletion struct {
+	Frame  int // as returned by Transmit
+	Status protocol.TxStatus
 }
 
 func (c *Conn) NumBlocks() int  { return c.numBlocks }
 func (c *Conn) BlockSize() int  { return c.blockSize }
 func (c *Conn) FanoutSize() int { return c.fanoutSize }
 
+// Interfaces returns the interfaces the socket captures on.  Each has its own
+// ring of NumBlocks()/len(Interfaces()) blocks.  Servers that don't say
+// return nil, and have a single ring.
+func (c *Conn) Interfaces() []string { return c.interfaces }
+
+// FilterHashes returns the hex SHA-256 hash of the socket filter on each of
+// Interfaces(), which the server read back from the kernel and checked before
+// serving the socket, so clients can confirm they see the packets of the
+// filter they expect ("testimonyd filtertest" prints a filter's hash).
+// Servers that don't say, or use AF_XDP, return nil.
+func (c *Conn) FilterHashes() []string { return c.filterHashes }
+
+// Timestamping returns where packet timestamps come from.  Servers that don't
+// say use software timestamps.
+func (c *Conn) Timestamping() protocol.TimestampSource { return c.timestamping }
+
+// CPU returns the CPU the server pinned fanout index i's socket to, which
+// readers of that index may want to run on too, or -1 if it isn't pinned to
+// one.
+func (c *Conn) CPU(i int) int {
+	if i < 0 || i >= len(c.cpus) {
+		return -1
+	}
+	return int(c.cpus[i])
+}
+
+// NUMANode returns the NUMA node fanout index i's ring was allocated on, or
+// -1 if the server didn't choose one.
+func (c *Conn) NUMANode(i int) int {
+	if i < 0 || i >= len(c.numaNodes) {
+		return -1
+	}
+	return int(int32(c.numaNodes[i]))
+}
+
+// TxFrameSize returns the largest frame Transmit accepts, or 0 if the socket
+// doesn't allow transmitting.
+func (c *Conn) TxFrameSize() int { return c.txFrameSize }
+
+// TxNumFrames returns how many frames may be being sent at once, or 0 if the
+// socket doesn't allow transmitting.
+func (c *Conn) TxNumFrames() int { return c.txNumFrames }
+
 // Close closes the connection to the testimonyd server.
 func (t *Conn) Close() (ret error) {
-	if t.ring != nil {
-		if err := syscall.Munmap(t.ring); err != nil {
+	if t.tx != nil {
+		if err := syscall.Munmap(t.tx); err != nil {
 			ret = err
 		} else {
-			t.ring = nil
+			t.tx = nil
 		}
 	}
-	if t.fd != 0 {
-		if err := syscall.Close(t.fd); err != nil {
+	for len(t.rings) > 0 {
+		if err := syscall.Munmap(t.rings[0]); err != nil {
 			ret = err
-		} else {
-			t.fd = 0
+			break
+		}
+		t.rings = t.rings[1:]
+	}
+	for len(t.fds) > 0 {
+		if err := syscall.Close(t.fds[0]); err != nil {
+			ret = err
+			break
 		}
+		t.fds = t.fds[1:]
 	}
 	if t.c != nil {
 		if err := t.c.Close(); err != nil {
@@ -87,14 +201,27 @@ func (t *Conn) Close() (ret error) {
 }
 
 // Block is an AF_PACKET TPACKETv3 block, and provides access to the packets in
-// that block.
+// that block.  For servers capturing with AF_XDP, B is instead a table of the
+// block's packets, whose data is in the UMEM.
 type Block struct {
 	t      *Conn
 	i      int
+	iface  string
 	B      []byte
 	offset int
 	left   int
 	pkt    *C.struct_tpacket3_hdr
+	umem   []byte     // UMEM the packets are in, nil for AF_PACKET blocks
+	xpkt   *xdpPacket // current AF_XDP packet
+}
+
+// xdpPacket is an entry in an AF_XDP block's packet table, in native byte
+// order.
+type xdpPacket struct {
+	Addr  uint64 // offset of the packet's data in the UMEM
+	Len   uint32
+	_     uint32
+	Nanos int64 // receive time
 }
 
 // Connect connects to the testimonyd server.
@@ -116,8 +243,8 @@ func Connect(socketname string) (*Conn, error) {
 	var version [1]byte
 	if _, err := io.ReadFull(t.c, version[:]); err != nil {
 		return nil, fmt.Errorf("error reading initial byte: %v", err)
-	} else if version[0] != protocolVersion {
-		return nil, fmt.Errorf("protocol mismatch, want %v got %v", protocolVersion, version[0])
+	} else if version[0] != protocolVersion && version[0] != xdpProtocolVersion && version[0] != multiInterfaceProtocolVersion {
+		return nil, fmt.Errorf("protocol mismatch, want %v, %v or %v got %v", protocolVersion, xdpProtocolVersion, multiInterfaceProtocolVersion, version[0])
 	}
 	var buf [4]byte
 tlvLoop:
@@ -151,6 +278,46 @@ tlvLoop:
 				return nil, fmt.Errorf("invalid num blocks length %d", length)
 			}
 			t.numBlocks = int(binary.BigEndian.Uint32(val))
+		case protocol.TypeTimestamping:
+			if length != 4 {
+				return nil, fmt.Errorf("invalid timestamping length %d", length)
+			}
+			t.timestamping = protocol.TimestampSource(binary.BigEndian.Uint32(val))
+		case protocol.TypeTxFrameSize:
+			if length != 4 {
+				return nil, fmt.Errorf("invalid TX frame size length %d", length)
+			}
+			t.txFrameSize = int(binary.BigEndian.Uint32(val))
+		case protocol.TypeTxNumFrames:
+			if length != 4 {
+				return nil, fmt.Errorf("invalid TX num frames length %d", length)
+			}
+			t.txNumFrames = int(binary.BigEndian.Uint32(val))
+		case protocol.TypeCPUs:
+			if t.cpus, err = protocol.Uint32s(val); err != nil {
+				return nil, fmt.Errorf("invalid CPUs: %v", err)
+			}
+		case protocol.TypeNUMANodes:
+			if t.numaNodes, err = protocol.Uint32s(val); err != nil {
+				return nil, fmt.Errorf("invalid NUMA nodes: %v", err)
+			}
+		case protocol.TypeInterfaces:
+			if t.interfaces, err = protocol.Strings(val); err != nil {
+				return nil, fmt.Errorf("invalid interfaces: %v", err)
+			}
+		case protocol.TypeFilterHashes:
+			if length%protocol.FilterHashSize != 0 {
+				return nil, fmt.Errorf("invalid filter hashes length %d", length)
+			}
+			t.filterHashes = []string{}
+			for i := 0; i < length; i += protocol.FilterHashSize {
+				t.filterHashes = append(t.filterHashes, hex.EncodeToString(val[i:i+protocol.FilterHashSize]))
+			}
+		case protocol.TypeXDPFrameSize:
+			if length != 4 {
+				return nil, fmt.Errorf("invalid XDP frame size length %d", length)
+			}
+			t.xdpFrameSize = int(binary.BigEndian.Uint32(val))
 		default:
 			// ignore
 		}
@@ -158,17 +325,56 @@ tlvLoop:
 	if t.fanoutSize <= 0 || t.blockSize <= 0 || t.numBlocks <= 0 {
 		return nil, fmt.Errorf("missing fanout/block size or num blocks")
 	}
+	if (t.cpus != nil && len(t.cpus) != t.fanoutSize) || (t.numaNodes != nil && len(t.numaNodes) != t.fanoutSize) {
+		return nil, fmt.Errorf("got CPUs or NUMA nodes for %d/%d fanout indexes, want %d", len(t.cpus), len(t.numaNodes), t.fanoutSize)
+	}
+	if t.interfaces != nil && (len(t.interfaces) == 0 || t.numBlocks%len(t.interfaces) != 0) {
+		return nil, fmt.Errorf("%d blocks can't be split between %d interfaces", t.numBlocks, len(t.interfaces))
+	}
+	if t.filterHashes != nil && len(t.filterHashes) != t.numRings() {
+		return nil, fmt.Errorf("got filter hashes for %d interfaces, want %d", len(t.filterHashes), t.numRings())
+	}
+	if multi := version[0] == multiInterfaceProtocolVersion; multi != (t.numRings() > 1) {
+		return nil, fmt.Errorf("protocol version %v doesn't match %d interfaces", version[0], t.numRings())
+	}
+	if version[0] == xdpProtocolVersion {
+		if t.xdpFrameSize <= 0 || t.blockSize%t.xdpFrameSize != 0 {
+			return nil, fmt.Errorf("invalid XDP frame size %d for block size %d", t.xdpFrameSize, t.blockSize)
+		} else if t.numRings() != 1 || t.txNumFrames != 0 {
+			return nil, fmt.Errorf("AF_XDP sockets have one interface and can't transmit")
+		}
+	} else {
+		t.xdpFrameSize = 0
+	}
 	done = true
 	return t, nil
 }
 
 func (t *Conn) Init(fanoutIndex int) (err error) {
+	return t.init(fanoutIndex, false)
+}
+
+// InitTx is Init, but also sets up the connection to transmit frames with
+// Transmit.  The socket must allow transmitting (see TxNumFrames).
+func (t *Conn) InitTx(fanoutIndex int) error {
+	if t.txNumFrames <= 0 || t.txFrameSize <= 0 {
+		return errors.New("socket does not allow transmitting")
+	}
+	return t.init(fanoutIndex, true)
+}
+
+func (t *Conn) init(fanoutIndex int, tx bool) (err error) {
 	// TODO:  Parse fanout size, allow client to chose fanout number based on it.
 	defer func() {
 		if err != nil {
 			t.Close()
 		}
 	}()
+	if tx {
+		if err := protocol.SendType(t.c, protocol.TypeTxRequest); err != nil {
+			return fmt.Errorf("error requesting TX: %v", err)
+		}
+	}
 	if err := protocol.SendUint32(t.c, protocol.TypeFanoutIndex, uint32(fanoutIndex)); err != nil {
 		return fmt.Errorf("error writing fanout index: %v", err)
 	}
@@ -188,17 +394,71 @@ func (t *Conn) Init(fanoutIndex int) (err error) {
 		return fmt.Errorf("wrong number of control messages: %d", len(msgs))
 	} else if fds, err := syscall.ParseUnixRights(&msgs[0]); err != nil {
 		return fmt.Errorf("could not parse unix rights: %v", err)
-	} else if len(fds) != 1 {
-		return fmt.Errorf("wrong number of fds: %d", len(fds))
+	} else if want := t.numRings() + btoi(tx); len(fds) != want {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return fmt.Errorf("wrong number of fds: got %d, want %d", len(fds), want)
 	} else {
-		t.fd = fds[0]
+		t.fds = fds[:t.numRings()]
+		if tx {
+			txFD := fds[len(fds)-1]
+			defer syscall.Close(txFD)
+			if t.tx, err = syscall.Mmap(txFD, 0, t.txFrameSize*t.txNumFrames, syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED); err != nil {
+				return fmt.Errorf("TX mmap failed: %v", err)
+			}
+			for i := 0; i < t.txNumFrames; i++ {
+				t.txFree = append(t.txFree, i)
+			}
+			t.txDone = make(chan TxCompletion, t.txNumFrames)
+		}
+	}
+	t.fanoutIndex = fanoutIndex
+	if t.xdpFrameSize > 0 {
+		// The one file holds the UMEM, then every block's packet table.
+		ring, err := syscall.Mmap(t.fds[0], 0, t.umemSize()+t.fanoutSize*t.numBlocks*t.xdpTableSize(), syscall.PROT_READ, syscall.MAP_SHARED|syscall.MAP_NORESERVE)
+		if err != nil {
+			return fmt.Errorf("mmap failed: %v", err)
+		}
+		t.rings = append(t.rings, ring)
+		return nil
 	}
-	if t.ring, err = syscall.Mmap(t.fd, 0, t.blockSize*t.numBlocks, syscall.PROT_READ, syscall.MAP_SHARED|syscall.MAP_NORESERVE); err != nil {
-		return fmt.Errorf("mmap failed: %v", err)
+	ringBlocks := t.numBlocks / t.numRings()
+	for _, fd := range t.fds {
+		ring, err := syscall.Mmap(fd, 0, t.blockSize*ringBlocks, syscall.PROT_READ, syscall.MAP_SHARED|syscall.MAP_NORESERVE)
+		if err != nil {
+			return fmt.Errorf("mmap failed: %v", err)
+		}
+		t.rings = append(t.rings, ring)
 	}
 	return nil
 }
 
+// numRings returns the number of rings the server passes, one per interface.
+func (t *Conn) numRings() int {
+	if t.interfaces == nil {
+		return 1
+	}
+	return len(t.interfaces)
+}
+
+// umemSize returns the size of an AF_XDP socket's UMEM.
+func (t *Conn) umemSize() int {
+	return t.fanoutSize * t.numBlocks * t.blockSize
+}
+
+// xdpTableSize returns the size of each AF_XDP block's packet table.
+func (t *Conn) xdpTableSize() int {
+	return xdpBlockHeaderSize + xdpPacketSize*(t.blockSize/t.xdpFrameSize)
+}
+
+func btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
 // Block gets the next block of packets from testimonyd.
 func (t *Conn) Block() (*Block, error) {
 	var idx int
@@ -215,9 +475,20 @@ readLoop:
 			idx = int(num)
 			break readLoop
 		case protocol.TypeServerToClient:
-			if _, err := io.ReadFull(t.c, make([]byte, int(length))); err != nil {
+			val := make([]byte, int(length))
+			if _, err := io.ReadFull(t.c, val); err != nil {
 				return nil, fmt.Errorf("error reading type %d value of length %d: %v", typ, length, err)
 			}
+			switch typ {
+			case protocol.TypeTxCompletion:
+				if err := t.txComplete(val); err != nil {
+					return nil, err
+				}
+			case protocol.TypeShuttingDown:
+				return nil, ErrShuttingDown
+			case protocol.TypeRingReplaced:
+				return nil, ErrRingReplaced
+			}
 		default:
 			return nil, fmt.Errorf("received non-server-to-client message: %d", typ)
 		}
@@ -225,12 +496,93 @@ readLoop:
 	if idx < 0 || idx >= t.numBlocks {
 		return nil, fmt.Errorf("read invalid index %d", idx)
 	}
-	start := idx * t.blockSize
-	return &Block{
+	if t.xdpFrameSize > 0 {
+		start := t.umemSize() + (t.fanoutIndex*t.numBlocks+idx)*t.xdpTableSize()
+		b := &Block{
+			t:    t,
+			i:    idx,
+			B:    t.rings[0][start : start+t.xdpTableSize()],
+			umem: t.rings[0][:t.umemSize()],
+		}
+		if t.interfaces != nil {
+			b.iface = t.interfaces[0]
+		}
+		return b, nil
+	}
+	ringBlocks := t.numBlocks / t.numRings()
+	r := idx / ringBlocks
+	start := (idx % ringBlocks) * t.blockSize
+	b := &Block{
 		t: t,
 		i: idx,
-		B: t.ring[start : start+t.blockSize],
-	}, nil
+		B: t.rings[r][start : start+t.blockSize],
+	}
+	if t.interfaces != nil {
+		b.iface = t.interfaces[r]
+	}
+	return b, nil
+}
+
+// Transmit sends a copy of frame, which must include its link-layer header,
+// out of the socket's interface, returning the index of the TX frame it's in.
+// The outcome arrives later on TxCompletions.  Completions are only read by
+// Block, so it must keep being called.  Returns ErrTxBusy if every TX frame is
+// still being sent.
+func (t *Conn) Transmit(frame []byte) (int, error) {
+	if t.tx == nil {
+		return -1, errors.New("connection not set up to transmit, see InitTx")
+	} else if len(frame) == 0 || len(frame) > t.txFrameSize {
+		return -1, fmt.Errorf("frame length %d not in [1, %d]", len(frame), t.txFrameSize)
+	}
+	t.txMu.Lock()
+	if len(t.txFree) == 0 {
+		t.txMu.Unlock()
+		return -1, ErrTxBusy
+	}
+	i := t.txFree[len(t.txFree)-1]
+	t.txFree = t.txFree[:len(t.txFree)-1]
+	t.txMu.Unlock()
+	copy(t.tx[i*t.txFrameSize:], frame)
+	var val [8]byte
+	binary.BigEndian.PutUint32(val[:4], uint32(i))
+	binary.BigEndian.PutUint32(val[4:], uint32(len(frame)))
+	if err := protocol.SendTLV(t.c, protocol.TypeTxFrameReady, val[:]); err != nil {
+		// No completion will come for the frame, so it's free again.
+		t.txMu.Lock()
+		t.txFree = append(t.txFree, i)
+		t.txMu.Unlock()
+		return -1, fmt.Errorf("error sending TX frame: %v", err)
+	}
+	return i, nil
+}
+
+// TxCompletions returns a channel of the outcomes of frames passed to
+// Transmit.  Completions that don't fit in its buffer (TxNumFrames long)
+// are dropped.
+func (t *Conn) TxCompletions() <-chan TxCompletion {
+	return t.txDone
+}
+
+// txComplete handles a TxCompletion TLV, freeing its TX frame.
+func (t *Conn) txComplete(val []byte) error {
+	if len(val) != 8 {
+		return fmt.Errorf("invalid TX completion length %d", len(val))
+	}
+	done := TxCompletion{
+		Frame:  int(binary.BigEndian.Uint32(val[:4])),
+		Status: protocol.TxStatus(binary.BigEndian.Uint32(val[4:])),
+	}
+	if done.Frame < 0 || done.Frame >= t.txNumFrames || t.tx == nil {
+		return fmt.Errorf("invalid TX completion for frame %d", done.Frame)
+	}
+	t.txMu.Lock()
+	t.txFree = append(t.txFree, done.Frame)
+	t.txMu.Unlock()
+	select {
+	case t.txDone <- done:
+	default:
+	}
+	return nil
 }
 
 // Return returns this block to the testimonyd server.
@@ -240,10 +592,14 @@ func (b *Block) Return() error {
 	if _, err := b.t.c.Write(m[:]); err != nil {
 		return fmt.Errorf("error writing index: %v", err)
 	}
-	b.t, b.i, b.B = nil, 0, nil
+	b.t, b.i, b.B, b.umem, b.xpkt = nil, 0, nil, nil, nil
 	return nil
 }
 
+// Interface returns the name of the interface the block's packets were
+// captured on, or "" if the server didn't say.
+func (b *Block) Interface() string { return b.iface }
+
 func (b *Block) header() *C.struct_tpacket_hdr_v1 {
 	desc := (*C.struct_tpacket_block_desc)(unsafe.Pointer(&b.B[0]))
 	return (*C.struct_tpacket_hdr_v1)(unsafe.Pointer(&desc.hdr[0]))
@@ -252,6 +608,9 @@ func (b *Block) header() *C.struct_tpacket_hdr_v1 {
 // Next allows the user to iterate through the set of packets in this Block,
 // changing the value returned by Packet.
 func (b *Block) Next() bool {
+	if b.umem != nil {
+		return b.nextXDP()
+	}
 	if b.offset == 0 {
 		b.left = int(b.header().num_pkts)
 		b.offset = int(b.header().offset_to_first_pkt)
@@ -266,17 +625,153 @@ func (b *Block) Next() bool {
 	return true
 }
 
+// nextXDP is Next for AF_XDP blocks.
+func (b *Block) nextXDP() bool {
+	if b.offset == 0 {
+		b.left = int(*(*uint32)(unsafe.Pointer(&b.B[0])))
+		if max := (len(b.B) - xdpBlockHeaderSize) / xdpPacketSize; b.left > max {
+			b.left = max
+		}
+		b.offset = xdpBlockHeaderSize
+	} else {
+		b.offset += xdpPacketSize
+	}
+	if b.left <= 0 {
+		b.xpkt = nil
+		return false
+	}
+	b.left--
+	b.xpkt = (*xdpPacket)(unsafe.Pointer(&b.B[b.offset]))
+	return true
+}
+
 // Packet provides access to the current packet.  Next calls change this to
-// point to the next packet in the block.
+// point to the next packet in the block.  It's nil for AF_XDP blocks, which
+// have no packet headers.
 func (b *Block) Packet() *C.struct_tpacket3_hdr {
 	return b.pkt
 }
 
+// Timestamp returns the time the current packet was received.
+func (b *Block) Timestamp() time.Time {
+	switch {
+	case b.xpkt != nil:
+		return time.Unix(0, b.xpkt.Nanos)
+	case b.pkt != nil:
+		return time.Unix(int64(b.pkt.tp_sec), int64(b.pkt.tp_nsec))
+	}
+	return time.Time{}
+}
+
 // PacketData provides access to the current packet's data.
 func (b *Block) PacketData() []byte {
+	if b.xpkt != nil {
+		start, end := b.xpkt.Addr, b.xpkt.Addr+uint64(b.xpkt.Len)
+		if start > end || end > uint64(len(b.umem)) {
+			return nil
+		}
+		return b.umem[start:end]
+	}
 	if b.pkt == nil {
 		return nil
 	}
 	start := b.offset + int(b.pkt.tp_mac)
 	return b.B[start : start+int(b.pkt.tp_snaplen)]
 }
+
+// VLAN is an 802.1Q tag that the NIC or kernel stripped from a packet.
+type VLAN struct {
+	TPID uint16 // tag protocol identifier, like 0x8100 or 0x88a8
+	TCI  uint16 // tag control information:  priority, DEI and VLAN ID
+}
+
+// ID returns the tag's VLAN ID.
+func (v VLAN) ID() uint16 { return v.TCI & 0xfff }
+
+// Priority returns the tag's priority code point.
+func (v VLAN) Priority() uint8 { return uint8(v.TCI >> 13) }
+
+// DEI returns the tag's drop eligible indicator.
+func (v VLAN) DEI() bool { return v.TCI&0x1000 != 0 }
+
+// VLAN returns the current packet's VLAN tag, if one was stripped from it.
+// Tags that weren't stripped are still in PacketData.
+func (b *Block) VLAN() (VLAN, bool) {
+	if b.pkt == nil || b.pkt.tp_status&C.TP_STATUS_VLAN_VALID == 0 {
+		return VLAN{}, false
+	}
+	v := VLAN{TPID: 0x8100, TCI: uint16(C.packet_vlan_tci(b.pkt))}
+	// Older kernels don't report the TPID.
+	if b.pkt.tp_status&C.TP_STATUS_VLAN_TPID_VALID != 0 {
+		v.TPID = uint16(C.packet_vlan_tpid(b.pkt))
+	}
+	return v, true
+}
+
+// PacketDataWithVLAN returns a copy of the current packet's data with its VLAN
+// tag, if one was stripped, put back after the Ethernet addresses, as it was
+// on the wire.  It's only meaningful for Ethernet interfaces.
+func (b *Block) PacketDataWithVLAN() []byte {
+	data := b.PacketData()
+	v, ok := b.VLAN()
+	if !ok || len(data) < 12 {
+		return append([]byte(nil), data...)
+	}
+	out := make([]byte, len(data)+4)
+	copy(out, data[:12])
+	binary.BigEndian.PutUint16(out[12:], v.TPID)
+	binary.BigEndian.PutUint16(out[14:], v.TCI)
+	copy(out[16:], data[12:])
+	return out
+}
+
+// RxHash returns the current packet's receive hash, or 0 if the kernel didn't
+// provide one.  Sockets only provide them with RxHash set in testimonyd's
+// configuration.
+func (b *Block) RxHash() uint32 {
+	if b.pkt == nil {
+		return 0
+	}
+	return uint32(C.packet_rxhash(b.pkt))
+}
+
+// PacketType says who a packet was addressed to, or that this host sent it.
+type PacketType uint8
+
+// Packet types, from linux/if_packet.h.
+const (
+	PacketHost      PacketType = 0 // to this host
+	PacketBroadcast PacketType = 1 // to everyone
+	PacketMulticast PacketType = 2 // to a multicast group
+	PacketOtherHost PacketType = 3 // to some other host, seen in promiscuous mode
+	PacketOutgoing  PacketType = 4 // from this host
+)
+
+var packetTypeNames = map[PacketType]string{
+	PacketHost:      "host",
+	PacketBroadcast: "broadcast",
+	PacketMulticast: "multicast",
+	PacketOtherHost: "otherhost",
+	PacketOutgoing:  "outgoing",
+}
+
+// String returns the type's name, or its number if it's not a known type.
+func (t PacketType) String() string {
+	if name, ok := packetTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("%d", uint8(t))
+}
+
+// Outgoing reports whether the packet was sent, rather than received, by
+// the host testimonyd runs on.
+func (t PacketType) Outgoing() bool { return t == PacketOutgoing }
+
+// PacketType returns the current packet's type, which tells which direction
+// it was going.
+func (b *Block) PacketType() PacketType {
+	if b.pkt == nil {
+		return PacketHost
+	}
+	return PacketType(C.packet_pkttype(b.pkt))
+}
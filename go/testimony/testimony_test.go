@@ -0,0 +1,128 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package testimony
+
+import (
+	"bytes"
+	"testing"
+	"unsafe"
+)
+
+// Status bits, from linux/if_packet.h.
+const (
+	tpStatusUser          = 0x1
+	tpStatusVLANValid     = 0x10
+	tpStatusVLANTPIDValid = 0x40
+)
+
+// Offsets in a TPACKET_V3 block of its header's fields, and of the fields of
+// the single packet testBlock puts in it.
+const (
+	blockNumPkts    = 12 // tpacket_block_desc.hdr.bh1.num_pkts
+	blockFirstPkt   = 16 // tpacket_block_desc.hdr.bh1.offset_to_first_pkt
+	pktOffset       = 48 // where testBlock puts the packet
+	pktSnapLen      = 12 // tpacket3_hdr.tp_snaplen
+	pktStatus       = 20 // tpacket3_hdr.tp_status
+	pktMac          = 24 // tpacket3_hdr.tp_mac
+	pktVLANTCI      = 32 // tpacket3_hdr.hv1.tp_vlan_tci
+	pktVLANTPID     = 36 // tpacket3_hdr.hv1.tp_vlan_tpid
+	pktDataOffset   = 80 // tp_mac, from the packet's header to its data
+	testBlockLength = 256
+)
+
+// testBlock returns a block holding a single packet with the given data and
+// status, and VLAN fields as the kernel would fill them in.
+func testBlock(data []byte, status uint32, tci, tpid uint16) *Block {
+	b := make([]byte, testBlockLength)
+	put32 := func(off int, v uint32) { *(*uint32)(unsafe.Pointer(&b[off])) = v }
+	put16 := func(off int, v uint16) { *(*uint16)(unsafe.Pointer(&b[off])) = v }
+	put32(blockNumPkts, 1)
+	put32(blockFirstPkt, pktOffset)
+	put32(pktOffset+pktSnapLen, uint32(len(data)))
+	put32(pktOffset+pktStatus, status)
+	put16(pktOffset+pktMac, pktDataOffset)
+	put32(pktOffset+pktVLANTCI, uint32(tci))
+	put16(pktOffset+pktVLANTPID, tpid)
+	copy(b[pktOffset+pktDataOffset:], data)
+	return &Block{B: b}
+}
+
+func TestVLAN(t *testing.T) {
+	// Ethernet addresses, then an IPv4 EtherType and the start of a header.
+	frame := []byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0x08, 0x00, 0x45, 0x00}
+	for _, test := range []struct {
+		desc      string
+		data      []byte
+		status    uint32
+		tci, tpid uint16
+		want      VLAN
+		tagged    bool
+		wantData  []byte // from PacketDataWithVLAN
+		id        uint16
+		priority  uint8
+		dei       bool
+	}{
+		{"untagged", frame, tpStatusUser, 0, 0, VLAN{}, false, frame, 0, 0, false},
+		{"stale VLAN fields", frame, tpStatusUser, 0xa00b, 0x88a8, VLAN{}, false, frame, 0, 0, false},
+		{"802.1Q", frame, tpStatusUser | tpStatusVLANValid | tpStatusVLANTPIDValid, 0xa00b, 0x8100,
+			VLAN{TPID: 0x8100, TCI: 0xa00b}, true,
+			[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0x81, 0x00, 0xa0, 0x0b, 0x08, 0x00, 0x45, 0x00}, 11, 5, false},
+		{"802.1ad", frame, tpStatusUser | tpStatusVLANValid | tpStatusVLANTPIDValid, 0x1fff, 0x88a8,
+			VLAN{TPID: 0x88a8, TCI: 0x1fff}, true,
+			[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0x88, 0xa8, 0x1f, 0xff, 0x08, 0x00, 0x45, 0x00}, 0xfff, 0, true},
+		// Older kernels don't report the TPID, so it's assumed to be 802.1Q.
+		{"TPID not valid", frame, tpStatusUser | tpStatusVLANValid, 0x0064, 0x88a8,
+			VLAN{TPID: 0x8100, TCI: 0x0064}, true,
+			[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0x81, 0x00, 0x00, 0x64, 0x08, 0x00, 0x45, 0x00}, 100, 0, false},
+		{"no EtherType", frame[:12], tpStatusUser | tpStatusVLANValid, 0x0064, 0,
+			VLAN{TPID: 0x8100, TCI: 0x0064}, true,
+			[]byte{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 0x81, 0x00, 0x00, 0x64}, 100, 0, false},
+		{"too short for a tag", frame[:11], tpStatusUser | tpStatusVLANValid, 0x0064, 0,
+			VLAN{TPID: 0x8100, TCI: 0x0064}, true, frame[:11], 100, 0, false},
+	} {
+		b := testBlock(test.data, test.status, test.tci, test.tpid)
+		if !b.Next() {
+			t.Fatalf("%s: block has no packets", test.desc)
+		}
+		if got := b.PacketData(); !bytes.Equal(got, test.data) {
+			t.Errorf("%s: PacketData = %x, want %x", test.desc, got, test.data)
+		}
+		v, ok := b.VLAN()
+		if v != test.want || ok != test.tagged {
+			t.Errorf("%s: VLAN = %+v, %v, want %+v, %v", test.desc, v, ok, test.want, test.tagged)
+		}
+		if v.ID() != test.id || v.Priority() != test.priority || v.DEI() != test.dei {
+			t.Errorf("%s: ID %d, priority %d, DEI %v, want %d, %d, %v", test.desc, v.ID(), v.Priority(), v.DEI(), test.id, test.priority, test.dei)
+		}
+		got := b.PacketDataWithVLAN()
+		if !bytes.Equal(got, test.wantData) {
+			t.Errorf("%s: PacketDataWithVLAN = %x, want %x", test.desc, got, test.wantData)
+		}
+		// It's a copy, which callers may keep after the block is returned.
+		if len(got) > 0 {
+			got[0] ^= 0xff
+			if b.PacketData()[0] != test.data[0] {
+				t.Errorf("%s: PacketDataWithVLAN shares the block's memory", test.desc)
+			}
+		}
+		if b.Next() {
+			t.Errorf("%s: block has more than one packet", test.desc)
+		}
+	}
+
+	if v, ok := new(Block).VLAN(); ok || v != (VLAN{}) {
+		t.Errorf("VLAN with no packet = %+v, %v", v, ok)
+	}
+}
@@ -15,24 +15,53 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
-	"io/ioutil"
+	"fmt"
 	"log"
 	"log/syslog"
+	"os"
+	"os/signal"
 	"syscall"
+	"time"
 
-	"github.com/google/testimony/go/testimonyd/internal/socket"
+	"github.com/google/testimony/go/server"
 )
 
 var (
-	confFilename = flag.String("config", "/etc/testimony.conf", "Testimony config")
-	logToSyslog  = flag.Bool("syslog", true, "log messages to syslog")
+	confFilename  = flag.String("config", "/etc/testimony.conf", "Testimony config file, directory of *.conf files, or glob of files")
+	logToSyslog   = flag.Bool("syslog", true, "log messages to syslog")
+	checkOnly     = flag.Bool("check", false, "validate the config, print the effective config and any problems, then exit")
+	verbose       = flag.Int("v", 0, "Verbose logging, increase for more logs")
+	shutdownGrace = flag.Duration("shutdown_grace", 5*time.Second, "How long to wait for clients to return their blocks when a socket shuts down")
+	runAs         = flag.String("run_as", "", "user[:group] to switch to once all sockets are set up; sockets created later are created by a privileged helper")
+	keepNetCaps   = flag.Bool("keep_net_caps", false, "with -run_as, run the privileged helper as the -run_as user with only CAP_NET_RAW and CAP_NET_ADMIN, rather than as root")
+	helperMode    = flag.Bool(server.HelperFlag, false, "internal use only: run as testimonyd's privileged helper")
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "filtertest" {
+		os.Exit(filterTest(os.Args[2:]))
+	}
 	flag.Parse()
+	opts := server.Options{
+		Verbosity:     *verbose,
+		ShutdownGrace: *shutdownGrace,
+		RunAs:         *runAs,
+		KeepNetCaps:   *keepNetCaps,
+		Systemd:       true,
+	}
+	if *checkOnly {
+		t, err := server.ReadConfig(*confFilename)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if !server.CheckConfig(t, opts, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
 	if *logToSyslog {
 		s, err := syslog.New(syslog.LOG_USER|syslog.LOG_INFO, "testimonyd")
 		if err != nil {
@@ -40,21 +69,49 @@ func main() {
 		}
 		log.SetOutput(s)
 	}
+	if *helperMode {
+		load := func() (server.Testimony, error) { return server.ReadConfig(*confFilename) }
+		if err := server.RunPrivilegedHelper(os.NewFile(3, "helper"), opts, load); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 	log.Printf("Starting testimonyd...")
-	confdata, err := ioutil.ReadFile(*confFilename)
+	t, err := server.ReadConfig(*confFilename)
 	if err != nil {
-		log.Fatalf("could not read configuration %q: %v", *confFilename, err)
+		log.Fatal(err)
 	}
 	// Set umask which will affect all of the sockets we create:
 	syscall.Umask(0177)
-	var t socket.Testimony
-	if err := json.NewDecoder(bytes.NewBuffer(confdata)).Decode(&t); err != nil {
-		log.Fatalf("could not parse configuration %q: %v", *confFilename, err)
+	// Shut down cleanly on SIGTERM/SIGINT.
+	ctx, cancel := context.WithCancel(context.Background())
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-term
+		log.Printf("Received %v", sig)
+		cancel()
+	}()
+	// Re-read the configuration on SIGHUP.
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	srv := server.New(t, opts)
+	if err := srv.Start(ctx); err != nil {
+		log.Fatal(err)
 	}
-	for i, _ := range t {
-		if t[i].FanoutSize == 0 {
-			t[i].FanoutSize = 1
+	go func() {
+		for range hup {
+			t, err := server.ReadConfig(*confFilename)
+			if err != nil {
+				log.Printf("not reloading: %v", err)
+				continue
+			}
+			if err := srv.Reload(t); err != nil {
+				log.Print(err)
+			}
 		}
+	}()
+	if err := srv.Wait(); err != nil {
+		log.Fatal(err)
 	}
-	socket.RunTestimony(t)
 }
@@ -0,0 +1,57 @@
+// Copyright 2015 Google Inc. All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/testimony/go/server"
+)
+
+// filterTest runs "testimonyd filtertest", which shows which packets in a
+// pcap file a socket's filter admits, and returns the exit status.
+func filterTest(args []string) int {
+	fs := flag.NewFlagSet("filtertest", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s filtertest -config FILE -socket NAME -pcap FILE [-admitted FILE] [-rejected FILE]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	config := fs.String("config", "/etc/testimony.conf", "Testimony config file, directory of *.conf files, or glob of files")
+	var opts server.FilterTestOptions
+	fs.StringVar(&opts.Socket, "socket", "", "SocketName of the socket whose filter to test")
+	fs.StringVar(&opts.Interface, "interface", "", "which of the socket's Interfaces to compile the filter for (default the first with the pcap's link type)")
+	fs.StringVar(&opts.Pcap, "pcap", "", "pcap file of packets to run the filter on")
+	fs.StringVar(&opts.Admitted, "admitted", "", "pcap file to write the packets the filter admits to")
+	fs.StringVar(&opts.Rejected, "rejected", "", "pcap file to write the packets the filter rejects to")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if opts.Socket == "" || opts.Pcap == "" || fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+	t, err := server.ReadConfig(*config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := server.FilterTest(t, opts, os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}